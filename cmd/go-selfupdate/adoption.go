@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// readAdoption reads the number of installations on each version from a
+// telemetry export, either JSON such as {"1.2": 830, "1.1": 95} or
+// [{"version": "1.2", "count": 830}], or CSV lines of version,count with an
+// optional header
+func readAdoption(path string) (map[string]int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var counts map[string]int64
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		counts, err = parseAdoptionJSON(f)
+	} else {
+		counts, err = parseAdoptionCSV(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(counts) == 0 {
+		return nil, fmt.Errorf("%s: no version counts found", path)
+	}
+	return counts, nil
+}
+
+func parseAdoptionJSON(r io.Reader) (map[string]int64, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var counts map[string]int64
+	if err := json.Unmarshal(b, &counts); err == nil {
+		return counts, nil
+	}
+	var rows []struct {
+		Version string
+		Count   int64
+	}
+	if err := json.Unmarshal(b, &rows); err != nil {
+		return nil, errors.New(`expected {"<version>": <count>} or [{"version": ..., "count": ...}]`)
+	}
+	counts = map[string]int64{}
+	for _, row := range rows {
+		counts[row.Version] += row.Count
+	}
+	return counts, nil
+}
+
+func parseAdoptionCSV(r io.Reader) (map[string]int64, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 2
+	cr.TrimLeadingSpace = true
+	counts := map[string]int64{}
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return counts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseInt(record[1], 10, 64)
+		if err != nil {
+			if line == 1 {
+				continue // header
+			}
+			return nil, fmt.Errorf("line %d: invalid count %q", line, record[1])
+		}
+		counts[record[0]] += n
+	}
+}
+
+// planPatches picks the versions worth patching from, most installed first,
+// until they cover the share coverage of the installations that are not on
+// current yet, or n versions are picked. Versions without installations
+// are never picked.
+func planPatches(versions []treeVersion, adoption map[string]int64, current string, coverage float64, n int) []treeVersion {
+	var total int64
+	for v, count := range adoption {
+		if v != current {
+			total += count
+		}
+	}
+	candidates := make([]treeVersion, 0, len(versions))
+	for _, v := range versions {
+		if adoption[v.name] > 0 {
+			candidates = append(candidates, v)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return adoption[candidates[i].name] > adoption[candidates[j].name] })
+
+	var planned []treeVersion
+	var covered int64
+	for _, v := range candidates {
+		if len(planned) == n || float64(covered) >= coverage*float64(total) {
+			break
+		}
+		planned = append(planned, v)
+		covered += adoption[v.name]
+	}
+	return planned
+}
+
+// downloadSizes holds the sizes of the full artifacts and patches clients
+// can download to reach a version
+type downloadSizes struct {
+	full    map[string]int64            // artifact size by platform
+	patches map[string]map[string]int64 // patch size by version and platform
+}
+
+// report prints how much the planned patches save over full downloads,
+// assuming installations of every version are spread over the platforms
+// like the artifacts
+func (d *downloadSizes) report(adoption map[string]int64, current string) {
+	if len(d.full) == 0 {
+		return
+	}
+	var full int64
+	for _, size := range d.full {
+		full += size
+	}
+	avgFull := float64(full) / float64(len(d.full))
+
+	var installs, patched int64
+	var baseline, expected float64
+	for v, count := range adoption {
+		if v == current || count <= 0 {
+			continue
+		}
+		installs += count
+		baseline += float64(count) * avgFull
+		perVersion := 0.0
+		for p, size := range d.full {
+			if patch, ok := d.patches[v][p]; ok {
+				perVersion += float64(patch)
+			} else {
+				perVersion += float64(size)
+			}
+		}
+		expected += float64(count) * perVersion / float64(len(d.full))
+		if len(d.patches[v]) > 0 {
+			patched += count
+		}
+	}
+	if installs == 0 || baseline == 0 {
+		return
+	}
+	printProgress(fmt.Sprintf("patches cover %.1f%% of %d installations: %s expected instead of %s, saving %.1f%%",
+		100*float64(patched)/float64(installs), installs, formatBytes(expected), formatBytes(baseline), 100*(1-expected/baseline)))
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for n >= 1000 && i < len(units)-1 {
+		n /= 1000
+		i++
+	}
+	return strconv.FormatFloat(n, 'f', 1, 64) + " " + units[i]
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/bobo/go-selfupdate/selfupdate"
+	"github.com/bobo/go-selfupdate/selfupdate/publish"
+)
+
+var clientCmd = &command{
+	name:    "client-config",
+	args:    "",
+	summary: "Print the Updater settings clients of a published tree need, as Go code or JSON.",
+	run:     runClientConfig,
+}
+
+// clientConfig holds the Updater fields a tree dictates, named like them so
+// the JSON form decodes straight into a selfupdate.Updater
+type clientConfig struct {
+	ApiURL    string
+	BinURL    string
+	BinLayout string `json:",omitempty"`
+	DiffURL   string `json:",omitempty"`
+	CmdName   string
+	Channel   string
+	PublicKey []byte `json:",omitempty"`
+}
+
+func runClientConfig(fs *flag.FlagSet, args []string) error {
+	output, cmd := outputFlags(fs)
+	baseURL := fs.String("url", "", "URL -o is served from, such as https://updates.example.com/. Derived for s3://, gs://, azblob:// and github:// targets.")
+	channel := fs.String("channel", "stable", "Channel the clients follow.")
+	pubKey := fs.String("pubkey", "", "Public key file created by keygen, for clients that require signatures.")
+	layout := fs.String("layout", "", "BinLayout the tree was released with, when it is not the default.")
+	outFormat := fs.String("format", "go", "Output format: go for a snippet to paste, or json.")
+	write := fs.String("write", "", "File to write the configuration to instead of stdout.")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usageError(fs, "unexpected arguments")
+	}
+	if *outFormat != "go" && *outFormat != "json" {
+		return usageError(fs, "-format must be go or json")
+	}
+	root := treeRoot(*output, *cmd)
+
+	cfg := &clientConfig{CmdName: *cmd, Channel: *channel, BinLayout: *layout}
+	backend, err := publish.OpenBackend(*output)
+	if err != nil {
+		return err
+	}
+	if gh, ok := backend.(*publish.GitHubBackend); ok && *baseURL == "" {
+		// release assets are flat, see GitHubBackend
+		if *cmd != "" {
+			return usageError(fs, "GitHub releases hold the files of one application, leave out -cmd")
+		}
+		repo := fmt.Sprintf("https://github.com/%s/%s/releases/", gh.Owner, gh.Repo)
+		cfg.ApiURL, cfg.BinURL, cfg.BinLayout = repo+"latest/download/", repo+"download/", "{{.Version}}/{{.Platform}}{{.Ext}}"
+	} else {
+		base := *baseURL
+		if base == "" {
+			if base, err = publish.PublicURL(*output); err != nil {
+				return usageError(fs, fmt.Sprintf("%v, pass -url", err))
+			}
+		}
+		if !strings.HasSuffix(base, "/") {
+			base += "/"
+		}
+		cfg.ApiURL, cfg.BinURL = base, base
+	}
+
+	// check the tree serves what the configuration points clients at
+	ctx := context.Background()
+	store, err := publish.OpenStore(root)
+	if err != nil {
+		return err
+	}
+	tree, err := scanStore(ctx, store)
+	if err != nil {
+		return err
+	}
+	manifests := tree.channelManifests(*channel)
+	if len(manifests) == 0 {
+		return fmt.Errorf("channel %s has no manifests in %s", *channel, root)
+	}
+	if len(tree.patches) > 0 {
+		cfg.DiffURL = cfg.ApiURL
+	}
+	if *pubKey != "" {
+		b, err := os.ReadFile(*pubKey)
+		if err != nil {
+			return err
+		}
+		if cfg.PublicKey, err = selfupdate.ParsePublicKey(string(b)); err != nil {
+			return fmt.Errorf("%s: %w", *pubKey, err)
+		}
+		for _, name := range manifests {
+			if err := requireSigned(ctx, store, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	out, err := cfg.encode(*outFormat)
+	if err != nil {
+		return err
+	}
+	if *write == "" {
+		_, err := os.Stdout.Write(out)
+		return err
+	}
+	if err := os.WriteFile(*write, out, 0644); err != nil {
+		return err
+	}
+	writtenFiles = append(writtenFiles, *write)
+	printProgress("wrote", *write)
+	return nil
+}
+
+// requireSigned fails when name has no signature, since clients with a
+// public key reject unsigned files
+func requireSigned(ctx context.Context, store publish.Store, name string) error {
+	r, err := store.Get(ctx, name+selfupdate.SignatureSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s is not signed, clients with a public key would reject it", name)
+	}
+	if err != nil {
+		return err
+	}
+	return r.Close()
+}
+
+func (c *clientConfig) encode(outFormat string) ([]byte, error) {
+	if outFormat == "json" {
+		b, err := json.MarshalIndent(c, "", "    ")
+		return append(b, '\n'), err
+	}
+
+	var b bytes.Buffer
+	if c.PublicKey != nil {
+		fmt.Fprintf(&b, "const publicKey = %q\n\n", base64.StdEncoding.EncodeToString(c.PublicKey))
+	}
+	b.WriteString("updater := &selfupdate.Updater{\n")
+	b.WriteString("CurrentVersion: version, // set at build time, ex: -ldflags \"-X main.version=1.2\"\n")
+	for _, field := range []struct{ name, value string }{
+		{"ApiURL", c.ApiURL},
+		{"BinURL", c.BinURL},
+		{"BinLayout", c.BinLayout},
+		{"DiffURL", c.DiffURL},
+		{"CmdName", c.CmdName},
+		{"Channel", c.Channel},
+	} {
+		if field.value != "" || field.name == "CmdName" {
+			fmt.Fprintf(&b, "%s: %q,\n", field.name, field.value)
+		}
+	}
+	b.WriteString("Dir: \"update/\",\n}\n")
+	if c.PublicKey != nil {
+		b.WriteString("\nvar err error\nif updater.PublicKey, err = selfupdate.ParsePublicKey(publicKey); err != nil {\nreturn err\n}\n")
+	}
+	return format.Source(b.Bytes())
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const defaultConfigFile = ".selfupdate.toml"
+
+// config holds the settings read from a .selfupdate.toml file. Every value
+// is a default for the flag of the same name; flags given on the command line
+// always win.
+type config struct {
+	values   map[string]string
+	commands map[string]map[string]string // values from [<command>] tables
+	path     string                       // binary or directory of binaries to release
+}
+
+// releaseConfigKeys are the top level keys that only apply to release: other
+// commands have flags of the same name that mean something else, so they can
+// only be set for them in the command's own table.
+var releaseConfigKeys = map[string]bool{
+	"channels": true,
+	"platform": true,
+	"rollout":  true,
+}
+
+// configTables are the command names accepted as [<command>] table headers
+var configTables = map[string]bool{}
+
+func init() {
+	for _, c := range commands {
+		configTables[c.name] = true
+	}
+}
+
+// value returns the setting for key that applies to the command cmd
+func (c *config) value(cmd, key string) (string, bool) {
+	if v, ok := c.commands[cmd][key]; ok {
+		return v, true
+	}
+	if releaseConfigKeys[key] && cmd != "release" {
+		return "", false
+	}
+	v, ok := c.values[key]
+	return v, ok
+}
+
+// configFlags maps configuration keys to the flags they provide defaults for
+var configFlags = map[string]string{
+	"cmd":                     "cmd",
+	"output":                  "o",
+	"channels":                "channel",
+	"platform":                "platform",
+	"platforms":               "platforms",
+	"map":                     "map",
+	"compression":             "compression",
+	"level":                   "level",
+	"date":                    "date",
+	"key":                     "key",
+	"notes":                   "notes",
+	"archive":                 "archive",
+	"files":                   "files",
+	"layout":                  "layout",
+	"rollout":                 "rollout",
+	"min_disk":                "min-disk",
+	"min_memory":              "min-memory",
+	"sbom":                    "sbom",
+	"provenance":              "provenance",
+	"checksums":               "checksums",
+	"encrypt_to":              "encrypt-to",
+	"compact":                 "compact",
+	"hash_encoding":           "hash-encoding",
+	"min_age":                 "min-age",
+	"notify":                  "notify",
+	"builder_id":              "builder-id",
+	"upload":                  "upload",
+	"cloudfront_distribution": "cloudfront-distribution",
+	"version_format":          "version-format",
+	"packages":                "packages",
+	"package_url":             "package-url",
+	"package_channel":         "package-channel",
+	"package_description":     "package-description",
+	"package_homepage":        "package-homepage",
+	"package_license":         "package-license",
+	"package_publisher":       "package-publisher",
+}
+
+// parseFlags parses args into fs and then fills every flag that was not given
+// explicitly from the configuration file, using the keys that apply to the
+// command fs is named after
+func parseFlags(fs *flag.FlagSet, args []string) (*config, error) {
+	configPath := fs.String("config", defaultConfigFile, "Configuration file providing defaults for the flags of this command.")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, err
+		}
+		// the flag package has already printed the problem and the usage
+		return nil, fmt.Errorf("%w: %v", errUsage, err)
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	f, err := os.Open(*configPath)
+	if errors.Is(err, os.ErrNotExist) && !set["config"] {
+		return &config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg, err := readConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", *configPath, err)
+	}
+	for key, name := range configFlags {
+		value, ok := cfg.value(fs.Name(), key)
+		if !ok || fs.Lookup(name) == nil || set[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", *configPath, key, err)
+		}
+	}
+	return cfg, nil
+}
+
+// readConfig reads the flat subset of TOML used by .selfupdate.toml:
+//
+//	# comment
+//	cmd = "myapp"
+//	path = "dist/"
+//	channels = ["beta", "stable"]
+//
+//	[promote]
+//	rollout = "25"
+//
+// Values are strings, booleans, integers or single line arrays of strings.
+// Arrays are joined with commas to match the comma separated list flags.
+// Keys after a [<command>] table header only apply to that command.
+func readConfig(r io.Reader) (*config, error) {
+	cfg := &config{values: map[string]string{}, commands: map[string]map[string]string{}}
+	values := cfg.values
+	table := ""
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(s.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			table = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, "["), "]"))
+			if !strings.HasSuffix(line, "]") || !configTables[table] {
+				return nil, fmt.Errorf("line %d: unknown table %s", n, line)
+			}
+			if cfg.commands[table] == nil {
+				cfg.commands[table] = map[string]string{}
+			}
+			values = cfg.commands[table]
+			continue
+		}
+		key, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		key = strings.TrimSpace(key)
+		value, err := parseConfigValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", n, key, err)
+		}
+
+		switch {
+		case key == "path" && (table == "" || table == "release"):
+			cfg.path = value
+		case configFlags[key] != "":
+			values[key] = value
+		default:
+			return nil, fmt.Errorf("line %d: unknown key %q", n, key)
+		}
+	}
+	return cfg, s.Err()
+}
+
+func parseConfigValue(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, "["):
+		if !strings.HasSuffix(raw, "]") {
+			return "", errors.New("arrays must be on a single line")
+		}
+		var items []string
+		for _, item := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(raw, "["), "]"), ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			v, err := parseConfigString(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, v)
+		}
+		return strings.Join(items, ","), nil
+	case strings.HasPrefix(raw, `"`), strings.HasPrefix(raw, "'"):
+		return parseConfigString(raw)
+	case raw == "true", raw == "false":
+		return raw, nil
+	}
+	if _, err := strconv.ParseInt(raw, 10, 64); err != nil {
+		return "", fmt.Errorf("unsupported value %s", raw)
+	}
+	return raw, nil
+}
+
+func parseConfigString(raw string) (string, error) {
+	if len(raw) >= 2 && raw[0] == '\'' && raw[len(raw)-1] == '\'' {
+		return raw[1 : len(raw)-1], nil
+	}
+	v, err := strconv.Unquote(raw)
+	if err != nil || raw[0] != '"' {
+		return "", fmt.Errorf("invalid string %s", raw)
+	}
+	return v, nil
+}
+
+// stripComment removes a trailing # comment that is not inside a string
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bobo/go-selfupdate/selfupdate"
+	"github.com/bobo/go-selfupdate/selfupdate/publish"
+)
+
+var diffCmd = &command{
+	name:    "diff",
+	args:    "",
+	summary: "Generate binary patches from the previous versions in an update tree to a new version.",
+	run:     runDiff,
+}
+
+func runDiff(fs *flag.FlagSet, args []string) error {
+	output, cmd := outputFlags(fs)
+	version := fs.String("version", "", "Version to generate patches to (required). It must already be released into the tree.")
+	keep := fs.Int("n", 3, "Number of previous versions to generate patches from.")
+	adoptionPath := fs.String("adoption", "",
+		"CSV or JSON file with the number of installations on each version. Patches are then made from the most installed versions, up to -n, until they cover -coverage of the installations.")
+	coverage := fs.Float64("coverage", 0.95, "Share of the installations not on -version yet that -adoption planning covers with patches.")
+	platform := fs.String("platform", "", "Only generate patches for this platform.")
+	keyPath := fs.String("key", "", "Private key file created by keygen. When set every patch is signed.")
+	layout := layoutFlag(fs)
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *version == "" {
+		return usageError(fs, "-version is required")
+	}
+	if *coverage <= 0 || *coverage > 1 {
+		return usageError(fs, "-coverage must be above 0 and at most 1")
+	}
+	var adoption map[string]int64
+	if *adoptionPath != "" {
+		var err error
+		if adoption, err = readAdoption(*adoptionPath); err != nil {
+			return err
+		}
+	}
+	root := treeRoot(*output, *cmd)
+
+	ctx := context.Background()
+	store, err := publish.OpenStore(root)
+	if err != nil {
+		return err
+	}
+	versions, err := treeVersions(ctx, store)
+	if err != nil {
+		return err
+	}
+	artifacts := &artifactReader{store: store, layout: treeLayout{layout: *layout, cmd: *cmd}}
+	current, ok := versions[*version]
+	if !ok && *layout != "" {
+		return fmt.Errorf("version %s is not in the index of %s, which -layout needs", *version, root)
+	}
+	if !ok {
+		return fmt.Errorf("version %s is not released into %s", *version, root)
+	}
+	platforms := current.platforms
+	if *platform != "" {
+		if _, ok := platforms[*platform]; !ok {
+			return fmt.Errorf("version %s has no artifact for %s", *version, *platform)
+		}
+		platforms = map[string]artifactFile{*platform: platforms[*platform]}
+	}
+
+	var previous []treeVersion
+	if adoption == nil {
+		previous = previousVersions(versions, *version, *keep)
+	} else {
+		all := previousVersions(versions, *version, math.MaxInt)
+		previous = planPatches(all, adoption, *version, *coverage, *keep)
+		for _, from := range previous {
+			printProgress("patching from", from.name, "with", adoption[from.name], "installations")
+		}
+	}
+	sizes := &downloadSizes{full: map[string]int64{}, patches: map[string]map[string]int64{}}
+
+	backend, err := withSigning(&recordingBackend{Backend: store, root: root}, *keyPath)
+	if err != nil {
+		return err
+	}
+	for p, a := range platforms {
+		newBin, err := artifacts.read(ctx, current, p, a)
+		if errors.Is(err, publish.ErrEncrypted) {
+			// a patch would give the binary away to anyone
+			printProgress("skipping", p, "- encrypted artifacts get no patches")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		sizes.full[p] = a.size
+		for _, from := range previous {
+			old, ok := from.platforms[p]
+			if !ok {
+				continue
+			}
+			oldBin, err := artifacts.read(ctx, &from, p, old)
+			if errors.Is(err, publish.ErrEncrypted) {
+				printProgress("skipping", p, "from", from.name, "- encrypted artifacts get no patches")
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			var patch bytes.Buffer
+			if err := publish.CreatePatch(&patch, oldBin, newBin); err != nil {
+				return fmt.Errorf("%s %s -> %s: %w", p, from.name, *version, err)
+			}
+			name := publish.PatchPath(from.name, *version, p)
+			printProgress("creating", name, patch.Len(), "bytes")
+			if sizes.patches[from.name] == nil {
+				sizes.patches[from.name] = map[string]int64{}
+			}
+			sizes.patches[from.name][p] = int64(patch.Len())
+			if err := backend.Put(ctx, name, &patch, publish.PatchMetadata); err != nil {
+				return err
+			}
+		}
+	}
+	if adoption != nil {
+		sizes.report(adoption, *version)
+	}
+	return nil
+}
+
+// artifactFile is a compressed or archived artifact of the update tree
+type artifactFile struct {
+	format     string
+	executable string // name of the binary in archives, the first member when empty
+	size       int64
+}
+
+// treeVersion is a version released into the update tree
+type treeVersion struct {
+	name      string
+	channel   string    // a channel the version was released to, empty without an index
+	date      time.Time // first release to any channel, zero without an index
+	platforms map[string]artifactFile
+}
+
+// treeVersions returns the versions of the tree in store by name. They are
+// taken from the index when the tree has one, which records the release
+// dates and the formats of the artifacts, and otherwise from the version
+// directories holding artifacts.
+func treeVersions(ctx context.Context, store publish.Store) (map[string]*treeVersion, error) {
+	index, err := publish.ReadIndex(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+	versions := map[string]*treeVersion{}
+	for channel, releases := range index.Channels {
+		for _, r := range releases {
+			v := versions[r.Version]
+			if v == nil {
+				v = &treeVersion{name: r.Version, channel: channel, date: r.Date, platforms: map[string]artifactFile{}}
+				versions[r.Version] = v
+			}
+			if r.Date.Before(v.date) {
+				v.date = r.Date
+			}
+			for p, a := range r.Platforms {
+				v.platforms[p] = artifactFile{
+					format:     publish.ArtifactFormat(&selfupdate.UpdateInfo{Compression: a.Compression, Archive: a.Archive}),
+					executable: a.Executable,
+					size:       a.Size,
+				}
+			}
+		}
+	}
+	if len(versions) > 0 {
+		return versions, nil
+	}
+
+	files, err := store.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		dir, file, ok := strings.Cut(f.Name, "/")
+		if !ok || dir == "patches" || dir == selfupdate.PluginsDir || strings.Contains(file, "/") {
+			continue
+		}
+		// channel directories hold manifests only
+		p, format, ok := publish.ParseArtifactName(file)
+		if !ok {
+			continue
+		}
+		v := versions[dir]
+		if v == nil {
+			v = &treeVersion{name: dir, platforms: map[string]artifactFile{}}
+			versions[dir] = v
+		}
+		v.platforms[p] = artifactFile{format: format, size: f.Size}
+	}
+	return versions, nil
+}
+
+// previousVersions returns up to n versions other than current, newest
+// first: by release date when the index records them, otherwise by version
+func previousVersions(versions map[string]*treeVersion, current string, n int) []treeVersion {
+	var previous []treeVersion
+	for name, v := range versions {
+		if name != current {
+			previous = append(previous, *v)
+		}
+	}
+	sort.Slice(previous, func(i, j int) bool {
+		a, b := previous[i], previous[j]
+		if !a.date.IsZero() && !b.date.IsZero() && !a.date.Equal(b.date) {
+			return a.date.After(b.date)
+		}
+		return compareVersions(a.name, b.name) > 0
+	})
+	if len(previous) > n {
+		previous = previous[:n]
+	}
+	return previous
+}
+
+// artifactReader reads the artifacts of a tree placed by layout
+type artifactReader struct {
+	store  publish.Store
+	layout treeLayout
+}
+
+// read returns the binary of the artifact a of v for platform
+func (ar *artifactReader) read(ctx context.Context, v *treeVersion, platform string, a artifactFile) ([]byte, error) {
+	if ar.layout.layout != "" && v.channel == "" {
+		return nil, fmt.Errorf("-layout needs the index of the tree to find the artifacts of %s", v.name)
+	}
+	name, err := ar.layout.artifactPath(v.channel, v.name, platform, a.format)
+	if err != nil {
+		return nil, err
+	}
+	r, err := ar.store.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return publish.ReadArtifact(r, a.format, a.executable)
+}
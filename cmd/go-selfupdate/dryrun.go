@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+
+	"github.com/bobo/go-selfupdate/selfupdate"
+	"github.com/bobo/go-selfupdate/selfupdate/publish"
+)
+
+// dryRunStore reads from the published tree but only reports the files that
+// would be written or removed, showing how every manifest would change
+type dryRunStore struct {
+	publish.Store
+	root string
+}
+
+func (s *dryRunStore) Put(ctx context.Context, name string, r io.Reader, meta publish.Metadata) error {
+	if path.Ext(name) != ".json" || name == selfupdate.IndexFile || publish.IsAttestation(name) {
+		n, err := io.Copy(io.Discard, r)
+		if err != nil {
+			return err
+		}
+		printProgress("would write", treeRoot(s.root, name), n, "bytes")
+		return nil
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	old, err := s.Store.Get(ctx, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		printProgress("would create", treeRoot(s.root, name))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	before, err := io.ReadAll(old)
+	if err != nil {
+		return err
+	}
+	changes, err := manifestChanges(before, b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if len(changes) == 0 {
+		printProgress("would rewrite", treeRoot(s.root, name), "unchanged")
+		return nil
+	}
+	printProgress("would update", treeRoot(s.root, name))
+	for _, c := range changes {
+		printProgress("   ", c)
+	}
+	return nil
+}
+
+func (s *dryRunStore) Delete(ctx context.Context, name string) error {
+	printProgress("would remove", treeRoot(s.root, name))
+	return nil
+}
+
+// manifestChanges lists the fields that differ between two manifests
+func manifestChanges(before, after []byte) ([]string, error) {
+	var old, cur map[string]json.RawMessage
+	if err := json.Unmarshal(before, &old); err != nil {
+		return nil, fmt.Errorf("invalid published manifest: %w", err)
+	}
+	if err := json.Unmarshal(after, &cur); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]bool{}
+	for k := range old {
+		keys[k] = true
+	}
+	for k := range cur {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var changes []string
+	for _, k := range sorted {
+		o, c := old[k], cur[k]
+		if bytes.Equal(o, c) {
+			continue
+		}
+		switch {
+		case o == nil:
+			changes = append(changes, fmt.Sprintf("%s: %s", k, shorten(c)))
+		case c == nil:
+			changes = append(changes, fmt.Sprintf("%s: %s removed", k, shorten(o)))
+		default:
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", k, shorten(o), shorten(c)))
+		}
+	}
+	return changes, nil
+}
+
+// shorten keeps long values such as release notes to one readable line
+func shorten(v json.RawMessage) string {
+	const maxLen = 60
+	if len(v) <= maxLen {
+		return string(v)
+	}
+	return string(v[:maxLen]) + "..."
+}
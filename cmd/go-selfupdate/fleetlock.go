@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// fleetLock is an in-memory FleetLock server with a number of slots per
+// group, answering the pre-reboot and steady-state requests of
+// selfupdate.HTTPFleetLock the way Airlock does
+type fleetLock struct {
+	slots int
+
+	mu      sync.Mutex
+	holders map[string]map[string]bool // ids holding a slot, by group
+}
+
+type fleetLockRequest struct {
+	ClientParams struct {
+		ID    string `json:"id"`
+		Group string `json:"group"`
+	} `json:"client_params"`
+}
+
+func (l *fleetLock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var req fleetLockRequest
+	if r.Header.Get("fleet-lock-protocol") != "true" {
+		fleetLockError(w, http.StatusBadRequest, "missing_header", "fleet-lock-protocol header must be true")
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ClientParams.ID == "" {
+		fleetLockError(w, http.StatusBadRequest, "bad_request", "client_params with an id are required")
+		return
+	}
+	id, group := req.ClientParams.ID, req.ClientParams.Group
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.holders == nil {
+		l.holders = map[string]map[string]bool{}
+	}
+	holders := l.holders[group]
+	if holders == nil {
+		holders = map[string]bool{}
+		l.holders[group] = holders
+	}
+	switch r.URL.Path {
+	case "/v1/pre-reboot":
+		if !holders[id] && len(holders) >= l.slots {
+			fleetLockError(w, http.StatusConflict, "failed_lock", fmt.Sprintf("all %d slots of group %s are taken", l.slots, group))
+			return
+		}
+		holders[id] = true
+		printProgress("fleet lock", "taken by", id, "-", len(holders), "of", l.slots, "slots of", group)
+	case "/v1/steady-state":
+		delete(holders, id)
+		printProgress("fleet lock", "released by", id, "-", len(holders), "of", l.slots, "slots of", group)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func fleetLockError(w http.ResponseWriter, status int, kind, value string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"kind": kind, "value": value})
+}
@@ -1,138 +1,129 @@
+// Command go-selfupdate publishes updates consumed by the selfupdate package.
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
-	"crypto/sha256"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
-	"path/filepath"
-	"runtime"
-	"time"
+	"strings"
 )
 
-var version, genDir string
-
-type current struct {
-	Version string
-	Sha256  []byte
-	Channel string
-	Date    time.Time
+// command is a go-selfupdate subcommand
+type command struct {
+	name    string
+	args    string // synopsis of the arguments after the flags
+	summary string
+	run     func(fs *flag.FlagSet, args []string) error
 }
 
-func generateSha256(path string) []byte {
-	h := sha256.New()
-	b, err := os.ReadFile(path)
-	if err != nil {
-		fmt.Println(err)
-	}
-	h.Write(b)
-	sum := h.Sum(nil)
-	return sum
-	//return base64.URLEncoding.EncodeToString(sum)
+var commands = []*command{
+	releaseCmd,
+	diffCmd,
+	signCmd,
+	keygenCmd,
+	verifyCmd,
+	serveCmd,
+	pruneCmd,
+	promoteCmd,
+	rolloutCmd,
+	yankCmd,
+	clientCmd,
 }
 
-func createUpdate(path string, platform string, channel string) {
-	c := current{Version: version, Sha256: generateSha256(path), Channel: channel, Date: time.Now()}
-
-	b, err := json.MarshalIndent(c, "", "    ")
-	if err != nil {
-		fmt.Println("error:", err)
-	}
-
-	// For JSON files, use genDir which is already set correctly for the channel
-	jsonPath := filepath.Join(genDir, platform+".json")
-	fmt.Println("creating", jsonPath)
-	err = os.WriteFile(jsonPath, b, 0755)
-	if err != nil {
-		panic(err)
-	}
-
-	// For GZ files, always use public/version regardless of channel
-	gzDir := filepath.Join("public", version)
-	os.MkdirAll(gzDir, 0755)
-
-	var buf bytes.Buffer
-	w := gzip.NewWriter(&buf)
-	f, err := os.ReadFile(path)
-	if err != nil {
-		panic(err)
+func lookupCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
 	}
-	w.Write(f)
-	w.Close() // You must close this first to flush the bytes to the buffer.
-	err = os.WriteFile(filepath.Join(gzDir, platform+".gz"), buf.Bytes(), 0755)
+	return nil
+}
 
-	if err != nil {
-		panic(err)
+// newFlagSet returns a flag set whose usage output documents c
+func newFlagSet(c *command) *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	jsonFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: go-selfupdate %s [flags] %s\n\n%s\n\nFlags:\n", c.name, c.args, c.summary)
+		fs.PrintDefaults()
 	}
-
+	return fs
 }
 
 func printUsage() {
-	fmt.Println("")
-	fmt.Println("Positional arguments:")
-	fmt.Println("\tSingle platform: go-selfupdate myapp version channel")
-	fmt.Println("\tCross platform: go-selfupdate /tmp/mybinares/ version channel")
-}
-
-func createBuildDir() {
-	os.MkdirAll(genDir, 0755)
+	fmt.Fprintln(os.Stderr, "Usage: go-selfupdate <command> [flags] [arguments]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "\t%-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Run 'go-selfupdate <command> -h' for the flags of a command.")
 }
 
 func main() {
-
-	var defaultPlatform string
-	goos := os.Getenv("GOOS")
-	goarch := os.Getenv("GOARCH")
-	if goos != "" && goarch != "" {
-		defaultPlatform = goos + "-" + goarch
-	} else {
-		defaultPlatform = runtime.GOOS + "-" + runtime.GOARCH
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(exitUsage)
 	}
-	platformFlag := flag.String("platform", defaultPlatform,
-		"Target platform in the form OS-ARCH. Defaults to running os/arch or the combination of the environment variables GOOS and GOARCH if both are set.")
 
-	flag.Parse()
-	if flag.NArg() < 2 {
-		flag.Usage()
+	name, args := os.Args[1], os.Args[2:]
+	switch name {
+	case "help", "-h", "-help", "--help":
+		if len(args) > 0 {
+			if c := lookupCommand(args[0]); c != nil {
+				newFlagSet(c).Usage()
+				return
+			}
+		}
 		printUsage()
-		os.Exit(0)
+		return
 	}
 
-	platform := *platformFlag
-	appPath := flag.Arg(0)
-	version = flag.Arg(1)
-	channel := flag.Arg(2)
-	genDir = "public"
-
-	if channel != "stable" {
-		genDir = filepath.Join(genDir, channel)
+	c := lookupCommand(name)
+	if c == nil {
+		// Before subcommands existed the tool took the release arguments
+		// positionally: go-selfupdate [flags] path version [channel]
+		fmt.Fprintln(os.Stderr, "warning: positional invocation is deprecated, use 'go-selfupdate release'")
+		c, args = releaseCmd, legacyReleaseArgs(os.Args[1:])
 	}
 
-	fmt.Println("platform", platform)
-	fmt.Println("appPath", appPath)
-	fmt.Println("channel", channel)
-	fmt.Println("version", version)
-	fmt.Println("genDir", genDir)
-	createBuildDir()
-
-	// If dir is given create update for each file
-	fi, err := os.Stat(appPath)
-	if err != nil {
-		panic(err)
+	err := c.run(newFlagSet(c), args)
+	if jsonOutput {
+		printResult(os.Stdout, c.name, err)
+	}
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintf(os.Stderr, "go-selfupdate %s: %v\n", c.name, err)
 	}
+	os.Exit(exitCode(err))
+}
 
-	if fi.IsDir() {
-		files, err := os.ReadDir(appPath)
-		if err == nil {
-			for _, file := range files {
-				createUpdate(filepath.Join(appPath, file.Name()), file.Name(), channel)
-			}
-			os.Exit(0)
+// legacyReleaseArgs converts the positional "path version [channel]" form
+// into release flags, keeping any leading flags as they are.
+func legacyReleaseArgs(args []string) []string {
+	var flags, positional []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if !strings.HasPrefix(a, "-") || len(positional) > 0 {
+			positional = append(positional, a)
+			continue
+		}
+		flags = append(flags, a)
+		if !strings.Contains(a, "=") && i+1 < len(args) {
+			i++
+			flags = append(flags, args[i])
 		}
 	}
 
-	createUpdate(appPath, platform, channel)
+	if len(positional) >= 2 {
+		flags = append(flags, "-version", positional[1])
+	}
+	if len(positional) >= 3 {
+		flags = append(flags, "-channel", positional[2])
+	}
+	if len(positional) >= 1 {
+		flags = append(flags, positional[0])
+	}
+	return flags
 }
@@ -1,9 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"filippo.io/age"
+
+	"github.com/bobo/go-selfupdate/internal/bsdiff"
+	"github.com/bobo/go-selfupdate/selfupdate"
+	"github.com/bobo/go-selfupdate/selfupdate/publish"
 )
 
 func TestChannelHandling(t *testing.T) {
@@ -13,6 +33,11 @@ func TestChannelHandling(t *testing.T) {
 	}
 	defer os.RemoveAll(tmpDir)
 
+	bin := filepath.Join(tmpDir, "myapp")
+	if err := os.WriteFile(bin, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
 	tests := []struct {
 		name           string
 		channel        string
@@ -37,15 +62,1493 @@ func TestChannelHandling(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			genDir = tmpDir
-			if tt.channel != "stable" {
-				genDir = filepath.Join(tmpDir, tt.channel)
+			genDir := filepath.Join(tmpDir, "public")
+			err := runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-platform", "linux-amd64",
+				"-version", "1.0", "-channel", tt.channel, bin})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedPath := filepath.Join(genDir, tt.expectedSubdir, "linux-amd64.json")
+			if _, err := os.Stat(expectedPath); err != nil {
+				t.Errorf("Expected manifest at %s: %v", expectedPath, err)
+			}
+		})
+	}
+}
+
+func TestLegacyReleaseArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{
+			args: []string{"myapp", "1.2"},
+			want: []string{"-version", "1.2", "myapp"},
+		},
+		{
+			args: []string{"-o", "public/myapp/", "myapp", "1.2", "beta"},
+			want: []string{"-o", "public/myapp/", "-version", "1.2", "-channel", "beta", "myapp"},
+		},
+		{
+			args: []string{"-platform=linux-arm", "/tmp/bins/", "1.2", "stable"},
+			want: []string{"-platform=linux-arm", "-version", "1.2", "-channel", "stable", "/tmp/bins/"},
+		},
+	}
+	for _, tt := range tests {
+		if got := legacyReleaseArgs(tt.args); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("legacyReleaseArgs(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tmpDir := t.TempDir()
+	genDir := filepath.Join(tmpDir, "public")
+	bin := filepath.Join(tmpDir, "myapp")
+
+	for _, v := range []string{"1.0", "1.1", "1.2"} {
+		if err := os.WriteFile(bin, []byte("myapp binary at version "+v), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-platform", "linux-amd64", "-version", v, bin})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := runDiff(newFlagSet(diffCmd), []string{"-o", genDir, "-version", "1.2", "-n", "5"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, from := range []string{"1.0", "1.1"} {
+		patch, err := os.Open(filepath.Join(genDir, filepath.FromSlash(publish.PatchPath(from, "1.2", "linux-amd64"))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := bsdiff.Patch([]byte("myapp binary at version "+from), patch)
+		patch.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "myapp binary at version 1.2" {
+			t.Errorf("patch from %s produced %q", from, got)
+		}
+	}
+}
+
+func TestDiffVersionOrder(t *testing.T) {
+	tmpDir := t.TempDir()
+	genDir := filepath.Join(tmpDir, "public")
+	bin := filepath.Join(tmpDir, "myapp")
+	for _, v := range []string{"1.9", "1.10", "1.11"} {
+		if err := os.WriteFile(bin, []byte("myapp binary at version "+v), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-platform", "linux-amd64", "-version", v, bin})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a re-upload makes the oldest version look newest
+	mod := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(genDir, "1.9", "linux-amd64.gz"), mod, mod); err != nil {
+		t.Fatal(err)
+	}
+
+	// from the release dates in the index, then without it from the versions
+	for _, removeIndex := range []bool{false, true} {
+		if removeIndex {
+			if err := os.Remove(filepath.Join(genDir, selfupdate.IndexFile)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.RemoveAll(filepath.Join(genDir, "patches")); err != nil {
+			t.Fatal(err)
+		}
+		if err := runDiff(newFlagSet(diffCmd), []string{"-o", genDir, "-version", "1.11", "-n", "1"}); err != nil {
+			t.Fatal(err)
+		}
+		for from, want := range map[string]bool{"1.9": false, "1.10": true} {
+			_, err := os.Stat(filepath.Join(genDir, filepath.FromSlash(publish.PatchPath(from, "1.11", "linux-amd64"))))
+			if (err == nil) != want {
+				t.Errorf("index removed %v: patch from %s exists %v, want %v", removeIndex, from, err == nil, want)
+			}
+		}
+	}
+}
+
+func TestDiffAdoption(t *testing.T) {
+	tmpDir := t.TempDir()
+	genDir := filepath.Join(tmpDir, "public")
+	bin := filepath.Join(tmpDir, "myapp")
+	for _, v := range []string{"1.0", "1.1", "1.2", "1.3"} {
+		if err := os.WriteFile(bin, []byte(strings.Repeat("myapp binary ", 1000)+v), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-platform", "linux-amd64", "-version", v, bin})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	csvPath := filepath.Join(tmpDir, "adoption.csv")
+	if err := os.WriteFile(csvPath, []byte("version,count\n1.0,5\n1.1,80\n1.2,15\n0.9,20\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	progress = &out
+	t.Cleanup(func() { progress = os.Stdout })
+	err := runDiff(newFlagSet(diffCmd), []string{"-o", genDir, "-version", "1.3", "-adoption", csvPath, "-coverage", "0.6"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for from, want := range map[string]bool{"1.0": false, "1.1": true, "1.2": false} {
+		_, err := os.Stat(filepath.Join(genDir, "patches", from, "1.3", "linux-amd64.patch"))
+		if (err == nil) != want {
+			t.Errorf("patch from %s: exists %v, want %v", from, err == nil, want)
+		}
+	}
+	if !strings.Contains(out.String(), "patches cover 66.7% of 120 installations") {
+		t.Errorf("missing savings report in:\n%s", out.String())
+	}
+
+	jsonPath := filepath.Join(tmpDir, "adoption.json")
+	for _, content := range []string{`{"1.1": 80, "1.2": 15}`, `[{"version": "1.1", "count": 80}, {"version": "1.2", "count": 15}]`} {
+		if err := os.WriteFile(jsonPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		counts, err := readAdoption(jsonPath)
+		if err != nil || counts["1.1"] != 80 || counts["1.2"] != 15 {
+			t.Errorf("%s: got %v, %v", content, counts, err)
+		}
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	bin := filepath.Join(tmpDir, "myapp")
+	if err := os.WriteFile(bin, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(tmpDir, "public")
+	configPath := filepath.Join(tmpDir, "selfupdate.toml")
+	config := `# release settings
+cmd = "myapp"
+path = '` + bin + `'
+output = "` + filepath.ToSlash(out) + `" # trailing comment
+channels = ["beta", "stable"]
+platform = "linux-arm64"
+`
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// -platform on the command line overrides the configuration file
+	err := runRelease(newFlagSet(releaseCmd), []string{"-config", configPath, "-version", "1.0", "-platform", "linux-amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{
+		filepath.Join(out, "myapp", "linux-amd64.json"),
+		filepath.Join(out, "myapp", "beta", "linux-amd64.json"),
+	} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("expected %s: %v", p, err)
+		}
+	}
+}
+
+func TestConfigCommandScope(t *testing.T) {
+	tmpDir := t.TempDir()
+	bin := filepath.Join(tmpDir, "myapp")
+	if err := os.WriteFile(bin, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(tmpDir, "public")
+	configPath := filepath.Join(tmpDir, "selfupdate.toml")
+	writeConfig := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rollout := func(channel string) int {
+		t.Helper()
+		b, err := os.ReadFile(filepath.Join(out, channel, "linux-amd64.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var info struct{ Rollout int }
+		if err := json.Unmarshal(b, &info); err != nil {
+			t.Fatal(err)
+		}
+		return info.Rollout
+	}
+
+	// rollout at the top level is a release setting, so promote keeps the
+	// rollout of the source channel
+	writeConfig(`output = "` + filepath.ToSlash(out) + `"
+rollout = "30"
+platform = "linux-amd64"
+
+[release]
+channels = ["beta"]
+`)
+	if err := runRelease(newFlagSet(releaseCmd), []string{"-config", configPath, "-version", "1.0", "-rollout", "40", bin}); err != nil {
+		t.Fatal(err)
+	}
+	if got := rollout("beta"); got != 40 {
+		t.Fatalf("beta rollout is %d, want 40", got)
+	}
+	if err := runPromote(newFlagSet(promoteCmd), []string{"-config", configPath, "-from", "beta", "-to", "candidate", "-version", "1.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := rollout("candidate"); got != 40 {
+		t.Errorf("candidate rollout is %d after promotion, want the 40 of beta", got)
+	}
+
+	// a [promote] table sets the rollout for promote only
+	writeConfig(`output = "` + filepath.ToSlash(out) + `"
+rollout = "30"
+
+[promote]
+rollout = "20"
+`)
+	if err := runPromote(newFlagSet(promoteCmd), []string{"-config", configPath, "-from", "beta", "-to", "candidate", "-version", "1.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := rollout("candidate"); got != 20 {
+		t.Errorf("candidate rollout is %d after promotion, want 20 from [promote]", got)
+	}
+}
+
+func TestReadConfigErrors(t *testing.T) {
+	for _, config := range []string{
+		"unknown = 1",
+		"cmd",
+		"platforms = [\"linux-amd64\",\n\"darwin-arm64\"]",
+		"cmd = unquoted",
+		"[nosuchcommand]",
+		"[promote]\npath = \"dist/\"",
+	} {
+		if _, err := readConfig(strings.NewReader(config)); err == nil {
+			t.Errorf("expected error for %q", config)
+		}
+	}
+}
+
+func TestDirArtifacts(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"myapp_linux_amd64", "myapp_darwin_arm64", "myapp_windows_amd64.exe", "README.md", ".DS_Store"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		mapping string
+		wanted  []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "identity rejects unknown platforms", wantErr: true},
+		{name: "pattern", mapping: "myapp_{os}_{arch}*", want: []string{"darwin-arm64", "linux-amd64", "windows-amd64"}},
+		{name: "pattern without wildcard", mapping: "myapp_{os}_{arch}", want: []string{"darwin-arm64", "linux-amd64", "windows-amd64"}},
+		{name: "explicit", mapping: "myapp_linux_amd64=linux-amd64,myapp_windows_amd64.exe=windows-amd64", want: []string{"linux-amd64", "windows-amd64"}},
+		{name: "wanted subset", mapping: "myapp_{os}_{arch}*", wanted: []string{"linux-amd64"}, want: []string{"linux-amd64"}},
+		{name: "missing wanted", mapping: "myapp_{os}_{arch}*", wanted: []string{"linux-arm64"}, wantErr: true},
+		{name: "invalid mapped platform", mapping: "myapp_linux_amd64=linux-x86", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mapper, err := parsePlatformMap(tt.mapping)
+			if err != nil {
+				t.Fatal(err)
+			}
+			artifacts, err := dirArtifacts(dir, mapper, tt.wanted)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dirArtifacts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, a := range artifacts {
+				got = append(got, a.Platform)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got platforms %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlatformMapperExe(t *testing.T) {
+	pattern, err := parsePlatformMap("myapp_{os}_{arch}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		mapper platformMapper
+		name   string
+		want   string
+		ok     bool
+	}{
+		{identityMapper{}, "windows-amd64.exe", "windows-amd64", true},
+		{identityMapper{}, "windows-amd64", "windows-amd64", true},
+		{identityMapper{}, "linux-amd64.exe", "linux-amd64.exe", true},
+		{pattern, "myapp_windows_arm64.exe", "windows-arm64", true},
+		{pattern, "myapp_linux_amd64.exe", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := tt.mapper.platform(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("platform(%q) = %q, %v, want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestReproducibleRelease(t *testing.T) {
+	tmpDir := t.TempDir()
+	bin := filepath.Join(tmpDir, "myapp")
+	if err := os.WriteFile(bin, []byte(strings.Repeat("myapp binary ", 1000)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+
+	for _, compression := range []string{"gzip", "zstd", "xz"} {
+		var trees [2]string
+		for i := range trees {
+			trees[i] = filepath.Join(tmpDir, compression, strconv.Itoa(i))
+			err := runRelease(newFlagSet(releaseCmd), []string{"-o", trees[i], "-platform", "linux-amd64",
+				"-version", "1.0", "-compression", compression, bin})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, name := range []string{"linux-amd64.json", "index.json", filepath.FromSlash(publish.ArtifactPath("1.0", "linux-amd64", compression))} {
+			a, err := os.ReadFile(filepath.Join(trees[0], name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := os.ReadFile(filepath.Join(trees[1], name))
+			if err != nil {
+				t.Fatal(err)
 			}
+			if !bytes.Equal(a, b) {
+				t.Errorf("%s: %s differs between identical releases", compression, name)
+			}
+		}
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	tests := []struct {
+		name string
+		run  func() error
+		want int
+	}{
+		{"missing version", func() error {
+			return runRelease(newFlagSet(releaseCmd), []string{"-o", tmpDir, "some-binary"})
+		}, exitUsage},
+		{"unknown flag", func() error {
+			return runRelease(newFlagSet(releaseCmd), []string{"-no-such-flag"})
+		}, exitUsage},
+		{"help", func() error {
+			return runRelease(newFlagSet(releaseCmd), []string{"-h"})
+		}, exitOK},
+		{"missing binary", func() error {
+			return runRelease(newFlagSet(releaseCmd), []string{"-o", tmpDir, "-version", "1.0", filepath.Join(tmpDir, "missing")})
+		}, exitFailure},
+		{"directory without binaries", func() error {
+			dir := filepath.Join(tmpDir, "empty")
+			os.MkdirAll(filepath.Join(dir, "linux-amd64"), 0755)
+			return runRelease(newFlagSet(releaseCmd), []string{"-o", tmpDir, "-version", "1.0", dir})
+		}, exitFailure},
+	}
 
-			expectedPath := filepath.Join(tmpDir, tt.expectedSubdir)
-			if genDir != expectedPath {
-				t.Errorf("Expected output dir %s, got %s", expectedPath, genDir)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.run()); got != tt.want {
+				t.Errorf("exit code %d, want %d", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestJSONResult(t *testing.T) {
+	writtenFiles = nil
+	t.Cleanup(func() { writtenFiles, jsonOutput, progress = nil, false, os.Stdout })
+
+	tmpDir := t.TempDir()
+	bin := filepath.Join(tmpDir, "myapp")
+	if err := os.WriteFile(bin, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(tmpDir, "public")
+	err := runRelease(newFlagSet(releaseCmd), []string{"-json", "-o", out, "-platform", "linux-amd64", "-version", "1.0", bin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !jsonOutput || progress != os.Stderr {
+		t.Error("-json should redirect progress to stderr")
+	}
+
+	var buf bytes.Buffer
+	printResult(&buf, "release", err)
+	var r result
+	if err := json.Unmarshal(buf.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{out + "/1.0/linux-amd64.gz", out + "/linux-amd64.json", out + "/index.json"}
+	if !r.OK || r.Command != "release" || !reflect.DeepEqual(r.Files, want) {
+		t.Errorf("unexpected result %+v", r)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tmpDir := t.TempDir()
+	genDir := filepath.Join(tmpDir, "public")
+	bin := filepath.Join(tmpDir, "myapp")
+	keyName := filepath.Join(tmpDir, "selfupdate")
+	if err := runKeygen(newFlagSet(keygenCmd), []string{"-o", keyName}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []string{"1.0", "1.1"} {
+		if err := os.WriteFile(bin, []byte("myapp binary at version "+v), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-platform", "linux-amd64",
+			"-version", v, "-channel", "stable,beta", "-key", keyName + ".key", "-checksums", bin})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := runDiff(newFlagSet(diffCmd), []string{"-o", genDir, "-version", "1.1", "-key", keyName + ".key"}); err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func() error {
+		return runVerify(newFlagSet(verifyCmd), []string{"-pubkey", keyName + ".pub", genDir})
+	}
+	if err := verify(); err != nil {
+		t.Fatalf("valid tree: %v", err)
+	}
+
+	// an artifact replaced after release breaks the manifest and index
+	// entry of both channels, the patch to it, its checksum and signature
+	artifact := filepath.Join(genDir, "1.1", "linux-amd64.gz")
+	var buf bytes.Buffer
+	if err := os.WriteFile(bin, []byte("tampered"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := publish.CompressArtifact(&buf, bin, "gzip", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(artifact, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(); err == nil || !strings.HasPrefix(err.Error(), "7 problems") {
+		t.Errorf("tampered artifact: got %v, want 7 problems", err)
+	}
+}
+
+func TestServe(t *testing.T) {
+	tmpDir := t.TempDir()
+	genDir := filepath.Join(tmpDir, "public")
+	bin := filepath.Join(tmpDir, "myapp")
+	if err := os.WriteFile(bin, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err := runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-cmd", "myapp", "-platform", "linux-amd64", "-version", "1.0", bin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(serveHandler(genDir))
+	defer srv.Close()
+
+	tests := []struct {
+		method, path string
+		status       int
+		contentType  string
+	}{
+		{"GET", "/myapp/linux-amd64.json", http.StatusOK, "application/json"},
+		{"GET", "/myapp/1.0/linux-amd64.gz", http.StatusOK, "application/gzip"},
+		{"HEAD", "/myapp/1.0/linux-amd64.gz", http.StatusOK, "application/gzip"},
+		{"GET", "/myapp/", http.StatusNotFound, ""},
+		{"GET", "/myapp/missing.json", http.StatusNotFound, ""},
+		{"PUT", "/myapp/linux-amd64.json", http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, srv.URL+tt.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, resp.StatusCode, tt.status)
+		}
+		if tt.contentType != "" && resp.Header.Get("Content-Type") != tt.contentType {
+			t.Errorf("%s %s: Content-Type %q, want %q", tt.method, tt.path, resp.Header.Get("Content-Type"), tt.contentType)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/myapp/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var stats treeStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	stable := stats.Channels["stable"]
+	if len(stable) != 1 || stable[0].Version != "1.0" || stable[0].Sizes["linux-amd64"] == 0 || stats.Downloads["1.0"] != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	resp, err = http.Get(srv.URL + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("stats of a directory without index: status %d", resp.StatusCode)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	tmpDir := t.TempDir()
+	genDir := filepath.Join(tmpDir, "public")
+	bin := filepath.Join(tmpDir, "myapp")
+
+	// 1.0 stays on the lts channel while stable moves on
+	releases := []struct{ version, channel string }{
+		{"1.0", "lts"}, {"1.1", "stable"}, {"1.2", "stable"}, {"1.3", "stable"},
+	}
+	for i, r := range releases {
+		if err := os.WriteFile(bin, []byte("myapp binary at version "+r.version), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-platform", "linux-amd64",
+			"-version", r.version, "-channel", r.channel, bin})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mod := time.Now().Add(time.Duration(i-len(releases)) * time.Hour)
+		if err := os.Chtimes(filepath.Join(genDir, r.version, "linux-amd64.gz"), mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := runDiff(newFlagSet(diffCmd), []string{"-o", genDir, "-version", "1.3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runPrune(newFlagSet(pruneCmd), []string{"-o", genDir, "-keep", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	for version, kept := range map[string]bool{"1.0": true, "1.1": false, "1.2": false, "1.3": true} {
+		_, err := os.Stat(filepath.Join(genDir, version))
+		if kept && err != nil {
+			t.Errorf("version %s was removed: %v", version, err)
+		}
+		if !kept && !os.IsNotExist(err) {
+			t.Errorf("version %s was kept", version)
+		}
+	}
+	for from, kept := range map[string]bool{"1.0": true, "1.1": false, "1.2": false} {
+		_, err := os.Stat(filepath.Join(genDir, filepath.FromSlash(publish.PatchPath(from, "1.3", "linux-amd64"))))
+		if kept != (err == nil) {
+			t.Errorf("patch from %s: kept %v, want %v", from, err == nil, kept)
+		}
+	}
+	index := readTestIndex(t, genDir)
+	if len(index.Channels["stable"]) != 1 || index.Channels["stable"][0].Version != "1.3" || len(index.Channels["lts"]) != 1 {
+		t.Errorf("pruned versions left in index: %+v", index.Channels)
+	}
+}
+
+func readTestIndex(t *testing.T, root string) *selfupdate.Index {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(root, selfupdate.IndexFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index selfupdate.Index
+	if err := json.Unmarshal(b, &index); err != nil {
+		t.Fatal(err)
+	}
+	return &index
+}
+
+func readTestManifest(t *testing.T, name string) *selfupdate.UpdateInfo {
+	t.Helper()
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info selfupdate.UpdateInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		t.Fatal(err)
+	}
+	return &info
+}
+
+func TestPromote(t *testing.T) {
+	tmpDir := t.TempDir()
+	genDir := filepath.Join(tmpDir, "public")
+	bin := filepath.Join(tmpDir, "myapp")
+	for _, r := range []struct{ version, channel string }{{"1.0", "stable"}, {"1.1", "beta"}} {
+		if err := os.WriteFile(bin, []byte("myapp binary at version "+r.version), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-platform", "linux-amd64",
+			"-version", r.version, "-channel", r.channel, bin})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var messages []string
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg struct{ Text, Content string }
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil || msg.Text != msg.Content {
+			t.Errorf("unexpected webhook message %+v, %v", msg, err)
+		}
+		messages = append(messages, msg.Text)
+	}))
+	defer webhook.Close()
+
+	err := runPromote(newFlagSet(promoteCmd), []string{"-o", genDir, "-from", "beta", "-version", "1.2", "-notify", webhook.URL})
+	if err == nil {
+		t.Error("expected error promoting a version beta is not on")
+	}
+	err = runPromote(newFlagSet(promoteCmd), []string{"-o", genDir, "-from", "beta", "-version", "1.1", "-min-age", "72h"})
+	if err == nil || !strings.Contains(err.Error(), "less than -min-age") {
+		t.Errorf("expected error promoting a version released just now, got %v", err)
+	}
+	if err := runPromote(newFlagSet(promoteCmd), []string{"-o", genDir, "-from", "beta", "-version", "1.1", "-diff", "-rollout", "10%", "-notify", webhook.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || !strings.HasPrefix(messages[0], "promoting 1.2 from beta to stable in "+genDir+" failed: ") ||
+		messages[1] != "promoted 1.1 from beta to stable in "+genDir+"\n"+filepath.Join(genDir, "linux-amd64.json") {
+		t.Errorf("unexpected notifications %q", messages)
+	}
+
+	b, err := os.ReadFile(filepath.Join(genDir, "linux-amd64.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info struct {
+		Version, Channel string
+		Rollout          int
+	}
+	if err := json.Unmarshal(b, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.1" || info.Channel != "stable" || info.Rollout != 10 {
+		t.Errorf("stable manifest is %+v after promotion", info)
+	}
+	patch, err := os.Open(filepath.Join(genDir, filepath.FromSlash(publish.PatchPath("1.0", "1.1", "linux-amd64"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer patch.Close()
+	if got, err := bsdiff.Patch([]byte("myapp binary at version 1.0"), patch); err != nil || string(got) != "myapp binary at version 1.1" {
+		t.Errorf("patch produced %q, %v", got, err)
+	}
+
+	stable := readTestIndex(t, genDir).Channels["stable"]
+	if len(stable) != 2 || stable[0].Version != "1.1" || stable[1].Version != "1.0" {
+		t.Errorf("unexpected stable history %+v", stable)
+	}
+}
+
+func TestPromoteChecksArtifacts(t *testing.T) {
+	tmpDir := t.TempDir()
+	bin := filepath.Join(tmpDir, "myapp")
+	keyName := filepath.Join(tmpDir, "selfupdate")
+	if err := runKeygen(newFlagSet(keygenCmd), []string{"-o", keyName}); err != nil {
+		t.Fatal(err)
+	}
+	release := func(dir, contents string, extra ...string) {
+		if err := os.WriteFile(bin, []byte(contents), 0755); err != nil {
+			t.Fatal(err)
+		}
+		args := append([]string{"-o", dir, "-platform", "linux-amd64", "-version", "1.0", "-channel", "beta"}, extra...)
+		if err := runRelease(newFlagSet(releaseCmd), append(args, bin)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := filepath.Join(tmpDir, "other")
+	release(other, "another binary")
+	corrupted, err := os.ReadFile(filepath.Join(other, "1.0", "linux-amd64.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, signed := range []bool{false, true} {
+		genDir := filepath.Join(tmpDir, "public"+strconv.FormatBool(signed))
+		var keyArgs []string
+		if signed {
+			keyArgs = []string{"-key", keyName + ".key"}
+		}
+		release(genDir, "myapp binary", keyArgs...)
+		args := append([]string{"-o", genDir, "-from", "beta", "-version", "1.0"}, keyArgs...)
+		if err := runPromote(newFlagSet(promoteCmd), append(args, "-dry-run")); err != nil {
+			t.Fatalf("signed %v: %v", signed, err)
+		}
+
+		if err := os.WriteFile(filepath.Join(genDir, "1.0", "linux-amd64.gz"), corrupted, 0644); err != nil {
+			t.Fatal(err)
+		}
+		want := selfupdate.ErrHashMismatch
+		if signed {
+			want = selfupdate.ErrSignatureMismatch
+		}
+		if err := runPromote(newFlagSet(promoteCmd), args); !errors.Is(err, want) {
+			t.Errorf("signed %v: promoting a corrupted artifact: got %v, want %v", signed, err, want)
+		}
+		if _, err := os.Stat(filepath.Join(genDir, "linux-amd64.json")); !os.IsNotExist(err) {
+			t.Errorf("signed %v: corrupted artifact was promoted: %v", signed, err)
+		}
+	}
+}
+
+func TestPromoteLayout(t *testing.T) {
+	tmpDir := t.TempDir()
+	bin := filepath.Join(tmpDir, "myapp")
+	if err := os.WriteFile(bin, []byte("myapp binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for layout, copied := range map[string]string{
+		"{{.Cmd}}/bin/{{.Version}}/{{.Platform}}{{.Ext}}":          "",
+		"{{.Cmd}}/{{.Channel}}/{{.Version}}/{{.Platform}}{{.Ext}}": "stable/1.0/linux-amd64.gz",
+	} {
+		genDir := filepath.Join(t.TempDir(), "public")
+		err := runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-cmd", "myapp", "-platform", "linux-amd64",
+			"-version", "1.0", "-channel", "beta", "-layout", layout, bin})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = runPromote(newFlagSet(promoteCmd), []string{"-o", genDir, "-cmd", "myapp", "-from", "beta", "-version", "1.0", "-layout", layout})
+		if err != nil {
+			t.Fatalf("%s: %v", layout, err)
+		}
+		tree := filepath.Join(genDir, "myapp")
+		if _, err := os.Stat(filepath.Join(tree, "linux-amd64.json")); err != nil {
+			t.Errorf("%s: not promoted: %v", layout, err)
+		}
+		if copied != "" {
+			if _, err := os.Stat(filepath.Join(tree, filepath.FromSlash(copied))); err != nil {
+				t.Errorf("%s: artifact not copied to the stable channel: %v", layout, err)
+			}
+		}
+		if err := runVerify(newFlagSet(verifyCmd), []string{"-o", genDir, "-cmd", "myapp", "-layout", layout}); err != nil {
+			t.Errorf("%s: %v", layout, err)
+		}
+	}
+}
+
+func TestReleaseNotes(t *testing.T) {
+	tmpDir := t.TempDir()
+	genDir := filepath.Join(tmpDir, "public")
+	bin := filepath.Join(tmpDir, "myapp")
+	notes := filepath.Join(tmpDir, "CHANGELOG.md")
+	if err := os.WriteFile(bin, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(notes, []byte("## 1.0\n\n* First release\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-platform", "linux-amd64", "-version", "1.0",
+		"-notes", notes, "-notes-url", "https://example.com/changelog#1.0", bin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(genDir, "linux-amd64.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info struct{ Notes, NotesURL string }
+	if err := json.Unmarshal(b, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Notes != "## 1.0\n\n* First release" || info.NotesURL != "https://example.com/changelog#1.0" {
+		t.Errorf("unexpected notes in manifest %+v", info)
+	}
+
+	err = runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-platform", "linux-amd64", "-version", "1.0",
+		"-notes-url", "changelog.html", bin})
+	if err == nil {
+		t.Error("expected error for a relative -notes-url")
+	}
+}
+
+func TestReleaseArchive(t *testing.T) {
+	tmpDir := t.TempDir()
+	genDir := filepath.Join(tmpDir, "public")
+	dist := filepath.Join(tmpDir, "dist")
+	if err := os.MkdirAll(filepath.Join(tmpDir, "completions"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dist, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"LICENSE": "MIT", "completions/myapp.bash": "complete -F _myapp myapp"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, filepath.FromSlash(name)), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	for _, v := range []string{"1.0", "1.1"} {
+		for _, p := range []string{"linux-amd64", "windows-amd64"} {
+			if err := os.WriteFile(filepath.Join(dist, p), []byte(p+" binary at version "+v), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-cmd", "myapp", "-version", v,
+			"-archive", "zip", "-files", "LICENSE,completions", dist})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := filepath.Join(genDir, "myapp")
+	if err := runDiff(newFlagSet(diffCmd), []string{"-o", genDir, "-cmd", "myapp", "-version", "1.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runVerify(newFlagSet(verifyCmd), []string{root}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(root, "windows-amd64.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info selfupdate.UpdateInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Archive != "zip" || info.Executable != "myapp.exe" || info.Compression != "" {
+		t.Errorf("unexpected manifest %+v", info)
+	}
+	f, err := os.Open(filepath.Join(root, "1.1", "windows-amd64.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	completion, err := publish.ReadArtifact(f, "zip", "completions/myapp.bash")
+	if err != nil || string(completion) != "complete -F _myapp myapp" {
+		t.Errorf("completions in archive: %q, %v", completion, err)
+	}
+
+	err = runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-version", "1.2", "-archive", "zip", dist})
+	if err == nil {
+		t.Error("expected error for -archive in directory mode without -cmd")
+	}
+}
+
+func TestReleaseLayout(t *testing.T) {
+	tmpDir := t.TempDir()
+	genDir := filepath.Join(tmpDir, "public")
+	bin := filepath.Join(tmpDir, "myapp")
+	if err := os.WriteFile(bin, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	err := runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-cmd", "myapp", "-platform", "linux-amd64",
+		"-version", "1.0", "-channel", "beta", "-layout", "{{.Cmd}}/{{.Channel}}/{{.Version}}/{{.Platform}}{{.Ext}}", bin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"myapp/beta/linux-amd64.json", "myapp/beta/1.0/linux-amd64.gz"} {
+		if _, err := os.Stat(filepath.Join(genDir, filepath.FromSlash(name))); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// diff finds the artifacts at the same layout
+	layout := "{{.Cmd}}/{{.Channel}}/{{.Version}}/{{.Platform}}{{.Ext}}"
+	if err := os.WriteFile(bin, []byte("binary 1.1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-cmd", "myapp", "-platform", "linux-amd64",
+		"-version", "1.1", "-channel", "beta", "-layout", layout, bin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runDiff(newFlagSet(diffCmd), []string{"-o", genDir, "-cmd", "myapp", "-version", "1.1", "-layout", layout}); err != nil {
+		t.Fatal(err)
+	}
+	patch, err := os.Open(filepath.Join(genDir, "myapp", filepath.FromSlash(publish.PatchPath("1.0", "1.1", "linux-amd64"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := bsdiff.Patch([]byte("binary"), patch)
+	patch.Close()
+	if err != nil || string(got) != "binary 1.1" {
+		t.Errorf("patch from 1.0 produced %q, %v", got, err)
+	}
+
+	// verify checks the manifests, index and patches at the same layout
+	if err := runVerify(newFlagSet(verifyCmd), []string{"-o", genDir, "-cmd", "myapp", "-layout", layout}); err != nil {
+		t.Error(err)
+	}
+
+	err = runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-cmd", "myapp", "-platform", "linux-amd64",
+		"-version", "1.0", "-layout", "bin/{{.Version}}/{{.Platform}}{{.Ext}}", bin})
+	if err == nil {
+		t.Error("expected error for a layout outside the update tree")
+	}
+}
+
+func TestReleaseApps(t *testing.T) {
+	tmpDir := t.TempDir()
+	genDir := filepath.Join(tmpDir, "public")
+	dist := filepath.Join(tmpDir, "dist")
+	if err := os.MkdirAll(filepath.Join(dist, "mytool"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"myapp_linux_amd64", "myapp_darwin_arm64", "mytool/linux-amd64"} {
+		if err := os.WriteFile(filepath.Join(dist, filepath.FromSlash(name)), []byte(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-cmd", "myapp", "-cmd", "mytool",
+		"-map", "{cmd}_{os}_{arch}", "-version", "1.0", dist})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"myapp/linux-amd64.json", "myapp/darwin-arm64.json", "myapp/1.0/linux-amd64.gz",
+		"mytool/linux-amd64.json", "mytool/1.0/linux-amd64.gz", "myapp/" + selfupdate.IndexFile, "mytool/" + selfupdate.IndexFile} {
+		if _, err := os.Stat(filepath.Join(genDir, filepath.FromSlash(name))); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(genDir, "mytool", "darwin-arm64.json")); err == nil {
+		t.Error("mytool was released with the binaries of myapp")
+	}
+
+	err = runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-cmd", "myapp,other", "-version", "1.1", dist})
+	if err == nil {
+		t.Error("expected error for an application without binaries")
+	}
+	err = runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-cmd", "myapp", "-cmd", "myapp", "-version", "1.1", dist})
+	if exitCode(err) != exitUsage {
+		t.Errorf("expected usage error for a repeated application, got %v", err)
+	}
+}
+
+func TestReleaseEncrypted(t *testing.T) {
+	tmpDir := t.TempDir()
+	genDir := filepath.Join(tmpDir, "public")
+	bin := filepath.Join(tmpDir, "myapp")
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityFile := filepath.Join(tmpDir, "fleet.txt")
+	if err := os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"1.0", "1.1"} {
+		if err := os.WriteFile(bin, []byte("private binary at version "+v), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-platform", "linux-amd64", "-version", v,
+			"-encrypt-to", identity.Recipient().String(), bin})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := runDiff(newFlagSet(diffCmd), []string{"-o", genDir, "-version", "1.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(genDir, "patches")); !os.IsNotExist(err) {
+		t.Error("patches were created for encrypted artifacts")
+	}
+	if err := runVerify(newFlagSet(verifyCmd), []string{genDir}); err == nil {
+		t.Error("expected verify to fail without the identity")
+	}
+	if err := runVerify(newFlagSet(verifyCmd), []string{"-identity", identityFile, genDir}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReleaseUpload(t *testing.T) {
+	tmpDir := t.TempDir()
+	genDir := filepath.Join(tmpDir, "public")
+	uploadDir := filepath.Join(tmpDir, "bucket")
+	bin := filepath.Join(tmpDir, "myapp")
+	if err := os.WriteFile(bin, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	err := runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-upload", uploadDir, "-platform", "linux-amd64",
+		"-version", "1.0", bin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{genDir, uploadDir} {
+		for _, name := range []string{"linux-amd64.json", "1.0/linux-amd64.gz", selfupdate.IndexFile} {
+			if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	err = runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-upload", uploadDir, "-cloudfront-distribution", "E123",
+		"-platform", "linux-amd64", "-version", "1.1", bin})
+	if exitCode(err) != exitUsage {
+		t.Errorf("expected usage error for CloudFront without S3, got %v", err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	tmpDir := t.TempDir()
+	genDir := filepath.Join(tmpDir, "public")
+	bin := filepath.Join(tmpDir, "myapp")
+	for _, v := range []string{"1.0", "1.1"} {
+		if err := os.WriteFile(bin, []byte("binary "+v), 0755); err != nil {
+			t.Fatal(err)
+		}
+		args := []string{"-o", genDir, "-platform", "linux-amd64", "-version", v, "-date", "2024-01-02T03:04:05Z", bin}
+		if v == "1.1" {
+			args = append([]string{"-dry-run"}, args...)
+		}
+		var out bytes.Buffer
+		progress = &out
+		err := runRelease(newFlagSet(releaseCmd), args)
+		progress = os.Stdout
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v == "1.1" && !strings.Contains(out.String(), `Version: "1.0" -> "1.1"`) {
+			t.Errorf("dry run does not show the manifest change:\n%s", out.String())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(genDir, "1.1")); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote version 1.1: %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(genDir, "linux-amd64.json"))
+	if err != nil || !strings.Contains(string(b), `"Version": "1.0"`) {
+		t.Errorf("dry run changed the manifest: %s, %v", b, err)
+	}
+}
+
+func TestReleaseDateAndCompact(t *testing.T) {
+	tmpDir := t.TempDir()
+	genDir := filepath.Join(tmpDir, "public")
+	bin := filepath.Join(tmpDir, "myapp")
+	if err := os.WriteFile(bin, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"-o", genDir, "-platform", "linux-amd64", "-version", "1.0", "-date", "2024-01-02T03:04:05+02:00", "-compact", bin}
+	if err := runRelease(newFlagSet(releaseCmd), args); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"linux-amd64.json", "index.json"} {
+		b, err := os.ReadFile(filepath.Join(genDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), `"2024-01-02T01:04:05Z"`) {
+			t.Errorf("%s: date is not in UTC: %s", name, b)
+		}
+		if bytes.ContainsRune(b, '\n') {
+			t.Errorf("%s is not compact: %s", name, b)
+		}
+	}
+}
+
+func TestReleaseHexDigests(t *testing.T) {
+	tmpDir := t.TempDir()
+	genDir := filepath.Join(tmpDir, "public")
+	bin := filepath.Join(tmpDir, "myapp")
+	keyName := filepath.Join(tmpDir, "selfupdate")
+	if err := os.WriteFile(bin, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := runKeygen(newFlagSet(keygenCmd), []string{"-o", keyName}); err != nil {
+		t.Fatal(err)
+	}
+	err := runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-platform", "linux-amd64", "-version", "1.0",
+		"-channel", "beta", "-hash-encoding", "hex", "-key", keyName + ".key", bin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runPromote(newFlagSet(promoteCmd), []string{"-o", genDir, "-from", "beta", "-version", "1.0",
+		"-hash-encoding", "hex", "-key", keyName + ".key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte("binary"))
+	for _, name := range []string{"beta/linux-amd64.json", "linux-amd64.json"} {
+		b, err := os.ReadFile(filepath.Join(genDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), `"Sha256": "`+hex.EncodeToString(sum[:])+`"`) {
+			t.Errorf("%s: digest is not in hex: %s", name, b)
+		}
+	}
+	if err := runVerify(newFlagSet(verifyCmd), []string{"-pubkey", keyName + ".pub", genDir}); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+
+	err = runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-platform", "linux-amd64", "-version", "1.1",
+		"-hash-encoding", "base32", bin})
+	if exitCode(err) != exitUsage {
+		t.Errorf("expected usage error for -hash-encoding base32, got %v", err)
+	}
+}
+
+func TestUpdateRollout(t *testing.T) {
+	tmpDir := t.TempDir()
+	genDir := filepath.Join(tmpDir, "public")
+	bin := filepath.Join(tmpDir, "myapp")
+	if err := os.WriteFile(bin, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	rollout := func() int {
+		t.Helper()
+		b, err := os.ReadFile(filepath.Join(genDir, "linux-amd64.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var info selfupdate.UpdateInfo
+		if err := json.Unmarshal(b, &info); err != nil {
+			t.Fatal(err)
+		}
+		return info.Rollout
+	}
+
+	err := runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-platform", "linux-amd64", "-version", "1.0", "-rollout", "10%", bin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rollout(); got != 10 {
+		t.Errorf("got rollout %d after release, want 10", got)
+	}
+	for _, tt := range []struct {
+		flag string
+		want int
+	}{{"50%", 50}, {"100", 0}} {
+		if err := runUpdateRollout(newFlagSet(rolloutCmd), []string{"-o", genDir, "-rollout", tt.flag}); err != nil {
+			t.Fatal(err)
+		}
+		if got := rollout(); got != tt.want {
+			t.Errorf("got rollout %d after -rollout %s, want %d", got, tt.flag, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"0%", "150%", "ten"} {
+		if _, err := parseRollout(bad); err == nil {
+			t.Errorf("expected error for rollout %q", bad)
+		}
+	}
+	if err := runUpdateRollout(newFlagSet(rolloutCmd), []string{"-o", genDir, "-rollout", "20%", "-version", "0.9"}); err == nil {
+		t.Error("expected error when no platform is on -version")
+	}
+	err = runUpdateRollout(newFlagSet(rolloutCmd), []string{"-o", genDir, "-rollout", "20%", "-cloudfront-distribution", "E123"})
+	if exitCode(err) != exitUsage {
+		t.Errorf("expected usage error for CloudFront without S3, got %v", err)
+	}
+}
+
+func TestYank(t *testing.T) {
+	tmpDir := t.TempDir()
+	genDir := filepath.Join(tmpDir, "public")
+	bin := filepath.Join(tmpDir, "myapp")
+	release := func(v string) error {
+		if err := os.WriteFile(bin, []byte("myapp binary at version "+v), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-platform", "linux-amd64",
+			"-version", v, "-channel", "stable,beta", "-min-disk", "10MB", bin})
+	}
+	for _, v := range []string{"1.0", "1.1"} {
+		if err := release(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := runDiff(newFlagSet(diffCmd), []string{"-o", genDir, "-version", "1.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runYank(newFlagSet(yankCmd), []string{"-o", genDir, "-version", "1.1", "-delete"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"linux-amd64.json", "beta/linux-amd64.json"} {
+		info := readTestManifest(t, filepath.Join(genDir, filepath.FromSlash(name)))
+		if info.Version != "1.0" {
+			t.Errorf("%s is on %s after yanking 1.1, want 1.0", name, info.Version)
+		}
+		// the rolled back manifest keeps what clients limit and check with
+		if info.Size == 0 || info.MinDisk == 0 {
+			t.Errorf("%s lost the size or requirements of 1.0: %+v", name, info)
+		}
+	}
+	for _, name := range []string{"1.1", "patches/1.0/1.1"} {
+		if _, err := os.Stat(filepath.Join(genDir, filepath.FromSlash(name))); !os.IsNotExist(err) {
+			t.Errorf("%s was not deleted", name)
+		}
+	}
+	index := readTestIndex(t, genDir)
+	if !index.IsYanked("1.1") || len(index.Channels["stable"]) != 1 {
+		t.Errorf("unexpected index after yank %+v", index)
+	}
+	if err := runVerify(newFlagSet(verifyCmd), []string{genDir}); err != nil {
+		t.Error(err)
+	}
+
+	if err := release("1.1"); err == nil {
+		t.Error("expected error when releasing a yanked version again")
+	}
+	if err := runYank(newFlagSet(yankCmd), []string{"-o", genDir, "-version", "1.0"}); err == nil {
+		t.Error("expected error when there is no earlier version to roll back to")
+	}
+}
+
+func TestClientConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	genDir := filepath.Join(tmpDir, "public")
+	bin := filepath.Join(tmpDir, "myapp")
+	keyName := filepath.Join(tmpDir, "selfupdate")
+	if err := os.WriteFile(bin, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := runKeygen(newFlagSet(keygenCmd), []string{"-o", keyName}); err != nil {
+		t.Fatal(err)
+	}
+	err := runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-cmd", "myapp", "-platform", "linux-amd64",
+		"-version", "1.0", "-channel", "beta", "-key", keyName + ".key", bin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(tmpDir, "updater.json")
+	err = runClientConfig(newFlagSet(clientCmd), []string{"-o", genDir, "-cmd", "myapp", "-url", "https://updates.example.com",
+		"-channel", "beta", "-pubkey", keyName + ".pub", "-format", "json", "-write", out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var u selfupdate.Updater
+	if err := json.Unmarshal(b, &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.ApiURL != "https://updates.example.com/" || u.BinURL != u.ApiURL || u.DiffURL != "" ||
+		u.CmdName != "myapp" || u.Channel != "beta" || len(u.PublicKey) != ed25519.PublicKeySize {
+		t.Errorf("unexpected client configuration %s", b)
+	}
+
+	for _, args := range [][]string{
+		{"-channel", "stable", "-url", "https://updates.example.com"},
+		{"-channel", "beta"},
+	} {
+		err := runClientConfig(newFlagSet(clientCmd), append([]string{"-o", genDir, "-cmd", "myapp", "-write", out}, args...))
+		if err == nil {
+			t.Errorf("%v: expected error", args)
+		}
+	}
+}
+
+func TestValidateVersion(t *testing.T) {
+	tests := []struct {
+		version, format string
+		valid           bool
+	}{
+		{"1.2", versionSemver, true},
+		{"v1.2.3", versionSemver, true},
+		{"1.3-beta1", versionSemver, true},
+		{"v1.2.3-4-gabcdef0-dirty", versionSemver, true},
+		{"1.2.3+build.5", versionSemver, true},
+		{"v1.2..3", versionSemver, false},
+		{"1.2.", versionSemver, false},
+		{"01.2", versionSemver, false},
+		{"1.2.3.4", versionSemver, false},
+		{"1.2", versionStrict, false},
+		{"1.2.3-rc.1", versionStrict, true},
+		{"66c6c12", versionAny, true},
+		{"66c6c12", versionSemver, false},
+		{"../1.2", versionAny, false},
+		{"patches", versionAny, false},
+		{"1.2", "calver", false},
+	}
+	for _, tt := range tests {
+		if err := validateVersion(tt.version, tt.format); (err == nil) != tt.valid {
+			t.Errorf("validateVersion(%q, %s) = %v, want valid %v", tt.version, tt.format, err, tt.valid)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.10", "1.9", 1},
+		{"v1.2", "1.2.0", 0},
+		{"1.3-beta1", "1.3", -1},
+		{"1.3-beta.2", "1.3-beta.10", -1},
+		{"1.3-rc.1", "1.3-beta.2", 1},
+		{"1.3-1", "1.3-beta", -1},
+		{"1.2.3+build.5", "1.2.3", 0},
+		{"66c6c12", "1.2", 1},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestGitVersion(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git("add", ".")
+	git("commit", "-q", "-m", "initial")
+	git("tag", "v1.4.2")
+
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	if v, err := gitVersion(); err != nil || v != "v1.4.2" {
+		t.Errorf("gitVersion() = %q, %v, want v1.4.2", v, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main // changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := gitVersion(); err != nil || v != "v1.4.2-dirty" {
+		t.Errorf("gitVersion() = %q, %v, want v1.4.2-dirty", v, err)
+	}
+}
+
+func TestFleetLockServer(t *testing.T) {
+	srv := httptest.NewServer(&fleetLock{slots: 1})
+	defer srv.Close()
+	ctx := context.Background()
+	a := &selfupdate.HTTPFleetLock{URL: srv.URL}
+	if err := a.Lock(ctx, "node-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Lock(ctx, "node-a"); err != nil {
+		t.Errorf("taking a held slot again: %v", err)
+	}
+	if err := a.Lock(ctx, "node-b"); !errors.Is(err, selfupdate.ErrFleetBusy) {
+		t.Errorf("taking a second slot: got %v, want ErrFleetBusy", err)
+	}
+	other := &selfupdate.HTTPFleetLock{URL: srv.URL, Group: "workers"}
+	if err := other.Lock(ctx, "node-b"); err != nil {
+		t.Errorf("groups share slots: %v", err)
+	}
+	if err := a.Unlock(ctx, "node-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Lock(ctx, "node-b"); err != nil {
+		t.Errorf("taking a released slot: %v", err)
+	}
+}
+
+func TestReleaseRequirements(t *testing.T) {
+	tmpDir := t.TempDir()
+	genDir := filepath.Join(tmpDir, "public")
+	bin := filepath.Join(tmpDir, "myapp")
+	if err := os.WriteFile(bin, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	err := runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-platform", "linux-amd64", "-version", "1.0",
+		"-min-disk", "200MB", "-min-memory", "1.5GiB", bin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(genDir, "linux-amd64.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info struct{ MinDisk, MinMemory int64 }
+	if err := json.Unmarshal(b, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.MinDisk != 200e6 || info.MinMemory != 3<<29 {
+		t.Errorf("unexpected requirements in manifest %+v", info)
+	}
+
+	err = runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-platform", "linux-amd64", "-version", "1.1",
+		"-min-disk", "lots", bin})
+	if err == nil {
+		t.Error("expected error for an invalid -min-disk")
+	}
+}
+
+func TestReleasePackages(t *testing.T) {
+	tmpDir := t.TempDir()
+	genDir := filepath.Join(tmpDir, "public")
+	bin := filepath.Join(tmpDir, "myapp")
+	if err := os.WriteFile(bin, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	err := runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-cmd", "myapp", "-platform", "darwin-arm64", "-version", "1.0",
+		"-channel", "beta,stable", "-packages", "homebrew", "-package-url", "https://example.com/", bin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(genDir, "myapp", "packages", "homebrew", "myapp.rb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `url "https://example.com/myapp/1.0/darwin-arm64.gz"`) {
+		t.Errorf("formula does not point at the artifact:\n%s", b)
+	}
+	if err := runVerify(newFlagSet(verifyCmd), []string{filepath.Join(genDir, "myapp")}); err != nil {
+		t.Errorf("verify of a tree with packages: %v", err)
+	}
+
+	err = runRelease(newFlagSet(releaseCmd), []string{"-o", genDir, "-cmd", "myapp", "-platform", "darwin-arm64", "-version", "1.1",
+		"-channel", "beta", "-packages", "homebrew", "-package-url", "https://example.com/", bin})
+	if err == nil {
+		t.Error("expected error for -packages with -channel not including stable")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bobo/go-selfupdate/selfupdate/publish"
+)
+
+// notifyTimeout bounds how long a command waits for the webhook
+const notifyTimeout = 10 * time.Second
+
+// notifyFlag registers the -notify flag of the commands changing what a
+// channel offers
+func notifyFlag(fs *flag.FlagSet) *string {
+	return fs.String("notify", "", "Slack, Microsoft Teams or Discord webhook URL to post to when the command succeeds or fails.")
+}
+
+// notify posts the outcome of a command to webhook. A notification that
+// cannot be delivered is reported but does not fail the command, which has
+// already changed the tree.
+func notify(webhook, action string, details []string, err error) {
+	text := action
+	if err != nil {
+		text = fmt.Sprintf("%s failed: %v", action, err)
+	} else if len(details) > 0 {
+		text += "\n" + strings.Join(details, "\n")
+	}
+	if err := postWebhook(webhook, text); err != nil {
+		fmt.Fprintln(os.Stderr, "warning: notification failed:", err)
+	}
+}
+
+// postWebhook sends text as an incoming webhook message. Slack and Teams
+// read the text field and Discord reads content, so both are set.
+func postWebhook(webhook, text string) error {
+	body, err := json.Marshal(map[string]string{"text": text, "content": text})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook answered %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// manifestLink returns where clients read the manifest at name of the tree
+// at root, falling back to its path when the storage has no public URL
+func manifestLink(root, name string) string {
+	if base, err := publish.PublicURL(root); err == nil {
+		return base + name
+	}
+	return treeRoot(root, name)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/bobo/go-selfupdate/selfupdate/publish"
+)
+
+// Exit codes. Runtime failures exit with 1 and invalid invocations with 2,
+// matching the flag package.
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+var (
+	// progress receives human readable progress messages. It switches to
+	// stderr with -json so that stdout only carries the JSON result.
+	progress io.Writer = os.Stdout
+	// jsonOutput is set by -json
+	jsonOutput bool
+	// writtenFiles lists every file written by the running command
+	writtenFiles []string
+)
+
+// result is the machine readable outcome of a command printed with -json
+type result struct {
+	Command string   `json:"command"`
+	OK      bool     `json:"ok"`
+	Error   string   `json:"error,omitempty"`
+	Files   []string `json:"files,omitempty"`
+}
+
+// jsonFlag registers the -json flag shared by every command
+func jsonFlag(fs *flag.FlagSet) {
+	fs.BoolFunc("json", "Print a machine readable JSON result on stdout.", func(string) error {
+		jsonOutput = true
+		progress = os.Stderr
+		return nil
+	})
+}
+
+// compactFlag registers the -compact flag of the commands writing manifests
+func compactFlag(fs *flag.FlagSet) *bool {
+	return fs.Bool("compact", false, "Write manifests and the index as compact JSON instead of indented.")
+}
+
+// withCompaction wraps backend to write compact JSON when compact is set.
+// It goes around the signing backend so signatures match what is stored.
+func withCompaction(backend publish.Backend, compact bool) publish.Backend {
+	if !compact {
+		return backend
+	}
+	return &publish.CompactBackend{Backend: backend}
+}
+
+// hashEncodingFlag registers the -hash-encoding flag of the commands
+// writing manifests
+func hashEncodingFlag(fs *flag.FlagSet) *string {
+	return fs.String("hash-encoding", publish.Base64Digests, "Encoding of the digests in manifests: base64, or hex as other release tools write them.")
+}
+
+// withHashEncoding wraps backend to write manifest digests in encoding
+func withHashEncoding(backend publish.Backend, encoding string) (publish.Backend, error) {
+	switch encoding {
+	case publish.Base64Digests:
+		return backend, nil
+	case publish.HexDigests:
+		return &publish.HexDigestBackend{Backend: backend}, nil
+	}
+	return nil, fmt.Errorf("%w: unsupported -hash-encoding %q, use base64 or hex", errUsage, encoding)
+}
+
+func printProgress(a ...any) {
+	fmt.Fprintln(progress, a...)
+}
+
+func printResult(w io.Writer, command string, err error) {
+	r := result{Command: command, OK: err == nil, Files: writtenFiles}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(r)
+}
+
+// errUsage marks errors caused by an invalid invocation
+var errUsage = errors.New("usage error")
+
+// usageError prints the usage of fs and returns an error exiting with
+// exitUsage
+func usageError(fs *flag.FlagSet, msg string) error {
+	fs.Usage()
+	return fmt.Errorf("%w: %s", errUsage, msg)
+}
+
+func exitCode(err error) int {
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.Is(err, errUsage):
+		return exitUsage
+	}
+	return exitFailure
+}
+
+// recordingBackend records the names of the files stored through it
+type recordingBackend struct {
+	publish.Backend
+	root string
+}
+
+// writtenMu guards writtenFiles against backends used concurrently
+var writtenMu sync.Mutex
+
+func (b *recordingBackend) Put(ctx context.Context, name string, r io.Reader, meta publish.Metadata) error {
+	if err := b.Backend.Put(ctx, name, r, meta); err != nil {
+		return err
+	}
+	writtenMu.Lock()
+	writtenFiles = append(writtenFiles, treeRoot(b.root, name))
+	writtenMu.Unlock()
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// platformMapper derives the platform of a binary from its file name in
+// directory mode
+type platformMapper interface {
+	// platform returns the platform for name, or false if name should be
+	// skipped
+	platform(name string) (string, bool)
+}
+
+// identityMapper uses the file name as the platform, without the .exe
+// suffix of Windows binaries
+type identityMapper struct{}
+
+func (identityMapper) platform(name string) (string, bool) {
+	if strings.HasPrefix(name, "windows-") {
+		name = strings.TrimSuffix(name, ".exe")
+	}
+	return name, true
+}
+
+// explicitMapper maps listed file names to platforms
+type explicitMapper map[string]string
+
+func (m explicitMapper) platform(name string) (string, bool) {
+	p, ok := m[name]
+	return p, ok
+}
+
+// patternMapper matches file names against a pattern with {os} and {arch}
+// placeholders and optional * wildcards, ex: myapp_{os}_{arch}*. Windows
+// binaries also match with a .exe suffix.
+type patternMapper struct {
+	re *regexp.Regexp
+}
+
+func (m patternMapper) platform(name string) (string, bool) {
+	match := m.re.FindStringSubmatch(name)
+	if match == nil {
+		return "", false
+	}
+	goos := match[m.re.SubexpIndex("os")]
+	if match[m.re.SubexpIndex("exe")] != "" && goos != "windows" {
+		return "", false
+	}
+	return goos + "-" + match[m.re.SubexpIndex("arch")], true
+}
+
+// parsePlatformMap parses the -map flag, which is either a pattern such as
+// "myapp_{os}_{arch}" or an explicit list such as
+// "myapp.exe=windows-amd64,myapp-mac=darwin-arm64"
+func parsePlatformMap(s string) (platformMapper, error) {
+	if s == "" {
+		return identityMapper{}, nil
+	}
+
+	if strings.Contains(s, "=") {
+		m := explicitMapper{}
+		for _, pair := range splitList(s) {
+			name, platform, ok := strings.Cut(pair, "=")
+			if !ok || name == "" || platform == "" {
+				return nil, fmt.Errorf("invalid mapping %q, expected file=platform", pair)
+			}
+			m[name] = platform
+		}
+		return m, nil
+	}
+
+	if !strings.Contains(s, "{os}") || !strings.Contains(s, "{arch}") {
+		return nil, fmt.Errorf("pattern %q must contain {os} and {arch}", s)
+	}
+	var expr strings.Builder
+	expr.WriteString("^")
+	for rest := s; rest != ""; {
+		switch {
+		case strings.HasPrefix(rest, "{os}"):
+			expr.WriteString(`(?P<os>[a-z0-9]+)`)
+			rest = rest[len("{os}"):]
+		case strings.HasPrefix(rest, "{arch}"):
+			expr.WriteString(`(?P<arch>[a-z0-9]+)`)
+			rest = rest[len("{arch}"):]
+		case rest[0] == '*':
+			expr.WriteString(".*")
+			rest = rest[1:]
+		default:
+			expr.WriteString(regexp.QuoteMeta(rest[:1]))
+			rest = rest[1:]
+		}
+	}
+	expr.WriteString(`(?P<exe>\.exe)?$`)
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, err
+	}
+	return patternMapper{re: re}, nil
+}
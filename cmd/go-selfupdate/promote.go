@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+
+	"github.com/bobo/go-selfupdate/selfupdate"
+	"github.com/bobo/go-selfupdate/selfupdate/publish"
+)
+
+var promoteCmd = &command{
+	name:    "promote",
+	args:    "",
+	summary: "Point the manifests of a channel at the version another channel is on, without uploading anything new.",
+	run:     runPromote,
+}
+
+func runPromote(fs *flag.FlagSet, args []string) (err error) {
+	output, cmd := outputFlags(fs)
+	from := fs.String("from", "", "Channel to promote from (required).")
+	to := fs.String("to", "stable", "Channel to promote to.")
+	version := fs.String("version", "", "Version expected on the -from channel (required). Platforms on another version are left alone.")
+	diff := fs.Bool("diff", false, "Generate patches from the version each platform of -to was on before, unless they exist already.")
+	keyPath := fs.String("key", "", "Private key file created by keygen. Required when the tree is signed.")
+	rollout := fs.String("rollout", "", "Offer the promoted version to this percentage of the installations on -to, such as 10%, instead of the rollout it has on -from.")
+	minAge := fs.Duration("min-age", 0, "Refuse to promote a version released less than this long ago, such as 72h, so it soaks on -from first.")
+	identityPath := fs.String("identity", "", "age identity file to decrypt artifacts released with -encrypt-to, whose digests are not checked otherwise.")
+	dryRun := fs.Bool("dry-run", false, "Print how the manifests would change without writing anything.")
+	layout := layoutFlag(fs)
+	compact := compactFlag(fs)
+	hashEncoding := hashEncodingFlag(fs)
+	webhook := notifyFlag(fs)
+	distribution := rewriteDistributionFlag(fs)
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *from == "" || *version == "" || *minAge < 0 {
+		return usageError(fs, "-from and -version are required and -min-age must not be negative")
+	}
+	if *from == *to {
+		return usageError(fs, "-from and -to must differ")
+	}
+	percent := -1
+	if *rollout != "" {
+		var err error
+		if percent, err = parseRollout(*rollout); err != nil {
+			return err
+		}
+	}
+	root := treeRoot(*output, *cmd)
+	artifacts := treeLayout{layout: *layout, cmd: *cmd}
+	if *distribution != "" && !strings.HasPrefix(root, "s3://") {
+		return usageError(fs, "-cloudfront-distribution needs -o to be an s3:// URL")
+	}
+	var links []string
+	if *webhook != "" && !*dryRun {
+		action := fmt.Sprintf("promoting %s from %s to %s in %s", *version, *from, *to, root)
+		defer func() {
+			if err == nil {
+				action = fmt.Sprintf("promoted %s from %s to %s in %s", *version, *from, *to, root)
+			}
+			notify(*webhook, action, links, err)
+		}()
+	}
+
+	ctx := context.Background()
+	store, err := publish.OpenStore(root)
+	if err != nil {
+		return err
+	}
+	tree, err := scanStore(ctx, store)
+	if err != nil {
+		return err
+	}
+	source := tree.channelManifests(*from)
+	if len(source) == 0 {
+		return fmt.Errorf("channel %s has no manifests in %s", *from, root)
+	}
+	target := tree.channelManifests(*to)
+	index, err := publish.ReadIndex(ctx, store)
+	if err != nil {
+		return err
+	}
+	if index.IsYanked(*version) {
+		return fmt.Errorf("version %s was yanked and cannot be promoted", *version)
+	}
+	if *keyPath == "" {
+		if err := requireUnsigned(ctx, store, selfupdate.IndexFile); err != nil {
+			return err
+		}
+	}
+
+	// artifacts are checked again before they reach a more trusted channel,
+	// against the public half of the signing key when the tree is signed
+	var pub ed25519.PublicKey
+	if *keyPath != "" {
+		key, err := loadSigningKey(*keyPath)
+		if err != nil {
+			return err
+		}
+		pub = key.Public().(ed25519.PublicKey)
+	}
+	var identities []age.Identity
+	if *identityPath != "" {
+		if identities, err = loadIdentities(*identityPath); err != nil {
+			return err
+		}
+	}
+
+	var backend publish.Backend = &recordingBackend{Backend: store, root: root}
+	if *dryRun {
+		backend = &dryRunStore{Store: store, root: root}
+	}
+	if backend, err = withSigning(backend, *keyPath); err != nil {
+		return err
+	}
+	backend = withCompaction(backend, *compact)
+	if backend, err = withHashEncoding(backend, *hashEncoding); err != nil {
+		return err
+	}
+
+	platforms := make([]string, 0, len(source))
+	for p := range source {
+		platforms = append(platforms, p)
+	}
+	sort.Strings(platforms)
+
+	infos := map[string]*selfupdate.UpdateInfo{}
+	for _, p := range platforms {
+		info, err := readStoredManifest(ctx, store, source[p])
+		if err != nil {
+			return err
+		}
+		if info.Version != *version {
+			printProgress("skipping", p, "- channel", *from, "is on", info.Version)
+			continue
+		}
+		if *keyPath == "" {
+			if err := requireUnsigned(ctx, store, source[p]); err != nil {
+				return err
+			}
+		}
+		if elapsed := time.Since(info.Date); elapsed < *minAge {
+			return fmt.Errorf("%s %s was released %s ago, less than -min-age %s", p, *version, elapsed.Round(time.Minute), *minAge)
+		}
+		if err := checkPromoted(ctx, store, artifacts, source[p], p, info, pub, identities); err != nil {
+			return err
+		}
+		infos[p] = info
+	}
+
+	var promoted []string
+	for _, p := range platforms {
+		info, ok := infos[p]
+		if !ok {
+			continue
+		}
+		var previous *selfupdate.UpdateInfo
+		if name, ok := target[p]; ok {
+			if previous, err = readStoredManifest(ctx, store, name); err != nil {
+				return err
+			}
+		}
+		if *diff && previous != nil && previous.Version != info.Version {
+			if err := promotePatch(ctx, store, artifacts, backend, p, previous, info); err != nil {
+				return err
+			}
+		}
+
+		if err := copyArtifact(ctx, store, artifacts, backend, p, info, *to); err != nil {
+			return err
+		}
+		info.Channel = *to
+		if percent >= 0 {
+			info.Rollout = percent
+		}
+		printProgress("promoting", p, "to", *to, *version, "for", rolloutString(info.Rollout))
+		if err := publish.PutManifest(ctx, backend, p, info); err != nil {
+			return err
+		}
+		index.Add(p, *info)
+		links = append(links, manifestLink(root, publish.ManifestPath(*to, p)))
+		promoted = append(promoted, p)
+	}
+	if len(promoted) == 0 {
+		return fmt.Errorf("no platform of channel %s is on version %s", *from, *version)
+	}
+	if err := publish.PutIndex(ctx, backend, index); err != nil {
+		return err
+	}
+	return invalidateRewritten(ctx, *distribution, root, []string{*to}, promoted, *keyPath != "", *dryRun)
+}
+
+// invalidateRewritten invalidates the manifests a command rewrote, if a
+// CloudFront distribution was given
+func invalidateRewritten(ctx context.Context, distribution, root string, channels, platforms []string, signed, dryRun bool) error {
+	if distribution == "" {
+		return nil
+	}
+	if dryRun {
+		printProgress("would invalidate the manifests in CloudFront distribution", distribution)
+		return nil
+	}
+	return invalidateManifests(ctx, distribution, root, channels, platforms, signed)
+}
+
+// requireUnsigned fails when name carries a signature, since a file
+// rewritten without the key would leave a stale signature clients reject
+func requireUnsigned(ctx context.Context, store publish.Store, name string) error {
+	r, err := store.Get(ctx, name+selfupdate.SignatureSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.Close()
+	return fmt.Errorf("%s is signed, pass -key to sign the rewritten files", name)
+}
+
+// checkPromoted downloads the artifact the manifest at name describes and
+// checks it against the manifest digests, and both files against their
+// signatures when key is set, so a corrupted upload is never promoted
+func checkPromoted(ctx context.Context, store publish.Store, layout treeLayout, name, platform string, info *selfupdate.UpdateInfo, key ed25519.PublicKey, identities []age.Identity) error {
+	format := publish.ArtifactFormat(info)
+	artifact, err := layout.artifactPath(info.Channel, info.Version, platform, format)
+	if err != nil {
+		return err
+	}
+	content, err := readStoredFile(ctx, store, artifact)
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		manifest, err := readStoredFile(ctx, store, name)
+		if err != nil {
+			return err
+		}
+		for file, b := range map[string][]byte{name: manifest, artifact: content} {
+			sig, err := readStoredFile(ctx, store, file+selfupdate.SignatureSuffix)
+			if err == nil {
+				err = selfupdate.VerifySignature(key, b, sig)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", file, err)
+			}
+		}
+	}
+
+	if info.Encryption != "" && len(identities) == 0 {
+		printProgress("not checking the digests of", artifact, "- pass -identity to decrypt it")
+		return nil
+	}
+	r, err := publish.DecryptArtifact(bytes.NewReader(content), identities)
+	if err != nil {
+		return fmt.Errorf("%s: %w", artifact, err)
+	}
+	bin, err := publish.ReadArtifact(r, format, info.Executable)
+	if err == nil {
+		err = info.Verify(bin)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", artifact, err)
+	}
+	return nil
+}
+
+// copyArtifact stores the artifact of platform that info describes where
+// layout places it in channel to, for layouts with a directory per channel.
+// Artifacts shared by the channels are left alone.
+func copyArtifact(ctx context.Context, store publish.Store, layout treeLayout, backend publish.Backend, platform string, info *selfupdate.UpdateInfo, to string) error {
+	format := publish.ArtifactFormat(info)
+	src, err := layout.artifactPath(info.Channel, info.Version, platform, format)
+	if err != nil {
+		return err
+	}
+	dst, err := layout.artifactPath(to, info.Version, platform, format)
+	if err != nil || dst == src {
+		return err
+	}
+	r, err := store.Get(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	meta := publish.ArtifactMetadata
+	meta.ContentType = publish.FormatContentType(format)
+	if info.Encryption != "" {
+		meta.ContentType = "application/octet-stream"
+	}
+	printProgress("copying", src, "to", dst)
+	return backend.Put(ctx, dst, r, meta)
+}
+
+// promotePatch stores the patch from the previous version of platform to
+// the promoted one unless it exists already
+func promotePatch(ctx context.Context, store publish.Store, layout treeLayout, backend publish.Backend, platform string, previous, info *selfupdate.UpdateInfo) error {
+	name := publish.PatchPath(previous.Version, info.Version, platform)
+	if r, err := store.Get(ctx, name); err == nil {
+		r.Close()
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if previous.Encryption != "" || info.Encryption != "" {
+		printProgress("skipping", name, "- encrypted artifacts get no patches")
+		return nil
+	}
+	oldBin, err := readStoredArtifact(ctx, store, layout, platform, previous)
+	if err != nil {
+		return err
+	}
+	newBin, err := readStoredArtifact(ctx, store, layout, platform, info)
+	if err != nil {
+		return err
+	}
+	var patch bytes.Buffer
+	if err := publish.CreatePatch(&patch, oldBin, newBin); err != nil {
+		return fmt.Errorf("%s %s -> %s: %w", platform, previous.Version, info.Version, err)
+	}
+	printProgress("creating", name, patch.Len(), "bytes")
+	return backend.Put(ctx, name, &patch, publish.PatchMetadata)
+}
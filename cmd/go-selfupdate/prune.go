@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"strings"
+
+	"github.com/bobo/go-selfupdate/selfupdate"
+	"github.com/bobo/go-selfupdate/selfupdate/publish"
+)
+
+var pruneCmd = &command{
+	name:    "prune",
+	args:    "",
+	summary: "Delete the artifacts and patches of old versions, never removing a version a channel manifest refers to.",
+	run:     runPrune,
+}
+
+func runPrune(fs *flag.FlagSet, args []string) error {
+	output, cmd := outputFlags(fs)
+	keep := fs.Int("keep", 10, "Number of most recent versions to keep. Versions referenced by a channel manifest are always kept.")
+	keyPath := fs.String("key", "", "Private key file created by keygen. Required when the tree is signed, to sign the updated index.")
+	dryRun := fs.Bool("dry-run", false, "Print the files that would be removed without removing anything.")
+	compact := compactFlag(fs)
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *keep < 0 {
+		return usageError(fs, "prune takes no arguments and -keep must not be negative")
+	}
+	root := treeRoot(*output, *cmd)
+
+	ctx := context.Background()
+	store, err := publish.OpenStore(root)
+	if err != nil {
+		return err
+	}
+	tree, err := scanStore(ctx, store)
+	if err != nil {
+		return err
+	}
+	referenced, err := tree.referencedVersions(ctx, store)
+	if err != nil {
+		return err
+	}
+	index, err := publish.ReadIndex(ctx, store)
+	if err != nil {
+		return err
+	}
+	if *keyPath == "" {
+		if err := requireUnsigned(ctx, store, selfupdate.IndexFile); err != nil {
+			return err
+		}
+	}
+	if *dryRun {
+		store = &dryRunStore{Store: store, root: root}
+	}
+	backend, err := withSigning(store, *keyPath)
+	if err != nil {
+		return err
+	}
+	backend = withCompaction(backend, *compact)
+
+	removed := map[string]bool{}
+	for i, v := range tree.versions {
+		if i < *keep || referenced[v.name] {
+			continue
+		}
+		printProgress("removing version", v.name)
+		for _, name := range v.files {
+			if err := store.Delete(ctx, name); err != nil {
+				return err
+			}
+		}
+		removed[v.name] = true
+		index.Remove(v.name)
+	}
+	for _, name := range tree.patches {
+		// patches/<from>/<to>/<platform>.patch
+		parts := strings.Split(name, "/")
+		if len(parts) == 4 && (removed[parts[1]] || removed[parts[2]]) {
+			printProgress("removing patch", name)
+			if err := store.Delete(ctx, name); err != nil {
+				return err
+			}
+		}
+	}
+	printProgress("removed", len(removed), "of", len(tree.versions), "versions from", root)
+	if len(removed) == 0 {
+		return nil
+	}
+	return publish.PutIndex(ctx, backend, index)
+}
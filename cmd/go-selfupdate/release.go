@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bobo/go-selfupdate/internal/archive"
+	compress "github.com/bobo/go-selfupdate/internal/compression"
+	"github.com/bobo/go-selfupdate/selfupdate"
+	"github.com/bobo/go-selfupdate/selfupdate/publish"
+)
+
+var releaseCmd = &command{
+	name:    "release",
+	args:    "[path]",
+	summary: "Publish a binary, or a directory of binaries named after their platform, as a new version.",
+	run:     runRelease,
+}
+
+func defaultPlatform() string {
+	goos := os.Getenv("GOOS")
+	goarch := os.Getenv("GOARCH")
+	if goos != "" && goarch != "" {
+		return goos + "-" + goarch
+	}
+	return runtime.GOOS + "-" + runtime.GOARCH
+}
+
+// outputFlags registers the flags selecting the update tree shared by the
+// commands that read or write it
+func outputFlags(fs *flag.FlagSet) (output, cmd *string) {
+	output = outputFlag(fs)
+	cmd = fs.String("cmd", "", "Application name. When set the update tree is <output>/<cmd>, matching the client's CmdName.")
+	return output, cmd
+}
+
+func outputFlag(fs *flag.FlagSet) *string {
+	return fs.String("o", "public",
+		"Output directory, or a storage URL such as s3://bucket/prefix, gs://bucket/prefix, azblob://account/container/prefix or github://owner/repo/tag.")
+}
+
+// appsFlag collects the application names of a repeated or comma separated
+// -cmd flag
+type appsFlag []string
+
+func (f *appsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *appsFlag) Set(s string) error {
+	for _, app := range splitList(s) {
+		if app == "." || app == ".." || strings.ContainsAny(app, `/\`) {
+			return fmt.Errorf("invalid application name %q", app)
+		}
+		if slices.Contains(*f, app) {
+			return fmt.Errorf("application %s is listed twice", app)
+		}
+		*f = append(*f, app)
+	}
+	return nil
+}
+
+// treeRoot returns the location of the update tree for cmd below output
+func treeRoot(output, cmd string) string {
+	if cmd == "" {
+		return output
+	}
+	return strings.TrimSuffix(output, "/") + "/" + cmd
+}
+
+// splitList splits a comma separated flag value, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func runRelease(fs *flag.FlagSet, args []string) error {
+	platform := fs.String("platform", defaultPlatform(),
+		"Target platform in the form OS-ARCH. Defaults to running os/arch or the combination of the environment variables GOOS and GOARCH if both are set.")
+	platforms := fs.String("platforms", "", "Comma separated platforms to release in directory mode. Other files in the directory are ignored.")
+	platformMap := fs.String("map", "",
+		"Map file names to platforms in directory mode, either as a pattern like 'myapp_{os}_{arch}*' or as a list like 'myapp.exe=windows-amd64,myapp-mac=darwin-arm64'. Defaults to using the file name.")
+	output := outputFlag(fs)
+	var apps appsFlag
+	fs.Var(&apps, "cmd",
+		"Application name. When set the update tree is <output>/<cmd>, matching the client's CmdName. Repeat it, or separate names with commas, to release several applications into their own trees.")
+	version := fs.String("version", "", "Version being released (required), or 'git' to derive it from git describe.")
+	versionFormat := fs.String("version-format", versionSemver,
+		"Format -version must follow: semver (1.2, v1.2.3, 1.3-beta1), strict for SemVer 2.0.0 only, or any.")
+	channels := fs.String("channel", "stable", "Comma separated channels to publish the release to.")
+	keyPath := fs.String("key", "", "Private key file created by keygen. When set every manifest and artifact is signed.")
+	compression := fs.String("compression", "gzip", "Artifact compression: gzip, zstd or xz. Clients older than zstd and xz support need gzip.")
+	level := fs.Int("level", 0, "Compression level on the scale of the gzip, zstd or xz tool. 0 selects the default.")
+	dateFlag := fs.String("date", "", "Release date recorded in manifests, in RFC3339. Defaults to $SOURCE_DATE_EPOCH when set, otherwise the current time.")
+	jobs := fs.Int("j", 0, "Number of platforms processed concurrently in directory mode. Defaults to the number of CPUs.")
+	notesPath := fs.String("notes", "", "File with release notes, such as CHANGELOG.md, to embed in every manifest.")
+	notesURL := fs.String("notes-url", "", "Link to the release notes recorded in every manifest.")
+	archiveFormat := fs.String("archive", "", "Publish every binary in a tar.gz or zip archive instead of compressed. Needs clients with archive support.")
+	rollout := fs.String("rollout", "100%", "Percentage of installations offered the release at first, such as 10%. Raise it later with update-rollout.")
+	minDisk := fs.String("min-disk", "", "Free disk space clients need to apply the release, such as 200MB. Clients with less skip it.")
+	minMemory := fs.String("min-memory", "", "Available memory the release needs to run, such as 512MiB. Clients with less skip it.")
+	sbom := fs.String("sbom", "", "Store an SBOM in cyclonedx or spdx format next to every artifact, listing the modules linked into the Go binary.")
+	provenance := fs.Bool("provenance", false, "Store a SLSA provenance statement next to every artifact.")
+	encryptTo := fs.String("encrypt-to", "", "Comma separated age recipients, such as age1..., to encrypt every artifact to. Clients decrypt with Updater.Identities.")
+	checksums := fs.Bool("checksums", false, "Store a SHA256SUMS file listing the artifacts of the release next to them, signed along with them when -key is set.")
+	builderID := fs.String("builder-id", publish.DefaultBuilderID, "Builder identity recorded in provenance statements, such as the URL of the CI workflow.")
+	dryRun := fs.Bool("dry-run", false, "Print the files that would be written and how the published manifests would change, without writing anything.")
+	upload := fs.String("upload", "", "Storage URL, such as s3://bucket/prefix, to upload the files written to -o to.")
+	distribution := fs.String("cloudfront-distribution", "", "CloudFront distribution to invalidate the updated manifests in once the release is uploaded to S3.")
+	layout := fs.String("layout", "",
+		"Template for artifact paths below -o, such as '{{.Cmd}}/{{.Channel}}/{{.Version}}/{{.Platform}}{{.Ext}}'. Clients need the same BinLayout. Defaults to '"+selfupdate.DefaultBinLayout+"'.")
+	compact := compactFlag(fs)
+	hashEncoding := hashEncodingFlag(fs)
+	files := fs.String("files", "", "Comma separated files or directories, such as LICENSE or completions/, bundled into every archive next to the binary.")
+	packages := fs.String("packages", "", "Comma separated package managers, homebrew, scoop, winget, deb or rpm, to write manifests and repositories for below packages/ in the tree. Scoop and winget need -archive zip.")
+	packageURL := fs.String("package-url", "", "URL the tree below -o is served from, such as https://example.com, that package manifests point at. Required with -packages.")
+	packageChannel := fs.String("package-channel", "stable", "Channel whose releases the package manifests follow.")
+	packageDescription := fs.String("package-description", "", "One line description of the package. Required for winget.")
+	packageHomepage := fs.String("package-homepage", "", "Homepage of the package.")
+	packageLicense := fs.String("package-license", "", "SPDX identifier of the license, such as MIT. Required for winget.")
+	packagePublisher := fs.String("package-publisher", "", "Publisher of the winget package, such as 'Example Corp'. Required for winget.")
+	cfg, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	appPath := cfg.path
+	if fs.NArg() == 1 {
+		appPath = fs.Arg(0)
+	}
+	if fs.NArg() > 1 || appPath == "" || *version == "" {
+		return usageError(fs, "a path and -version are required")
+	}
+	if *version == "git" {
+		if *version, err = gitVersion(); err != nil {
+			return err
+		}
+	}
+	if err := validateVersion(*version, *versionFormat); err != nil {
+		return err
+	}
+	if err := compress.Validate(*compression); err != nil {
+		return err
+	}
+	if *sbom != "" {
+		if err := publish.ValidateSBOM(*sbom); err != nil {
+			return err
+		}
+	}
+	recipients := splitList(*encryptTo)
+	if _, err := publish.ParseRecipients(recipients); err != nil {
+		return err
+	}
+	rolloutPercent, err := parseRollout(*rollout)
+	if err != nil {
+		return err
+	}
+	minDiskBytes, err := parseBytes(*minDisk)
+	if err != nil {
+		return fmt.Errorf("invalid -min-disk: %w", err)
+	}
+	minMemoryBytes, err := parseBytes(*minMemory)
+	if err != nil {
+		return fmt.Errorf("invalid -min-memory: %w", err)
+	}
+	date, err := releaseDate(*dateFlag)
+	if err != nil {
+		return err
+	}
+	notes, err := readNotes(*notesPath)
+	if err != nil {
+		return err
+	}
+	if *notesURL != "" {
+		if u, err := url.Parse(*notesURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid -notes-url %q: must be an http or https URL", *notesURL)
+		}
+	}
+	if *archiveFormat != "" {
+		if err := archive.Validate(*archiveFormat); err != nil {
+			return err
+		}
+	} else if *files != "" {
+		return usageError(fs, "-files needs -archive")
+	}
+	assets, err := archiveAssets(splitList(*files))
+	if err != nil {
+		return err
+	}
+	if *packages != "" && *packageURL == "" {
+		return usageError(fs, "-packages needs -package-url")
+	}
+	if *packages != "" && !slices.Contains(splitList(*channels), *packageChannel) {
+		return usageError(fs, "-packages needs -channel to include "+*packageChannel)
+	}
+	fi, err := os.Stat(appPath)
+	if err != nil {
+		return err
+	}
+	if len(apps) > 1 && !fi.IsDir() {
+		return usageError(fs, "releasing several applications needs a directory")
+	}
+	if len(apps) == 0 {
+		apps = appsFlag{""}
+	}
+
+	ctx := context.Background()
+	for _, cmd := range apps {
+		root := treeRoot(*output, cmd)
+
+		printProgress("platform", *platform)
+		printProgress("appPath", appPath)
+		printProgress("channel", *channels)
+		printProgress("version", *version)
+		printProgress("output", root)
+
+		store, err := publish.OpenStore(root)
+		if err != nil {
+			return err
+		}
+		var backend publish.Backend = &recordingBackend{Backend: store, root: root}
+		published := store
+		target := root
+		if *upload != "" {
+			// the index of what is already published lives at the upload target
+			target = treeRoot(*upload, cmd)
+			if published, err = publish.OpenStore(target); err != nil {
+				return err
+			}
+			backend = &mirrorBackend{local: store, mirror: &recordingBackend{Backend: published, root: target}}
+			printProgress("upload", target)
+		}
+		if *dryRun {
+			backend = &dryRunStore{Store: published, root: target}
+		}
+		if *distribution != "" && !strings.HasPrefix(target, "s3://") {
+			return usageError(fs, "-cloudfront-distribution needs -o or -upload to be an s3:// URL")
+		}
+		index, err := publish.ReadIndex(ctx, published)
+		if err != nil {
+			return err
+		}
+		if backend, err = withSigning(backend, *keyPath); err != nil {
+			return err
+		}
+		backend = withCompaction(backend, *compact)
+		if backend, err = withHashEncoding(backend, *hashEncoding); err != nil {
+			return err
+		}
+
+		// If dir is given create update for each file
+		var artifacts []publish.Artifact
+		if fi.IsDir() {
+			if artifacts, err = appArtifacts(appPath, cmd, *platformMap, splitList(*platforms), len(apps) > 1); err != nil {
+				return err
+			}
+		} else {
+			if err := publish.ValidatePlatform(*platform); err != nil {
+				return err
+			}
+			artifacts = []publish.Artifact{{Platform: *platform, Path: appPath}}
+		}
+		executable := cmd
+		if *archiveFormat != "" && executable == "" {
+			if fi.IsDir() {
+				return usageError(fs, "-archive in directory mode needs -cmd to name the executable")
+			}
+			executable = strings.TrimSuffix(filepath.Base(appPath), ".exe")
+		}
+		for _, a := range assets {
+			if a.Name == executable || a.Name == executable+".exe" {
+				return fmt.Errorf("%s would replace the executable in the archive", a.Path)
+			}
+		}
+
+		var pkgs *publish.Packages
+		if *packages != "" {
+			name := cmd
+			if name == "" {
+				name = strings.TrimSuffix(filepath.Base(appPath), ".exe")
+			}
+			baseURL := strings.TrimSuffix(*packageURL, "/")
+			if cmd != "" {
+				baseURL += "/" + cmd
+			}
+			pkgs = &publish.Packages{
+				Managers:    splitList(*packages),
+				BaseURL:     baseURL,
+				Name:        name,
+				Description: *packageDescription,
+				Homepage:    *packageHomepage,
+				License:     *packageLicense,
+				Publisher:   *packagePublisher,
+			}
+		}
+
+		// artifacts are published once and shared by the manifests of all
+		// channels, packages follow those of the package channel
+		releaseChannels := splitList(*channels)
+		if pkgs != nil {
+			releaseChannels = slices.DeleteFunc(releaseChannels, func(c string) bool { return c == *packageChannel })
+			releaseChannels = append([]string{*packageChannel}, releaseChannels...)
+		}
+		release := &publish.Release{
+			Version:     *version,
+			Channels:    releaseChannels,
+			Date:        date,
+			Compression: *compression,
+			Level:       *level,
+			Notes:       notes,
+			NotesURL:    *notesURL,
+			Rollout:     rolloutPercent,
+			MinDisk:     minDiskBytes,
+			MinMemory:   minMemoryBytes,
+			SBOM:        *sbom,
+			Provenance:  *provenance,
+			Checksums:   *checksums,
+			EncryptTo:   recipients,
+			BuilderID:   *builderID,
+			Jobs:        *jobs,
+			Archive:     *archiveFormat,
+			Executable:  executable,
+			Assets:      assets,
+			Artifacts:   artifacts,
+			Layout:      *layout,
+			Cmd:         cmd,
+			Index:       index,
+			Packages:    pkgs,
+		}
+		if err := publish.Publish(ctx, release, backend); err != nil {
+			return err
+		}
+		if err := publish.PutIndex(ctx, backend, index); err != nil {
+			return err
+		}
+		if *distribution == "" {
+			continue
+		}
+		if *dryRun {
+			printProgress("would invalidate the manifests in CloudFront distribution", *distribution)
+			continue
+		}
+		platformNames := make([]string, len(artifacts))
+		for i, a := range artifacts {
+			platformNames[i] = a.Platform
+		}
+		if err := invalidateManifests(ctx, *distribution, target, splitList(*channels), platformNames, *keyPath != ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appArtifacts returns the artifacts of application cmd in directory mode.
+// When several applications are released their binaries are read from
+// dir/<cmd> if it exists, where a -map with a {cmd} placeholder is ignored,
+// otherwise from the files of dir matching such a -map, ex: {cmd}_{os}_{arch}*
+func appArtifacts(dir, cmd, platformMap string, wanted []string, several bool) ([]publish.Artifact, error) {
+	if several {
+		sub := filepath.Join(dir, cmd)
+		if fi, err := os.Stat(sub); err == nil && fi.IsDir() {
+			dir = sub
+			if strings.Contains(platformMap, "{cmd}") {
+				platformMap = ""
+			}
+		} else if !strings.Contains(platformMap, "{cmd}") {
+			return nil, fmt.Errorf("no binaries for %s: %s is not a directory and -map has no {cmd} placeholder", cmd, sub)
+		}
+	}
+	mapper, err := parsePlatformMap(strings.ReplaceAll(platformMap, "{cmd}", cmd))
+	if err != nil {
+		return nil, err
+	}
+	return dirArtifacts(dir, mapper, wanted)
+}
+
+// dirArtifacts returns an artifact for every binary in dir, mapping file
+// names to platforms with mapper. When wanted is not empty only those
+// platforms are released and each of them must be present.
+func dirArtifacts(dir string, mapper platformMapper, wanted []string) ([]publish.Artifact, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var artifacts []publish.Artifact
+	seen := map[string]string{}
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		platform, ok := mapper.platform(file.Name())
+		if !ok || (len(wanted) > 0 && !slices.Contains(wanted, platform)) {
+			continue
+		}
+		if err := publish.ValidatePlatform(platform); err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Name(), err)
+		}
+		if other, ok := seen[platform]; ok {
+			return nil, fmt.Errorf("%s and %s both map to %s", other, file.Name(), platform)
+		}
+		seen[platform] = file.Name()
+		artifacts = append(artifacts, publish.Artifact{
+			Platform: platform,
+			Path:     filepath.Join(dir, file.Name()),
+		})
+	}
+
+	for _, p := range wanted {
+		if _, ok := seen[p]; !ok {
+			return nil, fmt.Errorf("%s does not contain a binary for %s", dir, p)
+		}
+	}
+	if len(artifacts) == 0 {
+		return nil, fmt.Errorf("no binaries found in %s", dir)
+	}
+	return artifacts, nil
+}
+
+// archiveAssets returns the files bundled into archives for the paths given
+// to -files, walking directories. Relative paths keep their place in the
+// archive, files outside the working directory are added by base name.
+func archiveAssets(paths []string) ([]publish.Asset, error) {
+	var assets []publish.Asset
+	seen := map[string]string{}
+	for _, p := range paths {
+		prefix := filepath.ToSlash(filepath.Clean(p))
+		if filepath.IsAbs(p) || prefix == ".." || strings.HasPrefix(prefix, "../") {
+			prefix = filepath.Base(p)
+		}
+		err := filepath.WalkDir(p, func(file string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return fmt.Errorf("%s is not a regular file", file)
+			}
+			rel, err := filepath.Rel(p, file)
+			if err != nil {
+				return err
+			}
+			name := path.Join(prefix, filepath.ToSlash(rel))
+			if other, ok := seen[name]; ok {
+				return fmt.Errorf("%s and %s would both be %s in the archive", other, file, name)
+			}
+			seen[name] = file
+			assets = append(assets, publish.Asset{Name: name, Path: file})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("-files: %w", err)
+		}
+	}
+	return assets, nil
+}
+
+// releaseDate returns the date to record in manifests. An explicit -date wins
+// over SOURCE_DATE_EPOCH, the reproducible builds convention; with neither
+// the zero time lets publish use the current time.
+func releaseDate(flagValue string) (time.Time, error) {
+	if flagValue != "" {
+		t, err := time.Parse(time.RFC3339, flagValue)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid -date: %w", err)
+		}
+		return t, nil
+	}
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		secs, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH: %w", err)
+		}
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	return time.Time{}, nil
+}
+
+// byteUnits are the size suffixes parseBytes accepts
+var byteUnits = map[string]int64{
+	"": 1, "B": 1,
+	"KB": 1e3, "MB": 1e6, "GB": 1e9, "TB": 1e12,
+	"KIB": 1 << 10, "MIB": 1 << 20, "GIB": 1 << 30, "TIB": 1 << 40,
+}
+
+// parseBytes parses a size such as 200MB or 1.5GiB, 0 when empty
+func parseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	unit, ok := byteUnits[strings.ToUpper(strings.TrimSpace(s[i:]))]
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if !ok || err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a size such as 200MB", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// maxNotesSize bounds embedded release notes, as every client downloads the
+// manifest on every check
+const maxNotesSize = 64 << 10
+
+// readNotes returns the release notes at path, if any
+func readNotes(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if len(b) > maxNotesSize {
+		return "", fmt.Errorf("%s is larger than %d KiB, link to it with -notes-url instead", path, maxNotesSize>>10)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bobo/go-selfupdate/selfupdate/publish"
+)
+
+var rolloutCmd = &command{
+	name:    "update-rollout",
+	args:    "",
+	summary: "Change the percentage of installations a channel's current version is offered to.",
+	run:     runUpdateRollout,
+}
+
+func runUpdateRollout(fs *flag.FlagSet, args []string) error {
+	output, cmd := outputFlags(fs)
+	channel := fs.String("channel", "stable", "Channel whose manifests are updated.")
+	rollout := fs.String("rollout", "", "New rollout percentage, such as 50% (required). 100% offers the version to everyone.")
+	version := fs.String("version", "", "Only update platforms on this version, failing if none is.")
+	keyPath := fs.String("key", "", "Private key file created by keygen. Required when the tree is signed.")
+	dryRun := fs.Bool("dry-run", false, "Print how the manifests would change without writing anything.")
+	compact := compactFlag(fs)
+	hashEncoding := hashEncodingFlag(fs)
+	distribution := rewriteDistributionFlag(fs)
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *rollout == "" {
+		return usageError(fs, "-rollout is required")
+	}
+	percent, err := parseRollout(*rollout)
+	if err != nil {
+		return err
+	}
+	root := treeRoot(*output, *cmd)
+	if *distribution != "" && !strings.HasPrefix(root, "s3://") {
+		return usageError(fs, "-cloudfront-distribution needs -o to be an s3:// URL")
+	}
+
+	ctx := context.Background()
+	store, err := publish.OpenStore(root)
+	if err != nil {
+		return err
+	}
+	tree, err := scanStore(ctx, store)
+	if err != nil {
+		return err
+	}
+	manifests := tree.channelManifests(*channel)
+	if len(manifests) == 0 {
+		return fmt.Errorf("channel %s has no manifests in %s", *channel, root)
+	}
+	var backend publish.Backend = &recordingBackend{Backend: store, root: root}
+	if *dryRun {
+		backend = &dryRunStore{Store: store, root: root}
+	}
+	if backend, err = withSigning(backend, *keyPath); err != nil {
+		return err
+	}
+	backend = withCompaction(backend, *compact)
+	if backend, err = withHashEncoding(backend, *hashEncoding); err != nil {
+		return err
+	}
+
+	platforms := make([]string, 0, len(manifests))
+	for p := range manifests {
+		platforms = append(platforms, p)
+	}
+	sort.Strings(platforms)
+
+	var updated []string
+	for _, p := range platforms {
+		info, err := readStoredManifest(ctx, store, manifests[p])
+		if err != nil {
+			return err
+		}
+		if *version != "" && info.Version != *version {
+			printProgress("skipping", p, "- channel", *channel, "is on", info.Version)
+			continue
+		}
+		if *keyPath == "" {
+			if err := requireUnsigned(ctx, store, manifests[p]); err != nil {
+				return err
+			}
+		}
+		info.Rollout = percent
+		printProgress("rolling out", info.Version, "to", rolloutString(percent), "of", p)
+		if err := publish.PutManifest(ctx, backend, p, info); err != nil {
+			return err
+		}
+		updated = append(updated, p)
+	}
+	if len(updated) == 0 {
+		return fmt.Errorf("no platform of channel %s is on version %s", *channel, *version)
+	}
+	return invalidateRewritten(ctx, *distribution, root, []string{*channel}, updated, *keyPath != "", *dryRun)
+}
+
+// parseRollout parses a percentage such as 10% or 10 into the manifest
+// Rollout value, where 100% is stored as 0 so the field is left out
+func parseRollout(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(s), "%"))
+	if err != nil || n < 1 || n > 100 {
+		return 0, fmt.Errorf("invalid rollout %q: must be a percentage between 1%% and 100%%", s)
+	}
+	if n == 100 {
+		return 0, nil
+	}
+	return n, nil
+}
+
+func rolloutString(percent int) string {
+	if percent == 0 {
+		percent = 100
+	}
+	return strconv.Itoa(percent) + "%"
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/bobo/go-selfupdate/selfupdate"
+	"github.com/bobo/go-selfupdate/selfupdate/publish"
+)
+
+var serveCmd = &command{
+	name:    "serve",
+	args:    "",
+	summary: "Serve a local update tree over HTTP for testing clients end to end.",
+	run:     runServe,
+}
+
+func runServe(fs *flag.FlagSet, args []string) error {
+	dir := fs.String("dir", "public", "Update tree to serve, the output directory of release.")
+	host := fs.String("host", "localhost", "Interface to listen on. Use 0.0.0.0 to reach the server from other machines.")
+	port := fs.Int("port", 8080, "Port to listen on.")
+	slots := fs.Int("fleet-lock-slots", 0, "Also serve a FleetLock server on /v1/ letting this many clients of a group apply an update at the same time.")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usageError(fs, "serve takes no arguments")
+	}
+	if _, err := os.Stat(*dir); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	addr := net.JoinHostPort(*host, strconv.Itoa(*port))
+	var handler http.Handler = serveHandler(*dir)
+	if *slots > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/", handler)
+		mux.Handle("/v1/", &fleetLock{slots: *slots})
+		handler = mux
+	}
+	srv := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+
+	printProgress("serving", *dir, "on", "http://"+addr+"/", "- use it as ApiURL, BinURL and DiffURL, Ctrl+C to quit")
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// serveHandler serves the update tree in root the way the storage backends
+// do: read only, without directory listings and with the headers release
+// would have uploaded each file with. <tree>/stats additionally reports the
+// versions of every tree holding an index.
+func serveHandler(root string) http.Handler {
+	files := http.FileServer(http.Dir(root))
+	downloads := &downloadCounter{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		printProgress(r.Method, r.URL.Path)
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		if path.Base(r.URL.Path) == statsName {
+			serveStats(w, r, root, downloads)
+			return
+		}
+		if name := path.Clean(r.URL.Path); r.Method == http.MethodGet {
+			if fi, err := fs.Stat(os.DirFS(root), strings.TrimPrefix(name, "/")); err == nil && !fi.IsDir() {
+				downloads.record(name)
+			}
+		}
+		if meta, ok := fileMetadata(r.URL.Path); ok {
+			w.Header().Set("Content-Type", meta.ContentType)
+			w.Header().Set("Cache-Control", meta.CacheControl)
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// fileMetadata returns the metadata files named like name are published with
+func fileMetadata(name string) (publish.Metadata, bool) {
+	if path.Base(name) == publish.ChecksumsFile {
+		return publish.ChecksumsMetadata, true
+	}
+	switch path.Ext(name) {
+	case ".json":
+		if publish.IsAttestation(name) {
+			return publish.AttestationMetadata, true
+		}
+		return publish.ManifestMetadata, true
+	case ".patch":
+		return publish.PatchMetadata, true
+	case selfupdate.SignatureSuffix:
+		return publish.SignatureMetadata, true
+	default:
+		if _, format, ok := publish.ParseArtifactName(path.Base(name)); ok {
+			meta := publish.ArtifactMetadata
+			meta.ContentType = publish.FormatContentType(format)
+			return meta, true
+		}
+	}
+	return publish.Metadata{}, false
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bobo/go-selfupdate/selfupdate"
+	"github.com/bobo/go-selfupdate/selfupdate/publish"
+)
+
+var signCmd = &command{
+	name:    "sign",
+	args:    "path...",
+	summary: "Write detached signatures for manifests, artifacts and patches. Directories are walked recursively.",
+	run:     runSign,
+}
+
+var keygenCmd = &command{
+	name:    "keygen",
+	args:    "",
+	summary: "Generate an Ed25519 key pair for signing updates.",
+	run:     runKeygen,
+}
+
+// signedExtensions are the files of an update tree that carry a signature
+var signedExtensions = []string{".json", ".gz", ".zst", ".xz", ".zip", ".patch", publish.ChecksumsFile}
+
+func runSign(fs *flag.FlagSet, args []string) error {
+	keyPath := fs.String("key", "", "Private key file created by keygen (required).")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 || *keyPath == "" {
+		return usageError(fs, "-key and at least one path are required")
+	}
+	key, err := loadSigningKey(*keyPath)
+	if err != nil {
+		return err
+	}
+
+	for _, root := range fs.Args() {
+		err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !hasSignedExtension(path) {
+				return err
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			sig, err := publish.SignReader(key, f)
+			if err != nil {
+				return err
+			}
+			printProgress("signing", path)
+			if err := os.WriteFile(path+selfupdate.SignatureSuffix, sig, 0644); err != nil {
+				return err
+			}
+			writtenFiles = append(writtenFiles, path+selfupdate.SignatureSuffix)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasSignedExtension(path string) bool {
+	for _, ext := range signedExtensions {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func runKeygen(fs *flag.FlagSet, args []string) error {
+	out := fs.String("o", "selfupdate", "Key file name without extension; writes <name>.key and <name>.pub.")
+	force := fs.Bool("f", false, "Overwrite existing key files.")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	pub, priv, err := publish.GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if *force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	if err := writeFileFlags(*out+".key", priv, flags, 0600); err != nil {
+		return err
+	}
+	if err := writeFileFlags(*out+".pub", pub, flags, 0644); err != nil {
+		return err
+	}
+	writtenFiles = append(writtenFiles, *out+".key", *out+".pub")
+	printProgress("wrote", *out+".key", "and", *out+".pub")
+	return nil
+}
+
+func writeFileFlags(path string, b []byte, flags int, perm fs.FileMode) error {
+	f, err := os.OpenFile(path, flags, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return publish.ParsePrivateKey(b)
+}
+
+// withSigning wraps backend so every file it stores is signed when keyPath
+// is set
+func withSigning(backend publish.Backend, keyPath string) (publish.Backend, error) {
+	if keyPath == "" {
+		return backend, nil
+	}
+	key, err := loadSigningKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return &publish.SigningBackend{Backend: backend, Key: key}, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bobo/go-selfupdate/selfupdate"
+	"github.com/bobo/go-selfupdate/selfupdate/publish"
+)
+
+// statsName is the file name serve answers with the statistics of the tree
+// in the same directory, such as /myapp/stats. Trees never hold a file of
+// that name, and a channel directory called stats is not listed either way.
+const statsName = "stats"
+
+// treeStats is the statistics document served for a tree
+type treeStats struct {
+	Channels map[string][]releaseStats
+	Yanked   []string `json:",omitempty"`
+
+	// Downloads counts the artifacts and patches of each version served
+	// since serve started, as a measure of adoption
+	Downloads map[string]int
+}
+
+// releaseStats describes a version published to a channel
+type releaseStats struct {
+	Version string
+	Date    time.Time
+	Sizes   map[string]int64 // artifact size by platform
+}
+
+// downloadCounter counts downloads by tree and version
+type downloadCounter struct {
+	mu     sync.Mutex
+	counts map[string]map[string]int
+}
+
+// record counts a successful request for urlPath if it is an artifact or a
+// patch, which are fetched once per installation updating to a version
+func (c *downloadCounter) record(urlPath string) {
+	tree, version, ok := downloadedVersion(urlPath)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = map[string]map[string]int{}
+	}
+	if c.counts[tree] == nil {
+		c.counts[tree] = map[string]int{}
+	}
+	c.counts[tree][version]++
+}
+
+func (c *downloadCounter) get(tree string) map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := map[string]int{}
+	for v, n := range c.counts[tree] {
+		counts[v] = n
+	}
+	return counts
+}
+
+// downloadedVersion returns the tree and the version urlPath updates to
+// when it names an artifact, <tree>/<version>/<platform><ext>, or a patch,
+// <tree>/patches/<from>/<to>/<platform>.patch
+func downloadedVersion(urlPath string) (tree, version string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(urlPath, "/"), "/")
+	n := len(parts)
+	if n >= 4 && parts[n-4] == "patches" && strings.HasSuffix(parts[n-1], ".patch") {
+		return "/" + path.Join(parts[:n-4]...), parts[n-2], true
+	}
+	if n >= 2 {
+		if _, _, ok := publish.ParseArtifactName(parts[n-1]); ok {
+			return "/" + path.Join(parts[:n-2]...), parts[n-2], true
+		}
+	}
+	return "", "", false
+}
+
+// serveStats answers a request for <tree>/stats from the index of the tree
+// in root and the downloads counted so far
+func serveStats(w http.ResponseWriter, r *http.Request, root string, downloads *downloadCounter) {
+	tree := path.Dir(path.Clean("/" + r.URL.Path))
+	dir := filepath.Join(root, filepath.FromSlash(tree))
+	b, err := os.ReadFile(filepath.Join(dir, selfupdate.IndexFile))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var idx selfupdate.Index
+	if err := json.Unmarshal(b, &idx); err != nil {
+		http.Error(w, "invalid "+selfupdate.IndexFile+": "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	stats := treeStats{Channels: map[string][]releaseStats{}, Yanked: idx.Yanked, Downloads: downloads.get(tree)}
+	for channel, releases := range idx.Channels {
+		for _, release := range releases {
+			rs := releaseStats{Version: release.Version, Date: release.Date, Sizes: map[string]int64{}}
+			for platform, a := range release.Platforms {
+				// the index records the size wherever the layout put the artifact
+				if a.Size > 0 {
+					rs.Sizes[platform] = a.Size
+					continue
+				}
+				// indexes written before sizes were recorded
+				info := selfupdate.UpdateInfo{Compression: a.Compression, Archive: a.Archive}
+				name := publish.ArtifactPath(release.Version, platform, publish.ArtifactFormat(&info))
+				if fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err == nil {
+					rs.Sizes[platform] = fi.Size()
+				}
+			}
+			stats.Channels[channel] = append(stats.Channels[channel], rs)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	enc.Encode(stats)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bobo/go-selfupdate/selfupdate"
+	"github.com/bobo/go-selfupdate/selfupdate/publish"
+)
+
+// storedTree is the layout of an update tree in a store
+type storedTree struct {
+	versions  []*storedVersion // newest first
+	manifests []string
+	patches   []string
+}
+
+// storedVersion is a version directory and the files below it
+type storedVersion struct {
+	name  string
+	mod   time.Time
+	files []string
+}
+
+// scanStore lists store and sorts its files into versions, channel
+// manifests and patches. Directories holding compressed artifacts are
+// versions, any other manifest belongs to a channel.
+func scanStore(ctx context.Context, store publish.Store) (*storedTree, error) {
+	files, err := store.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	versions := map[string]*storedVersion{}
+	for _, f := range files {
+		dir, file, ok := strings.Cut(f.Name, "/")
+		if !ok || dir == "patches" || dir == selfupdate.PluginsDir || strings.Contains(file, "/") || !isArtifactName(file) {
+			continue
+		}
+		v := versions[dir]
+		if v == nil {
+			v = &storedVersion{name: dir}
+			versions[dir] = v
+		}
+		if f.ModTime.After(v.mod) {
+			v.mod = f.ModTime
+		}
+	}
+
+	tree := &storedTree{}
+	for _, f := range files {
+		dir, file, _ := strings.Cut(f.Name, "/")
+		switch {
+		case dir == "patches":
+			tree.patches = append(tree.patches, f.Name)
+		case dir == selfupdate.PluginsDir:
+			// plugin manifests and the trees of the plugins
+		case versions[dir] != nil:
+			versions[dir].files = append(versions[dir].files, f.Name)
+		case f.Name == selfupdate.IndexFile:
+		case strings.HasSuffix(f.Name, ".json") && !strings.Contains(file, "/"):
+			tree.manifests = append(tree.manifests, f.Name)
+		}
+	}
+
+	for _, v := range versions {
+		tree.versions = append(tree.versions, v)
+	}
+	sort.Slice(tree.versions, func(i, j int) bool {
+		if !tree.versions[i].mod.Equal(tree.versions[j].mod) {
+			return tree.versions[i].mod.After(tree.versions[j].mod)
+		}
+		return tree.versions[i].name > tree.versions[j].name
+	})
+	return tree, nil
+}
+
+// referencedVersions returns the versions channel manifests point to. A
+// manifest that cannot be read is an error, so that pruning never guesses.
+func (t *storedTree) referencedVersions(ctx context.Context, store publish.Store) (map[string]bool, error) {
+	referenced := map[string]bool{}
+	for _, name := range t.manifests {
+		info, err := readStoredManifest(ctx, store, name)
+		if err != nil {
+			return nil, err
+		}
+		referenced[info.Version] = true
+	}
+	return referenced, nil
+}
+
+func readStoredFile(ctx context.Context, store publish.Store, name string) ([]byte, error) {
+	r, err := store.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func readStoredManifest(ctx context.Context, store publish.Store, name string) (*selfupdate.UpdateInfo, error) {
+	r, err := store.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	info, err := selfupdate.DecodeManifest(r, false)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return info, nil
+}
+
+// isArtifactName reports whether name is a compressed or archived artifact
+func isArtifactName(name string) bool {
+	_, _, ok := publish.ParseArtifactName(name)
+	return ok
+}
+
+// channelManifests returns the manifests of channel by platform
+func (t *storedTree) channelManifests(channel string) map[string]string {
+	dir := "."
+	if channel != "stable" {
+		dir = channel
+	}
+	manifests := map[string]string{}
+	for _, name := range t.manifests {
+		if path.Dir(name) == dir {
+			manifests[strings.TrimSuffix(path.Base(name), ".json")] = name
+		}
+	}
+	return manifests
+}
+
+// readStoredArtifact returns the binary of version for platform that info
+// describes, found through layout
+func readStoredArtifact(ctx context.Context, store publish.Store, layout treeLayout, platform string, info *selfupdate.UpdateInfo) ([]byte, error) {
+	format := publish.ArtifactFormat(info)
+	name, err := layout.artifactPath(info.Channel, info.Version, platform, format)
+	if err != nil {
+		return nil, err
+	}
+	r, err := store.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return publish.ReadArtifact(r, format, info.Executable)
+}
+
+// layoutFlag adds the -layout flag of the commands reading a tree that
+// release wrote with -layout
+func layoutFlag(fs *flag.FlagSet) *string {
+	return fs.String("layout", "", "Template for artifact paths the tree was released with using release -layout, when it is not the default.")
+}
+
+// treeLayout places the artifacts of the tree of cmd, following the
+// template layout or the default layout when empty
+type treeLayout struct {
+	layout string
+	cmd    string
+}
+
+// artifactPath returns the path of the artifact of version for platform in
+// channel relative to the root of the tree
+func (l treeLayout) artifactPath(channel, version, platform, format string) (string, error) {
+	if l.layout == "" {
+		return publish.ArtifactPath(version, platform, format), nil
+	}
+	return publish.LayoutPath(l.layout, l.cmd, channel, version, platform, format)
+}
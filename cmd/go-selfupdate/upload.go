@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+
+	"github.com/bobo/go-selfupdate/selfupdate"
+	"github.com/bobo/go-selfupdate/selfupdate/publish"
+)
+
+// mirrorBackend writes every file to a local tree first and then uploads the
+// local copy, so the generated tree is kept and uploads stream from disk
+type mirrorBackend struct {
+	local  publish.Store
+	mirror publish.Backend
+}
+
+func (b *mirrorBackend) Put(ctx context.Context, name string, r io.Reader, meta publish.Metadata) error {
+	if err := b.local.Put(ctx, name, r, meta); err != nil {
+		return err
+	}
+	f, err := b.local.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return b.mirror.Put(ctx, name, f, meta)
+}
+
+// rewriteDistributionFlag registers -cloudfront-distribution for the
+// commands rewriting the manifests of a published tree
+func rewriteDistributionFlag(fs *flag.FlagSet) *string {
+	return fs.String("cloudfront-distribution", "", "CloudFront distribution to invalidate the rewritten manifests in when -o is an s3:// URL.")
+}
+
+// invalidateManifests invalidates the CloudFront paths of the manifests of
+// platforms in channels and of the index, with their signatures when the
+// tree is signed. Artifacts never change once uploaded, so they are left out.
+func invalidateManifests(ctx context.Context, distribution, target string, channels, platforms []string, signed bool) error {
+	names := []string{selfupdate.IndexFile}
+	for _, c := range channels {
+		for _, p := range platforms {
+			names = append(names, publish.ManifestPath(c, p))
+		}
+	}
+	if signed {
+		for _, name := range names {
+			names = append(names, name+selfupdate.SignatureSuffix)
+		}
+	}
+
+	id, err := publish.NewCloudFront(distribution).Invalidate(ctx, publish.InvalidationPaths(target, names))
+	if err != nil {
+		return err
+	}
+	printProgress("invalidating", len(names), "paths in CloudFront distribution", distribution, "as", id)
+	return nil
+}
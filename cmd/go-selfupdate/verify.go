@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+
+	"github.com/bobo/go-selfupdate/internal/bsdiff"
+	"github.com/bobo/go-selfupdate/selfupdate"
+	"github.com/bobo/go-selfupdate/selfupdate/publish"
+)
+
+var verifyCmd = &command{
+	name:    "verify",
+	args:    "[path]",
+	summary: "Check that the manifests, artifacts, patches and signatures of a local update tree are consistent.",
+	run:     runVerify,
+}
+
+func runVerify(fs *flag.FlagSet, args []string) error {
+	output, cmd := outputFlags(fs)
+	pubPath := fs.String("pubkey", "", "Public key file created by keygen. When set every manifest, artifact and patch must carry a valid signature.")
+	identityPath := fs.String("identity", "", "age identity file to decrypt artifacts released with -encrypt-to, which cannot be checked otherwise.")
+	layout := layoutFlag(fs)
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return usageError(fs, "at most one path is accepted")
+	}
+	root := treeRoot(*output, *cmd)
+	if fs.NArg() == 1 {
+		root = fs.Arg(0)
+	}
+
+	v := &verifier{root: root, layout: treeLayout{layout: *layout, cmd: *cmd}, artifacts: map[string][]byte{}}
+	if *pubPath != "" {
+		b, err := os.ReadFile(*pubPath)
+		if err != nil {
+			return err
+		}
+		if v.key, err = selfupdate.ParsePublicKey(string(b)); err != nil {
+			return fmt.Errorf("%s: %w", *pubPath, err)
+		}
+	}
+	if *identityPath != "" {
+		var err error
+		if v.identities, err = loadIdentities(*identityPath); err != nil {
+			return err
+		}
+	}
+	if err := v.verifyTree(); err != nil {
+		return err
+	}
+
+	for _, p := range v.problems {
+		printProgress(p)
+	}
+	printProgress("checked", v.manifests, "manifests and", v.patches, "patches in", root)
+	if len(v.problems) > 0 {
+		return fmt.Errorf("%d problems found in %s", len(v.problems), root)
+	}
+	return nil
+}
+
+// loadIdentities reads the age identities of an identity file
+func loadIdentities(path string) ([]age.Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	identities, err := publish.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return identities, nil
+}
+
+// verifier collects the inconsistencies found in an update tree
+type verifier struct {
+	root       string
+	layout     treeLayout
+	index      *selfupdate.Index // nil when the tree has no valid index
+	key        ed25519.PublicKey
+	identities []age.Identity
+	artifacts  map[string][]byte // decompressed artifacts by tree path
+	problems   []string
+	manifests  int
+	patches    int
+}
+
+func (v *verifier) problemf(name, format string, a ...any) {
+	v.problems = append(v.problems, name+": "+fmt.Sprintf(format, a...))
+}
+
+// verifyTree checks every file of the tree. Only errors preventing the walk
+// itself are returned, everything else is recorded as a problem.
+func (v *verifier) verifyTree() error {
+	entries, err := os.ReadDir(v.root)
+	if err != nil {
+		return err
+	}
+	// patches find the artifacts of a custom layout through the index
+	if b, err := os.ReadFile(v.path(selfupdate.IndexFile)); err == nil {
+		var idx selfupdate.Index
+		if json.Unmarshal(b, &idx) == nil {
+			v.index = &idx
+		}
+	}
+	for _, e := range entries {
+		name := e.Name()
+		switch {
+		case name == selfupdate.IndexFile:
+			v.verifyIndex()
+		case !e.IsDir():
+			if strings.HasSuffix(name, ".json") {
+				v.verifyManifest(name, "stable")
+			}
+		case name == "patches":
+			if err := v.verifyPatches(); err != nil {
+				return err
+			}
+		case name == publish.PackagesDir:
+			// package manager manifests, checked by the package managers
+		default:
+			if err := v.verifyDir(name); err != nil {
+				return err
+			}
+		}
+	}
+	if v.key != nil {
+		return v.verifySignatures()
+	}
+	return nil
+}
+
+// verifyDir checks a top level directory, which either holds the artifacts
+// of a version or the manifests of a channel
+func (v *verifier) verifyDir(name string) error {
+	platforms, err := artifactPlatforms(filepath.Join(v.root, name))
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(filepath.Join(v.root, name))
+	if err != nil {
+		return err
+	}
+	var manifests []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") && !publish.IsAttestation(e.Name()) {
+			manifests = append(manifests, e.Name())
+		}
+	}
+
+	switch {
+	case len(platforms) > 0 && len(manifests) > 0:
+		v.problemf(name, "directory mixes artifacts and manifests")
+	case len(platforms) == 0 && len(manifests) == 0 && v.layout.layout == "":
+		// a custom layout may nest artifacts below directories of its own
+		v.problemf(name, "directory holds neither artifacts nor manifests")
+	case len(manifests) > 0 && name == "stable":
+		v.problemf(name, "stable manifests belong in the tree root, clients never read this directory")
+	}
+	for _, m := range manifests {
+		v.verifyManifest(name+"/"+m, name)
+	}
+	v.verifyChecksums(name)
+	return nil
+}
+
+// verifyChecksums checks the files listed by the SHA256SUMS file of a
+// version directory, if it has one
+func (v *verifier) verifyChecksums(dir string) {
+	name := dir + "/" + publish.ChecksumsFile
+	f, err := os.Open(v.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		v.problemf(name, "%v", err)
+		return
+	}
+	defer f.Close()
+	sums, err := publish.ParseChecksums(f)
+	if err != nil {
+		v.problemf(name, "%v", err)
+		return
+	}
+	for file, want := range sums {
+		b, err := os.ReadFile(v.path(dir + "/" + file))
+		if err != nil {
+			v.problemf(name, "%s: %v", file, err)
+			continue
+		}
+		if got := sha256.Sum256(b); !bytes.Equal(got[:], want) {
+			v.problemf(name, "%s does not match its checksum", file)
+		}
+	}
+}
+
+// verifyManifest checks that the manifest at name belongs to channel and
+// matches the artifact it points to
+func (v *verifier) verifyManifest(name, channel string) {
+	v.manifests++
+	b, err := os.ReadFile(v.path(name))
+	if err != nil {
+		v.problemf(name, "%v", err)
+		return
+	}
+	// unknown fields are reported since they are most likely typos
+	manifest, err := selfupdate.DecodeManifest(bytes.NewReader(b), true)
+	if err != nil {
+		v.problemf(name, "%v", err)
+		return
+	}
+	info := *manifest
+	if info.Version == "" {
+		v.problemf(name, "manifest has no version")
+		return
+	}
+	if info.Channel != "" && info.Channel != channel {
+		v.problemf(name, "manifest is for channel %q but lives in the %s channel", info.Channel, channel)
+	}
+	format := publish.ArtifactFormat(&info)
+	if _, err := publish.FormatExtension(format); err != nil {
+		v.problemf(name, "%v", err)
+		return
+	}
+
+	platform := strings.TrimSuffix(filepath.Base(name), ".json")
+	artifact, err := v.layout.artifactPath(channel, info.Version, platform, format)
+	if err != nil {
+		v.problemf(name, "%v", err)
+		return
+	}
+	bin, err := v.artifact(artifact, format, info.Executable)
+	if err != nil {
+		v.problemf(name, "artifact %s: %v", artifact, err)
+		return
+	}
+	if err := info.Verify(bin); err != nil {
+		v.problemf(name, "artifact %s: %v", artifact, err)
+	}
+	for _, attestation := range []string{info.SBOM, info.Provenance} {
+		if attestation == "" {
+			continue
+		}
+		if _, err := os.Stat(v.path(attestation)); err != nil {
+			v.problemf(name, "attestation %s: %v", attestation, err)
+		}
+	}
+}
+
+// verifyIndex checks that every release listed by the index still has
+// artifacts matching the recorded digests
+func (v *verifier) verifyIndex() {
+	b, err := os.ReadFile(v.path(selfupdate.IndexFile))
+	if err != nil {
+		v.problemf(selfupdate.IndexFile, "%v", err)
+		return
+	}
+	var idx selfupdate.Index
+	if err := json.Unmarshal(b, &idx); err != nil {
+		v.problemf(selfupdate.IndexFile, "invalid index: %v", err)
+		return
+	}
+	for channel, releases := range idx.Channels {
+		for _, r := range releases {
+			for platform := range r.Platforms {
+				info := r.Info(channel, platform)
+				format := publish.ArtifactFormat(&info)
+				artifact, err := v.layout.artifactPath(channel, r.Version, platform, format)
+				if err != nil {
+					v.problemf(selfupdate.IndexFile, "channel %s: %v", channel, err)
+					continue
+				}
+				bin, err := v.artifact(artifact, format, info.Executable)
+				if err == nil {
+					err = info.Verify(bin)
+				}
+				if err != nil {
+					v.problemf(selfupdate.IndexFile, "channel %s: artifact %s: %v", channel, artifact, err)
+				}
+			}
+		}
+	}
+}
+
+// verifyPatches checks that every patch turns the artifact of its source
+// version into the artifact of its target version
+func (v *verifier) verifyPatches() error {
+	return filepath.WalkDir(v.path("patches"), func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".patch") {
+			return err
+		}
+		rel, err := filepath.Rel(v.root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		v.patches++
+
+		parts := strings.Split(name, "/")
+		if len(parts) != 4 {
+			v.problemf(name, "patch is not in patches/<from>/<to>/<platform>.patch")
+			return nil
+		}
+		from, to, platform := parts[1], parts[2], strings.TrimSuffix(parts[3], ".patch")
+		old, err := v.versionArtifact(from, platform)
+		if err != nil {
+			v.problemf(name, "source version: %v", err)
+			return nil
+		}
+		want, err := v.versionArtifact(to, platform)
+		if err != nil {
+			v.problemf(name, "target version: %v", err)
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		got, err := bsdiff.Patch(old, f)
+		if err != nil {
+			v.problemf(name, "%v", err)
+		} else if !bytes.Equal(got, want) {
+			v.problemf(name, "patched binary does not match version %s", to)
+		}
+		return nil
+	})
+}
+
+// verifySignatures checks the detached signature of every signed file
+func (v *verifier) verifySignatures() error {
+	return filepath.WalkDir(v.root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !hasSignedExtension(path) {
+			return err
+		}
+		rel, err := filepath.Rel(v.root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		sig, err := os.ReadFile(path + selfupdate.SignatureSuffix)
+		if err != nil {
+			v.problemf(name, "missing signature")
+			return nil
+		}
+		if err := selfupdate.VerifySignature(v.key, content, sig); err != nil {
+			v.problemf(name, "%v", err)
+		}
+		return nil
+	})
+}
+
+// versionArtifact returns the binary in the artifact of version for
+// platform. Trees with a custom layout are looked up in the index.
+func (v *verifier) versionArtifact(version, platform string) ([]byte, error) {
+	if v.layout.layout != "" {
+		return v.indexedArtifact(version, platform)
+	}
+	platforms, err := artifactPlatforms(v.path(version))
+	if err != nil {
+		return nil, fmt.Errorf("version %s not found", version)
+	}
+	a, ok := platforms[platform]
+	if !ok {
+		return nil, fmt.Errorf("version %s has no artifact for %s", version, platform)
+	}
+	return v.artifact(publish.ArtifactPath(version, platform, a.format), a.format, "")
+}
+
+// indexedArtifact returns the binary in the artifact of version for
+// platform as recorded by the index
+func (v *verifier) indexedArtifact(version, platform string) ([]byte, error) {
+	if v.index == nil {
+		return nil, fmt.Errorf("-layout needs the index of the tree to find version %s", version)
+	}
+	for channel, releases := range v.index.Channels {
+		for _, r := range releases {
+			a, ok := r.Platforms[platform]
+			if r.Version != version || !ok {
+				continue
+			}
+			format := publish.ArtifactFormat(&selfupdate.UpdateInfo{Compression: a.Compression, Archive: a.Archive})
+			name, err := v.layout.artifactPath(channel, version, platform, format)
+			if err != nil {
+				return nil, err
+			}
+			return v.artifact(name, format, a.Executable)
+		}
+	}
+	return nil, fmt.Errorf("version %s has no artifact for %s in the index", version, platform)
+}
+
+// artifact returns the binary in the artifact at name, reading every
+// artifact only once however many manifests and patches refer to it.
+// Archives are searched for executable, or its first member when empty.
+func (v *verifier) artifact(name, format, executable string) ([]byte, error) {
+	if bin, ok := v.artifacts[name]; ok {
+		return bin, nil
+	}
+	f, err := os.Open(v.path(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := publish.DecryptArtifact(f, v.identities)
+	if err != nil {
+		return nil, err
+	}
+	bin, err := publish.ReadArtifact(r, format, executable)
+	if err != nil {
+		return nil, err
+	}
+	v.artifacts[name] = bin
+	return bin, nil
+}
+
+func (v *verifier) path(name string) string {
+	return filepath.Join(v.root, filepath.FromSlash(name))
+}
+
+// artifactPlatforms returns the platforms with an artifact in dir
+func artifactPlatforms(dir string) (map[string]artifactFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	platforms := map[string]artifactFile{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if p, format, ok := publish.ParseArtifactName(e.Name()); ok {
+			platforms[p] = artifactFile{format: format}
+		}
+	}
+	return platforms, nil
+}
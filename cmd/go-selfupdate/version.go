@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bobo/go-selfupdate/selfupdate"
+)
+
+// Version formats accepted by -version-format
+const (
+	// versionSemver accepts SemVer with optional minor and patch numbers and
+	// an optional v prefix, such as 1.2, v1.2.3 or 1.3-beta1
+	versionSemver = "semver"
+	// versionStrict accepts SemVer 2.0.0 versions, optionally prefixed with v
+	versionStrict = "strict"
+	// versionAny accepts anything usable as a directory name
+	versionAny = "any"
+)
+
+var (
+	semverIdentifiers = `(?:-[0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*)?(?:\+[0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*)?`
+	semverPattern     = regexp.MustCompile(`^v?(?:0|[1-9]\d*)(?:\.(?:0|[1-9]\d*)){0,2}` + semverIdentifiers + `$`)
+	strictPattern     = regexp.MustCompile(`^v?(?:0|[1-9]\d*)\.(?:0|[1-9]\d*)\.(?:0|[1-9]\d*)` + semverIdentifiers + `$`)
+)
+
+// validateVersion checks version against format. Whatever the format the
+// version must be usable as a single path segment of the update tree.
+func validateVersion(version, format string) error {
+	if version == "" || version == "." || version == ".." || version == "patches" || version == selfupdate.IndexFile ||
+		strings.ContainsAny(version, "/\\?#% \t\r\n") {
+		return fmt.Errorf("invalid version %q: it is used as a directory name in the update tree", version)
+	}
+
+	switch format {
+	case versionAny:
+		return nil
+	case versionSemver:
+		if !semverPattern.MatchString(version) {
+			return fmt.Errorf("invalid version %q: not a SemVer version like 1.2.3 or v1.3-beta1, use -version-format any to allow it", version)
+		}
+	case versionStrict:
+		if !strictPattern.MatchString(version) {
+			return fmt.Errorf("invalid version %q: not a SemVer 2.0.0 version like 1.2.3", version)
+		}
+	default:
+		return fmt.Errorf("unknown version format %q, use semver, strict or any", format)
+	}
+	return nil
+}
+
+// gitVersion derives the version from the most recent tag reachable from
+// HEAD, as printed by git describe. Commits after the tag and uncommitted
+// changes are reflected in the version so that they never reuse the name of
+// the tagged release.
+func gitVersion() (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", "describe", "--tags", "--dirty")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("-version git: git describe failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// compareVersions orders versions by SemVer precedence, returning -1, 0 or
+// +1. Missing minor and patch numbers count as 0 and a v prefix and build
+// metadata are ignored. Versions that are not SemVer compare as strings.
+func compareVersions(a, b string) int {
+	if !semverPattern.MatchString(a) || !semverPattern.MatchString(b) {
+		return strings.Compare(a, b)
+	}
+	coreA, preA := splitVersion(a)
+	coreB, preB := splitVersion(b)
+	for i := range 3 {
+		if c := cmp.Compare(coreA[i], coreB[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case preA == preB:
+		return 0
+	case preA == "":
+		return 1
+	case preB == "":
+		return -1
+	}
+	idsA, idsB := strings.Split(preA, "."), strings.Split(preB, ".")
+	for i := 0; i < len(idsA) && i < len(idsB); i++ {
+		numA, errA := strconv.ParseUint(idsA[i], 10, 64)
+		numB, errB := strconv.ParseUint(idsB[i], 10, 64)
+		var c int
+		switch {
+		case errA == nil && errB == nil:
+			c = cmp.Compare(numA, numB)
+		case errA == nil:
+			c = -1
+		case errB == nil:
+			c = 1
+		default:
+			c = strings.Compare(idsA[i], idsB[i])
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(idsA), len(idsB))
+}
+
+// splitVersion returns the major, minor and patch numbers and the pre-release
+// of a version matching semverPattern
+func splitVersion(version string) (core [3]uint64, pre string) {
+	version, _, _ = strings.Cut(strings.TrimPrefix(version, "v"), "+")
+	version, pre, _ = strings.Cut(version, "-")
+	for i, n := range strings.Split(version, ".") {
+		core[i], _ = strconv.ParseUint(n, 10, 64)
+	}
+	return core, pre
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/bobo/go-selfupdate/selfupdate"
+	"github.com/bobo/go-selfupdate/selfupdate/publish"
+)
+
+var yankCmd = &command{
+	name:    "yank",
+	args:    "",
+	summary: "Withdraw a bad version, pointing every channel manifest on it back at the version before and never publishing it again.",
+	run:     runYank,
+}
+
+func runYank(fs *flag.FlagSet, args []string) (err error) {
+	output, cmd := outputFlags(fs)
+	version := fs.String("version", "", "Version to withdraw (required).")
+	del := fs.Bool("delete", false, "Also delete the artifacts of the version and the patches from and to it.")
+	keyPath := fs.String("key", "", "Private key file created by keygen. Required when the tree is signed.")
+	dryRun := fs.Bool("dry-run", false, "Print how the manifests would change and what would be removed without writing anything.")
+	compact := compactFlag(fs)
+	hashEncoding := hashEncodingFlag(fs)
+	webhook := notifyFlag(fs)
+	distribution := rewriteDistributionFlag(fs)
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *version == "" {
+		return usageError(fs, "-version is required")
+	}
+	root := treeRoot(*output, *cmd)
+	if *distribution != "" && !strings.HasPrefix(root, "s3://") {
+		return usageError(fs, "-cloudfront-distribution needs -o to be an s3:// URL")
+	}
+	var links []string
+	if *webhook != "" && !*dryRun {
+		action := fmt.Sprintf("yanking %s from %s", *version, root)
+		defer func() {
+			if err == nil {
+				action = fmt.Sprintf("yanked %s from %s", *version, root)
+			}
+			notify(*webhook, action, links, err)
+		}()
+	}
+
+	ctx := context.Background()
+	store, err := publish.OpenStore(root)
+	if err != nil {
+		return err
+	}
+	tree, err := scanStore(ctx, store)
+	if err != nil {
+		return err
+	}
+	index, err := publish.ReadIndex(ctx, store)
+	if err != nil {
+		return err
+	}
+	if *keyPath == "" {
+		if err := requireUnsigned(ctx, store, selfupdate.IndexFile); err != nil {
+			return err
+		}
+	}
+
+	// find where every manifest on the version goes back to before writing
+	// anything, so a channel without an earlier version stops the yank
+	type rollback struct {
+		platform string
+		info     *selfupdate.UpdateInfo
+	}
+	var rollbacks []rollback
+	for _, name := range tree.manifests {
+		info, err := readStoredManifest(ctx, store, name)
+		if err != nil {
+			return err
+		}
+		if info.Version != *version {
+			continue
+		}
+		channel := path.Dir(name)
+		if channel == "." {
+			channel = "stable"
+		}
+		platform := strings.TrimSuffix(path.Base(name), ".json")
+		previous := previousRelease(index, channel, platform, *version)
+		if previous == nil {
+			return fmt.Errorf("%s: channel %s has no earlier version for %s to roll back to", name, channel, platform)
+		}
+		if *keyPath == "" {
+			if err := requireUnsigned(ctx, store, name); err != nil {
+				return err
+			}
+		}
+		rollbacks = append(rollbacks, rollback{platform: platform, info: previous})
+	}
+
+	var files []string
+	for _, v := range tree.versions {
+		if v.name == *version {
+			files = v.files
+		}
+	}
+	if len(rollbacks) == 0 && len(files) == 0 && !yankable(index, *version) {
+		return fmt.Errorf("version %s is not published in %s", *version, root)
+	}
+
+	var backend publish.Backend = &recordingBackend{Backend: store, root: root}
+	if *dryRun {
+		store = &dryRunStore{Store: store, root: root}
+		backend = store
+	}
+	if backend, err = withSigning(backend, *keyPath); err != nil {
+		return err
+	}
+	backend = withCompaction(backend, *compact)
+	if backend, err = withHashEncoding(backend, *hashEncoding); err != nil {
+		return err
+	}
+	for _, r := range rollbacks {
+		printProgress("rolling back", r.platform, "of", r.info.Channel, "to", r.info.Version)
+		if err := publish.PutManifest(ctx, backend, r.platform, r.info); err != nil {
+			return err
+		}
+		links = append(links, fmt.Sprintf("%s back on %s", manifestLink(root, publish.ManifestPath(r.info.Channel, r.platform)), r.info.Version))
+	}
+
+	// artifacts go once no manifest points at them anymore
+	if *del {
+		printProgress("removing version", *version)
+		for _, name := range files {
+			if err := store.Delete(ctx, name); err != nil {
+				return err
+			}
+		}
+		for _, name := range tree.patches {
+			// patches/<from>/<to>/<platform>.patch
+			parts := strings.Split(name, "/")
+			if len(parts) == 4 && (parts[1] == *version || parts[2] == *version) {
+				printProgress("removing patch", name)
+				if err := store.Delete(ctx, name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	index.Yank(*version)
+	if err := publish.PutIndex(ctx, backend, index); err != nil {
+		return err
+	}
+
+	channels, platforms := map[string]bool{}, map[string]bool{}
+	for _, r := range rollbacks {
+		channels[r.info.Channel] = true
+		platforms[r.platform] = true
+	}
+	return invalidateRewritten(ctx, *distribution, root, sortedKeys(channels), sortedKeys(platforms), *keyPath != "", *dryRun)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// previousRelease returns the manifest of the newest release of platform
+// published to channel before version that was not yanked, or nil if there
+// is none
+func previousRelease(index *selfupdate.Index, channel, platform, version string) *selfupdate.UpdateInfo {
+	found := false
+	for _, r := range index.Channels[channel] {
+		if r.Version == version {
+			found = true
+			continue
+		}
+		if !found || index.IsYanked(r.Version) {
+			continue
+		}
+		if _, ok := r.Platforms[platform]; !ok {
+			continue
+		}
+		info := r.Info(channel, platform)
+		return &info
+	}
+	return nil
+}
+
+// yankable reports whether the index lists version in any channel
+func yankable(index *selfupdate.Index, version string) bool {
+	for _, releases := range index.Channels {
+		for _, r := range releases {
+			if r.Version == version {
+				return true
+			}
+		}
+	}
+	return false
+}
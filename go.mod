@@ -1,3 +1,14 @@
 module github.com/bobo/go-selfupdate
 
 go 1.23.2
+
+require (
+	filippo.io/age v1.2.1
+	github.com/klauspost/compress v1.17.11
+	github.com/ulikunitz/xz v0.5.12
+)
+
+require (
+	golang.org/x/crypto v0.24.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+)
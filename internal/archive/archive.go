@@ -0,0 +1,231 @@
+// Package archive reads and writes the tar.gz and zip archives an update can
+// be published as, bundling the executable with extra files such as a
+// LICENSE or shell completions.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+
+	compress "github.com/bobo/go-selfupdate/internal/compression"
+)
+
+// Supported archive formats
+const (
+	TarGz = "tar.gz"
+	Zip   = "zip"
+)
+
+// ErrNoExecutable is returned when an archive does not contain the executable
+var ErrNoExecutable = errors.New("executable not found in archive")
+
+// Validate returns an error if format is not a supported archive format
+func Validate(format string) error {
+	_, err := Extension(format)
+	return err
+}
+
+// Extension returns the file extension of archives in format
+func Extension(format string) (string, error) {
+	switch format {
+	case TarGz, Zip:
+		return "." + format, nil
+	}
+	return "", fmt.Errorf("unsupported archive format %q", format)
+}
+
+// ContentType returns the media type of archives in format
+func ContentType(format string) string {
+	if format == Zip {
+		return "application/zip"
+	}
+	return "application/gzip"
+}
+
+// File is a member of an archive being written
+type File struct {
+	Name string // slash separated path inside the archive
+	Mode fs.FileMode
+	Size int64
+	Body io.Reader
+}
+
+// Write writes files to w as an archive in format. The executable should be
+// the first file: Extract falls back to the first member when no name is
+// given. Every member gets modTime, so identical files produce identical
+// archives. Level is the gzip level of tar.gz archives, 0 for the default.
+func Write(w io.Writer, format string, modTime time.Time, level int, files []File) error {
+	switch format {
+	case TarGz:
+		return writeTarGz(w, modTime, level, files)
+	case Zip:
+		return writeZip(w, modTime, files)
+	}
+	return Validate(format)
+}
+
+func writeTarGz(w io.Writer, modTime time.Time, level int, files []File) error {
+	gz, err := compress.NewWriter(w, compress.Gzip, level)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     f.Name,
+			Mode:     int64(f.Mode.Perm()),
+			Size:     f.Size,
+			ModTime:  modTime,
+			Format:   tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, f.Body); err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeZip(w io.Writer, modTime time.Time, files []File) error {
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		hdr := &zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: modTime}
+		hdr.SetMode(f.Mode.Perm())
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(fw, f.Body); err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+	return zw.Close()
+}
+
+// Extract returns the content of the member called name, or of the first
+// regular file when name is empty
+func Extract(r io.Reader, format, name string) ([]byte, error) {
+	switch format {
+	case TarGz:
+		return extractTarGz(r, name)
+	case Zip:
+		return extractZip(r, name)
+	}
+	return nil, Validate(format)
+}
+
+func extractTarGz(r io.Reader, name string) ([]byte, error) {
+	gz, err := compress.NewReader(r, compress.Gzip)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, ErrNoExecutable
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg && matches(hdr.Name, name) {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+func extractZip(r io.Reader, name string) ([]byte, error) {
+	// the central directory is at the end, so zip needs random access
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() || !matches(f.Name, name) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+	return nil, ErrNoExecutable
+}
+
+// Walk calls fn with the name and content of every regular member of the
+// archive in order, stopping at the first error fn returns
+func Walk(r io.Reader, format string, fn func(name string, r io.Reader) error) error {
+	switch format {
+	case TarGz:
+		gz, err := compress.NewReader(r, compress.Gzip)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		tr := tar.NewReader(gz)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if hdr.Typeflag != tar.TypeReg {
+				continue
+			}
+			if err := fn(hdr.Name, tr); err != nil {
+				return err
+			}
+		}
+	case Zip:
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			return err
+		}
+		for _, f := range zr.File {
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(f.Name, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return Validate(format)
+}
+
+func matches(member, name string) bool {
+	return name == "" || path.Clean(member) == path.Clean(name)
+}
@@ -0,0 +1,63 @@
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testFiles() []File {
+	return []File{
+		{Name: "myapp", Mode: 0755, Size: 6, Body: strings.NewReader("binary")},
+		{Name: "LICENSE", Mode: 0644, Size: 3, Body: strings.NewReader("MIT")},
+		{Name: "completions/myapp.bash", Mode: 0644, Size: 8, Body: strings.NewReader("complete")},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, format := range []string{TarGz, Zip} {
+		t.Run(format, func(t *testing.T) {
+			var a, b bytes.Buffer
+			if err := Write(&a, format, modTime, 0, testFiles()); err != nil {
+				t.Fatal(err)
+			}
+			if err := Write(&b, format, modTime, 0, testFiles()); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(a.Bytes(), b.Bytes()) {
+				t.Error("identical files produced different archives")
+			}
+
+			for name, want := range map[string]string{"": "binary", "myapp": "binary", "completions/myapp.bash": "complete"} {
+				got, err := Extract(bytes.NewReader(a.Bytes()), format, name)
+				if err != nil {
+					t.Fatalf("%q: %v", name, err)
+				}
+				if string(got) != want {
+					t.Errorf("%q: got %q, want %q", name, got, want)
+				}
+			}
+			if _, err := Extract(bytes.NewReader(a.Bytes()), format, "missing"); !errors.Is(err, ErrNoExecutable) {
+				t.Errorf("expected ErrNoExecutable, got %v", err)
+			}
+
+			var walked []string
+			err := Walk(bytes.NewReader(a.Bytes()), format, func(name string, r io.Reader) error {
+				b, err := io.ReadAll(r)
+				walked = append(walked, name+"="+string(b))
+				return err
+			})
+			if err != nil || strings.Join(walked, ",") != "myapp=binary,LICENSE=MIT,completions/myapp.bash=complete" {
+				t.Errorf("walked %v, %v", walked, err)
+			}
+		})
+	}
+
+	if err := Write(&bytes.Buffer{}, "rar", modTime, 0, nil); err == nil {
+		t.Error("expected error for unsupported format")
+	}
+}
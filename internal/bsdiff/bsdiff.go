@@ -0,0 +1,411 @@
+// Package bsdiff implements Colin Percival's bsdiff algorithm for creating
+// and applying binary patches.
+//
+// Patches use the interleaved control/diff/extra layout of bsdiff 4.3 but are
+// compressed with gzip instead of bzip2, since the standard library has no
+// bzip2 writer, and are therefore not compatible with the bsdiff tool.
+// A patch is the magic "BSDIFFGZ", the little-endian int64 size of the new
+// file, and a gzip stream of blocks, each made of three little-endian int64
+// control values (diff length, extra length, old file seek) followed by the
+// diff and extra bytes.
+package bsdiff
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const magic = "BSDIFFGZ"
+
+// ErrCorrupt is returned when a patch is malformed or does not fit the old file
+var ErrCorrupt = errors.New("corrupt patch")
+
+// Diff writes a patch that transforms old into new to patch
+func Diff(old, new []byte, patch io.Writer) error {
+	var hdr [16]byte
+	copy(hdr[:8], magic)
+	binary.LittleEndian.PutUint64(hdr[8:], uint64(len(new)))
+	if _, err := patch.Write(hdr[:]); err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(patch)
+	w := bufio.NewWriter(gz)
+	if err := diff(old, new, w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Patch applies patch to old and returns the new file
+func Patch(old []byte, patch io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := PatchTo(bytes.NewReader(old), int64(len(old)), patch, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// chunkSize is how much of the old and new files PatchTo holds at a time
+const chunkSize = 64 << 10
+
+// PatchTo applies patch to the oldSize bytes of old and writes the new file
+// to w. The new file is produced in order and old is read a chunk at a time,
+// so neither has to fit in memory, such as when old is a memory mapped file
+// and w the file being staged.
+func PatchTo(old io.ReaderAt, oldSize int64, patch io.Reader, w io.Writer) error {
+	var hdr [16]byte
+	if _, err := io.ReadFull(patch, hdr[:]); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	if string(hdr[:8]) != magic {
+		return fmt.Errorf("%w: bad magic", ErrCorrupt)
+	}
+	newSize := int64(binary.LittleEndian.Uint64(hdr[8:]))
+	if newSize < 0 {
+		return fmt.Errorf("%w: bad size", ErrCorrupt)
+	}
+
+	gz, err := gzip.NewReader(patch)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	defer gz.Close()
+	r := bufio.NewReader(gz)
+
+	chunk := make([]byte, chunkSize)
+	oldChunk := make([]byte, chunkSize)
+	var oldPos, newPos int64
+	var ctrl [3]int64
+	for newPos < newSize {
+		if err := binary.Read(r, binary.LittleEndian, &ctrl); err != nil {
+			return fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		diffLen, extraLen, seek := ctrl[0], ctrl[1], ctrl[2]
+		if diffLen < 0 || extraLen < 0 || newPos+diffLen+extraLen > newSize {
+			return fmt.Errorf("%w: control block out of range", ErrCorrupt)
+		}
+
+		for left := diffLen; left > 0; {
+			b := chunk[:min(left, chunkSize)]
+			if _, err := io.ReadFull(r, b); err != nil {
+				return fmt.Errorf("%w: %v", ErrCorrupt, err)
+			}
+			if err := addOld(b, old, oldPos, oldSize, oldChunk); err != nil {
+				return err
+			}
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+			left -= int64(len(b))
+			oldPos += int64(len(b))
+		}
+		newPos += diffLen
+
+		for left := extraLen; left > 0; {
+			b := chunk[:min(left, chunkSize)]
+			if _, err := io.ReadFull(r, b); err != nil {
+				return fmt.Errorf("%w: %v", ErrCorrupt, err)
+			}
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+			left -= int64(len(b))
+		}
+		newPos += extraLen
+		oldPos += seek
+	}
+
+	// drain the stream so a truncated or damaged gzip trailer is detected
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return nil
+}
+
+// addOld adds the bytes of old at pos to b, leaving the bytes of b that fall
+// outside old as they are
+func addOld(b []byte, old io.ReaderAt, pos, oldSize int64, buf []byte) error {
+	start, end := max(pos, 0), min(pos+int64(len(b)), oldSize)
+	if start >= end {
+		return nil
+	}
+	o := buf[:end-start]
+	if n, err := old.ReadAt(o, start); n < len(o) {
+		return fmt.Errorf("failed to read old file: %w", err)
+	}
+	for i, c := range o {
+		b[start-pos+int64(i)] += c
+	}
+	return nil
+}
+
+func diff(old, new []byte, w io.Writer) error {
+	oldSize, newSize := len(old), len(new)
+	I := qsufsort(old)
+
+	var scan, pos, n, lastScan, lastPos, lastOffset int
+	for scan < newSize {
+		oldScore := 0
+		scan += n
+		for scsc := scan; scan < newSize; scan++ {
+			pos, n = search(I, old, new[scan:], 0, oldSize)
+			for ; scsc < scan+n; scsc++ {
+				if scsc+lastOffset < oldSize && old[scsc+lastOffset] == new[scsc] {
+					oldScore++
+				}
+			}
+			if (n == oldScore && n != 0) || n > oldScore+8 {
+				break
+			}
+			if scan+lastOffset < oldSize && old[scan+lastOffset] == new[scan] {
+				oldScore--
+			}
+		}
+
+		if n == oldScore && scan != newSize {
+			continue
+		}
+
+		// extend the previous match forwards
+		var lenf int
+		for i, s, sf := 0, 0, 0; lastScan+i < scan && lastPos+i < oldSize; {
+			if old[lastPos+i] == new[lastScan+i] {
+				s++
+			}
+			i++
+			if s*2-i > sf*2-lenf {
+				sf = s
+				lenf = i
+			}
+		}
+
+		// extend the current match backwards
+		var lenb int
+		if scan < newSize {
+			for i, s, sb := 1, 0, 0; scan >= lastScan+i && pos >= i; i++ {
+				if old[pos-i] == new[scan-i] {
+					s++
+				}
+				if s*2-i > sb*2-lenb {
+					sb = s
+					lenb = i
+				}
+			}
+		}
+
+		// resolve any overlap between the two extensions
+		if lastScan+lenf > scan-lenb {
+			overlap := (lastScan + lenf) - (scan - lenb)
+			var s, ss, lens int
+			for i := 0; i < overlap; i++ {
+				if new[lastScan+lenf-overlap+i] == old[lastPos+lenf-overlap+i] {
+					s++
+				}
+				if new[scan-lenb+i] == old[pos-lenb+i] {
+					s--
+				}
+				if s > ss {
+					ss = s
+					lens = i + 1
+				}
+			}
+			lenf += lens - overlap
+			lenb -= lens
+		}
+
+		ctrl := [3]int64{
+			int64(lenf),
+			int64((scan - lenb) - (lastScan + lenf)),
+			int64((pos - lenb) - (lastPos + lenf)),
+		}
+		if err := binary.Write(w, binary.LittleEndian, ctrl); err != nil {
+			return err
+		}
+		db := make([]byte, lenf)
+		for i := range db {
+			db[i] = new[lastScan+i] - old[lastPos+i]
+		}
+		if _, err := w.Write(db); err != nil {
+			return err
+		}
+		if _, err := w.Write(new[lastScan+lenf : scan-lenb]); err != nil {
+			return err
+		}
+
+		lastScan = scan - lenb
+		lastPos = pos - lenb
+		lastOffset = pos - scan
+	}
+	return nil
+}
+
+func matchlen(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// search finds the longest match for target in old using the suffix array I
+func search(I []int, old, target []byte, st, en int) (pos, n int) {
+	if en-st < 2 {
+		x := matchlen(old[I[st]:], target)
+		y := matchlen(old[I[en]:], target)
+		if x > y {
+			return I[st], x
+		}
+		return I[en], y
+	}
+
+	x := st + (en-st)/2
+	suffix := old[I[x]:]
+	m := min(len(suffix), len(target))
+	if bytes.Compare(suffix[:m], target[:m]) < 0 {
+		return search(I, old, target, x, en)
+	}
+	return search(I, old, target, st, x)
+}
+
+// qsufsort builds the suffix array of buf with the Larsson-Sadakane algorithm
+func qsufsort(buf []byte) []int {
+	n := len(buf)
+	I := make([]int, n+1)
+	V := make([]int, n+1)
+
+	var buckets [256]int
+	for _, c := range buf {
+		buckets[c]++
+	}
+	for i := 1; i < 256; i++ {
+		buckets[i] += buckets[i-1]
+	}
+	copy(buckets[1:], buckets[:255])
+	buckets[0] = 0
+
+	for i, c := range buf {
+		buckets[c]++
+		I[buckets[c]] = i
+	}
+	I[0] = n
+	for i, c := range buf {
+		V[i] = buckets[c]
+	}
+	V[n] = 0
+	for i := 1; i < 256; i++ {
+		if buckets[i] == buckets[i-1]+1 {
+			I[buckets[i]] = -1
+		}
+	}
+	I[0] = -1
+
+	for h := 1; I[0] != -(n + 1); h += h {
+		length := 0
+		i := 0
+		for i < n+1 {
+			if I[i] < 0 {
+				length -= I[i]
+				i -= I[i]
+				continue
+			}
+			if length != 0 {
+				I[i-length] = -length
+			}
+			length = V[I[i]] + 1 - i
+			split(I, V, i, length, h)
+			i += length
+			length = 0
+		}
+		if length != 0 {
+			I[i-length] = -length
+		}
+	}
+
+	for i := 0; i < n+1; i++ {
+		I[V[i]] = i
+	}
+	return I
+}
+
+func split(I, V []int, start, length, h int) {
+	if length < 16 {
+		for k, j := start, 0; k < start+length; k += j {
+			j = 1
+			x := V[I[k]+h]
+			for i := 1; k+i < start+length; i++ {
+				if V[I[k+i]+h] < x {
+					x = V[I[k+i]+h]
+					j = 0
+				}
+				if V[I[k+i]+h] == x {
+					I[k+j], I[k+i] = I[k+i], I[k+j]
+					j++
+				}
+			}
+			for i := 0; i < j; i++ {
+				V[I[k+i]] = k + j - 1
+			}
+			if j == 1 {
+				I[k] = -1
+			}
+		}
+		return
+	}
+
+	x := V[I[start+length/2]+h]
+	var jj, kk int
+	for i := start; i < start+length; i++ {
+		if V[I[i]+h] < x {
+			jj++
+		}
+		if V[I[i]+h] == x {
+			kk++
+		}
+	}
+	jj += start
+	kk += jj
+
+	i, j, k := start, 0, 0
+	for i < jj {
+		switch v := V[I[i]+h]; {
+		case v < x:
+			i++
+		case v == x:
+			I[i], I[jj+j] = I[jj+j], I[i]
+			j++
+		default:
+			I[i], I[kk+k] = I[kk+k], I[i]
+			k++
+		}
+	}
+	for jj+j < kk {
+		if V[I[jj+j]+h] == x {
+			j++
+		} else {
+			I[jj+j], I[kk+k] = I[kk+k], I[jj+j]
+			k++
+		}
+	}
+
+	if jj > start {
+		split(I, V, start, jj-start, h)
+	}
+	for i := 0; i < kk-jj; i++ {
+		V[I[jj+i]] = kk - 1
+	}
+	if jj == kk-1 {
+		I[jj] = -1
+	}
+	if start+length > kk {
+		split(I, V, kk, start+length-kk, h)
+	}
+}
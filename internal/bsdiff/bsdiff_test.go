@@ -0,0 +1,99 @@
+package bsdiff
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestDiffPatchRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	base := make([]byte, 64*1024)
+	rnd.Read(base)
+
+	modified := append([]byte(nil), base...)
+	for i := 0; i < 200; i++ {
+		modified[rnd.Intn(len(modified))] = byte(rnd.Intn(256))
+	}
+	modified = append(modified[:1000], append([]byte("inserted block of new code"), modified[1000:]...)...)
+	modified = append(modified[:30000], modified[31000:]...)
+
+	tests := []struct {
+		name     string
+		old, new []byte
+	}{
+		{"empty to empty", nil, nil},
+		{"empty to data", nil, []byte("hello world")},
+		{"data to empty", []byte("hello world"), nil},
+		{"identical", base, base},
+		{"small edits", base, modified},
+		{"unrelated", []byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"), []byte("the quick brown fox jumps over the lazy dog")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var patch bytes.Buffer
+			if err := Diff(tt.old, tt.new, &patch); err != nil {
+				t.Fatal(err)
+			}
+			got, err := Patch(tt.old, bytes.NewReader(patch.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.new) {
+				t.Errorf("patched output differs from new file (got %d bytes, want %d)", len(got), len(tt.new))
+			}
+		})
+	}
+
+	var patch bytes.Buffer
+	if err := Diff(base, modified, &patch); err != nil {
+		t.Fatal(err)
+	}
+	if patch.Len() > len(modified)/4 {
+		t.Errorf("patch for small edits is too large: %d bytes", patch.Len())
+	}
+}
+
+func TestPatchCorrupt(t *testing.T) {
+	if _, err := Patch(nil, bytes.NewReader([]byte("not a patch at all"))); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt, got %v", err)
+	}
+
+	var patch bytes.Buffer
+	if err := Diff([]byte("old contents"), []byte("new contents"), &patch); err != nil {
+		t.Fatal(err)
+	}
+	truncated := patch.Bytes()[:patch.Len()-4]
+	if _, err := Patch([]byte("old contents"), bytes.NewReader(truncated)); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt for truncated patch, got %v", err)
+	}
+}
+
+func TestPatchTo(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	old := make([]byte, 3*chunkSize+123)
+	rnd.Read(old)
+	new := append([]byte("prefix"), old[chunkSize/2:]...)
+	for i := 0; i < 100; i++ {
+		new[rnd.Intn(len(new))]++
+	}
+	new = append(new, "suffix longer than nothing"...)
+
+	var patch bytes.Buffer
+	if err := Diff(old, new, &patch); err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if err := PatchTo(bytes.NewReader(old), int64(len(old)), bytes.NewReader(patch.Bytes()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), new) {
+		t.Errorf("patched output differs from new file (got %d bytes, want %d)", got.Len(), len(new))
+	}
+	if err := PatchTo(bytes.NewReader(old[:chunkSize]), int64(len(old)), bytes.NewReader(patch.Bytes()), io.Discard); err == nil {
+		t.Error("expected an error for an old file shorter than its size")
+	}
+}
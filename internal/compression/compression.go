@@ -0,0 +1,119 @@
+// Package compression maps the compression names recorded in update
+// manifests to their encoders, decoders and file extensions.
+package compression
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Supported compression names. An empty name in a manifest means Gzip.
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+	Xz   = "xz"
+)
+
+// xzDictCaps are the dictionary sizes of the xz utility presets 0-9
+var xzDictCaps = [10]int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+func normalize(name string) string {
+	if name == "" {
+		return Gzip
+	}
+	return name
+}
+
+// Validate returns an error if name is not a supported compression
+func Validate(name string) error {
+	_, err := Extension(name)
+	return err
+}
+
+// Extension returns the file extension used for artifacts compressed with name
+func Extension(name string) (string, error) {
+	switch normalize(name) {
+	case Gzip:
+		return ".gz", nil
+	case Zstd:
+		return ".zst", nil
+	case Xz:
+		return ".xz", nil
+	}
+	return "", fmt.Errorf("unsupported compression %q", name)
+}
+
+// ContentType returns the media type of artifacts compressed with name
+func ContentType(name string) string {
+	switch normalize(name) {
+	case Zstd:
+		return "application/zstd"
+	case Xz:
+		return "application/x-xz"
+	}
+	return "application/gzip"
+}
+
+// NewWriter returns a writer compressing to w. Level follows the scale of
+// the gzip, zstd and xz command line tools; 0 selects the default.
+//
+// Output is deterministic: identical input, compression and level always
+// produce identical bytes, so published artifact hashes can be reproduced.
+func NewWriter(w io.Writer, name string, level int) (io.WriteCloser, error) {
+	switch normalize(name) {
+	case Gzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		gz, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		// no file name, modification time or originating OS in the header
+		gz.Header = gzip.Header{OS: 255}
+		return gz, nil
+	case Zstd:
+		// a single encoder goroutine keeps block boundaries independent of
+		// the number of CPUs
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	case Xz:
+		cfg := xz.WriterConfig{}
+		if level != 0 {
+			if level < 0 || level > 9 {
+				return nil, fmt.Errorf("invalid xz level %d", level)
+			}
+			cfg.DictCap = xzDictCaps[level]
+		}
+		return cfg.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unsupported compression %q", name)
+}
+
+// NewReader returns a reader decompressing r
+func NewReader(r io.Reader, name string) (io.ReadCloser, error) {
+	switch normalize(name) {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case Xz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	}
+	return nil, fmt.Errorf("unsupported compression %q", name)
+}
@@ -0,0 +1,104 @@
+package compression
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	payload := []byte(strings.Repeat("self updating binary ", 1000))
+
+	for _, name := range []string{"", Gzip, Zstd, Xz} {
+		for _, level := range []int{0, 1, 9} {
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf, name, level)
+			if err != nil {
+				t.Fatalf("%q level %d: %v", name, level, err)
+			}
+			if _, err := w.Write(payload); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if buf.Len() >= len(payload) {
+				t.Errorf("%q level %d did not compress: %d bytes", name, level, buf.Len())
+			}
+
+			r, err := NewReader(&buf, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Errorf("%q level %d: round trip mismatch", name, level)
+			}
+		}
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	if err := Validate("brotli"); err == nil {
+		t.Error("expected error for unsupported compression")
+	}
+	if _, err := NewWriter(io.Discard, "brotli", 0); err == nil {
+		t.Error("expected error from NewWriter")
+	}
+	if _, err := NewReader(strings.NewReader(""), "brotli"); err == nil {
+		t.Error("expected error from NewReader")
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	payload := []byte(strings.Repeat("reproducible build output ", 5000))
+
+	for _, name := range []string{Gzip, Zstd, Xz} {
+		var outputs [2][]byte
+		for i := range outputs {
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf, name, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(payload)
+			w.Close()
+			outputs[i] = buf.Bytes()
+		}
+		if !bytes.Equal(outputs[0], outputs[1]) {
+			t.Errorf("%s output is not deterministic", name)
+		}
+	}
+}
+
+func BenchmarkDecompress(b *testing.B) {
+	payload := []byte(strings.Repeat("self updating binary ", 200000))
+	for _, name := range []string{Gzip, Zstd, Xz} {
+		b.Run(name, func(b *testing.B) {
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf, name, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			w.Write(payload)
+			w.Close()
+			b.ReportAllocs()
+			b.SetBytes(int64(len(payload)))
+			for range b.N {
+				r, err := NewReader(bytes.NewReader(buf.Bytes()), name)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, r); err != nil {
+					b.Fatal(err)
+				}
+				r.Close()
+			}
+		})
+	}
+}
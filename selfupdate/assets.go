@@ -0,0 +1,141 @@
+package selfupdate
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bobo/go-selfupdate/internal/archive"
+)
+
+// keepArchive holds on to the archive of info read while staging, so that
+// installAssets does not download it again
+func (u *Updater) keepArchive(info UpdateInfo, b []byte) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.archived, u.archivedOf = b, info.Version
+}
+
+// installAssets installs the members of the archive of info named by Assets,
+// such as shell completions and man pages, once its binary is swapped in at
+// execPath. The archive kept from staging is used when there is one,
+// otherwise it is downloaded, as after a patch update. Its executable must
+// match info, so the assets come from the same release as the binary.
+func (u *Updater) installAssets(info UpdateInfo, execPath string) error {
+	if len(u.Assets) == 0 || info.Archive == "" {
+		return nil
+	}
+	u.mu.Lock()
+	b := u.archived
+	if u.archivedOf != info.Version {
+		b = nil
+	}
+	u.archived, u.archivedOf = nil, ""
+	u.mu.Unlock()
+
+	if b == nil {
+		artifact, err := u.artifactURL(info)
+		if err != nil {
+			return err
+		}
+		r, err := u.fetch(artifact)
+		if err != nil {
+			return fmt.Errorf("failed to fetch archive: %w", err)
+		}
+		defer r.Close()
+		dr, err := u.decrypt(r, info)
+		if err != nil {
+			return err
+		}
+		if b, err = io.ReadAll(dr); err != nil {
+			return fmt.Errorf("failed to fetch archive: %w", err)
+		}
+	}
+
+	var bin []byte
+	files := map[string][]byte{}
+	first := true
+	err := archive.Walk(bytes.NewReader(b), info.Archive, func(name string, r io.Reader) error {
+		exe := (info.Executable == "" && first) || path.Clean(name) == path.Clean(info.Executable)
+		first = false
+		dest, ok := assetDest(u.Assets, name)
+		if !exe && !ok {
+			return nil
+		}
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if exe {
+			bin = content
+		}
+		if ok {
+			if !filepath.IsAbs(dest) {
+				dest = filepath.Join(filepath.Dir(execPath), dest)
+			}
+			files[dest] = content
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+	if !verifyDigests(bin, info) {
+		return ErrHashMismatch
+	}
+	for dest, content := range files {
+		if err := writeAsset(dest, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assetDest returns where the archive member name is installed: at the
+// destination of an entry of assets naming it, or below the destination of
+// an entry ending in / naming a directory it is in
+func assetDest(assets map[string]string, name string) (string, bool) {
+	name = path.Clean(name)
+	for member, dest := range assets {
+		if !strings.HasSuffix(member, "/") {
+			if name == path.Clean(member) {
+				return dest, true
+			}
+			continue
+		}
+		if rel, ok := strings.CutPrefix(name, path.Clean(member)+"/"); ok {
+			return filepath.Join(dest, filepath.FromSlash(rel)), true
+		}
+	}
+	return "", false
+}
+
+// writeAsset replaces the file at dest, through a temporary file so that a
+// shell loading completions never reads a partial one
+func writeAsset(dest string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(dest), fmt.Sprintf(".%s.new-*", filepath.Base(dest)))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), dest)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+package selfupdate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrAuthenticode is wrapped when a staged binary does not carry a valid
+// Authenticode signature of Updater.AuthenticodeSigner
+var ErrAuthenticode = errors.New("invalid Authenticode signature")
+
+// authenticodeScript prints the status of the Authenticode signature of the
+// file named by the SELFUPDATE_PATH environment variable, followed by the
+// thumbprint and subject of the signing certificate
+const authenticodeScript = `$s = Get-AuthenticodeSignature -LiteralPath $env:SELFUPDATE_PATH
+"$($s.Status)"
+"$($s.SignerCertificate.Thumbprint)"
+"$($s.SignerCertificate.Subject)"`
+
+// verifyAuthenticode checks that the binary at path carries a valid
+// Authenticode signature whose certificate matches signer, by thumbprint,
+// subject or common name. Windows checks the certificate chain and
+// revocation the way SmartScreen and application control policies do.
+func verifyAuthenticode(ctx context.Context, path, signer string) error {
+	out, err := runCommand(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command",
+		"$env:SELFUPDATE_PATH = '"+strings.ReplaceAll(path, "'", "''")+"'\n"+authenticodeScript)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrAuthenticode, err)
+	}
+	status, thumbprint, subject := parseAuthenticode(string(out))
+	if status != "Valid" {
+		return fmt.Errorf("%w: status %s", ErrAuthenticode, status)
+	}
+	if !matchSigner(signer, thumbprint, subject) {
+		return fmt.Errorf("%w: signed by %s, not %s", ErrAuthenticode, subject, signer)
+	}
+	return nil
+}
+
+// parseAuthenticode reads the output of authenticodeScript
+func parseAuthenticode(out string) (status, thumbprint, subject string) {
+	lines := strings.Split(strings.ReplaceAll(out, "\r\n", "\n"), "\n")
+	for len(lines) < 3 {
+		lines = append(lines, "")
+	}
+	return strings.TrimSpace(lines[0]), strings.TrimSpace(lines[1]), strings.TrimSpace(lines[2])
+}
+
+// matchSigner reports whether signer names the certificate with thumbprint
+// and subject, such as "CN=Example Corp, O=Example Corp, C=US"
+func matchSigner(signer, thumbprint, subject string) bool {
+	if signer == "" {
+		return false
+	}
+	if strings.EqualFold(signer, thumbprint) || signer == subject {
+		return true
+	}
+	for _, rdn := range strings.Split(subject, ",") {
+		if cn, ok := strings.CutPrefix(strings.TrimSpace(rdn), "CN="); ok && strings.Trim(cn, `"`) == signer {
+			return true
+		}
+	}
+	return false
+}
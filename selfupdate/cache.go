@@ -0,0 +1,229 @@
+package selfupdate
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cacheKey names the cache entry of the binary described by info
+func cacheKey(info UpdateInfo) string {
+	if len(info.Sha256) != 0 {
+		return hex.EncodeToString(info.Sha256)
+	}
+	return hex.EncodeToString(info.Sha512)
+}
+
+// cacheLockPoll is how often an updater waiting for a cache entry checks
+// whether the updater filling it is done
+const cacheLockPoll = 100 * time.Millisecond
+
+func (u *Updater) cachePath() string {
+	if u.CacheDir != "" {
+		return u.CacheDir
+	}
+	return filepath.Join(getExecRelativeDir(u.Dir), cacheDir)
+}
+
+// cachedBin returns the binary of Info when a previous attempt downloaded
+// it, from memory or from the cache directory. Entries are verified again
+// before they are used, so a corrupted entry is removed and downloaded anew.
+func (u *Updater) cachedBin() []byte {
+	if u.CacheSize <= 0 {
+		return nil
+	}
+	u.mu.Lock()
+	bin := u.cached
+	u.mu.Unlock()
+	if bin != nil && verifyDigests(bin, u.Info) {
+		return bin
+	}
+	path := filepath.Join(u.cachePath(), cacheKey(u.Info))
+	bin, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	if !verifyDigests(bin, u.Info) {
+		os.Remove(path)
+		return nil
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return bin
+}
+
+// cacheBin keeps the verified binary of Info for the next attempt, in
+// memory and in the cache directory, pruned to CacheSize
+func (u *Updater) cacheBin(bin []byte) {
+	if u.CacheSize <= 0 || int64(len(bin)) > u.CacheSize {
+		return
+	}
+	u.mu.Lock()
+	u.cached = bin
+	u.mu.Unlock()
+
+	dir := u.cachePath()
+	key := cacheKey(u.Info)
+	if err := writeCacheEntry(dir, key, bytes.NewReader(bin)); err != nil {
+		slog.Warn("failed to cache download", "error", err)
+		return
+	}
+	pruneCache(dir, u.CacheSize, key)
+}
+
+// dropCached removes the cache entry key once its binary is applied
+func (u *Updater) dropCached(key string) {
+	if u.CacheSize <= 0 {
+		return
+	}
+	u.mu.Lock()
+	u.cached = nil
+	u.mu.Unlock()
+	os.Remove(filepath.Join(u.cachePath(), key))
+}
+
+// fetchArtifact downloads the artifact at url and returns the verified
+// binary in it.
+// With a shared CacheDir the artifact itself is cached too, so that the
+// binaries of a product published in the same archive download it once, and
+// an updater finding another one downloading it waits for the download.
+func (u *Updater) fetchArtifact(ctx context.Context, url string) ([]byte, error) {
+	if u.CacheSize <= 0 || u.CacheDir == "" {
+		r, err := u.fetch(url)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch binary: %w", err)
+		}
+		defer r.Close()
+		return u.readBin(r)
+	}
+
+	dir := u.CacheDir
+	sum := sha256.Sum256([]byte(url))
+	key := "artifact-" + hex.EncodeToString(sum[:])
+	unlock, err := lockCacheEntry(ctx, dir, key)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	path := filepath.Join(dir, key)
+	if bin, err := u.readCachedArtifact(path); err == nil {
+		slog.Info("using cached artifact", "url", url)
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return bin, nil
+	}
+
+	r, err := u.fetch(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch binary: %w", err)
+	}
+	defer r.Close()
+	if err := writeCacheEntry(dir, key, limitArtifact(r, u.Info.Size)); err != nil {
+		return nil, fmt.Errorf("failed to fetch binary: %w", err)
+	}
+	pruneCache(dir, u.CacheSize, key)
+	return u.readCachedArtifact(path)
+}
+
+func (u *Updater) readCachedArtifact(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return u.readBin(f)
+}
+
+// lockCacheEntry takes the lock of cache entry key, waiting while another
+// updater, possibly of another binary of the product, fills it
+func lockCacheEntry(ctx context.Context, dir, key string) (func(), error) {
+	if err := makeStateDir(dir); err != nil {
+		return nil, err
+	}
+	lockPath := filepath.Join(dir, "."+key+".lock")
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+			return holdLock(lockPath), nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if fi, err := os.Stat(lockPath); err == nil && time.Since(fi.ModTime()) > staleLockAge {
+			os.Remove(lockPath)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(cacheLockPoll):
+		}
+	}
+}
+
+// writeCacheEntry stores the contents of r as dir/key, through a temporary
+// file so that a reader never sees a partial entry
+func writeCacheEntry(dir, key string, r io.Reader) error {
+	if err := makeStateDir(dir); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// pruneCache removes the least recently used entries of dir until the rest
+// fit in limit bytes, always keeping the entry named keep
+func pruneCache(dir string, limit int64, keep string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var files []os.FileInfo
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil || !fi.Mode().IsRegular() || fi.Name() == stateMarker {
+			continue
+		}
+		if strings.HasPrefix(fi.Name(), ".") && time.Since(fi.ModTime()) < staleLockAge {
+			continue // being written
+		}
+		files = append(files, fi)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Name() == keep || files[j].Name() == keep {
+			return files[i].Name() == keep
+		}
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+	var total int64
+	for _, fi := range files {
+		total += fi.Size()
+		if fi.Name() != keep && (total > limit || strings.HasPrefix(fi.Name(), ".")) {
+			os.Remove(filepath.Join(dir, fi.Name()))
+			total -= fi.Size()
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package selfupdate
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Canary elects a share of the installations of a cluster to apply each
+// version first, while the others wait for the version to soak. Every
+// installation makes the same choice by hashing its id with the cluster key
+// and the version, so no coordination is needed and the canaries change from
+// one version to the next.
+type Canary struct {
+	Cluster string        // key shared by the installations of the cluster
+	Percent int           // share of installations updating first, such as 10
+	Soak    time.Duration // how long after the release Date the others wait
+}
+
+// IsCanary reports whether the installation id is a canary of version
+func (c *Canary) IsCanary(id, version string) bool {
+	return rolloutBucket(c.Cluster+"\x00"+id, version) < c.Percent
+}
+
+// wait returns how much longer an installation that is not a canary waits
+// before applying info. Releases without a Date are applied right away.
+func (c *Canary) wait(id string, info UpdateInfo, now time.Time) time.Duration {
+	if c.IsCanary(id, info.Version) || info.Date.IsZero() {
+		return 0
+	}
+	return max(info.Date.Add(c.Soak).Sub(now), 0)
+}
+
+// waitForCanaries reports whether the update must wait for the canaries of
+// the cluster
+func (u *Updater) waitForCanaries() bool {
+	if u.Canary == nil {
+		return false
+	}
+	wait := u.Canary.wait(u.installationID(), u.Info, time.Now())
+	if wait <= 0 {
+		return false
+	}
+	slog.Info("waiting for the canaries of the cluster", "version", u.Info.Version, "cluster", u.Canary.Cluster,
+		"until", time.Now().Add(wait).Format(time.RFC3339))
+	return true
+}
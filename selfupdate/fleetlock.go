@@ -0,0 +1,140 @@
+package selfupdate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrFleetBusy is returned by a FleetLock when every slot is taken
+var ErrFleetBusy = errors.New("no fleet lock slot free")
+
+// fleetLockTimeout bounds how long taking or releasing a slot may take
+const fleetLockTimeout = 30 * time.Second
+
+// FleetLock limits how many installations of a cluster apply an update at
+// the same time. An installation takes a slot before swapping its binary and
+// only releases it once the new version runs, so a bad release stops at the
+// nodes holding a slot.
+type FleetLock interface {
+	// Lock takes a slot for the installation id, failing with ErrFleetBusy
+	// when all are taken. Taking a slot id already holds succeeds.
+	Lock(ctx context.Context, id string) error
+	// Unlock releases the slot held by id
+	Unlock(ctx context.Context, id string) error
+}
+
+// HTTPFleetLock is a FleetLock speaking the FleetLock protocol of Zincati,
+// served by Airlock or by go-selfupdate serve -fleet-lock-slots
+type HTTPFleetLock struct {
+	URL    string       // base URL of the lock server
+	Group  string       // Optional, group of installations sharing the slots, default when empty
+	Client *http.Client // Optional, http.DefaultClient when nil
+}
+
+func (l *HTTPFleetLock) Lock(ctx context.Context, id string) error {
+	return l.post(ctx, "/v1/pre-reboot", id)
+}
+
+func (l *HTTPFleetLock) Unlock(ctx context.Context, id string) error {
+	return l.post(ctx, "/v1/steady-state", id)
+}
+
+func (l *HTTPFleetLock) post(ctx context.Context, endpoint, id string) error {
+	group := l.Group
+	if group == "" {
+		group = "default"
+	}
+	body, err := json.Marshal(map[string]any{"client_params": map[string]string{"id": id, "group": group}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(l.URL, "/")+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("fleet-lock-protocol", "true")
+	client := l.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	var reply struct{ Kind, Value string }
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if json.Unmarshal(msg, &reply) == nil && reply.Value != "" {
+		msg = []byte(reply.Value)
+	}
+	if endpoint == "/v1/pre-reboot" && resp.StatusCode != http.StatusBadRequest {
+		return fmt.Errorf("%w: %s: %s", ErrFleetBusy, resp.Status, bytes.TrimSpace(msg))
+	}
+	return fmt.Errorf("fleet lock %s: %s: %s", endpoint, resp.Status, bytes.TrimSpace(msg))
+}
+
+// installationID identifies this installation for staged rollouts and the
+// fleet lock
+func (u *Updater) installationID() string {
+	if u.RolloutID != "" {
+		return u.RolloutID
+	}
+	id, _ := os.Hostname()
+	return id
+}
+
+// lockFleet takes a slot of the FleetLock, recording it in Status so that it
+// is released once the new version runs
+func (u *Updater) lockFleet() error {
+	if u.FleetLock == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fleetLockTimeout)
+	defer cancel()
+	if err := u.FleetLock.Lock(ctx, u.installationID()); err != nil {
+		return err
+	}
+	u.recordStatus(func(s *Status) { s.FleetLocked = true })
+	return nil
+}
+
+// unlockFleet releases the slot of the FleetLock recorded in Status
+func (u *Updater) unlockFleet(ctx context.Context) error {
+	if u.FleetLock == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, fleetLockTimeout)
+	defer cancel()
+	if err := u.FleetLock.Unlock(ctx, u.installationID()); err != nil {
+		return fmt.Errorf("failed to release fleet lock: %w", err)
+	}
+	u.recordStatus(func(s *Status) { s.FleetLocked = false })
+	return nil
+}
+
+// releaseFleet releases the slot taken to apply the update that is now
+// running. A slot that cannot be released is retried on the next cycle.
+func (u *Updater) releaseFleet(ctx context.Context) {
+	if u.FleetLock == nil {
+		return
+	}
+	if s := readStatus(u.statusPath()); !s.FleetLocked || s.LastVersion != u.CurrentVersion {
+		return
+	}
+	if err := u.unlockFleet(ctx); err != nil {
+		slog.Warn("keeping fleet lock slot", "error", err)
+	}
+}
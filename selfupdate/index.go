@@ -0,0 +1,193 @@
+package selfupdate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"time"
+)
+
+// IndexFile is the name of the index of an update tree, next to the stable
+// channel manifests
+const IndexFile = "index.json"
+
+// Index lists every version published to each channel of an update tree,
+// newest first. Unlike the channel manifests, which only point at the latest
+// version, it keeps the history needed for rollbacks and dashboards.
+type Index struct {
+	Channels map[string][]IndexRelease
+
+	// Yanked lists the versions withdrawn because they were bad, which
+	// are never published again
+	Yanked []string `json:",omitempty"`
+}
+
+// IndexRelease is one version published to a channel
+type IndexRelease struct {
+	Version   string
+	Date      time.Time
+	Platforms map[string]IndexArtifact
+}
+
+// IndexArtifact holds the digests of the binary of one platform
+type IndexArtifact struct {
+	Sha256      []byte `json:",omitempty"`
+	Sha512      []byte `json:",omitempty"`
+	Compression string `json:",omitempty"`
+	Archive     string `json:",omitempty"`
+	Executable  string `json:",omitempty"`
+	Encryption  string `json:",omitempty"`
+	Size        int64  `json:",omitempty"`
+	MinDisk     int64  `json:",omitempty"`
+	MinMemory   int64  `json:",omitempty"`
+}
+
+// Add records the manifest info of platform in the channel named by info
+func (idx *Index) Add(platform string, info UpdateInfo) {
+	if idx.Channels == nil {
+		idx.Channels = map[string][]IndexRelease{}
+	}
+	channel := info.Channel
+	if channel == "" {
+		channel = stableChannel
+	}
+	artifact := IndexArtifact{
+		Sha256:      info.Sha256,
+		Sha512:      info.Sha512,
+		Compression: info.Compression,
+		Archive:     info.Archive,
+		Executable:  info.Executable,
+		Encryption:  info.Encryption,
+		Size:        info.Size,
+		MinDisk:     info.MinDisk,
+		MinMemory:   info.MinMemory,
+	}
+
+	releases := idx.Channels[channel]
+	for i := range releases {
+		if releases[i].Version == info.Version {
+			if releases[i].Platforms == nil {
+				releases[i].Platforms = map[string]IndexArtifact{}
+			}
+			releases[i].Platforms[platform] = artifact
+			return
+		}
+	}
+	release := IndexRelease{
+		Version:   info.Version,
+		Date:      info.Date.UTC(),
+		Platforms: map[string]IndexArtifact{platform: artifact},
+	}
+	idx.Channels[channel] = append([]IndexRelease{release}, releases...)
+}
+
+// Remove drops version from every channel
+func (idx *Index) Remove(version string) {
+	for channel, releases := range idx.Channels {
+		kept := releases[:0]
+		for _, r := range releases {
+			if r.Version != version {
+				kept = append(kept, r)
+			}
+		}
+		if len(kept) == 0 {
+			delete(idx.Channels, channel)
+		} else {
+			idx.Channels[channel] = kept
+		}
+	}
+}
+
+// Yank drops version from every channel and records it as yanked
+func (idx *Index) Yank(version string) {
+	idx.Remove(version)
+	if !idx.IsYanked(version) {
+		idx.Yanked = append(idx.Yanked, version)
+	}
+}
+
+// IsYanked reports whether version was yanked
+func (idx *Index) IsYanked(version string) bool {
+	return slices.Contains(idx.Yanked, version)
+}
+
+// Releases returns the versions published to channel for the running
+// platform, newest first
+func (idx *Index) Releases(channel string) []IndexRelease {
+	if channel == "" {
+		channel = stableChannel
+	}
+	var releases []IndexRelease
+	for _, r := range idx.Channels[channel] {
+		if _, ok := r.Platforms[platform]; ok {
+			releases = append(releases, r)
+		}
+	}
+	return releases
+}
+
+// Info returns the manifest of platform for the release as it was
+// published to channel
+func (r IndexRelease) Info(channel, platform string) UpdateInfo {
+	a := r.Platforms[platform]
+	return UpdateInfo{
+		Version:     r.Version,
+		Sha256:      a.Sha256,
+		Sha512:      a.Sha512,
+		Channel:     channel,
+		Date:        r.Date,
+		Compression: a.Compression,
+		Archive:     a.Archive,
+		Executable:  a.Executable,
+		Encryption:  a.Encryption,
+		Size:        a.Size,
+		MinDisk:     a.MinDisk,
+		MinMemory:   a.MinMemory,
+	}
+}
+
+// AvailableVersions returns the versions published to the channel of u for
+// the running platform, newest first, read from the index of the update
+// tree. Yanked versions are not listed. Any of them can be installed with
+// UpdateTo, for "roll back to 1.8.3" flows.
+func (u *Updater) AvailableVersions(ctx context.Context) ([]UpdateInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	idx, err := u.FetchIndex()
+	if err != nil {
+		return nil, err
+	}
+	channel := u.Channel
+	if channel == "" {
+		channel = stableChannel
+	}
+	var versions []UpdateInfo
+	for _, r := range idx.Releases(channel) {
+		if !idx.IsYanked(r.Version) {
+			versions = append(versions, r.Info(channel, platform))
+		}
+	}
+	return versions, nil
+}
+
+// FetchIndex downloads the index of the update tree of u.CmdName
+func (u *Updater) FetchIndex() (*Index, error) {
+	indexURL, err := joinURL(u.ApiURL, path.Join(escapeSegments(u.CmdName), IndexFile))
+	if err != nil {
+		return nil, err
+	}
+	r, err := u.fetchManifest(indexURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch index: %w", err)
+	}
+	defer r.Close()
+
+	var idx Index
+	if err := json.NewDecoder(r).Decode(&idx); err != nil {
+		return nil, fmt.Errorf("failed to decode index: %w", err)
+	}
+	return &idx, nil
+}
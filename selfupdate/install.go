@@ -0,0 +1,116 @@
+package selfupdate
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// DefaultInstallDir returns where a binary named cmd installs itself for the
+// current user: %LOCALAPPDATA%\Programs\<cmd> on Windows, /usr/local/bin
+// when running as root elsewhere, and $XDG_BIN_HOME or ~/.local/bin
+// otherwise
+func DefaultInstallDir(cmd string) (string, error) {
+	if runtime.GOOS == "windows" {
+		local := os.Getenv("LOCALAPPDATA")
+		if local == "" {
+			return "", fmt.Errorf("LOCALAPPDATA is not set")
+		}
+		return filepath.Join(local, "Programs", cmd), nil
+	}
+	if os.Geteuid() == 0 {
+		return "/usr/local/bin", nil
+	}
+	if dir := os.Getenv("XDG_BIN_HOME"); dir != "" {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "bin"), nil
+}
+
+// IsDownloadLocation reports whether the binary at path sits where browsers
+// and archive tools leave files rather than where programs are installed:
+// the Downloads folder of the user, $XDG_DOWNLOAD_DIR, or the temporary
+// directory, which also holds the copies macOS runs quarantined apps from
+func IsDownloadLocation(path string) bool {
+	dir := filepath.Dir(path)
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	candidates := []string{os.TempDir(), os.Getenv("XDG_DOWNLOAD_DIR")}
+	if home, err := os.UserHomeDir(); err == nil {
+		candidates = append(candidates, filepath.Join(home, "Downloads"))
+	}
+	for _, c := range candidates {
+		if c == "" {
+			continue
+		}
+		if resolved, err := filepath.EvalSymlinks(c); err == nil {
+			c = resolved
+		}
+		if rel, err := filepath.Rel(c, dir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Install copies the binary of u into dir, such as DefaultInstallDir, and
+// returns the path of the copy, for a first run from a download location to
+// offer installing itself. The state of u, kept in Dir relative to the
+// binary, is carried over next to the copy so that the installed binary
+// picks up where this one left off. The downloaded binary is left in place.
+func (u *Updater) Install(dir string) (string, error) {
+	execPath, err := u.execPath()
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(dir, filepath.Base(execPath))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	unlock, err := lockTarget(target)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	src, err := os.Open(execPath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	bin, err := io.ReadAll(src)
+	if err != nil {
+		return "", err
+	}
+	newPath, err := writeStaged(target, bin)
+	if err == nil {
+		err = markOfTheWeb(newPath, u.ZoneID)
+	}
+	if err != nil {
+		os.Remove(newPath)
+		return "", fmt.Errorf("failed to install: %w", err)
+	}
+	if err := swapBinary(target, newPath); err != nil {
+		os.Remove(newPath)
+		return "", fmt.Errorf("failed to install: %w", err)
+	}
+
+	stateDir := filepath.Join(dir, u.Dir)
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return "", err
+	}
+	if b, err := os.ReadFile(u.statusPath()); err == nil {
+		if err := os.WriteFile(filepath.Join(stateDir, statusFile), b, 0644); err != nil {
+			return "", err
+		}
+	}
+	return target, nil
+}
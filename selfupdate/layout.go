@@ -0,0 +1,172 @@
+package selfupdate
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// DefaultBinLayout is where binaries are published below BinURL. Binaries
+// are shared by every channel, which only differ in their manifests.
+const DefaultBinLayout = "{{.Cmd}}/{{.Version}}/{{.Platform}}{{.Ext}}"
+
+// ManifestPath returns the slash separated path of the manifest of platform
+// in channel relative to the directory of an application. Stable manifests
+// sit at its top, other channels in a directory of their own. Clients and
+// the publish package both build manifest paths with it.
+func ManifestPath(channel, platform string) string {
+	if channel == "" || channel == stableChannel {
+		return platform + ".json"
+	}
+	return channel + "/" + platform + ".json"
+}
+
+// PatchPath returns the slash separated path of the patch of platform from
+// one version to another relative to the directory of an application
+func PatchPath(from, to, platform string) string {
+	return "patches/" + from + "/" + to + "/" + platform + ".patch"
+}
+
+// LayoutData holds the values a layout template can refer to
+type LayoutData struct {
+	Cmd      string
+	Channel  string // stable when no channel is set
+	Version  string
+	Platform string // os-arch
+	OS       string // GOOS, such as linux
+	Arch     string // GOARCH, such as amd64
+	Ext      string // extension of the compression or archive, such as .gz
+}
+
+// layoutData returns the values of a layout template for the version of cmd
+// in channel on platform
+func layoutData(cmd, channel, version, platform, ext string) LayoutData {
+	goos, goarch, _ := strings.Cut(platform, "-")
+	return LayoutData{Cmd: cmd, Channel: channel, Version: version, Platform: platform, OS: goos, Arch: goarch, Ext: ext}
+}
+
+// ExpandLayout renders the layout template for data into a slash separated
+// path relative to the base URL. The values of data are inserted as they
+// are, callers building URLs escape them first.
+func ExpandLayout(layout string, data LayoutData) (string, error) {
+	s, err := renderLayout(layout, data)
+	if err != nil {
+		return "", err
+	}
+	p := strings.TrimLeft(path.Clean("/"+s), "/")
+	if p == "" || strings.HasSuffix(s, "/") {
+		return "", fmt.Errorf("invalid layout %q: does not name a file", layout)
+	}
+	return p, nil
+}
+
+// escaped returns d with its values escaped as URL path segments, keeping
+// the slashes of Cmd
+func (d LayoutData) escaped() LayoutData {
+	return LayoutData{
+		Cmd:      escapeSegments(d.Cmd),
+		Channel:  escapeSegment(d.Channel),
+		Version:  escapeSegment(d.Version),
+		Platform: escapeSegment(d.Platform),
+		OS:       escapeSegment(d.OS),
+		Arch:     escapeSegment(d.Arch),
+		Ext:      d.Ext,
+	}
+}
+
+// expandURLTemplate renders the URL template tmpl for data, escaped first,
+// into an absolute URL
+func expandURLTemplate(tmpl string, data LayoutData) (string, error) {
+	s, err := renderLayout(tmpl, data.escaped())
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL template %q: %w", tmpl, err)
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return "", fmt.Errorf("invalid URL template %q: %s is not an absolute URL", tmpl, s)
+	}
+	return s, nil
+}
+
+func renderLayout(layout string, data LayoutData) (string, error) {
+	t, err := template.New("layout").Option("missingkey=error").Parse(layout)
+	if err != nil {
+		return "", fmt.Errorf("invalid layout: %w", err)
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("invalid layout: %w", err)
+	}
+	return b.String(), nil
+}
+
+// PluginsDir is the directory of an application holding the manifests of
+// its plugins and, in a directory per plugin, their artifacts and patches
+const PluginsDir = "plugins"
+
+// PluginCmd returns the command name plugin is published under, so that
+// its artifacts and patches follow the layout of an application in the
+// directory of plugin below PluginsDir of cmd
+func PluginCmd(cmd, plugin string) string {
+	return cmd + "/" + PluginsDir + "/" + plugin
+}
+
+// PluginManifestPath returns the slash separated path of the manifest of
+// the plugins for platform in channel relative to the directory of an
+// application. Its file name sets it apart from the directories of the
+// plugins, which may be named like channels.
+func PluginManifestPath(channel, platform string) string {
+	return PluginsDir + "/" + ManifestPath(channel, platform+".plugins")
+}
+
+// escapeSegments escapes each slash separated segment of p for use in a URL
+// path, so that command names such as those of plugins keep their slashes
+func escapeSegments(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = escapeSegment(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// escapeSegment escapes s as a single segment of a URL path. Slashes become
+// %2F, plus signs %2B as S3 and CloudFront read a literal + as a space, and
+// the dot segments . and .. are escaped so that neither path.Clean nor the
+// server resolves them.
+func escapeSegment(s string) string {
+	switch s {
+	case ".":
+		return "%2E"
+	case "..":
+		return "%2E%2E"
+	}
+	return strings.ReplaceAll(url.PathEscape(s), "+", "%2B")
+}
+
+// joinURL appends the escaped slash separated path p to the path of base,
+// keeping the query of base, such as the signature of a presigned prefix
+func joinURL(base, p string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("invalid base URL: %w", err)
+	}
+	raw := strings.TrimSuffix(u.EscapedPath(), "/") + "/" + p
+	if u.Path, err = url.PathUnescape(raw); err != nil {
+		return "", fmt.Errorf("invalid URL path %q: %w", raw, err)
+	}
+	u.RawPath = raw
+	return u.String(), nil
+}
+
+// withSuffix appends suffix to the path of rawURL, before its query
+func withSuffix(rawURL, suffix string) string {
+	if i := strings.IndexAny(rawURL, "?#"); i >= 0 {
+		return rawURL[:i] + suffix + rawURL[i:]
+	}
+	return rawURL + suffix
+}
@@ -0,0 +1,217 @@
+package selfupdate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// ErrManagedInstall is wrapped by a ManagedInstallError
+var ErrManagedInstall = errors.New("binary is managed by a package manager")
+
+// ostreeBooted exists on systems booted from an OSTree deployment, such as
+// Fedora Silverblue and CoreOS, whose /usr is read-only
+var ostreeBooted = "/run/ostree-booted"
+
+// ManagedInstallError is returned instead of updating a binary installed by a
+// package manager, whose files are read-only or would get out of sync with
+// what the package manager installed. The update is skipped before anything
+// is downloaded, so the application can tell the user to run Command.
+type ManagedInstallError struct {
+	Manager string   // nix, snap, flatpak, brew, scoop, winget, rpm-ostree, or dpkg and rpm with Updater.QueryPackageDB
+	Package string   // name of the package, when it can be told from the path
+	Command string   // command updating the package
+	Path    string   // the binary
+	Args    []string // Command to run with Updater.UsePackageManager, nil for package managers that need root or a reboot
+}
+
+func (e *ManagedInstallError) Error() string {
+	return fmt.Sprintf("%v: %s is installed by %s, update it with %s", ErrManagedInstall, e.Path, e.Manager, e.Command)
+}
+
+func (e *ManagedInstallError) Unwrap() error {
+	return ErrManagedInstall
+}
+
+// ManagedInstall returns the ManagedInstallError for the binary of u when it
+// was installed by a package manager, and nil when it updates itself. With
+// QueryPackageDB it also reports binaries owned by a dpkg or rpm package,
+// even when OverwritePackaged lets Update replace them.
+func (u *Updater) ManagedInstall() (*ManagedInstallError, error) {
+	execPath, err := u.execPath()
+	if err != nil {
+		return nil, err
+	}
+	return u.managedInstall(context.Background(), execPath), nil
+}
+
+// checkManaged returns the ManagedInstallError keeping the binary at
+// execPath from being replaced, or nil
+func (u *Updater) checkManaged(ctx context.Context, execPath string) error {
+	managed := u.managedInstall(ctx, execPath)
+	if managed == nil {
+		return nil
+	}
+	if u.overwrites(managed) {
+		slog.Warn("replacing a file owned by a package", "path", execPath, "manager", managed.Manager, "package", managed.Package)
+		return nil
+	}
+	return managed
+}
+
+// overwrites reports whether the updater replaces the binary of managed
+// anyway, as OverwritePackaged does for dpkg and rpm
+func (u *Updater) overwrites(managed *ManagedInstallError) bool {
+	return u.OverwritePackaged && (managed.Manager == "dpkg" || managed.Manager == "rpm")
+}
+
+// managedInstall detects the package manager of the binary at execPath
+// from its location, and with QueryPackageDB from the dpkg and rpm databases
+func (u *Updater) managedInstall(ctx context.Context, execPath string) *ManagedInstallError {
+	if managed := detectManagedInstall(execPath); managed != nil {
+		return managed
+	}
+	if !u.QueryPackageDB || runtime.GOOS != "linux" {
+		return nil
+	}
+	return queryPackageOwner(ctx, execPath)
+}
+
+// queryPackageOwner asks dpkg, then rpm, which package installed the file
+// at execPath. Either failing, such as when it is not installed or the file
+// is not owned by any package, is taken as the file not being owned.
+func queryPackageOwner(ctx context.Context, execPath string) *ManagedInstallError {
+	if out, err := runCommand(ctx, "dpkg-query", "-S", execPath); err == nil {
+		if pkg := parseDpkgOwner(string(out)); pkg != "" {
+			return &ManagedInstallError{Manager: "dpkg", Package: pkg, Command: "apt-get install --only-upgrade " + pkg, Path: execPath}
+		}
+	}
+	if out, err := runCommand(ctx, "rpm", "-qf", "--queryformat", "%{NAME}\\n", execPath); err == nil {
+		if pkg, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n"); pkg != "" {
+			return &ManagedInstallError{Manager: "rpm", Package: pkg, Command: "dnf upgrade " + pkg, Path: execPath}
+		}
+	}
+	return nil
+}
+
+// parseDpkgOwner reads the output of dpkg-query -S, such as
+// "myapp:amd64: /usr/bin/myapp", returning the first package listed and
+// skipping the lines of diversions
+func parseDpkgOwner(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "diversion by ") {
+			continue
+		}
+		pkgs, _, ok := strings.Cut(line, ": ")
+		if !ok {
+			continue
+		}
+		pkg, _, _ := strings.Cut(pkgs, ", ")
+		pkg, _, _ = strings.Cut(pkg, ":")
+		return strings.TrimSpace(pkg)
+	}
+	return ""
+}
+
+// detectManagedInstall tells the package manager of the binary at execPath,
+// with symlinks resolved, from where the known package managers install
+// binaries
+func detectManagedInstall(execPath string) *ManagedInstallError {
+	path := filepath.ToSlash(execPath)
+	managed := func(manager, pkg, command string) *ManagedInstallError {
+		return &ManagedInstallError{Manager: manager, Package: pkg, Command: strings.TrimSpace(command + " " + pkg), Path: execPath}
+	}
+	delegated := func(manager, pkg string, args ...string) *ManagedInstallError {
+		m := managed(manager, pkg, strings.Join(args, " "))
+		if pkg != "" {
+			m.Args = append(args, pkg)
+		}
+		return m
+	}
+	switch {
+	case strings.HasPrefix(path, "/nix/store/"):
+		return managed("nix", "", "nix profile upgrade")
+	case strings.HasPrefix(path, "/snap/"):
+		return managed("snap", pathSegmentAfter(path, "/snap/"), "snap refresh")
+	case os.Getenv("FLATPAK_ID") != "" && strings.HasPrefix(path, "/app/"):
+		return managed("flatpak", os.Getenv("FLATPAK_ID"), "flatpak update")
+	case strings.Contains(path, "/flatpak/app/"):
+		return managed("flatpak", pathSegmentAfter(path, "/flatpak/app/"), "flatpak update")
+	case strings.Contains(path, "/Cellar/"):
+		return delegated("brew", pathSegmentAfter(path, "/Cellar/"), "brew", "upgrade")
+	case strings.Contains(path, "/Caskroom/"):
+		return delegated("brew", pathSegmentAfter(path, "/Caskroom/"), "brew", "upgrade", "--cask")
+	case containsFold(path, "/scoop/apps/"):
+		return delegated("scoop", pathSegmentAfter(path, "/scoop/apps/"), "scoop", "update")
+	case containsFold(path, "/Microsoft/WinGet/Packages/"):
+		// package directories are named <id>_<source>
+		id, _, _ := strings.Cut(pathSegmentAfter(path, "/Microsoft/WinGet/Packages/"), "_")
+		return delegated("winget", id, "winget", "upgrade", "--silent", "--accept-source-agreements", "--accept-package-agreements", "--id")
+	case strings.HasPrefix(path, "/usr/") && !strings.HasPrefix(path, "/usr/local/"):
+		if _, err := os.Stat(ostreeBooted); err == nil {
+			return managed("rpm-ostree", "", "rpm-ostree upgrade")
+		}
+	}
+	return nil
+}
+
+// pathSegmentAfter returns the path segment following the first occurrence
+// of dir in path, matched case insensitively as Windows paths are, such as
+// the formula of a Homebrew Cellar path
+func pathSegmentAfter(path, dir string) string {
+	i := indexFold(path, dir)
+	if i < 0 {
+		return ""
+	}
+	segment, _, _ := strings.Cut(path[i+len(dir):], "/")
+	return segment
+}
+
+func containsFold(path, dir string) bool {
+	return indexFold(path, dir) >= 0
+}
+
+func indexFold(s, substr string) int {
+	for i := 0; i+len(substr) <= len(s); i++ {
+		if strings.EqualFold(s[i:i+len(substr)], substr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// packageManagerTimeout bounds how long a delegated package manager may run
+const packageManagerTimeout = 30 * time.Minute
+
+// runPackageManager runs the command updating a managed install
+var runPackageManager = func(ctx context.Context, args []string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, packageManagerTimeout)
+	defer cancel()
+	return exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+}
+
+// delegate updates a managed install with its package manager, recording
+// the update as if the binary had been swapped by the updater
+func (u *Updater) delegate(ctx context.Context, managed *ManagedInstallError) error {
+	slog.Info("updating with package manager", "version", u.Info.Version, "command", managed.Command)
+	if out, err := runPackageManager(ctx, managed.Args); err != nil {
+		return fmt.Errorf("%s failed: %w: %s", managed.Command, err, bytes.TrimSpace(out))
+	}
+	u.recordStatus(func(st *Status) {
+		st.PreviousVersion = u.CurrentVersion
+		st.LastVersion = u.Info.Version
+		st.LastApplied = time.Now()
+	})
+	if u.OnSuccessfulUpdate != nil {
+		u.OnSuccessfulUpdate()
+	}
+	return nil
+}
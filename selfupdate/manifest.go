@@ -0,0 +1,146 @@
+package selfupdate
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// MaxManifestSize bounds how much of a manifest DecodeManifest reads.
+// Manifests are small, embedded release notes are limited to 64 KiB.
+const MaxManifestSize = 1 << 20
+
+// ErrInvalidManifest is wrapped by the errors of DecodeManifest
+var ErrInvalidManifest = errors.New("invalid manifest")
+
+// manifestFields maps the JSON names of the UpdateInfo fields to their index
+var manifestFields = func() map[string]int {
+	fields := map[string]int{}
+	t := reflect.TypeOf(UpdateInfo{})
+	for i := 0; i < t.NumField(); i++ {
+		fields[t.Field(i).Name] = i
+	}
+	return fields
+}()
+
+// manifestNames are the names of the UpdateInfo fields by index
+var manifestNames = func() []string {
+	t := reflect.TypeOf(UpdateInfo{})
+	names := make([]string, t.NumField())
+	for i := range names {
+		names[i] = t.Field(i).Name
+	}
+	return names
+}()
+
+// DecodeManifest reads a manifest from untrusted input. It reads at most
+// MaxManifestSize bytes, names the field of any malformed value, and takes
+// the Sha256 and Sha512 digests in base64, as go-selfupdate writes them, or
+// in hex, as other release tools do. Unknown fields are ignored so that
+// clients keep reading manifests written by newer versions, unless strict
+// is set.
+func DecodeManifest(r io.Reader, strict bool) (*UpdateInfo, error) {
+	buf := manifestBuffers.Get().(*bytes.Buffer)
+	defer releaseBuffer(buf)
+	buf.Reset()
+	if _, err := buf.ReadFrom(io.LimitReader(r, MaxManifestSize+1)); err != nil {
+		return nil, err
+	}
+	b := buf.Bytes()
+	if len(b) > MaxManifestSize {
+		return nil, fmt.Errorf("%w: larger than %d bytes", ErrInvalidManifest, MaxManifestSize)
+	}
+	// the values decoded are copies, so b can be reused once this returns
+	info := new(UpdateInfo)
+	if scanManifest(b, strict, info) {
+		return info, nil
+	}
+	return decodeManifest(b, strict)
+}
+
+// manifestBuffers holds the buffers manifests are read into, since every
+// update check reads one
+var manifestBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// maxPooledBuffer is the largest buffer kept for the next manifest, so that
+// one manifest with long release notes does not pin its buffer forever
+const maxPooledBuffer = 64 << 10
+
+func releaseBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		manifestBuffers.Put(buf)
+	}
+}
+
+// decodeManifest decodes b field by field with encoding/json, naming the
+// field of a malformed value
+func decodeManifest(b []byte, strict bool) (*UpdateInfo, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+
+	var info UpdateInfo
+	v := reflect.ValueOf(&info).Elem()
+	for name, value := range raw {
+		i, ok := manifestFields[name]
+		if !ok {
+			// encoding/json matches names case insensitively
+			for field, j := range manifestFields {
+				if strings.EqualFold(field, name) {
+					i, ok = j, true
+				}
+			}
+		}
+		if !ok {
+			if strict {
+				return nil, fmt.Errorf("%w: unknown field %s", ErrInvalidManifest, name)
+			}
+			continue
+		}
+		field := manifestNames[i]
+		if field == "Sha256" || field == "Sha512" {
+			var err error
+			if value, err = normalizeDigest(value); err != nil {
+				return nil, fmt.Errorf("%w: %s: %v", ErrInvalidManifest, field, err)
+			}
+		}
+		if err := json.Unmarshal(value, v.Field(i).Addr().Interface()); err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				err = fmt.Errorf("expected %s, got %s", typeErr.Type, typeErr.Value)
+			}
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidManifest, field, err)
+		}
+	}
+	return &info, nil
+}
+
+// normalizeDigest turns a hex encoded SHA256 or SHA512 digest into the
+// base64 JSON string encoding/json expects for []byte. Hex digests are told
+// apart by their length, 64 or 128 hex digits, which base64 encodings of
+// these digests never have.
+func normalizeDigest(value json.RawMessage) (json.RawMessage, error) {
+	var s string
+	if err := json.Unmarshal(value, &s); err != nil {
+		return value, nil // null, or a type error reported by the caller
+	}
+	if len(s) == 64 || len(s) == 128 {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex digest %q", s)
+		}
+		return json.Marshal(b)
+	}
+	if _, err := base64.StdEncoding.DecodeString(s); err != nil {
+		return nil, fmt.Errorf("digest %q is neither base64 nor hex", s)
+	}
+	return value, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd
+
+package selfupdate
+
+import (
+	"errors"
+	"os"
+)
+
+func mapFile(f *os.File, size int64) ([]byte, func() error, error) {
+	return nil, nil, errors.ErrUnsupported
+}
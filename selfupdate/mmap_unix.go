@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd
+
+package selfupdate
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the size bytes of f read-only, returning the function
+// unmapping them
+func mapFile(f *os.File, size int64) ([]byte, func() error, error) {
+	if size == 0 || int64(int(size)) != size {
+		return nil, nil, syscall.EINVAL
+	}
+	b, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, func() error { return syscall.Munmap(b) }, nil
+}
@@ -0,0 +1,28 @@
+package selfupdate
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// zoneIdentifier is the NTFS alternate data stream holding the Mark of the
+// Web, which makes SmartScreen and Office treat a file as downloaded
+const zoneIdentifier = ":Zone.Identifier"
+
+// markOfTheWeb sets the Mark of the Web of the binary at path on Windows to
+// the URL zone, such as 3 for the internet, or removes it when zone is 0 so
+// that the next launch of an updated binary does not prompt the user. File
+// systems without alternate data streams, such as FAT, carry no mark.
+var markOfTheWeb = func(path string, zone int) error {
+	if runtime.GOOS != "windows" {
+		return nil
+	}
+	if zone == 0 {
+		if err := os.Remove(path + zoneIdentifier); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(path+zoneIdentifier, []byte(fmt.Sprintf("[ZoneTransfer]\r\nZoneId=%d\r\n", zone)), 0644)
+}
@@ -0,0 +1,208 @@
+package selfupdate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// pluginVersionsFile records the installed version of each plugin in the
+// plugin directory
+const pluginVersionsFile = ".plugins.json"
+
+// ErrUnknownPlugin is returned for a plugin missing from the plugin manifest
+var ErrUnknownPlugin = errors.New("plugin not in manifest")
+
+// PluginUpdater keeps a directory of plugin binaries or shared objects up to
+// date against the plugin manifest of an application, published at
+// PluginManifestPath. Every plugin is downloaded, verified and swapped in
+// the way the application binary is, from the tree of PluginCmd.
+type PluginUpdater struct {
+	App     *Updater // application the plugins belong to, whose URLs, channel, keys and requester are used
+	Dir     string   // directory the plugins are installed in, named as in the manifest
+	Plugins []string // Optional, plugins to install and keep up to date, every plugin of the manifest when empty
+}
+
+// Update installs or updates each plugin whose version differs from the
+// manifest. A plugin failing to update does not keep the others from
+// updating, the errors of all of them are returned together.
+func (p *PluginUpdater) Update(ctx context.Context) error {
+	manifest, err := p.fetchManifest()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(p.Dir, 0755); err != nil {
+		return err
+	}
+	installed, err := p.Installed()
+	if err != nil {
+		return err
+	}
+
+	names := p.Plugins
+	if len(names) == 0 {
+		for name := range manifest {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	var errs []error
+	for _, name := range names {
+		info, ok := manifest[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrUnknownPlugin, name))
+			continue
+		}
+		if info.Version == installed[name] {
+			continue
+		}
+		applied, err := p.update(ctx, name, installed[name], info)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("plugin %s: %w", name, err))
+			continue
+		}
+		if !applied {
+			continue
+		}
+		installed[name] = info.Version
+		if err := p.writeInstalled(installed); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Installed returns the version of each plugin installed in Dir
+func (p *PluginUpdater) Installed() (map[string]string, error) {
+	installed := map[string]string{}
+	b, err := os.ReadFile(filepath.Join(p.Dir, pluginVersionsFile))
+	if os.IsNotExist(err) {
+		return installed, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &installed); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", pluginVersionsFile, err)
+	}
+	return installed, nil
+}
+
+func (p *PluginUpdater) writeInstalled(installed map[string]string) error {
+	b, err := json.MarshalIndent(installed, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(p.Dir, pluginVersionsFile), b, 0644)
+}
+
+// fetchManifest reads the plugin manifest of the channel and platform of
+// the application, checking every entry like an application manifest
+func (p *PluginUpdater) fetchManifest() (map[string]UpdateInfo, error) {
+	app := p.App
+	channel := app.Channel
+	if channel == "" {
+		channel = stableChannel
+	}
+	manifestURL, err := joinURL(app.ApiURL, path.Join(escapeSegments(app.CmdName), PluginManifestPath(escapeSegment(channel), escapeSegment(platform))))
+	if err != nil {
+		return nil, err
+	}
+	r, err := app.fetchManifest(manifestURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch plugin manifest: %w", err)
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(io.LimitReader(r, MaxManifestSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch plugin manifest: %w", err)
+	}
+	if len(b) > MaxManifestSize {
+		return nil, fmt.Errorf("%w: larger than %d bytes", ErrInvalidManifest, MaxManifestSize)
+	}
+	var m struct{ Plugins map[string]json.RawMessage }
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+
+	manifest := map[string]UpdateInfo{}
+	for name, raw := range m.Plugins {
+		if !validPluginName(name) {
+			return nil, fmt.Errorf("%w: invalid plugin name %q", ErrInvalidManifest, name)
+		}
+		info, err := DecodeManifest(bytes.NewReader(raw), false)
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s: %w", name, err)
+		}
+		if err := app.validateInfo(*info, channel); err != nil {
+			return nil, fmt.Errorf("plugin %s: %w", name, err)
+		}
+		manifest[name] = *info
+	}
+	return manifest, nil
+}
+
+// update stages and swaps in version info of plugin name, currently at
+// version current or not installed when empty. It reports false when the
+// version is not rolled out to this installation yet.
+func (p *PluginUpdater) update(ctx context.Context, name, current string, info UpdateInfo) (bool, error) {
+	app := p.App
+	// the state of every plugin is kept below PluginsDir of the application
+	if err := makeStateDir(getExecRelativeDir(filepath.Join(app.Dir, PluginsDir))); err != nil {
+		return false, err
+	}
+	u := &Updater{
+		CurrentVersion:      current,
+		ApiURL:              app.ApiURL,
+		CmdName:             PluginCmd(app.CmdName, name),
+		BinURL:              app.BinURL,
+		BinLayout:           app.BinLayout,
+		ArtifactURLTemplate: app.ArtifactURLTemplate,
+		DiffURL:             app.DiffURL,
+		Dir:                 filepath.Join(app.Dir, PluginsDir, name),
+		Requester:           app.Requester,
+		Channel:             app.Channel,
+		Info:                info,
+		PublicKey:           app.PublicKey,
+		RolloutID:           app.RolloutID,
+		Identities:          app.Identities,
+		ExecPath:            filepath.Join(p.Dir, name),
+		UserAgent:           app.userAgent(),
+		CacheSize:           app.CacheSize,
+		CacheDir:            app.CacheDir,
+		AuthenticodeSigner:  app.AuthenticodeSigner,
+		ZoneID:              app.ZoneID,
+		ChannelPolicy:       app.ChannelPolicy,
+		UpstreamChannels:    app.UpstreamChannels,
+	}
+	unlock, err := lockTarget(u.ExecPath)
+	if err != nil {
+		return false, err
+	}
+	staged, err := u.stageInfo(ctx, u.ExecPath, false)
+	unlock()
+	if err != nil || staged == nil {
+		return false, err
+	}
+	if err := staged.Commit(); err != nil {
+		return false, err
+	}
+	slog.Info("plugin updated", "plugin", name, "version", info.Version)
+	return true, nil
+}
+
+// validPluginName reports whether name can be installed as a file of the
+// plugin directory
+func validPluginName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`) && filepath.Base(name) == name
+}
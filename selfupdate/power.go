@@ -0,0 +1,113 @@
+package selfupdate
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// powerSupplyDir is where Linux lists batteries and AC adapters
+var powerSupplyDir = "/sys/class/power_supply"
+
+// CheckPower returns a Precheck failing with ErrOnBattery while the machine
+// runs on battery charged below minPercent, so an update is not interrupted
+// by the laptop going to sleep or shutting down halfway. The state is read
+// from sysfs on Linux, pmset on macOS and Win32_Battery on Windows; machines
+// without a battery, or whose state cannot be read, are never held back.
+func CheckPower(minPercent int) Precheck {
+	return func(ctx context.Context, u *Updater) error {
+		onBattery, percent, ok := batteryState(ctx)
+		if ok && onBattery && percent < minPercent {
+			return fmt.Errorf("%w: %d%%, updates wait for %d%% or AC power", ErrOnBattery, percent, minPercent)
+		}
+		return nil
+	}
+}
+
+// batteryState reports whether the machine draws from its battery and how
+// much charge is left
+func batteryState(ctx context.Context) (onBattery bool, percent int, ok bool) {
+	switch runtime.GOOS {
+	case "linux":
+		return linuxBatteryState(powerSupplyDir)
+	case "darwin":
+		out, err := runCommand(ctx, "pmset", "-g", "batt")
+		if err != nil {
+			return false, 0, false
+		}
+		return parsePmset(string(out))
+	case "windows":
+		out, err := runCommand(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", windowsBatteryScript)
+		if err != nil {
+			return false, 0, false
+		}
+		return parseWindowsBattery(string(out))
+	}
+	return false, 0, false
+}
+
+// linuxBatteryState reads the batteries in dir, on battery when one of
+// them is discharging, with the charge of the least charged one
+func linuxBatteryState(dir string) (onBattery bool, percent int, ok bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, 0, false
+	}
+	read := func(supply, name string) string {
+		b, _ := os.ReadFile(filepath.Join(dir, supply, name))
+		return strings.TrimSpace(string(b))
+	}
+	percent = 100
+	for _, e := range entries {
+		if read(e.Name(), "type") != "Battery" {
+			continue
+		}
+		capacity, err := strconv.Atoi(read(e.Name(), "capacity"))
+		if err != nil {
+			continue
+		}
+		ok = true
+		percent = min(percent, capacity)
+		if read(e.Name(), "status") == "Discharging" {
+			onBattery = true
+		}
+	}
+	return onBattery, percent, ok
+}
+
+var pmsetPercent = regexp.MustCompile(`(\d+)%`)
+
+// parsePmset reads the output of pmset -g batt, such as
+//
+//	Now drawing from 'Battery Power'
+//	 -InternalBattery-0 (id=4653155)	85%; discharging; 3:20 remaining present: true
+func parsePmset(out string) (onBattery bool, percent int, ok bool) {
+	m := pmsetPercent.FindStringSubmatch(out)
+	if m == nil {
+		return false, 0, false
+	}
+	percent, _ = strconv.Atoi(m[1])
+	return strings.Contains(out, "'Battery Power'"), percent, true
+}
+
+// windowsBatteryScript prints the BatteryStatus and charge of the first
+// battery, where status 1 means discharging
+const windowsBatteryScript = `$b = Get-CimInstance Win32_Battery | Select-Object -First 1
+if ($b) { "$($b.BatteryStatus) $($b.EstimatedChargeRemaining)" }`
+
+func parseWindowsBattery(out string) (onBattery bool, percent int, ok bool) {
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return false, 0, false
+	}
+	percent, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return false, 0, false
+	}
+	return fields[0] == "1", percent, true
+}
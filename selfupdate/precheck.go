@@ -0,0 +1,139 @@
+package selfupdate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrDeferred is wrapped by UpdateIfNeeded when a precheck failed and
+	// the update cycle was left for the next call
+	ErrDeferred  = errors.New("update deferred")
+	ErrOffline   = errors.New("update host unreachable")
+	ErrMetered   = errors.New("network connection is metered")
+	ErrOnBattery = errors.New("running on low battery")
+	// ErrDownloadDeclined is wrapped when Updater.OnConfirmDownload
+	// declined the download
+	ErrDownloadDeclined = errors.New("download declined")
+)
+
+// onlineTimeout bounds how long CheckOnline waits for the update host
+const onlineTimeout = 5 * time.Second
+
+// Precheck decides whether the conditions allow an update cycle to run now.
+// When one of Updater.Prechecks returns an error, UpdateIfNeeded returns it
+// wrapped in ErrDeferred without downloading anything or moving the next
+// scheduled check, so the next call tries again.
+type Precheck func(ctx context.Context, u *Updater) error
+
+// CheckOnline is a Precheck failing with ErrOffline when no connection to
+// the host of the manifest URL can be opened, such as when the machine has
+// no network at all
+func CheckOnline(ctx context.Context, u *Updater) error {
+	manifestURL, err := u.manifestURL(u.Channel)
+	if err != nil {
+		return err
+	}
+	addr, err := hostAddr(manifestURL)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, onlineTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrOffline, err)
+	}
+	return conn.Close()
+}
+
+// CheckUnmetered is a Precheck failing with ErrMetered when the operating
+// system reports the connection as metered: the cost of the internet
+// connection profile on Windows, and the Metered property of NetworkManager
+// on Linux. macOS does not expose it without cgo, so there and whenever the
+// state cannot be read the connection is taken as unmetered.
+func CheckUnmetered(ctx context.Context, u *Updater) error {
+	var metered bool
+	switch runtime.GOOS {
+	case "windows":
+		out, err := runCommand(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", windowsCostScript)
+		if err != nil {
+			return nil
+		}
+		metered = parseWindowsCost(string(out))
+	case "linux":
+		out, err := runCommand(ctx, "busctl", "get-property", "org.freedesktop.NetworkManager",
+			"/org/freedesktop/NetworkManager", "org.freedesktop.NetworkManager", "Metered")
+		if err != nil {
+			return nil
+		}
+		metered = parseNetworkManagerMetered(string(out))
+	}
+	if metered {
+		return ErrMetered
+	}
+	return nil
+}
+
+// windowsCostScript prints the cost type of the internet connection profile
+// followed by whether it is roaming and over its data limit
+const windowsCostScript = `[void][Windows.Networking.Connectivity.NetworkInformation,Windows.Networking.Connectivity,ContentType=WindowsRuntime]
+$p = [Windows.Networking.Connectivity.NetworkInformation]::GetInternetConnectionProfile()
+if ($p) { $c = $p.GetConnectionCost(); "$($c.NetworkCostType) $($c.Roaming) $($c.OverDataLimit)" }`
+
+// runCommand runs a platform tool and returns its output
+var runCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, onlineTimeout)
+	defer cancel()
+	return exec.CommandContext(ctx, name, args...).Output()
+}
+
+// parseWindowsCost reads the output of windowsCostScript. Fixed and Variable
+// cost types are billed by the amount of data.
+func parseWindowsCost(out string) bool {
+	fields := strings.Fields(out)
+	if len(fields) != 3 {
+		return false
+	}
+	return fields[0] == "Fixed" || fields[0] == "Variable" ||
+		strings.EqualFold(fields[1], "True") || strings.EqualFold(fields[2], "True")
+}
+
+// parseNetworkManagerMetered reads the NMMetered value printed by busctl,
+// such as "u 1": 1 is yes and 3 is guessed yes, as for a phone hotspot
+func parseNetworkManagerMetered(out string) bool {
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return false
+	}
+	v, err := strconv.Atoi(fields[1])
+	return err == nil && (v == 1 || v == 3)
+}
+
+// hostAddr returns the host:port to dial for rawURL
+func hostAddr(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("no host in %q", rawURL)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
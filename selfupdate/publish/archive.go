@@ -0,0 +1,142 @@
+package publish
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bobo/go-selfupdate/internal/archive"
+	compress "github.com/bobo/go-selfupdate/internal/compression"
+	"github.com/bobo/go-selfupdate/selfupdate"
+)
+
+// Asset is an extra file, such as a LICENSE or shell completions, bundled
+// into every archive of a release
+type Asset struct {
+	Name string // slash separated path inside the archive
+	Path string
+}
+
+// artifactFormats are the compressions and archive formats artifacts are
+// stored in, longest extension first so that .tar.gz is not taken for .gz
+var artifactFormats = []string{archive.TarGz, archive.Zip, compress.Gzip, compress.Zstd, compress.Xz}
+
+// ArtifactFormat returns the compression or archive format of the artifact
+// info refers to
+func ArtifactFormat(info *selfupdate.UpdateInfo) string {
+	switch {
+	case info.Archive != "":
+		return info.Archive
+	case info.Compression == "":
+		return compress.Gzip
+	}
+	return info.Compression
+}
+
+// FormatExtension returns the file extension of artifacts in format, a
+// compression or an archive format
+func FormatExtension(format string) (string, error) {
+	if ext, err := archive.Extension(format); err == nil {
+		return ext, nil
+	}
+	return compress.Extension(format)
+}
+
+// FormatContentType returns the media type of artifacts in format
+func FormatContentType(format string) string {
+	if archive.Validate(format) == nil {
+		return archive.ContentType(format)
+	}
+	return compress.ContentType(format)
+}
+
+// ParseArtifactName splits the file name of an artifact into its platform
+// and format
+func ParseArtifactName(name string) (platform, format string, ok bool) {
+	for _, f := range artifactFormats {
+		ext, _ := FormatExtension(f)
+		if p, found := strings.CutSuffix(name, ext); found && p != "" {
+			return p, f, true
+		}
+	}
+	return "", "", false
+}
+
+// ReadArtifact returns the binary in an artifact stored in format. For
+// archives it is the member called executable, or the first member when
+// executable is empty. Encrypted artifacts fail with ErrEncrypted, see
+// DecryptArtifact.
+func ReadArtifact(r io.Reader, format, executable string) ([]byte, error) {
+	r, err := DecryptArtifact(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	if archive.Validate(format) == nil {
+		return archive.Extract(r, format, executable)
+	}
+	return DecompressArtifact(r, format)
+}
+
+// ExecutableName returns the name of the binary called name inside the
+// archive of platform, adding the .exe suffix Windows requires
+func ExecutableName(name, platform string) string {
+	if strings.HasPrefix(platform, "windows-") && !strings.HasSuffix(name, ".exe") {
+		return name + ".exe"
+	}
+	return name
+}
+
+// archiveArtifact writes an archive in format to w holding the binary at
+// binPath as exe followed by assets, computing the digests of the binary on
+// the way
+func archiveArtifact(w io.Writer, format, binPath, exe string, assets []Asset, date time.Time, level int) (sum256, sum512 []byte, err error) {
+	var files []archive.File
+	var closers []io.Closer
+	defer func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}()
+
+	h256, h512 := sha256.New(), sha512.New()
+	// members are 0755 or 0644 whatever the umask of the machine
+	// publishing, so archives stay reproducible
+	add := func(name, path string, executable bool) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		closers = append(closers, f)
+		var body io.Reader = f
+		mode := os.FileMode(0644)
+		if executable {
+			body, mode = io.TeeReader(f, io.MultiWriter(h256, h512)), 0755
+		} else if fi.Mode()&0111 != 0 {
+			mode = 0755
+		}
+		files = append(files, archive.File{Name: name, Mode: mode, Size: fi.Size(), Body: body})
+		return nil
+	}
+
+	if err := add(exe, binPath, true); err != nil {
+		return nil, nil, fmt.Errorf("failed to read binary: %w", err)
+	}
+	for _, a := range assets {
+		if err := add(a.Name, a.Path, false); err != nil {
+			return nil, nil, fmt.Errorf("failed to read asset: %w", err)
+		}
+	}
+	if err := archive.Write(w, format, date, level, files); err != nil {
+		return nil, nil, fmt.Errorf("failed to archive binary: %w", err)
+	}
+	return h256.Sum(nil), h512.Sum(nil), nil
+}
@@ -0,0 +1,242 @@
+package publish
+
+import (
+	"bytes"
+	"context"
+	"debug/buildinfo"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// SBOM formats
+const (
+	CycloneDX = "cyclonedx"
+	SPDX      = "spdx"
+)
+
+// File name suffixes of the attestations stored next to an artifact
+const (
+	cycloneDXSuffix  = ".cdx.json"
+	spdxSuffix       = ".spdx.json"
+	provenanceSuffix = ".intoto.json"
+)
+
+// DefaultBuilderID identifies go-selfupdate as the builder in provenance
+// statements when the release does not name one
+const DefaultBuilderID = "https://github.com/bobo/go-selfupdate"
+
+// AttestationMetadata is used for SBOMs and provenance statements, which
+// like artifacts never change once published
+var AttestationMetadata = Metadata{ContentType: "application/json", CacheControl: "public, max-age=31536000, immutable"}
+
+// ValidateSBOM returns an error if format is not a supported SBOM format
+func ValidateSBOM(format string) error {
+	switch format {
+	case CycloneDX, SPDX:
+		return nil
+	}
+	return fmt.Errorf("unsupported SBOM format %q, use cyclonedx or spdx", format)
+}
+
+// IsAttestation reports whether name is an SBOM or provenance statement
+// rather than a manifest
+func IsAttestation(name string) bool {
+	for _, suffix := range []string{cycloneDXSuffix, spdxSuffix, provenanceSuffix} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// attestationPath returns the path of an attestation with suffix stored next
+// to the artifact at name
+func attestationPath(name, format, suffix string) string {
+	ext, _ := FormatExtension(format)
+	return strings.TrimSuffix(name, ext) + suffix
+}
+
+// putSBOM describes the modules linked into the Go binary of a and
+// stores the SBOM next to the artifact at name, returning its path
+func putSBOM(ctx context.Context, backend Backend, r *Release, a Artifact, name, format string, date time.Time) (string, error) {
+	bi, err := buildinfo.ReadFile(a.Path)
+	if err != nil {
+		return "", fmt.Errorf("SBOMs need Go binaries with build information: %w", err)
+	}
+
+	var doc any
+	var suffix string
+	switch r.SBOM {
+	case CycloneDX:
+		doc, suffix = cycloneDXDocument(bi, r.Version, date), cycloneDXSuffix
+	case SPDX:
+		doc, suffix = spdxDocument(bi, r.Version, a.Platform, date), spdxSuffix
+	default:
+		return "", ValidateSBOM(r.SBOM)
+	}
+	sbomName := attestationPath(name, format, suffix)
+	return sbomName, putJSON(ctx, backend, sbomName, doc)
+}
+
+// putProvenance stores a SLSA provenance statement for the artifact at name
+// with the given SHA256, returning its path
+func putProvenance(ctx context.Context, backend Backend, r *Release, a Artifact, name, format string, artifactSum []byte, date time.Time) (string, error) {
+	builder := r.BuilderID
+	if builder == "" {
+		builder = DefaultBuilderID
+	}
+	type digest map[string]string
+	type resource struct {
+		Name   string `json:"name,omitempty"`
+		URI    string `json:"uri,omitempty"`
+		Digest digest `json:"digest"`
+	}
+
+	internal := map[string]string{}
+	var deps []resource
+	if bi, err := buildinfo.ReadFile(a.Path); err == nil {
+		internal["goVersion"] = bi.GoVersion
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" {
+				deps = append(deps, resource{URI: "git+" + bi.Main.Path, Digest: digest{"gitCommit": s.Value}})
+			}
+		}
+	}
+
+	statement := map[string]any{
+		"_type":         "https://in-toto.io/Statement/v1",
+		"subject":       []resource{{Name: name, Digest: digest{"sha256": hex.EncodeToString(artifactSum)}}},
+		"predicateType": "https://slsa.dev/provenance/v1",
+		"predicate": map[string]any{
+			"buildDefinition": map[string]any{
+				"buildType":            DefaultBuilderID + "/release@v1",
+				"externalParameters":   map[string]string{"version": r.Version, "platform": a.Platform},
+				"internalParameters":   internal,
+				"resolvedDependencies": deps,
+			},
+			"runDetails": map[string]any{
+				"builder":  map[string]string{"id": builder},
+				"metadata": map[string]string{"finishedOn": date.UTC().Format(time.RFC3339)},
+			},
+		},
+	}
+	provenanceName := attestationPath(name, format, provenanceSuffix)
+	return provenanceName, putJSON(ctx, backend, provenanceName, statement)
+}
+
+func putJSON(ctx context.Context, backend Backend, name string, v any) error {
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", name, err)
+	}
+	return backend.Put(ctx, name, bytes.NewReader(b), AttestationMetadata)
+}
+
+// goModules returns the main module of bi followed by its dependencies,
+// with replacements applied
+func goModules(bi *debug.BuildInfo) []debug.Module {
+	modules := []debug.Module{bi.Main}
+	for _, dep := range bi.Deps {
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		modules = append(modules, *dep)
+	}
+	return modules
+}
+
+func purl(m debug.Module) string {
+	if m.Version == "" || m.Version == "(devel)" {
+		return "pkg:golang/" + m.Path
+	}
+	return "pkg:golang/" + m.Path + "@" + m.Version
+}
+
+func cycloneDXDocument(bi *debug.BuildInfo, version string, date time.Time) any {
+	type component struct {
+		Type    string `json:"type"`
+		BOMRef  string `json:"bom-ref"`
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+		PURL    string `json:"purl"`
+	}
+	modules := goModules(bi)
+	app := component{Type: "application", BOMRef: purl(modules[0]), Name: modules[0].Path, Version: version, PURL: purl(modules[0])}
+	var components []component
+	var refs []string
+	for _, m := range modules[1:] {
+		components = append(components, component{Type: "library", BOMRef: purl(m), Name: m.Path, Version: m.Version, PURL: purl(m)})
+		refs = append(refs, purl(m))
+	}
+	return map[string]any{
+		"bomFormat":   "CycloneDX",
+		"specVersion": "1.5",
+		"version":     1,
+		"metadata": map[string]any{
+			"timestamp": date.UTC().Format(time.RFC3339),
+			"tools":     map[string]any{"components": []map[string]string{{"type": "application", "name": "go-selfupdate"}}},
+			"component": app,
+		},
+		"components":   components,
+		"dependencies": []map[string]any{{"ref": app.BOMRef, "dependsOn": refs}},
+	}
+}
+
+func spdxDocument(bi *debug.BuildInfo, version, platform string, date time.Time) any {
+	type externalRef struct {
+		Category string `json:"referenceCategory"`
+		Type     string `json:"referenceType"`
+		Locator  string `json:"referenceLocator"`
+	}
+	type pkg struct {
+		Name             string        `json:"name"`
+		SPDXID           string        `json:"SPDXID"`
+		VersionInfo      string        `json:"versionInfo,omitempty"`
+		DownloadLocation string        `json:"downloadLocation"`
+		ExternalRefs     []externalRef `json:"externalRefs"`
+	}
+	type relationship struct {
+		Element string `json:"spdxElementId"`
+		Type    string `json:"relationshipType"`
+		Related string `json:"relatedSpdxElement"`
+	}
+
+	modules := goModules(bi)
+	var packages []pkg
+	relationships := []relationship{{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Package-0"}}
+	for i, m := range modules {
+		v := m.Version
+		if i == 0 {
+			v = version
+		}
+		id := fmt.Sprintf("SPDXRef-Package-%d", i)
+		packages = append(packages, pkg{
+			Name:             m.Path,
+			SPDXID:           id,
+			VersionInfo:      v,
+			DownloadLocation: "NOASSERTION",
+			ExternalRefs:     []externalRef{{"PACKAGE-MANAGER", "purl", purl(m)}},
+		})
+		if i > 0 {
+			relationships = append(relationships, relationship{"SPDXRef-Package-0", "DEPENDS_ON", id})
+		}
+	}
+	name := fmt.Sprintf("%s-%s-%s", modules[0].Path, version, platform)
+	return map[string]any{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              name,
+		"documentNamespace": "https://spdx.org/spdxdocs/" + name,
+		"creationInfo": map[string]any{
+			"created":  date.UTC().Format(time.RFC3339),
+			"creators": []string{"Tool: go-selfupdate"},
+		},
+		"packages":      packages,
+		"relationships": relationships,
+	}
+}
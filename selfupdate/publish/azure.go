@@ -0,0 +1,151 @@
+package publish
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// azureVersion is the Blob service REST API version requests are made with
+const azureVersion = "2021-08-06"
+
+// AzureBackend uploads the update tree to an Azure Blob Storage container
+// using a shared access signature with write permission on the container.
+type AzureBackend struct {
+	Account   string
+	Container string
+	Prefix    string
+	SASToken  string // without the leading '?'
+	Endpoint  string // defaults to https://<account>.blob.core.windows.net
+	Client    *http.Client
+}
+
+// Put uploads r as a block blob
+func (b *AzureBackend) Put(ctx context.Context, name string, r io.Reader, meta Metadata) error {
+	req, _, err := newPutRequest(ctx, b.blobURL(name), r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Ms-Blob-Type", "BlockBlob")
+	req.Header.Set("X-Ms-Version", azureVersion)
+	if meta.ContentType != "" {
+		req.Header.Set("X-Ms-Blob-Content-Type", meta.ContentType)
+	}
+	if meta.CacheControl != "" {
+		req.Header.Set("X-Ms-Blob-Cache-Control", meta.CacheControl)
+	}
+
+	return doPut(b.Client, req)
+}
+
+// Get downloads name
+func (b *AzureBackend) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := b.do(ctx, http.MethodGet, b.blobURL(name))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// List returns the blobs below the backend prefix starting with prefix
+func (b *AzureBackend) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	rootKey := objectKey(b.Prefix, "")
+	var files []FileInfo
+	var marker string
+	for {
+		q := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {rootKey + prefix}}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		resp, err := b.do(ctx, http.MethodGet, b.containerURL(q))
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Blobs struct {
+				Blob []struct {
+					Name       string
+					Properties struct {
+						LastModified  string `xml:"Last-Modified"`
+						ContentLength int64  `xml:"Content-Length"`
+					}
+				}
+			}
+			NextMarker string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid blob listing: %w", err)
+		}
+		for _, blob := range result.Blobs.Blob {
+			modTime, _ := http.ParseTime(blob.Properties.LastModified)
+			files = append(files, FileInfo{
+				Name:    strings.TrimPrefix(blob.Name, rootKey),
+				Size:    blob.Properties.ContentLength,
+				ModTime: modTime,
+			})
+		}
+		if result.NextMarker == "" {
+			return files, nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+// Delete removes name
+func (b *AzureBackend) Delete(ctx context.Context, name string) error {
+	resp, err := b.do(ctx, http.MethodDelete, b.blobURL(name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b *AzureBackend) do(ctx context.Context, method, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Ms-Version", azureVersion)
+	return doRequest(b.Client, req)
+}
+
+func (b *AzureBackend) blobURL(name string) string {
+	return b.withSAS(fmt.Sprintf("%s/%s/%s", b.endpoint(), b.Container, awsEscape(objectKey(b.Prefix, name), false)), nil)
+}
+
+func (b *AzureBackend) containerURL(q url.Values) string {
+	return b.withSAS(fmt.Sprintf("%s/%s", b.endpoint(), b.Container), q)
+}
+
+// withSAS appends the query q and the shared access signature to u
+func (b *AzureBackend) withSAS(u string, q url.Values) string {
+	var query []string
+	if len(q) > 0 {
+		query = append(query, q.Encode())
+	}
+	if b.SASToken != "" {
+		query = append(query, strings.TrimPrefix(b.SASToken, "?"))
+	}
+	if len(query) == 0 {
+		return u
+	}
+	return u + "?" + strings.Join(query, "&")
+}
+
+func (b *AzureBackend) endpoint() string {
+	if b.Endpoint == "" {
+		return fmt.Sprintf("https://%s.blob.core.windows.net", b.Account)
+	}
+	return strings.TrimSuffix(b.Endpoint, "/")
+}
@@ -0,0 +1,387 @@
+package publish
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bobo/go-selfupdate/selfupdate"
+)
+
+// Metadata describes how a stored file should be served to clients
+type Metadata struct {
+	ContentType  string
+	CacheControl string
+}
+
+var (
+	// ManifestMetadata is used for channel manifests, which are rewritten on
+	// every release and must not be cached for long.
+	ManifestMetadata = Metadata{ContentType: "application/json", CacheControl: "no-cache"}
+	// ArtifactMetadata is used for compressed binaries, which never change
+	// once published under a version.
+	ArtifactMetadata = Metadata{ContentType: "application/gzip", CacheControl: "public, max-age=31536000, immutable"}
+)
+
+// Backend stores the files of an update tree. Names are slash separated and
+// relative to the root of the tree.
+type Backend interface {
+	Put(ctx context.Context, name string, r io.Reader, meta Metadata) error
+}
+
+// Store is a Backend that can also read, list and remove the files it holds.
+// Commands maintaining an existing tree, such as pruning old versions,
+// require one. Every backend returned by OpenBackend is a Store.
+type Store interface {
+	Backend
+	// Get opens name. Missing files return an error wrapping fs.ErrNotExist.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// List returns all files whose name starts with prefix
+	List(ctx context.Context, prefix string) ([]FileInfo, error)
+	// Delete removes name. Deleting a missing file is not an error.
+	Delete(ctx context.Context, name string) error
+}
+
+// FileInfo describes a file listed by a Store
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// DirBackend stores the update tree in a local directory
+type DirBackend struct {
+	Root string
+}
+
+// Put writes r to name below the backend root. Metadata is ignored.
+func (b *DirBackend) Put(ctx context.Context, name string, r io.Reader, meta Metadata) error {
+	path := b.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Get opens name below the backend root
+func (b *DirBackend) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(b.path(name))
+}
+
+// List walks the backend root. A missing root holds no files.
+func (b *DirBackend) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	var files []FileInfo
+	err := filepath.WalkDir(b.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == b.Root && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(b.Root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, FileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return files, err
+}
+
+// Delete removes name and the directories it leaves empty
+func (b *DirBackend) Delete(ctx context.Context, name string) error {
+	if err := os.Remove(b.path(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if os.Remove(b.path(dir)) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (b *DirBackend) path(name string) string {
+	return filepath.Join(b.Root, filepath.FromSlash(name))
+}
+
+// CompactBackend wraps a Backend and strips the indentation of the JSON
+// files written through it. Wrap a SigningBackend, not the other way round,
+// so signatures cover the compact form.
+type CompactBackend struct {
+	Backend
+}
+
+// Put stores JSON files compacted and anything else unchanged
+func (b *CompactBackend) Put(ctx context.Context, name string, r io.Reader, meta Metadata) error {
+	if path.Ext(name) != ".json" {
+		return b.Backend.Put(ctx, name, r, meta)
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, content); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return b.Backend.Put(ctx, name, &buf, meta)
+}
+
+// Digest encodings of the manifests
+const (
+	Base64Digests = "base64"
+	HexDigests    = "hex"
+)
+
+// HexDigestBackend wraps a Backend and writes the Sha256 and Sha512 digests
+// of the manifests stored through it in hex, as other release tools do,
+// rather than in base64. Clients read either. Like CompactBackend it goes
+// around a SigningBackend and leaves the layout of the manifest untouched.
+type HexDigestBackend struct {
+	Backend
+}
+
+// Put stores manifests with hex digests and anything else unchanged
+func (b *HexDigestBackend) Put(ctx context.Context, name string, r io.Reader, meta Metadata) error {
+	if path.Ext(name) != ".json" || path.Base(name) == selfupdate.IndexFile || IsAttestation(name) {
+		return b.Backend.Put(ctx, name, r, meta)
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	info, err := selfupdate.DecodeManifest(bytes.NewReader(content), false)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	for _, digest := range [][]byte{info.Sha256, info.Sha512} {
+		if len(digest) == 0 {
+			continue
+		}
+		// the base64 string of a digest cannot occur anywhere else in
+		// the manifest, replacing it keeps the field order and spacing
+		b64, _ := json.Marshal(digest)
+		hx, _ := json.Marshal(hex.EncodeToString(digest))
+		content = bytes.Replace(content, b64, hx, 1)
+	}
+	return b.Backend.Put(ctx, name, bytes.NewReader(content), meta)
+}
+
+// OpenBackend returns the backend for target, which is either a local
+// directory or a storage URL:
+//
+//	s3://bucket/prefix              AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, AWS_REGION, AWS_ENDPOINT_URL
+//	gs://bucket/prefix              GOOGLE_OAUTH_ACCESS_TOKEN
+//	azblob://account/container/prefix  AZURE_STORAGE_SAS_TOKEN
+//	github://owner/repo/tag         GITHUB_TOKEN, GITHUB_API_URL
+//
+// Credentials are read from the environment variables listed next to each
+// scheme.
+func OpenBackend(target string) (Backend, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme == "" || len(u.Scheme) == 1 {
+		// plain paths, including Windows drive letters
+		return &DirBackend{Root: target}, nil
+	}
+	prefix := strings.Trim(u.Path, "/")
+
+	switch u.Scheme {
+	case "file":
+		return &DirBackend{Root: filepath.FromSlash(u.Path)}, nil
+	case "s3":
+		region := os.Getenv("AWS_REGION")
+		if region == "" {
+			region = os.Getenv("AWS_DEFAULT_REGION")
+		}
+		return &S3Backend{
+			Bucket:          u.Host,
+			Prefix:          prefix,
+			Region:          region,
+			Endpoint:        os.Getenv("AWS_ENDPOINT_URL"),
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	case "gs":
+		return &GCSBackend{
+			Bucket: u.Host,
+			Prefix: prefix,
+			Token:  os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"),
+		}, nil
+	case "azblob":
+		container, prefix, _ := strings.Cut(prefix, "/")
+		return &AzureBackend{
+			Account:   u.Host,
+			Container: container,
+			Prefix:    prefix,
+			SASToken:  os.Getenv("AZURE_STORAGE_SAS_TOKEN"),
+		}, nil
+	case "github":
+		repo, tag, _ := strings.Cut(prefix, "/")
+		if repo == "" || tag == "" || strings.Contains(tag, "/") {
+			return nil, fmt.Errorf("%s: GitHub targets are github://owner/repo/tag", target)
+		}
+		return &GitHubBackend{
+			Owner:    u.Host,
+			Repo:     repo,
+			Tag:      tag,
+			Token:    os.Getenv("GITHUB_TOKEN"),
+			Endpoint: os.Getenv("GITHUB_API_URL"),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported storage scheme %q", u.Scheme)
+}
+
+// PublicURL returns the URL the storage service of a target opened by
+// OpenBackend serves its files from, ending in a slash. Local directories
+// and GitHub releases have no such URL.
+func PublicURL(target string) (string, error) {
+	backend, err := OpenBackend(target)
+	if err != nil {
+		return "", err
+	}
+	var base, prefix string
+	switch b := backend.(type) {
+	case *S3Backend:
+		base, prefix = b.bucketURL(), b.Prefix
+	case *GCSBackend:
+		base, prefix = b.bucketURL(), b.Prefix
+	case *AzureBackend:
+		base, prefix = b.endpoint()+"/"+b.Container, b.Prefix
+	default:
+		return "", fmt.Errorf("%s is not served from a known URL", target)
+	}
+	return base + "/" + awsEscape(objectKey(prefix, ""), false), nil
+}
+
+// OpenStore is OpenBackend for callers that also read, list or delete files
+func OpenStore(target string) (Store, error) {
+	backend, err := OpenBackend(target)
+	if err != nil {
+		return nil, err
+	}
+	store, ok := backend.(Store)
+	if !ok {
+		return nil, fmt.Errorf("%s: storage does not support listing files", target)
+	}
+	return store, nil
+}
+
+// objectKey joins a backend prefix and an object name
+func objectKey(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + name
+}
+
+// requestBody prepares r for an upload request. Seekable readers such as
+// files are streamed with their length taken from Seek; anything else is
+// read into memory, in which case the hex SHA256 of the content is returned
+// as well for backends that sign payloads.
+func requestBody(r io.Reader) (body io.Reader, size int64, payloadHash string, err error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		start, err := rs.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		end, err := rs.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		if _, err := rs.Seek(start, io.SeekStart); err != nil {
+			return nil, 0, "", err
+		}
+		// hide Close so the client does not close the caller's file
+		return struct{ io.Reader }{rs}, end - start, "", nil
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	return bytes.NewReader(b), int64(len(b)), hashHex(b), nil
+}
+
+// newPutRequest returns a PUT request for u streaming r
+func newPutRequest(ctx context.Context, u string, r io.Reader) (*http.Request, string, error) {
+	body, size, payloadHash, err := requestBody(r)
+	if err != nil {
+		return nil, "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, body)
+	if err != nil {
+		return nil, "", err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	return req, payloadHash, nil
+}
+
+// doPut sends req and turns any non 2xx response into an error
+func doPut(client *http.Client, req *http.Request) error {
+	resp, err := doRequest(client, req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// doRequest sends req and turns any non 2xx response into an error wrapping
+// fs.ErrNotExist for 404s. The caller must close the body of the returned
+// response.
+func doRequest(client *http.Client, req *http.Request) (*http.Response, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	// the query may carry credentials such as SAS tokens, so leave it out
+	err = fmt.Errorf("bad http status from %s%s: %v: %s", req.URL.Host, req.URL.EscapedPath(), resp.Status, strings.TrimSpace(string(body)))
+	if resp.StatusCode == http.StatusNotFound {
+		err = fmt.Errorf("%w: %w", fs.ErrNotExist, err)
+	}
+	return nil, err
+}
@@ -0,0 +1,395 @@
+package publish
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignV4(t *testing.T) {
+	// Example request from the AWS Signature Version 4 documentation
+	req, _ := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signV4(req, hashHex(nil), "us-east-1", "iam", awsCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("unexpected Authorization header\n got: %s\nwant: %s", got, want)
+	}
+}
+
+type recordedPut struct {
+	path   string
+	header http.Header
+	body   string
+}
+
+func newRecordingServer(t *testing.T) (*httptest.Server, *[]recordedPut) {
+	var puts []recordedPut
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("unexpected method %s", r.Method)
+		}
+		b, _ := io.ReadAll(r.Body)
+		puts = append(puts, recordedPut{path: r.URL.RequestURI(), header: r.Header, body: string(b)})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &puts
+}
+
+func TestRemoteBackends(t *testing.T) {
+	srv, puts := newRecordingServer(t)
+
+	tests := []struct {
+		name     string
+		backend  Backend
+		wantPath string
+		check    func(t *testing.T, h http.Header)
+	}{
+		{
+			name: "s3",
+			backend: &S3Backend{Bucket: "updates", Prefix: "myapp/", Endpoint: srv.URL,
+				AccessKeyID: "AKID", SecretAccessKey: "secret"},
+			wantPath: "/updates/myapp/beta/linux-amd64.json",
+			check: func(t *testing.T, h http.Header) {
+				if !strings.HasPrefix(h.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+					t.Errorf("missing signature: %q", h.Get("Authorization"))
+				}
+				if h.Get("Cache-Control") != "no-cache" || h.Get("Content-Type") != "application/json" {
+					t.Errorf("unexpected metadata headers %v", h)
+				}
+			},
+		},
+		{
+			name:     "gcs",
+			backend:  &GCSBackend{Bucket: "updates", Prefix: "myapp", Token: "tok", Endpoint: srv.URL},
+			wantPath: "/updates/myapp/beta/linux-amd64.json",
+			check: func(t *testing.T, h http.Header) {
+				if h.Get("Authorization") != "Bearer tok" || h.Get("Cache-Control") != "no-cache" {
+					t.Errorf("unexpected headers %v", h)
+				}
+			},
+		},
+		{
+			name:     "azure",
+			backend:  &AzureBackend{Container: "updates", Prefix: "myapp", SASToken: "?sig=abc", Endpoint: srv.URL},
+			wantPath: "/updates/myapp/beta/linux-amd64.json?sig=abc",
+			check: func(t *testing.T, h http.Header) {
+				if h.Get("X-Ms-Blob-Type") != "BlockBlob" || h.Get("X-Ms-Blob-Cache-Control") != "no-cache" {
+					t.Errorf("unexpected headers %v", h)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*puts = nil
+			err := tt.backend.Put(context.Background(), "beta/linux-amd64.json", strings.NewReader("{}"), ManifestMetadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(*puts) != 1 {
+				t.Fatalf("expected one request, got %d", len(*puts))
+			}
+			put := (*puts)[0]
+			if put.path != tt.wantPath {
+				t.Errorf("unexpected path %s, want %s", put.path, tt.wantPath)
+			}
+			if put.body != "{}" {
+				t.Errorf("unexpected body %q", put.body)
+			}
+			tt.check(t, put.header)
+		})
+	}
+}
+
+func TestOpenBackend(t *testing.T) {
+	tests := []struct {
+		target string
+		check  func(Backend) bool
+	}{
+		{"public", func(b Backend) bool { d, ok := b.(*DirBackend); return ok && d.Root == "public" }},
+		{`C:\releases`, func(b Backend) bool { _, ok := b.(*DirBackend); return ok }},
+		{"s3://bucket/myapp", func(b Backend) bool {
+			s, ok := b.(*S3Backend)
+			return ok && s.Bucket == "bucket" && s.Prefix == "myapp"
+		}},
+		{"gs://bucket", func(b Backend) bool { g, ok := b.(*GCSBackend); return ok && g.Bucket == "bucket" && g.Prefix == "" }},
+		{"azblob://acct/container/myapp", func(b Backend) bool {
+			a, ok := b.(*AzureBackend)
+			return ok && a.Account == "acct" && a.Container == "container" && a.Prefix == "myapp"
+		}},
+		{"github://bobo/myapp/v1.2", func(b Backend) bool {
+			g, ok := b.(*GitHubBackend)
+			return ok && g.Owner == "bobo" && g.Repo == "myapp" && g.Tag == "v1.2"
+		}},
+	}
+	for _, tt := range tests {
+		b, err := OpenBackend(tt.target)
+		if err != nil {
+			t.Errorf("%s: %v", tt.target, err)
+			continue
+		}
+		if !tt.check(b) {
+			t.Errorf("%s: unexpected backend %#v", tt.target, b)
+		}
+	}
+
+	if _, err := OpenBackend("ftp://host/path"); err == nil {
+		t.Error("expected error for unsupported scheme")
+	}
+	if _, err := OpenBackend("github://bobo/myapp"); err == nil {
+		t.Error("expected error for a GitHub target without tag")
+	}
+}
+
+func TestPublicURL(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("AWS_ENDPOINT_URL", "")
+	tests := map[string]string{
+		"s3://bucket/myapp":           "https://bucket.s3.eu-west-1.amazonaws.com/myapp/",
+		"gs://bucket":                 "https://storage.googleapis.com/bucket/",
+		"azblob://acct/container/a b": "https://acct.blob.core.windows.net/container/a%20b/",
+	}
+	for target, want := range tests {
+		got, err := PublicURL(target)
+		if err != nil || got != want {
+			t.Errorf("PublicURL(%q) = %q, %v, want %q", target, got, err, want)
+		}
+	}
+	if _, err := PublicURL("public"); err == nil {
+		t.Error("expected error for a local directory")
+	}
+}
+
+func TestS3BackendStreamsFiles(t *testing.T) {
+	var got *http.Request
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got, body = r, string(b)
+	}))
+	defer srv.Close()
+
+	f, err := os.Open(writeTestBinary(t, "compressed artifact"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	b := &S3Backend{Bucket: "updates", Endpoint: srv.URL, AccessKeyID: "AKID", SecretAccessKey: "secret"}
+	if err := b.Put(context.Background(), "1.2/linux-amd64.gz", f, ArtifactMetadata); err != nil {
+		t.Fatal(err)
+	}
+	if got.ContentLength != int64(len("compressed artifact")) || body != "compressed artifact" {
+		t.Errorf("unexpected upload: length %d body %q", got.ContentLength, body)
+	}
+	if got.Header.Get("X-Amz-Content-Sha256") != "UNSIGNED-PAYLOAD" {
+		t.Errorf("expected unsigned payload, got %q", got.Header.Get("X-Amz-Content-Sha256"))
+	}
+	if got.TransferEncoding != nil {
+		t.Errorf("expected a fixed length upload, got %v", got.TransferEncoding)
+	}
+}
+
+func TestDirBackendStore(t *testing.T) {
+	ctx := context.Background()
+	b := &DirBackend{Root: filepath.Join(t.TempDir(), "public")}
+	if files, err := b.List(ctx, ""); err != nil || len(files) != 0 {
+		t.Fatalf("missing root: got %v, %v", files, err)
+	}
+
+	for _, name := range []string{"linux-amd64.json", "1.0/linux-amd64.gz", "1.1/linux-amd64.gz"} {
+		if err := b.Put(ctx, name, strings.NewReader(name), ArtifactMetadata); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := b.List(ctx, "1.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name != "1.0/linux-amd64.gz" || files[0].Size != int64(len("1.0/linux-amd64.gz")) {
+		t.Errorf("unexpected listing %+v", files)
+	}
+
+	r, err := b.Get(ctx, "1.1/linux-amd64.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(r)
+	r.Close()
+	if string(content) != "1.1/linux-amd64.gz" {
+		t.Errorf("unexpected content %q", content)
+	}
+
+	if err := b.Delete(ctx, "1.0/linux-amd64.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ctx, "1.0/linux-amd64.gz"); err != nil {
+		t.Errorf("deleting a missing file: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(b.Root, "1.0")); !os.IsNotExist(err) {
+		t.Error("empty version directory was not removed")
+	}
+	if _, err := b.Get(ctx, "1.0/linux-amd64.gz"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestRemoteList(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch {
+		case q.Get("list-type") == "2" && q.Get("continuation-token") == "":
+			if q.Get("prefix") != "myapp/1." {
+				t.Errorf("unexpected prefix %q", q.Get("prefix"))
+			}
+			io.WriteString(w, `<ListBucketResult><Contents><Key>myapp/1.0/linux-amd64.gz</Key><Size>3</Size>`+
+				`<LastModified>2024-01-02T03:04:05.000Z</LastModified></Contents>`+
+				`<IsTruncated>true</IsTruncated><NextContinuationToken>next</NextContinuationToken></ListBucketResult>`)
+		case q.Get("list-type") == "2":
+			io.WriteString(w, `<ListBucketResult><Contents><Key>myapp/1.1/linux-amd64.gz</Key></Contents></ListBucketResult>`)
+		case q.Get("comp") == "list":
+			if q.Get("sig") != "abc" {
+				t.Error("missing shared access signature")
+			}
+			io.WriteString(w, `<EnumerationResults><Blobs><Blob><Name>myapp/1.0/linux-amd64.gz</Name><Properties>`+
+				`<Last-Modified>Tue, 02 Jan 2024 03:04:05 GMT</Last-Modified><Content-Length>3</Content-Length></Properties></Blob>`+
+				`</Blobs><NextMarker/></EnumerationResults>`)
+		default:
+			t.Errorf("unexpected request %s", r.URL)
+		}
+	}))
+	defer srv.Close()
+
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name  string
+		store Store
+		want  []FileInfo
+	}{
+		{"s3", &S3Backend{Bucket: "updates", Prefix: "myapp", Endpoint: srv.URL, AccessKeyID: "AKID", SecretAccessKey: "secret"},
+			[]FileInfo{{"1.0/linux-amd64.gz", 3, modTime}, {"1.1/linux-amd64.gz", 0, time.Time{}}}},
+		{"gcs", &GCSBackend{Bucket: "updates", Prefix: "myapp", Endpoint: srv.URL},
+			[]FileInfo{{"1.0/linux-amd64.gz", 3, modTime}, {"1.1/linux-amd64.gz", 0, time.Time{}}}},
+		{"azure", &AzureBackend{Container: "updates", Prefix: "myapp", SASToken: "sig=abc", Endpoint: srv.URL},
+			[]FileInfo{{"1.0/linux-amd64.gz", 3, modTime}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := tt.store.List(context.Background(), "1.")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != len(tt.want) {
+				t.Fatalf("got %+v, want %+v", files, tt.want)
+			}
+			for i := range files {
+				if files[i].Name != tt.want[i].Name || files[i].Size != tt.want[i].Size || !files[i].ModTime.Equal(tt.want[i].ModTime) {
+					t.Errorf("got %+v, want %+v", files[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCloudFrontInvalidate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/2020-05-31/distribution/E123/invalidation" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+		if !strings.Contains(r.Header.Get("Authorization"), "/us-east-1/cloudfront/aws4_request") {
+			t.Errorf("unexpected Authorization header %q", r.Header.Get("Authorization"))
+		}
+		b, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(b), "<Quantity>2</Quantity><Items><Path>/myapp/linux-amd64.json</Path><Path>/myapp/beta/linux-amd64.json</Path></Items>") {
+			t.Errorf("unexpected invalidation batch %s", b)
+		}
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `<Invalidation><Id>I2J0I21PCUYOIK</Id><Status>InProgress</Status></Invalidation>`)
+	}))
+	defer srv.Close()
+
+	cf := &CloudFront{DistributionID: "E123", Endpoint: srv.URL, AccessKeyID: "AKID", SecretAccessKey: "secret"}
+	paths := InvalidationPaths("s3://updates/myapp/", []string{"linux-amd64.json", "beta/linux-amd64.json"})
+	id, err := cf.Invalidate(context.Background(), paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "I2J0I21PCUYOIK" {
+		t.Errorf("unexpected invalidation id %q", id)
+	}
+}
+
+func TestGitHubBackend(t *testing.T) {
+	var requests []string
+	var srvURL string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("missing token on %s", r.URL)
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/repos/bobo/myapp/releases/tags/1.0":
+			http.NotFound(w, r)
+		case r.Method == http.MethodPost && r.URL.Path == "/repos/bobo/myapp/releases":
+			io.WriteString(w, `{"id": 1, "upload_url": "`+srvURL+`/uploads/1/assets{?name,label}"}`)
+		case r.Method == http.MethodPost && r.URL.Path == "/uploads/1/assets":
+			b, _ := io.ReadAll(r.Body)
+			if string(b) != "zipped" || r.Header.Get("Content-Type") != "application/zip" {
+				t.Errorf("unexpected upload %q of type %s", b, r.Header.Get("Content-Type"))
+			}
+			io.WriteString(w, `{"id": 7, "name": "`+r.URL.Query().Get("name")+`", "size": 6}`)
+		case r.Method == http.MethodDelete && r.URL.Path == "/repos/bobo/myapp/releases/assets/7":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer srv.Close()
+	srvURL = srv.URL
+
+	b := &GitHubBackend{Owner: "bobo", Repo: "myapp", Tag: "1.0", Token: "token", Endpoint: srv.URL}
+	ctx := context.Background()
+	meta := Metadata{ContentType: "application/zip"}
+	for i := 0; i < 2; i++ {
+		if err := b.Put(ctx, "1.0/linux-amd64.zip", strings.NewReader("zipped"), meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{
+		"GET /repos/bobo/myapp/releases/tags/1.0",
+		"POST /repos/bobo/myapp/releases",
+		"POST /uploads/1/assets?name=linux-amd64.zip",
+		"DELETE /repos/bobo/myapp/releases/assets/7",
+		"POST /uploads/1/assets?name=linux-amd64.zip",
+	}
+	if strings.Join(requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected requests\n got: %q\nwant: %q", requests, want)
+	}
+
+	files, err := b.List(ctx, "")
+	if err != nil || len(files) != 1 || files[0].Name != "linux-amd64.zip" {
+		t.Errorf("unexpected listing %+v, %v", files, err)
+	}
+	if err := b.Put(ctx, "1.1/linux-amd64.zip", strings.NewReader("zipped"), meta); err == nil {
+		t.Error("expected error for two files stored as the same asset")
+	}
+	if err := b.Put(ctx, "patches/0.9/1.0/linux-amd64.patch", strings.NewReader("patch"), meta); err == nil {
+		t.Error("expected error for a patch")
+	}
+}
@@ -0,0 +1,77 @@
+package publish
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ChecksumsFile lists the SHA256 of every artifact of a release in the
+// format of sha256sum, so downloads can be checked outside the update flow
+const ChecksumsFile = "SHA256SUMS"
+
+// ChecksumsMetadata is used for SHA256SUMS files, which are rewritten every
+// time a release is published to another channel
+var ChecksumsMetadata = Metadata{ContentType: "text/plain; charset=utf-8", CacheControl: ManifestMetadata.CacheControl}
+
+// checksumsPath returns where the SHA256SUMS file of the artifacts at names
+// is stored, which is the directory they share
+func checksumsPath(names []string) (string, error) {
+	if len(names) == 0 {
+		return "", fmt.Errorf("%s needs at least one artifact", ChecksumsFile)
+	}
+	dir := path.Dir(names[0])
+	for _, name := range names[1:] {
+		if path.Dir(name) != dir {
+			return "", fmt.Errorf("%s needs the artifacts of a release in one directory, the layout puts %s and %s apart", ChecksumsFile, names[0], name)
+		}
+	}
+	return path.Join(dir, ChecksumsFile), nil
+}
+
+// putChecksums stores the SHA256SUMS file listing the artifacts at names,
+// with sums being the SHA256 of the stored files
+func putChecksums(ctx context.Context, backend Backend, names []string, sums [][]byte) error {
+	name, err := checksumsPath(names)
+	if err != nil {
+		return err
+	}
+	lines := make([]string, len(names))
+	for i := range names {
+		lines[i] = hex.EncodeToString(sums[i]) + "  " + path.Base(names[i]) + "\n"
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i][64:] < lines[j][64:] })
+	return backend.Put(ctx, name, strings.NewReader(strings.Join(lines, "")), ChecksumsMetadata)
+}
+
+// ParseChecksums reads a SHA256SUMS file, returning the SHA256 of every file
+// it lists by name
+func ParseChecksums(r io.Reader) (map[string][]byte, error) {
+	sums := map[string][]byte{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		sum, name, ok := strings.Cut(line, "  ")
+		if !ok {
+			// sha256sum -b marks binary files with a '*'
+			sum, name, ok = strings.Cut(line, " *")
+		}
+		b, err := hex.DecodeString(sum)
+		if !ok || err != nil || len(b) != 32 || name == "" {
+			return nil, fmt.Errorf("line %d: invalid checksum line %q", n, line)
+		}
+		sums[name] = b
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return sums, nil
+}
@@ -0,0 +1,103 @@
+package publish
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CloudFront invalidates cached copies of the update tree in a CloudFront
+// distribution, so that clients see new manifests before their TTL expires
+type CloudFront struct {
+	DistributionID  string
+	Endpoint        string // defaults to https://cloudfront.amazonaws.com
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Client          *http.Client
+}
+
+// NewCloudFront returns a CloudFront client for distribution using the
+// AWS credentials in the environment
+func NewCloudFront(distribution string) *CloudFront {
+	return &CloudFront{
+		DistributionID:  distribution,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// Invalidate creates an invalidation of paths, each starting with a slash,
+// and returns its ID. It does not wait for the invalidation to complete.
+func (c *CloudFront) Invalidate(ctx context.Context, paths []string) (string, error) {
+	type invalidationBatch struct {
+		XMLName         xml.Name `xml:"http://cloudfront.amazonaws.com/doc/2020-05-31/ InvalidationBatch"`
+		Quantity        int      `xml:"Paths>Quantity"`
+		Items           []string `xml:"Paths>Items>Path"`
+		CallerReference string
+	}
+	batch := invalidationBatch{
+		Quantity:        len(paths),
+		Items:           paths,
+		CallerReference: strconv.FormatInt(time.Now().UnixNano(), 10),
+	}
+	body, err := xml.Marshal(batch)
+	if err != nil {
+		return "", err
+	}
+
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = "https://cloudfront.amazonaws.com"
+	}
+	u := fmt.Sprintf("%s/2020-05-31/distribution/%s/invalidation", strings.TrimSuffix(endpoint, "/"), url.PathEscape(c.DistributionID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "text/xml")
+	payloadHash := hashHex(body)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	// CloudFront is a global service signed in us-east-1
+	signV4(req, payloadHash, "us-east-1", "cloudfront", awsCredentials{
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: c.SecretAccessKey,
+		SessionToken:    c.SessionToken,
+	}, time.Now())
+
+	resp, err := doRequest(c.Client, req)
+	if err != nil {
+		return "", fmt.Errorf("cloudfront invalidation: %w", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		ID string `xml:"Id"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("cloudfront invalidation: invalid response: %w", err)
+	}
+	return result.ID, nil
+}
+
+// InvalidationPaths returns the CloudFront paths of names in the update
+// tree stored at target, assuming the distribution serves the bucket from
+// its root
+func InvalidationPaths(target string, names []string) []string {
+	prefix := ""
+	if u, err := url.Parse(target); err == nil && u.Scheme != "" && len(u.Scheme) > 1 {
+		prefix = strings.Trim(u.Path, "/")
+	}
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = "/" + objectKey(prefix, name)
+	}
+	return paths
+}
@@ -0,0 +1,189 @@
+package publish
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// debArches maps Go platforms to Debian architectures
+var debArches = map[string]string{
+	"linux-amd64":   "amd64",
+	"linux-arm64":   "arm64",
+	"linux-386":     "i386",
+	"linux-arm":     "armhf",
+	"linux-ppc64le": "ppc64el",
+	"linux-riscv64": "riscv64",
+	"linux-s390x":   "s390x",
+}
+
+// packageVersion turns a release version into one dpkg and rpm order the
+// same way: without the v prefix, and with pre-releases such as 1.3-beta1
+// sorting before 1.3, which is what ~ means to both
+func packageVersion(version string) string {
+	return strings.ReplaceAll(strings.TrimPrefix(version, "v"), "-", "~")
+}
+
+// buildDeb returns a .deb package installing the binary at binPath as
+// /usr/bin/<name>, followed by the fields of its control file
+func (p *Packages) buildDeb(r *Release, binPath, arch string, date time.Time) ([]byte, string, error) {
+	bin, err := os.ReadFile(binPath)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := debTar(date, []debFile{
+		{name: "./usr/", mode: 0755, dir: true},
+		{name: "./usr/bin/", mode: 0755, dir: true},
+		{name: "./usr/bin/" + p.Name, mode: 0755, body: bin},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	description := p.Description
+	if description == "" {
+		description = p.Name
+	}
+	maintainer := p.Publisher
+	if maintainer == "" {
+		maintainer = p.Name
+	}
+	var control strings.Builder
+	fmt.Fprintf(&control, "Package: %s\nVersion: %s\nArchitecture: %s\nMaintainer: %s\nInstalled-Size: %d\nSection: utils\nPriority: optional\n",
+		p.Name, packageVersion(r.Version), arch, maintainer, (len(bin)+1023)/1024)
+	if p.Homepage != "" {
+		fmt.Fprintf(&control, "Homepage: %s\n", p.Homepage)
+	}
+	fmt.Fprintf(&control, "Description: %s\n", description)
+	sum := md5.Sum(bin)
+	controlTar, err := debTar(date, []debFile{
+		{name: "./control", mode: 0644, body: []byte(control.String())},
+		{name: "./md5sums", mode: 0644, body: []byte(hex.EncodeToString(sum[:]) + "  usr/bin/" + p.Name + "\n")},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	var deb bytes.Buffer
+	deb.WriteString("!<arch>\n")
+	for _, member := range []repoFile{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", controlTar},
+		{"data.tar.gz", data},
+	} {
+		fmt.Fprintf(&deb, "%-16s%-12d%-6d%-6d%-8o%-10d`\n", member.name, date.Unix(), 0, 0, 0100644, len(member.body))
+		deb.Write(member.body)
+		if len(member.body)%2 == 1 {
+			deb.WriteByte('\n')
+		}
+	}
+	return deb.Bytes(), control.String(), nil
+}
+
+// repoFile is a file of a package or of the metadata of a repository
+type repoFile struct {
+	name string
+	body []byte
+}
+
+type debFile struct {
+	name string
+	mode int64
+	dir  bool
+	body []byte
+}
+
+// debTar returns a gzipped tar of files owned by root, as in .deb members
+func debTar(date time.Time, files []debFile) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: f.name, Mode: f.mode, Size: int64(len(f.body)), ModTime: date, Uname: "root", Gname: "root", Format: tar.FormatGNU}
+		if f.dir {
+			hdr.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(f.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// putDebRepo stores a .deb package of every Linux binary of r in
+// packages/deb/pool and a flat apt repository indexing them, which apt
+// reads with a line such as "deb [trusted=yes] <url>/packages/deb ./"
+func putDebRepo(ctx context.Context, backend Backend, p *Packages, r *Release, date time.Time) error {
+	dir := path.Join(PackagesDir, "deb")
+	var index strings.Builder
+	for _, a := range r.Artifacts {
+		arch, ok := debArches[a.Platform]
+		if !ok {
+			continue
+		}
+		deb, control, err := p.buildDeb(r, a.Path, arch, date)
+		if err != nil {
+			return fmt.Errorf("%s: %w", a.Platform, err)
+		}
+		name := fmt.Sprintf("pool/%s_%s_%s.deb", p.Name, packageVersion(r.Version), arch)
+		if err := backend.Put(ctx, path.Join(dir, name), bytes.NewReader(deb), Metadata{ContentType: "application/vnd.debian.binary-package"}); err != nil {
+			return err
+		}
+		md5sum, sha := md5.Sum(deb), sha256.Sum256(deb)
+		if index.Len() > 0 {
+			index.WriteString("\n")
+		}
+		fmt.Fprintf(&index, "%sFilename: %s\nSize: %d\nMD5sum: %s\nSHA256: %s\n", control, name, len(deb), hex.EncodeToString(md5sum[:]), hex.EncodeToString(sha[:]))
+	}
+
+	packages := []byte(index.String())
+	var packagesGz bytes.Buffer
+	gz := gzip.NewWriter(&packagesGz)
+	gz.Write(packages)
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	files := []repoFile{{"Packages", packages}, {"Packages.gz", packagesGz.Bytes()}}
+
+	var release strings.Builder
+	fmt.Fprintf(&release, "Origin: %s\nLabel: %s\nDate: %s\n", p.Name, p.Name, date.UTC().Format(time.RFC1123))
+	for _, digest := range []struct {
+		field string
+		sum   func([]byte) string
+	}{
+		{"MD5Sum", func(b []byte) string { s := md5.Sum(b); return hex.EncodeToString(s[:]) }},
+		{"SHA256", func(b []byte) string { s := sha256.Sum256(b); return hex.EncodeToString(s[:]) }},
+	} {
+		release.WriteString(digest.field + ":\n")
+		for _, f := range files {
+			fmt.Fprintf(&release, " %s %d %s\n", digest.sum(f.body), len(f.body), f.name)
+		}
+	}
+	files = append(files, repoFile{"Release", []byte(release.String())})
+
+	// the Release file last, so apt never sees it list indexes not stored yet
+	for _, f := range files {
+		if err := backend.Put(ctx, path.Join(dir, f.name), bytes.NewReader(f.body), PackageMetadata); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package publish
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age"
+
+	"github.com/bobo/go-selfupdate/selfupdate"
+)
+
+// AgeEncryption is the UpdateInfo.Encryption of artifacts encrypted with age
+const AgeEncryption = "age"
+
+// ErrEncrypted is returned when reading an artifact encrypted with age
+// without an identity to decrypt it
+var ErrEncrypted = selfupdate.ErrEncrypted
+
+const ageHeader = "age-encryption.org/v1\n"
+
+// ParseRecipients parses age X25519 recipients, ex: age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+func ParseRecipients(keys []string) ([]age.Recipient, error) {
+	recipients := make([]age.Recipient, len(keys))
+	for i, key := range keys {
+		r, err := age.ParseX25519Recipient(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid -encrypt-to recipient %q: %w", key, err)
+		}
+		recipients[i] = r
+	}
+	return recipients, nil
+}
+
+// ParseIdentities reads the age identities of an identity file as written
+// by age-keygen
+func ParseIdentities(r io.Reader) ([]age.Identity, error) {
+	return age.ParseIdentities(r)
+}
+
+// encryptArtifact wraps write so its output is encrypted to recipients
+func encryptArtifact(recipients []age.Recipient, write func(w io.Writer) ([]byte, []byte, error)) func(w io.Writer) ([]byte, []byte, error) {
+	return func(w io.Writer) ([]byte, []byte, error) {
+		ew, err := age.Encrypt(w, recipients...)
+		if err != nil {
+			return nil, nil, err
+		}
+		sum256, sum512, err := write(ew)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := ew.Close(); err != nil {
+			return nil, nil, fmt.Errorf("failed to encrypt artifact: %w", err)
+		}
+		return sum256, sum512, nil
+	}
+}
+
+// DecryptArtifact returns the content of the artifact read from r,
+// decrypting it with identities when it is encrypted with age
+func DecryptArtifact(r io.Reader, identities []age.Identity) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if head, _ := br.Peek(len(ageHeader)); string(head) != ageHeader {
+		return br, nil
+	}
+	if len(identities) == 0 {
+		return nil, ErrEncrypted
+	}
+	dr, err := age.Decrypt(br, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt artifact: %w", err)
+	}
+	return dr, nil
+}
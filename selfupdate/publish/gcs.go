@@ -0,0 +1,83 @@
+package publish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+// GCSBackend uploads the update tree to a Google Cloud Storage bucket through
+// the XML API using an OAuth2 access token, such as the output of
+// `gcloud auth print-access-token`.
+type GCSBackend struct {
+	Bucket   string
+	Prefix   string
+	Token    string
+	Endpoint string // defaults to https://storage.googleapis.com
+	Client   *http.Client
+}
+
+// Put uploads r as a single object
+func (b *GCSBackend) Put(ctx context.Context, name string, r io.Reader, meta Metadata) error {
+	req, _, err := newPutRequest(ctx, b.objectURL(name), r)
+	if err != nil {
+		return err
+	}
+	setMetadataHeaders(req.Header, meta)
+	req.Header.Set("Authorization", "Bearer "+b.Token)
+
+	return doPut(b.Client, req)
+}
+
+// Get downloads name
+func (b *GCSBackend) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := b.do(ctx, http.MethodGet, b.objectURL(name))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// List returns the objects below the backend prefix starting with prefix
+func (b *GCSBackend) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	return listObjectsV2(b.bucketURL(), b.Prefix, prefix, func(u string) (*http.Response, error) {
+		return b.do(ctx, http.MethodGet, u)
+	})
+}
+
+// Delete removes name
+func (b *GCSBackend) Delete(ctx context.Context, name string) error {
+	resp, err := b.do(ctx, http.MethodDelete, b.objectURL(name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b *GCSBackend) do(ctx context.Context, method, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.Token)
+	return doRequest(b.Client, req)
+}
+
+func (b *GCSBackend) objectURL(name string) string {
+	return b.bucketURL() + "/" + awsEscape(objectKey(b.Prefix, name), false)
+}
+
+func (b *GCSBackend) bucketURL() string {
+	endpoint := b.Endpoint
+	if endpoint == "" {
+		endpoint = "https://storage.googleapis.com"
+	}
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(endpoint, "/"), b.Bucket)
+}
@@ -0,0 +1,282 @@
+package publish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GitHubBackend stores the update tree as the assets of a GitHub Release,
+// creating the release when it does not exist. Assets are flat, so every
+// file is stored under its base name: a release holds one version and the
+// manifests of one channel, and patches are not supported. When tags are
+// named after versions, clients of the stable channel use
+//
+//	ApiURL:    https://github.com/<owner>/<repo>/releases/latest/download/
+//	BinURL:    https://github.com/<owner>/<repo>/releases/download/
+//	BinLayout: {{.Version}}/{{.Platform}}{{.Ext}}
+type GitHubBackend struct {
+	Owner    string
+	Repo     string
+	Tag      string
+	Token    string
+	Endpoint string // API endpoint, defaults to https://api.github.com
+	Client   *http.Client
+
+	mu       sync.Mutex
+	release  *githubRelease
+	uploaded map[string]string // asset name to the file stored under it
+}
+
+type githubRelease struct {
+	ID        int64         `json:"id"`
+	UploadURL string        `json:"upload_url"`
+	Assets    []githubAsset `json:"assets"`
+}
+
+type githubAsset struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Put uploads r as an asset, replacing any asset of the same name
+func (b *GitHubBackend) Put(ctx context.Context, name string, r io.Reader, meta Metadata) error {
+	asset, err := b.assetName(name)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	if other, ok := b.uploaded[asset]; ok && other != name {
+		b.mu.Unlock()
+		return fmt.Errorf("%s and %s would both be asset %s of release %s", other, name, asset, b.Tag)
+	}
+	if b.uploaded == nil {
+		b.uploaded = map[string]string{}
+	}
+	b.uploaded[asset] = name
+	b.mu.Unlock()
+
+	release, err := b.getRelease(ctx, true)
+	if err != nil {
+		return err
+	}
+	if a := b.findAsset(release, asset); a != nil {
+		if err := b.deleteAsset(ctx, a.ID); err != nil {
+			return err
+		}
+	}
+
+	uploadURL, _, _ := strings.Cut(release.UploadURL, "{")
+	req, _, err := newPutRequest(ctx, uploadURL+"?"+url.Values{"name": {asset}}.Encode(), r)
+	if err != nil {
+		return err
+	}
+	req.Method = http.MethodPost
+	contentType := meta.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	req.Header.Set("Content-Type", contentType)
+	b.authorize(req)
+	resp, err := doRequest(b.Client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var a githubAsset
+	if err := json.NewDecoder(resp.Body).Decode(&a); err != nil {
+		return fmt.Errorf("invalid asset upload response: %w", err)
+	}
+	b.mu.Lock()
+	release.Assets = append(release.Assets, a)
+	b.mu.Unlock()
+	return nil
+}
+
+// Get downloads the asset called after name
+func (b *GitHubBackend) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	asset, err := b.assetName(name)
+	if err != nil {
+		return nil, err
+	}
+	release, err := b.getRelease(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	a := b.findAsset(release, asset)
+	if a == nil {
+		return nil, fmt.Errorf("%w: asset %s of release %s", fs.ErrNotExist, asset, b.Tag)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.apiURL(fmt.Sprintf("releases/assets/%d", a.ID)), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/octet-stream")
+	b.authorize(req)
+	resp, err := doRequest(b.Client, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// List returns the assets of the release starting with prefix. A release
+// that does not exist yet has none.
+func (b *GitHubBackend) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	release, err := b.getRelease(ctx, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var files []FileInfo
+	for _, a := range release.Assets {
+		if strings.HasPrefix(a.Name, prefix) {
+			files = append(files, FileInfo{Name: a.Name, Size: a.Size, ModTime: a.UpdatedAt})
+		}
+	}
+	return files, nil
+}
+
+// Delete removes the asset called after name
+func (b *GitHubBackend) Delete(ctx context.Context, name string) error {
+	asset, err := b.assetName(name)
+	if err != nil {
+		return err
+	}
+	release, err := b.getRelease(ctx, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if a := b.findAsset(release, asset); a != nil {
+		return b.deleteAsset(ctx, a.ID)
+	}
+	return nil
+}
+
+// assetName returns the asset a file of the update tree is stored as
+func (b *GitHubBackend) assetName(name string) (string, error) {
+	dir, file := path.Split(name)
+	if strings.HasPrefix(name, "patches/") || strings.Count(dir, "/") > 1 {
+		return "", fmt.Errorf("%s: GitHub releases only hold artifacts and manifests", name)
+	}
+	return file, nil
+}
+
+// getRelease looks up the release of b.Tag once, creating it when create is
+// set and it does not exist
+func (b *GitHubBackend) getRelease(ctx context.Context, create bool) (*githubRelease, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.release != nil {
+		return b.release, nil
+	}
+
+	var release githubRelease
+	err := b.call(ctx, http.MethodGet, "releases/tags/"+url.PathEscape(b.Tag), nil, &release)
+	if errors.Is(err, fs.ErrNotExist) && create {
+		body := map[string]any{"tag_name": b.Tag, "name": b.Tag}
+		err = b.call(ctx, http.MethodPost, "releases", body, &release)
+	}
+	if err != nil {
+		return nil, err
+	}
+	b.release = &release
+	return b.release, nil
+}
+
+func (b *GitHubBackend) deleteAsset(ctx context.Context, id int64) error {
+	if err := b.call(ctx, http.MethodDelete, fmt.Sprintf("releases/assets/%d", id), nil, nil); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	assets := b.release.Assets[:0]
+	for _, a := range b.release.Assets {
+		if a.ID != id {
+			assets = append(assets, a)
+		}
+	}
+	b.release.Assets = assets
+	return nil
+}
+
+// call sends a JSON API request for the repository and decodes the response
+// into out when set
+func (b *GitHubBackend) call(ctx context.Context, method, endpoint string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, b.apiURL(endpoint), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	b.authorize(req)
+	resp, err := doRequest(b.Client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid GitHub API response: %w", err)
+	}
+	return nil
+}
+
+func (b *GitHubBackend) authorize(req *http.Request) {
+	if b.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.Token)
+	}
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+}
+
+func (b *GitHubBackend) apiURL(endpoint string) string {
+	base := b.Endpoint
+	if base == "" {
+		base = "https://api.github.com"
+	}
+	return fmt.Sprintf("%s/repos/%s/%s/%s", strings.TrimSuffix(base, "/"), url.PathEscape(b.Owner), url.PathEscape(b.Repo), endpoint)
+}
+
+// findAsset returns a copy of the asset of release called name, if any
+func (b *GitHubBackend) findAsset(release *githubRelease, name string) *githubAsset {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, a := range release.Assets {
+		if a.Name == name {
+			return &a
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package publish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/bobo/go-selfupdate/selfupdate"
+)
+
+// ReadIndex returns the index of the tree in store, or an empty index when
+// the tree has none yet
+func ReadIndex(ctx context.Context, store Store) (*selfupdate.Index, error) {
+	r, err := store.Get(ctx, selfupdate.IndexFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &selfupdate.Index{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var idx selfupdate.Index
+	if err := json.NewDecoder(r).Decode(&idx); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", selfupdate.IndexFile, err)
+	}
+	return &idx, nil
+}
+
+// PutIndex stores idx as the index of the tree, with dates in UTC
+func PutIndex(ctx context.Context, backend Backend, idx *selfupdate.Index) error {
+	for _, releases := range idx.Channels {
+		for i := range releases {
+			releases[i].Date = releases[i].Date.UTC()
+		}
+	}
+	b, err := json.MarshalIndent(idx, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to encode index: %w", err)
+	}
+	return backend.Put(ctx, selfupdate.IndexFile, bytes.NewReader(b), ManifestMetadata)
+}
@@ -0,0 +1,311 @@
+package publish
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bobo/go-selfupdate/internal/archive"
+)
+
+// PackagesDir is the directory of the update tree holding the package
+// manager manifests of the latest release
+const PackagesDir = "packages"
+
+// Package managers Publish writes manifests for
+const (
+	Homebrew = "homebrew"
+	Scoop    = "scoop"
+	Winget   = "winget"
+	Deb      = "deb" // an apt repository of .deb packages
+	RPM      = "rpm" // a yum repository of .rpm packages
+)
+
+// wingetManifestVersion is the schema version of the winget manifests
+const wingetManifestVersion = "1.6.0"
+
+// PackageMetadata is used for package manager manifests, which are
+// rewritten with every release
+var PackageMetadata = Metadata{ContentType: "text/plain; charset=utf-8", CacheControl: ManifestMetadata.CacheControl}
+
+// Packages describes the package manager manifests Publish writes below
+// PackagesDir, pointing at the artifacts of the release with their SHA256,
+// so that a Homebrew tap, Scoop bucket or winget-pkgs pull request can take
+// them as they are and follow the channel the release is published to. For
+// apt and yum, it wraps the Linux binaries into .deb and .rpm packages
+// installing /usr/bin/<Name> and writes the repositories serving them.
+type Packages struct {
+	Managers    []string // homebrew, scoop, winget, deb or rpm
+	BaseURL     string   // URL the update tree is served from, such as https://example.com/myapp
+	Name        string   // name of the package and its command
+	Description string   // one line description, required for winget
+	Homepage    string   // Optional
+	License     string   // SPDX identifier such as MIT, required for winget
+	Publisher   string   // publisher of the winget package, such as Example Corp
+}
+
+// WingetID returns the PackageIdentifier of the winget package, such as
+// ExampleCorp.MyApp
+func (p *Packages) WingetID() string {
+	strip := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' {
+				return r
+			}
+			return -1
+		}, s)
+	}
+	return strip(p.Publisher) + "." + strip(p.Name)
+}
+
+// validate checks that packages can be written for r
+func (p *Packages) validate(r *Release) error {
+	if len(p.Managers) == 0 || p.BaseURL == "" || p.Name == "" {
+		return fmt.Errorf("package manifests need package managers and the base URL and name of the package")
+	}
+	if len(r.EncryptTo) > 0 {
+		return fmt.Errorf("package managers cannot install encrypted artifacts")
+	}
+	for _, m := range p.Managers {
+		switch m {
+		case Homebrew:
+			if len(p.platforms(r, Homebrew)) == 0 {
+				return fmt.Errorf("homebrew needs a darwin or linux amd64 or arm64 artifact")
+			}
+		case Scoop, Winget:
+			if r.Archive != archive.Zip {
+				return fmt.Errorf("%s needs zip archives", m)
+			}
+			if len(p.platforms(r, m)) == 0 {
+				return fmt.Errorf("%s needs a windows artifact", m)
+			}
+			if m == Winget && (p.Publisher == "" || p.Description == "" || p.License == "") {
+				return fmt.Errorf("winget needs the publisher, description and license of the package")
+			}
+		case Deb, RPM:
+			if len(p.platforms(r, m)) == 0 {
+				return fmt.Errorf("%s needs a linux artifact", m)
+			}
+		default:
+			return fmt.Errorf("unknown package manager %q, expected homebrew, scoop, winget, deb or rpm", m)
+		}
+	}
+	return nil
+}
+
+// platforms maps the platforms of r's artifacts to the architecture names
+// of manager, leaving out platforms it does not install
+func (p *Packages) platforms(r *Release, manager string) map[string]string {
+	arches := map[string]map[string]string{
+		Homebrew: {"darwin-arm64": "macos arm", "darwin-amd64": "macos intel", "linux-arm64": "linux arm", "linux-amd64": "linux intel"},
+		Scoop:    {"windows-amd64": "64bit", "windows-386": "32bit", "windows-arm64": "arm64"},
+		Winget:   {"windows-amd64": "x64", "windows-386": "x86", "windows-arm64": "arm64"},
+		Deb:      debArches,
+		RPM:      rpmArches,
+	}[manager]
+	platforms := map[string]string{}
+	for _, a := range r.Artifacts {
+		if arch, ok := arches[a.Platform]; ok {
+			platforms[a.Platform] = arch
+		}
+	}
+	return platforms
+}
+
+// packageArtifact is an artifact of the release as a package manager
+// downloads it
+type packageArtifact struct {
+	platform string
+	arch     string
+	url      string
+	sha256   string
+}
+
+// putPackages stores the manifests of p for release r, whose artifacts
+// are stored at artifactNames with sums being the SHA256 of the stored files
+func putPackages(ctx context.Context, backend Backend, p *Packages, r *Release, artifactNames []string, sums [][]byte, date time.Time) error {
+	for _, manager := range p.Managers {
+		switch manager {
+		case Deb:
+			if err := putDebRepo(ctx, backend, p, r, date); err != nil {
+				return err
+			}
+			continue
+		case RPM:
+			if err := putRPMRepo(ctx, backend, p, r, date); err != nil {
+				return err
+			}
+			continue
+		}
+		arches := p.platforms(r, manager)
+		var artifacts []packageArtifact
+		for i, a := range r.Artifacts {
+			if arch, ok := arches[a.Platform]; ok {
+				artifacts = append(artifacts, packageArtifact{
+					platform: a.Platform,
+					arch:     arch,
+					url:      strings.TrimSuffix(p.BaseURL, "/") + "/" + artifactNames[i],
+					sha256:   hex.EncodeToString(sums[i]),
+				})
+			}
+		}
+		files, err := p.manifests(manager, r, artifacts, date)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(files))
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := backend.Put(ctx, path.Join(PackagesDir, manager, name), strings.NewReader(files[name]), PackageMetadata); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// manifests returns the files making up the manifest of manager by name
+func (p *Packages) manifests(manager string, r *Release, artifacts []packageArtifact, date time.Time) (map[string]string, error) {
+	switch manager {
+	case Homebrew:
+		return map[string]string{p.Name + ".rb": p.formula(r, artifacts)}, nil
+	case Scoop:
+		b, err := p.scoopManifest(r, artifacts)
+		return map[string]string{p.Name + ".json": string(b)}, err
+	}
+	return p.wingetManifests(r, artifacts, date), nil
+}
+
+// formula returns the Homebrew formula of the release. Homebrew unpacks
+// compressed binaries as well as archives.
+func (p *Packages) formula(r *Release, artifacts []packageArtifact) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "class %s < Formula\n", formulaClass(p.Name))
+	if p.Description != "" {
+		fmt.Fprintf(&b, "  desc %s\n", rubyString(p.Description))
+	}
+	if p.Homepage != "" {
+		fmt.Fprintf(&b, "  homepage %s\n", rubyString(p.Homepage))
+	}
+	fmt.Fprintf(&b, "  version %s\n", rubyString(r.Version))
+	if p.License != "" {
+		fmt.Fprintf(&b, "  license %s\n", rubyString(p.License))
+	}
+	for _, system := range []string{"macos", "linux"} {
+		var blocks []string
+		for _, cpu := range []string{"arm", "intel"} {
+			for _, a := range artifacts {
+				if a.arch == system+" "+cpu {
+					blocks = append(blocks, fmt.Sprintf("    on_%s do\n      url %s\n      sha256 %s\n    end\n", cpu, rubyString(a.url), rubyString(a.sha256)))
+				}
+			}
+		}
+		if len(blocks) > 0 {
+			fmt.Fprintf(&b, "\n  on_%s do\n%s  end\n", system, strings.Join(blocks, ""))
+		}
+	}
+	b.WriteString("\n  def install\n")
+	if r.Archive != "" {
+		fmt.Fprintf(&b, "    bin.install %s\n", rubyString(r.Executable))
+	} else {
+		fmt.Fprintf(&b, "    bin.install Dir[\"*\"].first => %s\n", rubyString(p.Name))
+	}
+	b.WriteString("  end\nend\n")
+	return b.String()
+}
+
+// formulaClass returns the class name Homebrew expects for a formula, such
+// as MyApp for my-app
+func formulaClass(name string) string {
+	var b strings.Builder
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
+
+// rubyString quotes s as a Ruby string literal without interpolation
+func rubyString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, `#`, `\#`).Replace(s) + `"`
+}
+
+// scoopManifest returns the Scoop manifest of the release
+func (p *Packages) scoopManifest(r *Release, artifacts []packageArtifact) ([]byte, error) {
+	type arch struct {
+		URL  string `json:"url"`
+		Hash string `json:"hash"`
+	}
+	m := struct {
+		Version      string          `json:"version"`
+		Description  string          `json:"description,omitempty"`
+		Homepage     string          `json:"homepage,omitempty"`
+		License      string          `json:"license,omitempty"`
+		Architecture map[string]arch `json:"architecture"`
+		Bin          string          `json:"bin"`
+	}{
+		Version:      r.Version,
+		Description:  p.Description,
+		Homepage:     p.Homepage,
+		License:      p.License,
+		Architecture: map[string]arch{},
+		Bin:          ExecutableName(r.Executable, "windows-amd64"),
+	}
+	for _, a := range artifacts {
+		m.Architecture[a.arch] = arch{URL: a.url, Hash: a.sha256}
+	}
+	b, err := json.MarshalIndent(m, "", "    ")
+	return append(b, '\n'), err
+}
+
+// wingetManifests returns the version, installer and default locale
+// manifests of the release, the multi-file layout winget-pkgs expects
+func (p *Packages) wingetManifests(r *Release, artifacts []packageArtifact, date time.Time) map[string]string {
+	id := p.WingetID()
+	header := fmt.Sprintf("PackageIdentifier: %s\nPackageVersion: %s\n", yamlString(id), yamlString(r.Version))
+	footer := func(manifestType string) string {
+		return fmt.Sprintf("ManifestType: %s\nManifestVersion: %s\n", manifestType, wingetManifestVersion)
+	}
+
+	version := header + "DefaultLocale: en-US\n" + footer("version")
+
+	var installer strings.Builder
+	installer.WriteString(header)
+	fmt.Fprintf(&installer, "InstallerType: zip\nNestedInstallerType: portable\nNestedInstallerFiles:\n- RelativeFilePath: %s\n  PortableCommandAlias: %s\n",
+		yamlString(ExecutableName(r.Executable, "windows-amd64")), yamlString(p.Name))
+	fmt.Fprintf(&installer, "ReleaseDate: %s\nInstallers:\n", date.UTC().Format(time.DateOnly))
+	for _, a := range artifacts {
+		fmt.Fprintf(&installer, "- Architecture: %s\n  InstallerUrl: %s\n  InstallerSha256: %s\n", a.arch, yamlString(a.url), strings.ToUpper(a.sha256))
+	}
+	installer.WriteString(footer("installer"))
+
+	var locale strings.Builder
+	locale.WriteString(header)
+	fmt.Fprintf(&locale, "PackageLocale: en-US\nPublisher: %s\nPackageName: %s\nLicense: %s\nShortDescription: %s\n",
+		yamlString(p.Publisher), yamlString(p.Name), yamlString(p.License), yamlString(p.Description))
+	if p.Homepage != "" {
+		fmt.Fprintf(&locale, "PackageUrl: %s\n", yamlString(p.Homepage))
+	}
+	locale.WriteString(footer("defaultLocale"))
+
+	return map[string]string{
+		id + ".yaml":              version,
+		id + ".installer.yaml":    installer.String(),
+		id + ".locale.en-US.yaml": locale.String(),
+	}
+}
+
+// yamlString quotes s as a YAML double quoted scalar, whose escapes are a
+// superset of those of JSON strings
+func yamlString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
@@ -0,0 +1,23 @@
+package publish
+
+import (
+	"io"
+
+	"github.com/bobo/go-selfupdate/internal/bsdiff"
+	"github.com/bobo/go-selfupdate/selfupdate"
+)
+
+// PatchMetadata is used for binary patches, which like artifacts never change
+// once published.
+var PatchMetadata = Metadata{ContentType: "application/octet-stream", CacheControl: ArtifactMetadata.CacheControl}
+
+// PatchPath returns the slash separated path of the patch from one version to
+// another relative to the root of the update tree
+func PatchPath(from, to, platform string) string {
+	return selfupdate.PatchPath(from, to, platform)
+}
+
+// CreatePatch writes a binary patch transforming oldBin into newBin to w
+func CreatePatch(w io.Writer, oldBin, newBin []byte) error {
+	return bsdiff.Diff(oldBin, newBin, w)
+}
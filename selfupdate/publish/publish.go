@@ -0,0 +1,521 @@
+// Package publish generates the manifests and compressed binaries consumed by
+// the selfupdate client. It is the library form of the go-selfupdate command
+// so that release tooling written in Go can publish updates directly.
+package publish
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+
+	"github.com/bobo/go-selfupdate/internal/archive"
+	compress "github.com/bobo/go-selfupdate/internal/compression"
+	"github.com/bobo/go-selfupdate/selfupdate"
+)
+
+const stableChannel = "stable"
+
+// Artifact is a single platform binary belonging to a release
+type Artifact struct {
+	Platform string // ex: linux-amd64
+	Path     string // path to the uncompressed binary
+}
+
+// Release describes one version of an application published to a channel
+type Release struct {
+	Version     string
+	Channel     string
+	Date        time.Time // defaults to the time the release is written
+	Compression string    // gzip (default), zstd or xz
+	Level       int       // compression level, 0 for the default
+	Notes       string    // optional release notes embedded in every manifest
+	NotesURL    string    // optional link to the release notes
+	Rollout     int       // percentage of installations offered the release, everyone when 0
+	SBOM        string    // cyclonedx or spdx to store an SBOM of every Go binary next to its artifact
+	Provenance  bool      // store a SLSA provenance statement next to every artifact
+	BuilderID   string    // builder named in provenance statements, DefaultBuilderID when empty
+	Jobs        int       // artifacts processed concurrently, defaults to the number of CPUs
+	Archive     string    // tar.gz or zip to publish every binary in an archive instead of compressed
+	Executable  string    // name of the binary inside archives, required with Archive
+	Assets      []Asset   // extra files added to every archive
+	Checksums   bool      // store a SHA256SUMS file listing the artifacts
+	EncryptTo   []string  // age recipients, ex: age1..., every artifact is encrypted to
+	MinDisk     int64     // free bytes clients need to apply the release, no requirement when 0
+	MinMemory   int64     // available memory in bytes the release needs to run, no requirement when 0
+	Packages    *Packages // package manager manifests written for the release, none when nil
+	Artifacts   []Artifact
+
+	// Channels, when set, replaces Channel to publish the release to
+	// several channels at once. The artifacts are stored once and every
+	// channel gets manifests pointing at them, unless Layout places them
+	// per channel. Packages follow the artifacts of the first channel.
+	Channels []string
+
+	// Layout, when set, places artifacts where the client's BinLayout
+	// template expects them instead of at ArtifactPath. The template is
+	// relative to the base URL, so its result must start with Cmd.
+	Layout string
+	Cmd    string
+
+	// Index, when set, records every manifest Publish writes. Store it
+	// with PutIndex once all channels are published.
+	Index *selfupdate.Index
+}
+
+// CreateManifest computes the update manifest for the binary at path. The
+// binary is streamed through the hash functions rather than read into memory.
+func CreateManifest(path, version, channel string, date time.Time) (*selfupdate.UpdateInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read binary: %w", err)
+	}
+	defer f.Close()
+
+	h256, h512 := sha256.New(), sha512.New()
+	if _, err := io.Copy(io.MultiWriter(h256, h512), f); err != nil {
+		return nil, fmt.Errorf("failed to read binary: %w", err)
+	}
+	return newManifest(version, channel, date, h256.Sum(nil), h512.Sum(nil)), nil
+}
+
+// CompressArtifact writes the binary at path to w compressed with
+// compression (gzip, zstd or xz) at the given level, 0 being the default
+func CompressArtifact(w io.Writer, path, compression string, level int) error {
+	_, _, err := compressArtifact(w, path, compression, level)
+	return err
+}
+
+// compressArtifact streams the binary at path through the compressor into w
+// while computing its digests, so it is read once and never held in memory
+func compressArtifact(w io.Writer, path, compression string, level int) (sum256, sum512 []byte, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read binary: %w", err)
+	}
+	defer f.Close()
+
+	cw, err := compress.NewWriter(w, compression, level)
+	if err != nil {
+		return nil, nil, err
+	}
+	h256, h512 := sha256.New(), sha512.New()
+	if _, err := io.Copy(io.MultiWriter(h256, h512, cw), f); err != nil {
+		return nil, nil, fmt.Errorf("failed to compress binary: %w", err)
+	}
+	if err := cw.Close(); err != nil {
+		return nil, nil, fmt.Errorf("failed to compress binary: %w", err)
+	}
+	return h256.Sum(nil), h512.Sum(nil), nil
+}
+
+// DecompressArtifact returns the binary contained in an artifact compressed
+// with compression
+func DecompressArtifact(r io.Reader, compression string) ([]byte, error) {
+	cr, err := compress.NewReader(r, compression)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s reader: %w", compression, err)
+	}
+	defer cr.Close()
+
+	return io.ReadAll(cr)
+}
+
+func newManifest(version, channel string, date time.Time, sum256, sum512 []byte) *selfupdate.UpdateInfo {
+	return &selfupdate.UpdateInfo{
+		Version: version,
+		Sha256:  sum256,
+		Sha512:  sum512,
+		Channel: normalizeChannel(channel),
+		Date:    date.UTC(),
+	}
+}
+
+// ManifestPath returns the slash separated path of a platform manifest
+// relative to the root of the update tree
+func ManifestPath(channel, platform string) string {
+	return selfupdate.ManifestPath(channel, platform)
+}
+
+// ArtifactPath returns the slash separated path of a binary compressed with
+// compression, or archived in an archive format, relative to the root of the
+// update tree
+func ArtifactPath(version, platform, format string) string {
+	ext, err := FormatExtension(format)
+	if err != nil {
+		ext = "." + format
+	}
+	return path.Join(version, platform+ext)
+}
+
+// artifactPath returns the path of the artifact of platform in channel
+// relative to the root of the update tree, following r.Layout when set
+func (r *Release) artifactPath(channel, platform, format string) (string, error) {
+	if r.Layout == "" {
+		return ArtifactPath(r.Version, platform, format), nil
+	}
+	return LayoutPath(r.Layout, r.Cmd, channel, r.Version, platform, format)
+}
+
+// LayoutPath returns the path of the artifact of version for platform in
+// channel that layout, a client BinLayout template, places it at, relative
+// to the root of the update tree of cmd
+func LayoutPath(layout, cmd, channel, version, platform, format string) (string, error) {
+	ext, err := FormatExtension(format)
+	if err != nil {
+		return "", err
+	}
+	goos, goarch, _ := strings.Cut(platform, "-")
+	name, err := selfupdate.ExpandLayout(layout, selfupdate.LayoutData{
+		Cmd:      cmd,
+		Channel:  normalizeChannel(channel),
+		Version:  version,
+		Platform: platform,
+		OS:       goos,
+		Arch:     goarch,
+		Ext:      ext,
+	})
+	if err != nil {
+		return "", err
+	}
+	if cmd == "" {
+		return name, nil
+	}
+	rel, ok := strings.CutPrefix(name, cmd+"/")
+	if !ok {
+		return "", fmt.Errorf("layout %q places %s outside the update tree of %s", layout, name, cmd)
+	}
+	return rel, nil
+}
+
+// WriteTree writes the manifests and compressed binaries of r below dir
+func WriteTree(dir string, r *Release) error {
+	return Publish(context.Background(), r, &DirBackend{Root: dir})
+}
+
+// Publish writes the manifests and compressed binaries of r to backend.
+// Artifacts are written before their manifest so clients never see a
+// manifest pointing at a binary that has not been uploaded yet. Up to r.Jobs
+// artifacts are processed at once, so backend must be safe for concurrent
+// use.
+func Publish(ctx context.Context, r *Release, backend Backend) error {
+	date := r.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	compression := r.Compression
+	if compression == "" {
+		compression = compress.Gzip
+	}
+	if err := compress.Validate(compression); err != nil {
+		return err
+	}
+	if r.Archive != "" {
+		if err := archive.Validate(r.Archive); err != nil {
+			return err
+		}
+		if r.Executable == "" {
+			return fmt.Errorf("archives need the name of the executable")
+		}
+	}
+
+	if r.SBOM != "" {
+		if err := ValidateSBOM(r.SBOM); err != nil {
+			return err
+		}
+	}
+	if r.Index != nil && r.Index.IsYanked(r.Version) {
+		return fmt.Errorf("version %s was yanked and cannot be published again", r.Version)
+	}
+	recipients, err := ParseRecipients(r.EncryptTo)
+	if err != nil {
+		return err
+	}
+	if r.Rollout < 0 || r.Rollout > 100 {
+		return fmt.Errorf("invalid rollout %d%%", r.Rollout)
+	}
+	if r.MinDisk < 0 || r.MinMemory < 0 {
+		return fmt.Errorf("negative resource requirement")
+	}
+	if r.Packages != nil {
+		if err := r.Packages.validate(r); err != nil {
+			return err
+		}
+	}
+	format := compression
+	if r.Archive != "" {
+		format = r.Archive
+	}
+	channels := r.Channels
+	if len(channels) == 0 {
+		channels = []string{r.Channel}
+	}
+	// channels whose artifacts the layout puts at the same paths share them
+	var groups []channelGroup
+	for _, channel := range channels {
+		names, err := r.artifactNames(channel, format)
+		if err != nil {
+			return err
+		}
+		i := slices.IndexFunc(groups, func(g channelGroup) bool { return slices.Equal(g.names, names) })
+		if i < 0 {
+			if r.Checksums {
+				if _, err := checksumsPath(names); err != nil {
+					return err
+				}
+			}
+			i = len(groups)
+			groups = append(groups, channelGroup{names: names})
+		}
+		groups[i].channels = append(groups[i].channels, channel)
+	}
+
+	for i, g := range groups {
+		infos, sums, err := publishArtifacts(ctx, r, g.channels[0], g.names, compression, recipients, date, backend)
+		if err != nil {
+			return err
+		}
+		if r.Checksums {
+			if err := putChecksums(ctx, backend, g.names, sums); err != nil {
+				return err
+			}
+		}
+		if r.Packages != nil && i == 0 {
+			if err := putPackages(ctx, backend, r.Packages, r, g.names, sums, date); err != nil {
+				return err
+			}
+		}
+		if r.Index != nil {
+			for j, a := range r.Artifacts {
+				r.Index.Add(a.Platform, *infos[j])
+			}
+		}
+		// the other channels only get manifests of the artifacts just stored
+		for _, channel := range g.channels[1:] {
+			for j, a := range r.Artifacts {
+				info := *infos[j]
+				info.Channel = normalizeChannel(channel)
+				if err := PutManifest(ctx, backend, a.Platform, &info); err != nil {
+					return err
+				}
+				if r.Index != nil {
+					r.Index.Add(a.Platform, info)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// channelGroup is a set of channels sharing the artifacts at names
+type channelGroup struct {
+	channels []string
+	names    []string
+}
+
+// artifactNames returns the paths of the artifacts of r in channel
+func (r *Release) artifactNames(channel, format string) ([]string, error) {
+	names := make([]string, len(r.Artifacts))
+	seen := map[string]string{}
+	for i, a := range r.Artifacts {
+		name, err := r.artifactPath(channel, a.Platform, format)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := seen[name]; ok {
+			return nil, fmt.Errorf("layout puts %s and %s both at %s", other, a.Platform, name)
+		}
+		seen[name] = a.Platform
+		names[i] = name
+	}
+	return names, nil
+}
+
+// publishArtifacts stores the artifacts of r at names with their manifests
+// in channel, up to r.Jobs at once. It returns the manifests and the SHA256
+// of every stored artifact.
+func publishArtifacts(ctx context.Context, r *Release, channel string, names []string, compression string, recipients []age.Recipient, date time.Time, backend Backend) ([]*selfupdate.UpdateInfo, [][]byte, error) {
+	jobs := r.Jobs
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		infos    = make([]*selfupdate.UpdateInfo, len(r.Artifacts))
+		sums     = make([][]byte, len(r.Artifacts))
+		sem      = make(chan struct{}, jobs)
+	)
+	for i, a := range r.Artifacts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if ctx.Err() != nil {
+				return
+			}
+
+			info, sum, err := publishArtifact(ctx, r, channel, a, names[i], compression, recipients, date, backend)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("%s: %w", a.Platform, err)
+					cancel()
+				}
+				mu.Unlock()
+				return
+			}
+			infos[i], sums[i] = info, sum
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, nil, firstErr
+	}
+	return infos, sums, nil
+}
+
+// publishArtifact stores the compressed or archived binary of a at name,
+// encrypted to recipients if there are any, followed by its manifest in
+// channel. It returns the manifest and the SHA256 of the stored artifact.
+func publishArtifact(ctx context.Context, r *Release, channel string, a Artifact, name, compression string, recipients []age.Recipient, date time.Time, backend Backend) (*selfupdate.UpdateInfo, []byte, error) {
+	format := compression
+	write := func(w io.Writer) ([]byte, []byte, error) {
+		return compressArtifact(w, a.Path, compression, r.Level)
+	}
+	var exe string
+	if r.Archive != "" {
+		format, exe = r.Archive, ExecutableName(r.Executable, a.Platform)
+		write = func(w io.Writer) ([]byte, []byte, error) {
+			return archiveArtifact(w, r.Archive, a.Path, exe, r.Assets, date, r.Level)
+		}
+	}
+
+	contentType := FormatContentType(format)
+	if len(recipients) > 0 {
+		write, contentType = encryptArtifact(recipients, write), "application/octet-stream"
+	}
+	sum256, sum512, fileSum, size, err := putArtifact(ctx, backend, name, contentType, write)
+	if err != nil {
+		return nil, nil, err
+	}
+	info := newManifest(r.Version, channel, date, sum256, sum512)
+	info.Size = size
+	if r.SBOM != "" {
+		if info.SBOM, err = putSBOM(ctx, backend, r, a, name, format, date); err != nil {
+			return nil, nil, err
+		}
+	}
+	if r.Provenance {
+		if info.Provenance, err = putProvenance(ctx, backend, r, a, name, format, fileSum, date); err != nil {
+			return nil, nil, err
+		}
+	}
+	if r.Archive != "" {
+		info.Archive, info.Executable = r.Archive, exe
+	} else {
+		info.Compression = compression
+	}
+	info.Notes = r.Notes
+	info.NotesURL = r.NotesURL
+	info.Rollout = r.Rollout
+	info.MinDisk, info.MinMemory = r.MinDisk, r.MinMemory
+	if len(recipients) > 0 {
+		info.Encryption = AgeEncryption
+	}
+	if err := PutManifest(ctx, backend, a.Platform, info); err != nil {
+		return nil, nil, err
+	}
+	return info, fileSum, nil
+}
+
+// PutManifest stores info as the manifest of platform in the channel named
+// by info. Dates are written in UTC so rewriting a manifest elsewhere does
+// not change it.
+func PutManifest(ctx context.Context, backend Backend, platform string, info *selfupdate.UpdateInfo) error {
+	m := *info
+	m.Date = m.Date.UTC()
+	b, err := json.MarshalIndent(&m, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	return backend.Put(ctx, ManifestPath(info.Channel, platform), bytes.NewReader(b), ManifestMetadata)
+}
+
+// PutPluginManifest stores the plugin manifest of platform in channel,
+// listing the manifest of the version of each plugin clients install.
+// Plugins are published with Publish to a backend rooted at the directory
+// of selfupdate.PluginCmd, and backend here is rooted at the application.
+func PutPluginManifest(ctx context.Context, backend Backend, channel, platform string, plugins map[string]*selfupdate.UpdateInfo) error {
+	m := struct {
+		Plugins map[string]selfupdate.UpdateInfo
+	}{map[string]selfupdate.UpdateInfo{}}
+	for name, info := range plugins {
+		if info.Channel != normalizeChannel(channel) {
+			return fmt.Errorf("plugin %s: %w: expected %s, got %s", name, selfupdate.ErrChannelMismatch, normalizeChannel(channel), info.Channel)
+		}
+		p := *info
+		p.Date = p.Date.UTC()
+		m.Plugins[name] = p
+	}
+	b, err := json.MarshalIndent(&m, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to encode plugin manifest: %w", err)
+	}
+	return backend.Put(ctx, selfupdate.PluginManifestPath(channel, platform), bytes.NewReader(b), ManifestMetadata)
+}
+
+// putArtifact has write compress or archive the binary into a temporary
+// file, computing its digests on the way, and stores the file. Backends
+// receive a seekable reader so uploads can stream with a known length.
+// Besides the digests of the binary it returns the SHA256 and size of the
+// stored file.
+func putArtifact(ctx context.Context, backend Backend, name, contentType string, write func(w io.Writer) (sum256, sum512 []byte, err error)) (sum256, sum512, fileSum []byte, size int64, err error) {
+	tmp, err := os.CreateTemp("", "selfupdate-artifact-*")
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	if sum256, sum512, err = write(io.MultiWriter(tmp, h)); err != nil {
+		return nil, nil, nil, 0, err
+	}
+	if size, err = tmp.Seek(0, io.SeekCurrent); err != nil {
+		return nil, nil, nil, 0, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, nil, 0, err
+	}
+	meta := ArtifactMetadata
+	meta.ContentType = contentType
+	if err := backend.Put(ctx, name, tmp, meta); err != nil {
+		return nil, nil, nil, 0, err
+	}
+	return sum256, sum512, h.Sum(nil), size, nil
+}
+
+func normalizeChannel(channel string) string {
+	if channel == "" {
+		return stableChannel
+	}
+	return channel
+}
@@ -0,0 +1,586 @@
+package publish
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+
+	"github.com/bobo/go-selfupdate/selfupdate"
+)
+
+func writeTestBinary(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "myapp")
+	if err := os.WriteFile(path, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestWriteTree(t *testing.T) {
+	bin := writeTestBinary(t, "binary contents")
+	date := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		channel      string
+		manifestPath string
+	}{
+		{"stable channel", "stable", "linux-amd64.json"},
+		{"empty channel is stable", "", "linux-amd64.json"},
+		{"beta channel", "beta", filepath.Join("beta", "linux-amd64.json")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			err := WriteTree(dir, &Release{
+				Version:   "1.2",
+				Channel:   tt.channel,
+				Date:      date,
+				Artifacts: []Artifact{{Platform: "linux-amd64", Path: bin}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := os.ReadFile(filepath.Join(dir, tt.manifestPath))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var info selfupdate.UpdateInfo
+			if err := json.Unmarshal(b, &info); err != nil {
+				t.Fatal(err)
+			}
+			sum := sha256.Sum256([]byte("binary contents"))
+			if !bytes.Equal(info.Sha256, sum[:]) {
+				t.Errorf("unexpected sha256 %x", info.Sha256)
+			}
+			if info.Version != "1.2" || info.Channel != normalizeChannel(tt.channel) || !info.Date.Equal(date) {
+				t.Errorf("unexpected manifest %+v", info)
+			}
+
+			f, err := os.Open(filepath.Join(dir, "1.2", "linux-amd64.gz"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if fi, err := f.Stat(); err != nil || fi.Size() != info.Size {
+				t.Errorf("manifest size %d does not match the artifact: %v", info.Size, err)
+			}
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(gz)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "binary contents" {
+				t.Errorf("unexpected artifact contents %q", got)
+			}
+		})
+	}
+}
+
+func TestSigningBackend(t *testing.T) {
+	pubFile, privFile, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParsePrivateKey(privFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := selfupdate.ParsePublicKey(string(pubFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compact := range []bool{false, true} {
+		dir := t.TempDir()
+		var backend Backend = &SigningBackend{Backend: &DirBackend{Root: dir}, Key: key}
+		if compact {
+			backend = &CompactBackend{Backend: backend}
+		}
+		err = Publish(context.Background(), &Release{
+			Version:   "1.2",
+			Artifacts: []Artifact{{Platform: "linux-amd64", Path: writeTestBinary(t, "binary contents")}},
+		}, backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifySignatures(t, pub, dir, "linux-amd64.json", filepath.Join("1.2", "linux-amd64.gz"))
+
+		manifest, err := os.ReadFile(filepath.Join(dir, "linux-amd64.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bytes.Contains(manifest, []byte("\n")); got == compact {
+			t.Errorf("compact %v: unexpected manifest %s", compact, manifest)
+		}
+	}
+}
+
+func verifySignatures(t *testing.T, pub ed25519.PublicKey, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigFile, err := os.ReadFile(filepath.Join(dir, name+selfupdate.SignatureSuffix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Count(sigFile, []byte("\n")) != 1 {
+			t.Errorf("signature for %s is not a single line: %q", name, sigFile)
+		}
+		sig, err := selfupdate.DecodeKeyData(string(sigFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest := sha512.Sum512(content)
+		if ed25519.VerifyWithOptions(pub, digest[:], sig, &ed25519.Options{Hash: crypto.SHA512}) != nil {
+			t.Errorf("signature for %s does not verify", name)
+		}
+	}
+}
+
+func TestPublishConcurrently(t *testing.T) {
+	platforms := []string{"linux-amd64", "linux-arm64", "darwin-amd64", "darwin-arm64", "windows-amd64", "freebsd-amd64"}
+	var artifacts []Artifact
+	for _, p := range platforms {
+		artifacts = append(artifacts, Artifact{Platform: p, Path: writeTestBinary(t, "binary for "+p)})
+	}
+
+	dir := t.TempDir()
+	index := &selfupdate.Index{}
+	err := Publish(context.Background(), &Release{Version: "1.2", Jobs: 3, Artifacts: artifacts, Index: index}, &DirBackend{Root: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range platforms {
+		if _, err := os.Stat(filepath.Join(dir, ManifestPath("stable", p))); err != nil {
+			t.Error(err)
+		}
+	}
+	if got := len(index.Channels["stable"][0].Platforms); got != len(platforms) {
+		t.Errorf("index lists %d platforms, want %d", got, len(platforms))
+	}
+
+	artifacts[2].Path = filepath.Join(dir, "missing")
+	err = Publish(context.Background(), &Release{Version: "1.3", Jobs: 3, Artifacts: artifacts}, &DirBackend{Root: dir})
+	if err == nil || !strings.HasPrefix(err.Error(), "darwin-amd64: ") {
+		t.Errorf("expected error for darwin-amd64, got %v", err)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "myapp")
+	if err := os.WriteFile(bin, []byte("myapp binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	release := &Release{
+		Version:   "1.2",
+		Checksums: true,
+		Artifacts: []Artifact{{Platform: "linux-amd64", Path: bin}, {Platform: "windows-amd64", Path: bin}},
+	}
+	if err := WriteTree(dir, release); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "1.2", ChecksumsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sums, err := ParseChecksums(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sums) != 2 {
+		t.Fatalf("got checksums for %v, want both artifacts", sums)
+	}
+	for _, name := range []string{"linux-amd64.gz", "windows-amd64.gz"} {
+		b, err := os.ReadFile(filepath.Join(dir, "1.2", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum := sha256.Sum256(b); !bytes.Equal(sums[name], sum[:]) {
+			t.Errorf("checksum of %s does not match the artifact", name)
+		}
+	}
+
+	release.Layout = "{{.Platform}}/{{.Version}}{{.Ext}}"
+	if err := WriteTree(t.TempDir(), release); err == nil {
+		t.Error("expected error for artifacts in different directories")
+	}
+	if _, err := ParseChecksums(strings.NewReader("abc  myapp\n")); err == nil {
+		t.Error("expected error for an invalid checksum")
+	}
+}
+
+func TestPackages(t *testing.T) {
+	bin := writeTestBinary(t, "myapp binary")
+	dir := t.TempDir()
+	release := &Release{
+		Version:    "1.2",
+		Date:       time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Archive:    "zip",
+		Executable: "myapp",
+		Packages: &Packages{
+			Managers:    []string{Homebrew, Scoop, Winget},
+			BaseURL:     "https://example.com/myapp/",
+			Name:        "my-app",
+			Description: `The "#1" app`,
+			License:     "MIT",
+			Publisher:   "Example Corp",
+		},
+		Artifacts: []Artifact{{Platform: "darwin-arm64", Path: bin}, {Platform: "linux-amd64", Path: bin}, {Platform: "windows-amd64", Path: bin}},
+	}
+	if err := WriteTree(dir, release); err != nil {
+		t.Fatal(err)
+	}
+	sum := func(name string) string {
+		b, err := os.ReadFile(filepath.Join(dir, "1.2", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := sha256.Sum256(b)
+		return hex.EncodeToString(s[:])
+	}
+	read := func(name string) string {
+		b, err := os.ReadFile(filepath.Join(dir, PackagesDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	formula := read("homebrew/my-app.rb")
+	for _, want := range []string{
+		"class MyApp < Formula\n",
+		`desc "The \"\#1\" app"`,
+		"  on_macos do\n    on_arm do\n      url \"https://example.com/myapp/1.2/darwin-arm64.zip\"\n      sha256 \"" + sum("darwin-arm64.zip") + "\"",
+		"  on_linux do\n    on_intel do\n",
+		`bin.install "myapp"`,
+	} {
+		if !strings.Contains(formula, want) {
+			t.Errorf("formula lacks %q:\n%s", want, formula)
+		}
+	}
+
+	var scoop struct {
+		Version      string
+		Architecture map[string]struct{ URL, Hash string }
+		Bin          string
+	}
+	if err := json.Unmarshal([]byte(read("scoop/my-app.json")), &scoop); err != nil {
+		t.Fatal(err)
+	}
+	if a := scoop.Architecture["64bit"]; scoop.Version != "1.2" || scoop.Bin != "myapp.exe" || len(scoop.Architecture) != 1 ||
+		a.URL != "https://example.com/myapp/1.2/windows-amd64.zip" || a.Hash != sum("windows-amd64.zip") {
+		t.Errorf("unexpected scoop manifest %+v", scoop)
+	}
+
+	installer := read("winget/ExampleCorp.my-app.installer.yaml")
+	if !strings.Contains(installer, "- Architecture: x64\n  InstallerUrl: \"https://example.com/myapp/1.2/windows-amd64.zip\"\n  InstallerSha256: "+strings.ToUpper(sum("windows-amd64.zip"))) ||
+		!strings.Contains(installer, "ReleaseDate: 2024-01-02\n") {
+		t.Errorf("unexpected winget installer manifest:\n%s", installer)
+	}
+	read("winget/ExampleCorp.my-app.yaml")
+	read("winget/ExampleCorp.my-app.locale.en-US.yaml")
+
+	release.Archive = "tar.gz"
+	if err := WriteTree(t.TempDir(), release); err == nil {
+		t.Error("expected error for scoop without zip archives")
+	}
+	release.Archive, release.Packages.Managers = "", []string{Homebrew}
+	if err := WriteTree(t.TempDir(), release); err != nil {
+		t.Errorf("homebrew with compressed binaries: %v", err)
+	}
+}
+
+func TestLinuxRepositories(t *testing.T) {
+	bin := writeTestBinary(t, "myapp binary")
+	dir := t.TempDir()
+	err := WriteTree(dir, &Release{
+		Version:   "1.3-beta1",
+		Packages:  &Packages{Managers: []string{Deb, RPM}, BaseURL: "https://example.com/myapp", Name: "myapp", License: "MIT"},
+		Artifacts: []Artifact{{Platform: "linux-amd64", Path: bin}, {Platform: "darwin-arm64", Path: bin}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(name string) []byte {
+		b, err := os.ReadFile(filepath.Join(dir, PackagesDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	deb := read("deb/pool/myapp_1.3~beta1_amd64.deb")
+	if !bytes.HasPrefix(deb, []byte("!<arch>\ndebian-binary   ")) {
+		t.Errorf("not an ar archive: %q", deb[:24])
+	}
+	sum := sha256.Sum256(deb)
+	packages := string(read("deb/Packages"))
+	for _, want := range []string{"Package: myapp\nVersion: 1.3~beta1\nArchitecture: amd64\n", "Filename: pool/myapp_1.3~beta1_amd64.deb\n", "SHA256: " + hex.EncodeToString(sum[:])} {
+		if !strings.Contains(packages, want) {
+			t.Errorf("Packages lacks %q:\n%s", want, packages)
+		}
+	}
+	sum = sha256.Sum256([]byte(packages))
+	if release := string(read("deb/Release")); !strings.Contains(release, " "+hex.EncodeToString(sum[:])+" "+strconv.Itoa(len(packages))+" Packages\n") {
+		t.Errorf("Release does not list Packages:\n%s", release)
+	}
+
+	rpm := read("rpm/pool/myapp-1.3~beta1-1.x86_64.rpm")
+	if !bytes.HasPrefix(rpm, []byte{0xed, 0xab, 0xee, 0xdb, 3, 0}) || !bytes.Equal(rpm[96:99], []byte{0x8e, 0xad, 0xe8}) {
+		t.Errorf("not an rpm package: %x", rpm[:100])
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(read("rpm/repodata/primary.xml.gz")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum = sha256.Sum256(rpm)
+	if !bytes.Contains(primary, []byte(`<checksum type="sha256" pkgid="YES">`+hex.EncodeToString(sum[:]))) || !bytes.Contains(primary, []byte(`<location href="pool/myapp-1.3~beta1-1.x86_64.rpm"/>`)) {
+		t.Errorf("primary.xml does not list the package:\n%s", primary)
+	}
+	if repomd := read("rpm/repodata/repomd.xml"); !bytes.Contains(repomd, []byte(`<location href="repodata/primary.xml.gz"/>`)) {
+		t.Errorf("repomd.xml does not list primary.xml:\n%s", repomd)
+	}
+}
+
+func TestEncryptArtifacts(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "myapp")
+	if err := os.WriteFile(bin, []byte("private binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	err = WriteTree(dir, &Release{
+		Version:   "1.2",
+		EncryptTo: []string{identity.Recipient().String()},
+		Artifacts: []Artifact{{Platform: "linux-amd64", Path: bin}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info selfupdate.UpdateInfo
+	readJSON(t, filepath.Join(dir, "linux-amd64.json"), &info)
+	if info.Encryption != AgeEncryption {
+		t.Errorf("manifest does not record the encryption: %+v", info)
+	}
+
+	read := func(identities []age.Identity) ([]byte, error) {
+		f, err := os.Open(filepath.Join(dir, "1.2", "linux-amd64.gz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		r, err := DecryptArtifact(f, identities)
+		if err != nil {
+			return nil, err
+		}
+		return ReadArtifact(r, "gzip", "")
+	}
+	if _, err := read(nil); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("got %v, want ErrEncrypted", err)
+	}
+	got, err := read([]age.Identity{identity})
+	if err != nil || string(got) != "private binary" {
+		t.Errorf("decrypted artifact %q, %v", got, err)
+	}
+
+	err = WriteTree(t.TempDir(), &Release{Version: "1.2", EncryptTo: []string{"age1nope"}, Artifacts: []Artifact{{Platform: "linux-amd64", Path: bin}}})
+	if err == nil {
+		t.Error("expected error for an invalid recipient")
+	}
+}
+
+// countingBackend counts the files stored by name
+type countingBackend struct {
+	Backend
+	mu   sync.Mutex
+	puts map[string]int
+}
+
+func (b *countingBackend) Put(ctx context.Context, name string, r io.Reader, meta Metadata) error {
+	b.mu.Lock()
+	b.puts[name]++
+	b.mu.Unlock()
+	return b.Backend.Put(ctx, name, r, meta)
+}
+
+func TestPublishChannels(t *testing.T) {
+	bin := writeTestBinary(t, "binary contents")
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	backend := &countingBackend{Backend: &DirBackend{Root: dir}, puts: map[string]int{}}
+	index := &selfupdate.Index{}
+	err = Publish(context.Background(), &Release{
+		Version:    "1.2",
+		Channels:   []string{"stable", "beta"},
+		EncryptTo:  []string{identity.Recipient().String()},
+		Provenance: true,
+		Artifacts:  []Artifact{{Platform: "linux-amd64", Path: bin}},
+		Index:      index,
+	}, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, n := range backend.puts {
+		if n != 1 {
+			t.Errorf("%s stored %d times", name, n)
+		}
+	}
+	var stable, beta selfupdate.UpdateInfo
+	readJSON(t, filepath.Join(dir, "linux-amd64.json"), &stable)
+	readJSON(t, filepath.Join(dir, "beta", "linux-amd64.json"), &beta)
+	if beta.Channel != "beta" {
+		t.Errorf("unexpected beta manifest %+v", beta)
+	}
+	beta.Channel = stable.Channel
+	if !reflect.DeepEqual(stable, beta) {
+		t.Errorf("channels describe different artifacts:\n%+v\n%+v", stable, beta)
+	}
+	if len(index.Channels["stable"]) != 1 || len(index.Channels["beta"]) != 1 {
+		t.Errorf("index does not list both channels: %+v", index.Channels)
+	}
+
+	// a layout placing artifacts per channel stores them per channel
+	dir = t.TempDir()
+	err = WriteTree(dir, &Release{
+		Version:   "1.2",
+		Channels:  []string{"stable", "beta"},
+		Layout:    "{{.Channel}}/{{.Version}}/{{.Platform}}{{.Ext}}",
+		Artifacts: []Artifact{{Platform: "linux-amd64", Path: bin}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"stable/1.2/linux-amd64.gz", "beta/1.2/linux-amd64.gz"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestAttestations(t *testing.T) {
+	// the test binary is a Go binary with build information
+	bin, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, format := range []string{CycloneDX, SPDX} {
+		t.Run(format, func(t *testing.T) {
+			dir := t.TempDir()
+			err := WriteTree(dir, &Release{
+				Version:    "1.2",
+				Date:       date,
+				Level:      1,
+				SBOM:       format,
+				Provenance: true,
+				BuilderID:  "https://ci.example.com/release",
+				Artifacts:  []Artifact{{Platform: "linux-amd64", Path: bin}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var info selfupdate.UpdateInfo
+			readJSON(t, filepath.Join(dir, "linux-amd64.json"), &info)
+			wantSBOM := map[string]string{CycloneDX: "1.2/linux-amd64.cdx.json", SPDX: "1.2/linux-amd64.spdx.json"}[format]
+			if info.SBOM != wantSBOM || info.Provenance != "1.2/linux-amd64.intoto.json" {
+				t.Fatalf("unexpected attestations in manifest %+v", info)
+			}
+
+			b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(info.SBOM)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(b), "pkg:golang/github.com/ulikunitz/xz@") {
+				t.Errorf("SBOM does not list the xz module:\n%s", b)
+			}
+
+			var statement struct {
+				Subject []struct {
+					Name   string
+					Digest map[string]string
+				}
+				Predicate struct {
+					RunDetails struct {
+						Builder struct{ ID string }
+					}
+				}
+			}
+			readJSON(t, filepath.Join(dir, filepath.FromSlash(info.Provenance)), &statement)
+			artifact, err := os.ReadFile(filepath.Join(dir, "1.2", "linux-amd64.gz"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum := sha256.Sum256(artifact)
+			if len(statement.Subject) != 1 || statement.Subject[0].Name != "1.2/linux-amd64.gz" ||
+				statement.Subject[0].Digest["sha256"] != hex.EncodeToString(sum[:]) {
+				t.Errorf("unexpected provenance subject %+v", statement.Subject)
+			}
+			if statement.Predicate.RunDetails.Builder.ID != "https://ci.example.com/release" {
+				t.Errorf("unexpected builder %q", statement.Predicate.RunDetails.Builder.ID)
+			}
+		})
+	}
+
+	err = WriteTree(t.TempDir(), &Release{
+		Version:   "1.2",
+		SBOM:      CycloneDX,
+		Artifacts: []Artifact{{Platform: "linux-amd64", Path: writeTestBinary(t, "not a Go binary")}},
+	})
+	if err == nil {
+		t.Error("expected error for an SBOM of a binary without build information")
+	}
+}
+
+func readJSON(t *testing.T, path string, v any) {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		t.Fatal(err)
+	}
+}
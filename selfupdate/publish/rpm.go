@@ -0,0 +1,401 @@
+package publish
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// rpmArches maps Go platforms to RPM architectures
+var rpmArches = map[string]string{
+	"linux-amd64":   "x86_64",
+	"linux-arm64":   "aarch64",
+	"linux-386":     "i686",
+	"linux-arm":     "armv7hl",
+	"linux-ppc64le": "ppc64le",
+	"linux-riscv64": "riscv64",
+	"linux-s390x":   "s390x",
+}
+
+// rpmRelease is the release of every package, the packaging of a version
+// never changes
+const rpmRelease = "1"
+
+// Types of RPM header entries
+const (
+	rpmInt16       = 3
+	rpmInt32       = 4
+	rpmString      = 6
+	rpmBin         = 7
+	rpmStringArray = 8
+	rpmI18NString  = 9
+)
+
+// Tags of RPM headers
+const (
+	rpmTagSignatures = 62 // region of the signature header
+	rpmTagImmutable  = 63 // region of the main header
+
+	rpmTagName              = 1000
+	rpmTagVersion           = 1001
+	rpmTagRelease           = 1002
+	rpmTagSummary           = 1004
+	rpmTagDescription       = 1005
+	rpmTagBuildTime         = 1006
+	rpmTagSize              = 1009
+	rpmTagVendor            = 1011
+	rpmTagLicense           = 1014
+	rpmTagGroup             = 1016
+	rpmTagURL               = 1020
+	rpmTagOS                = 1021
+	rpmTagArch              = 1022
+	rpmTagFileSizes         = 1028
+	rpmTagFileModes         = 1030
+	rpmTagFileRdevs         = 1033
+	rpmTagFileMtimes        = 1034
+	rpmTagFileDigests       = 1035
+	rpmTagFileLinkTos       = 1036
+	rpmTagFileFlags         = 1037
+	rpmTagFileUserName      = 1039
+	rpmTagFileGroupName     = 1040
+	rpmTagSourceRPM         = 1044
+	rpmTagFileVerifyFlags   = 1045
+	rpmTagProvideName       = 1047
+	rpmTagRequireFlags      = 1048
+	rpmTagRequireName       = 1049
+	rpmTagRequireVersion    = 1050
+	rpmTagFileDevices       = 1095
+	rpmTagFileInodes        = 1096
+	rpmTagFileLangs         = 1097
+	rpmTagProvideFlags      = 1112
+	rpmTagProvideVersion    = 1113
+	rpmTagDirIndexes        = 1116
+	rpmTagBaseNames         = 1117
+	rpmTagDirNames          = 1118
+	rpmTagPayloadFormat     = 1124
+	rpmTagPayloadCompressor = 1125
+	rpmTagPayloadFlags      = 1126
+	rpmTagFileDigestAlgo    = 5011
+
+	rpmSigTagSize        = 1000
+	rpmSigTagMD5         = 1004
+	rpmSigTagPayloadSize = 1007
+	rpmSigTagSHA1        = 269
+	rpmSigTagSHA256      = 273
+)
+
+// Flags of RPM dependencies
+const (
+	rpmSenseLess   = 1 << 1
+	rpmSenseEqual  = 1 << 3
+	rpmSenseRPMLib = 1 << 24
+
+	// rpmlibRequires requires a feature of rpm up to a version
+	rpmlibRequires = rpmSenseRPMLib | rpmSenseLess | rpmSenseEqual
+)
+
+// rpmEntry is a tag of an RPM header with its encoded value
+type rpmEntry struct {
+	tag, typ, count uint32
+	data            []byte
+}
+
+// rpmHeader collects the tags of an RPM header
+type rpmHeader []rpmEntry
+
+func (h *rpmHeader) add(tag, typ uint32, count int, data []byte) {
+	*h = append(*h, rpmEntry{tag: tag, typ: typ, count: uint32(count), data: data})
+}
+
+func (h *rpmHeader) string(tag uint32, s string) {
+	h.add(tag, rpmString, 1, append([]byte(s), 0))
+}
+
+func (h *rpmHeader) i18nString(tag uint32, s string) {
+	h.add(tag, rpmI18NString, 1, append([]byte(s), 0))
+}
+
+func (h *rpmHeader) strings(tag uint32, ss ...string) {
+	var b []byte
+	for _, s := range ss {
+		b = append(append(b, s...), 0)
+	}
+	h.add(tag, rpmStringArray, len(ss), b)
+}
+
+func (h *rpmHeader) int32s(tag uint32, vs ...int32) {
+	b := make([]byte, 4*len(vs))
+	for i, v := range vs {
+		binary.BigEndian.PutUint32(b[4*i:], uint32(v))
+	}
+	h.add(tag, rpmInt32, len(vs), b)
+}
+
+func (h *rpmHeader) int16s(tag uint32, vs ...uint16) {
+	b := make([]byte, 2*len(vs))
+	for i, v := range vs {
+		binary.BigEndian.PutUint16(b[2*i:], v)
+	}
+	h.add(tag, rpmInt16, len(vs), b)
+}
+
+// marshal encodes the header as an immutable region named regionTag, which
+// is how rpm tells the tags that were signed
+func (h rpmHeader) marshal(regionTag uint32) []byte {
+	entries := append(rpmHeader(nil), h...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+	n := len(entries) + 1
+	index := make([]byte, 16, 16*n) // the region tag comes first
+	var store bytes.Buffer
+	for _, e := range entries {
+		align := map[uint32]int{rpmInt16: 2, rpmInt32: 4}[e.typ]
+		for align > 0 && store.Len()%align != 0 {
+			store.WriteByte(0)
+		}
+		index = binary.BigEndian.AppendUint32(index, e.tag)
+		index = binary.BigEndian.AppendUint32(index, e.typ)
+		index = binary.BigEndian.AppendUint32(index, uint32(store.Len()))
+		index = binary.BigEndian.AppendUint32(index, e.count)
+		store.Write(e.data)
+	}
+	// the region tag points at a trailer holding the size of the region as
+	// a negative offset into the index
+	binary.BigEndian.PutUint32(index[0:], regionTag)
+	binary.BigEndian.PutUint32(index[4:], rpmBin)
+	binary.BigEndian.PutUint32(index[8:], uint32(store.Len()))
+	binary.BigEndian.PutUint32(index[12:], 16)
+	for _, v := range []uint32{regionTag, rpmBin, uint32(int32(-16 * n)), 16} {
+		binary.Write(&store, binary.BigEndian, v)
+	}
+
+	var b bytes.Buffer
+	b.Write([]byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0})
+	binary.Write(&b, binary.BigEndian, []uint32{uint32(n), uint32(store.Len())})
+	b.Write(index)
+	b.Write(store.Bytes())
+	return b.Bytes()
+}
+
+// builtRPM is a package with what the repository metadata needs of it
+type builtRPM struct {
+	body        []byte
+	arch        string
+	headerStart int
+	headerEnd   int
+	installed   int
+	archive     int
+}
+
+// buildRPM returns an .rpm package installing the binary at binPath as
+// /usr/bin/<name>
+func (p *Packages) buildRPM(r *Release, binPath, arch string, date time.Time) (*builtRPM, error) {
+	bin, err := os.ReadFile(binPath)
+	if err != nil {
+		return nil, err
+	}
+	version := packageVersion(r.Version)
+	mtime := int32(date.Unix())
+
+	// the payload is a gzipped cpio archive in the newc format
+	var cpio bytes.Buffer
+	writeCpio := func(ino, mode, nlink int, name string, data []byte) {
+		fmt.Fprintf(&cpio, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+			ino, mode, 0, 0, nlink, mtime, len(data), 0, 0, 0, 0, len(name)+1, 0)
+		cpio.WriteString(name + "\x00")
+		for cpio.Len()%4 != 0 {
+			cpio.WriteByte(0)
+		}
+		cpio.Write(data)
+		for cpio.Len()%4 != 0 {
+			cpio.WriteByte(0)
+		}
+	}
+	writeCpio(1, 0100755, 1, "./usr/bin/"+p.Name, bin)
+	writeCpio(0, 0, 1, "TRAILER!!!", nil)
+	var payload bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&payload, gzip.BestCompression)
+	gz.Write(cpio.Bytes())
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	description := p.Description
+	if description == "" {
+		description = p.Name
+	}
+	license := p.License
+	if license == "" {
+		license = "Unspecified"
+	}
+	digest := sha256.Sum256(bin)
+	var h rpmHeader
+	h.string(rpmTagName, p.Name)
+	h.string(rpmTagVersion, version)
+	h.string(rpmTagRelease, rpmRelease)
+	h.i18nString(rpmTagSummary, description)
+	h.i18nString(rpmTagDescription, description)
+	h.int32s(rpmTagBuildTime, mtime)
+	h.int32s(rpmTagSize, int32(len(bin)))
+	h.string(rpmTagLicense, license)
+	h.i18nString(rpmTagGroup, "Unspecified")
+	h.string(rpmTagOS, "linux")
+	h.string(rpmTagArch, arch)
+	h.int32s(rpmTagFileSizes, int32(len(bin)))
+	h.int16s(rpmTagFileModes, 0100755)
+	h.int16s(rpmTagFileRdevs, 0)
+	h.int32s(rpmTagFileMtimes, mtime)
+	h.strings(rpmTagFileDigests, hex.EncodeToString(digest[:]))
+	h.strings(rpmTagFileLinkTos, "")
+	h.int32s(rpmTagFileFlags, 0)
+	h.strings(rpmTagFileUserName, "root")
+	h.strings(rpmTagFileGroupName, "root")
+	h.string(rpmTagSourceRPM, fmt.Sprintf("%s-%s-%s.src.rpm", p.Name, version, rpmRelease))
+	h.int32s(rpmTagFileVerifyFlags, -1)
+	h.strings(rpmTagProvideName, p.Name)
+	h.int32s(rpmTagRequireFlags, rpmlibRequires, rpmlibRequires, rpmlibRequires)
+	h.strings(rpmTagRequireName, "rpmlib(CompressedFileNames)", "rpmlib(FileDigests)", "rpmlib(PayloadFilesHavePrefix)")
+	h.strings(rpmTagRequireVersion, "3.0.4-1", "4.6.0-1", "4.0-1")
+	h.int32s(rpmTagFileDevices, 1)
+	h.int32s(rpmTagFileInodes, 1)
+	h.strings(rpmTagFileLangs, "")
+	h.int32s(rpmTagProvideFlags, rpmSenseEqual)
+	h.strings(rpmTagProvideVersion, version+"-"+rpmRelease)
+	h.int32s(rpmTagDirIndexes, 0)
+	h.strings(rpmTagBaseNames, p.Name)
+	h.strings(rpmTagDirNames, "/usr/bin/")
+	h.string(rpmTagPayloadFormat, "cpio")
+	h.string(rpmTagPayloadCompressor, "gzip")
+	h.string(rpmTagPayloadFlags, "9")
+	h.int32s(rpmTagFileDigestAlgo, 8) // SHA256
+	if p.Homepage != "" {
+		h.string(rpmTagURL, p.Homepage)
+	}
+	if p.Publisher != "" {
+		h.string(rpmTagVendor, p.Publisher)
+	}
+	header := h.marshal(rpmTagImmutable)
+
+	signed := append(append([]byte(nil), header...), payload.Bytes()...)
+	md5sum, sha1sum, sha256sum := md5.Sum(signed), sha1.Sum(header), sha256.Sum256(header)
+	var sig rpmHeader
+	sig.int32s(rpmSigTagSize, int32(len(signed)))
+	sig.add(rpmSigTagMD5, rpmBin, 16, md5sum[:])
+	sig.int32s(rpmSigTagPayloadSize, int32(cpio.Len()))
+	sig.string(rpmSigTagSHA1, hex.EncodeToString(sha1sum[:]))
+	sig.string(rpmSigTagSHA256, hex.EncodeToString(sha256sum[:]))
+	signature := sig.marshal(rpmTagSignatures)
+	for len(signature)%8 != 0 {
+		signature = append(signature, 0)
+	}
+
+	lead := make([]byte, 96)
+	copy(lead, []byte{0xed, 0xab, 0xee, 0xdb, 3, 0})
+	binary.BigEndian.PutUint16(lead[8:], 1) // archnum, ignored by rpm
+	copy(lead[10:75], fmt.Sprintf("%s-%s-%s", p.Name, version, rpmRelease))
+	binary.BigEndian.PutUint16(lead[76:], 1) // linux
+	binary.BigEndian.PutUint16(lead[78:], 5) // header style signature
+
+	var b bytes.Buffer
+	b.Write(lead)
+	b.Write(signature)
+	start := b.Len()
+	b.Write(header)
+	end := b.Len()
+	b.Write(payload.Bytes())
+	return &builtRPM{body: b.Bytes(), arch: arch, headerStart: start, headerEnd: end, installed: len(bin), archive: cpio.Len()}, nil
+}
+
+// putRPMRepo stores an .rpm package of every Linux binary of r in
+// packages/rpm/pool and the repodata of a yum repository listing them,
+// which dnf and yum read with baseurl=<url>/packages/rpm
+func putRPMRepo(ctx context.Context, backend Backend, p *Packages, r *Release, date time.Time) error {
+	dir := path.Join(PackagesDir, "rpm")
+	version := packageVersion(r.Version)
+	var primary, filelists, other strings.Builder
+	n := 0
+	for _, a := range r.Artifacts {
+		arch, ok := rpmArches[a.Platform]
+		if !ok {
+			continue
+		}
+		rpm, err := p.buildRPM(r, a.Path, arch, date)
+		if err != nil {
+			return fmt.Errorf("%s: %w", a.Platform, err)
+		}
+		name := fmt.Sprintf("pool/%s-%s-%s.%s.rpm", p.Name, version, rpmRelease, arch)
+		if err := backend.Put(ctx, path.Join(dir, name), bytes.NewReader(rpm.body), Metadata{ContentType: "application/x-rpm"}); err != nil {
+			return err
+		}
+		n++
+
+		sum := sha256.Sum256(rpm.body)
+		pkgid := hex.EncodeToString(sum[:])
+		ver := fmt.Sprintf(`<version epoch="0" ver="%s" rel="%s"/>`, xmlText(version), rpmRelease)
+		file := "<file>/usr/bin/" + xmlText(p.Name) + "</file>"
+		fmt.Fprintf(&primary, `<package type="rpm"><name>%s</name><arch>%s</arch>%s<checksum type="sha256" pkgid="YES">%s</checksum>`,
+			xmlText(p.Name), arch, ver, pkgid)
+		fmt.Fprintf(&primary, `<summary>%s</summary><description>%s</description><packager>%s</packager><url>%s</url>`,
+			xmlText(p.Description), xmlText(p.Description), xmlText(p.Publisher), xmlText(p.Homepage))
+		fmt.Fprintf(&primary, `<time file="%d" build="%d"/><size package="%d" installed="%d" archive="%d"/><location href="%s"/>`,
+			date.Unix(), date.Unix(), len(rpm.body), rpm.installed, rpm.archive, name)
+		fmt.Fprintf(&primary, `<format><rpm:license>%s</rpm:license><rpm:vendor>%s</rpm:vendor><rpm:group>Unspecified</rpm:group>`,
+			xmlText(p.License), xmlText(p.Publisher))
+		fmt.Fprintf(&primary, `<rpm:sourcerpm>%s-%s-%s.src.rpm</rpm:sourcerpm><rpm:header-range start="%d" end="%d"/>`,
+			xmlText(p.Name), xmlText(version), rpmRelease, rpm.headerStart, rpm.headerEnd)
+		fmt.Fprintf(&primary, `<rpm:provides><rpm:entry name="%s" flags="EQ" epoch="0" ver="%s" rel="%s"/></rpm:provides>%s</format></package>`+"\n",
+			xmlText(p.Name), xmlText(version), rpmRelease, file)
+		fmt.Fprintf(&filelists, `<package pkgid="%s" name="%s" arch="%s">%s%s</package>`+"\n", pkgid, xmlText(p.Name), arch, ver, file)
+		fmt.Fprintf(&other, `<package pkgid="%s" name="%s" arch="%s">%s</package>`+"\n", pkgid, xmlText(p.Name), arch, ver)
+	}
+
+	const header = `<?xml version="1.0" encoding="UTF-8"?>` + "\n"
+	metadata := []struct {
+		kind, root, namespaces, body string
+	}{
+		{"primary", "metadata", `xmlns="http://linux.duke.edu/metadata/common" xmlns:rpm="http://linux.duke.edu/metadata/rpm"`, primary.String()},
+		{"filelists", "filelists", `xmlns="http://linux.duke.edu/metadata/filelists"`, filelists.String()},
+		{"other", "otherdata", `xmlns="http://linux.duke.edu/metadata/other"`, other.String()},
+	}
+	var repomd strings.Builder
+	fmt.Fprintf(&repomd, "%s<repomd xmlns=\"http://linux.duke.edu/metadata/repo\" xmlns:rpm=\"http://linux.duke.edu/metadata/rpm\">\n<revision>%d</revision>\n", header, date.Unix())
+	for _, m := range metadata {
+		doc := []byte(fmt.Sprintf("%s<%s %s packages=\"%d\">\n%s</%s>\n", header, m.root, m.namespaces, n, m.body, m.root))
+		var gzipped bytes.Buffer
+		gz := gzip.NewWriter(&gzipped)
+		gz.Write(doc)
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		name := "repodata/" + m.kind + ".xml.gz"
+		if err := backend.Put(ctx, path.Join(dir, name), bytes.NewReader(gzipped.Bytes()), PackageMetadata); err != nil {
+			return err
+		}
+		sum, openSum := sha256.Sum256(gzipped.Bytes()), sha256.Sum256(doc)
+		fmt.Fprintf(&repomd, "<data type=\"%s\"><checksum type=\"sha256\">%s</checksum><open-checksum type=\"sha256\">%s</open-checksum>"+
+			"<location href=\"%s\"/><timestamp>%d</timestamp><size>%d</size><open-size>%d</open-size></data>\n",
+			m.kind, hex.EncodeToString(sum[:]), hex.EncodeToString(openSum[:]), name, date.Unix(), gzipped.Len(), len(doc))
+	}
+	repomd.WriteString("</repomd>\n")
+	// repomd.xml last, so dnf never sees it point at metadata not stored yet
+	return backend.Put(ctx, path.Join(dir, "repodata/repomd.xml"), strings.NewReader(repomd.String()), PackageMetadata)
+}
+
+// xmlText escapes s for XML character data and attribute values
+func xmlText(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,161 @@
+package publish
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// S3Backend uploads the update tree to an S3 bucket. Endpoint may point at
+// any S3 compatible service, including the Google Cloud Storage XML API with
+// HMAC keys; requests then use path-style addressing.
+type S3Backend struct {
+	Bucket          string
+	Prefix          string
+	Region          string // defaults to us-east-1
+	Endpoint        string // optional, ex: https://storage.googleapis.com
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Client          *http.Client
+}
+
+// Put uploads r as a single PUT Object request. Seekable readers are
+// streamed with an unsigned payload.
+func (b *S3Backend) Put(ctx context.Context, name string, r io.Reader, meta Metadata) error {
+	req, payloadHash, err := newPutRequest(ctx, b.objectURL(name), r)
+	if err != nil {
+		return err
+	}
+	setMetadataHeaders(req.Header, meta)
+	if payloadHash == "" {
+		// streamed bodies are protected by TLS rather than the signature
+		payloadHash = "UNSIGNED-PAYLOAD"
+	}
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signV4(req, payloadHash, b.region(), "s3", b.credentials(), time.Now())
+
+	return doPut(b.Client, req)
+}
+
+// Get downloads name
+func (b *S3Backend) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := b.do(ctx, http.MethodGet, b.objectURL(name))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// List returns the keys below the backend prefix starting with prefix
+func (b *S3Backend) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	return listObjectsV2(b.bucketURL(), b.Prefix, prefix, func(u string) (*http.Response, error) {
+		return b.do(ctx, http.MethodGet, u)
+	})
+}
+
+// Delete removes name
+func (b *S3Backend) Delete(ctx context.Context, name string) error {
+	resp, err := b.do(ctx, http.MethodDelete, b.objectURL(name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// do sends a signed request without a body
+func (b *S3Backend) do(ctx context.Context, method, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	payloadHash := hashHex(nil)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signV4(req, payloadHash, b.region(), "s3", b.credentials(), time.Now())
+	return doRequest(b.Client, req)
+}
+
+func (b *S3Backend) credentials() awsCredentials {
+	return awsCredentials{
+		AccessKeyID:     b.AccessKeyID,
+		SecretAccessKey: b.SecretAccessKey,
+		SessionToken:    b.SessionToken,
+	}
+}
+
+func (b *S3Backend) region() string {
+	if b.Region == "" {
+		return "us-east-1"
+	}
+	return b.Region
+}
+
+func (b *S3Backend) objectURL(name string) string {
+	return b.bucketURL() + "/" + awsEscape(objectKey(b.Prefix, name), false)
+}
+
+func (b *S3Backend) bucketURL() string {
+	if b.Endpoint != "" {
+		return fmt.Sprintf("%s/%s", strings.TrimSuffix(b.Endpoint, "/"), b.Bucket)
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com", b.Bucket, b.region())
+}
+
+// listObjectsV2 pages through a ListObjectsV2 listing of bucketURL, which
+// Google Cloud Storage implements as well, returning the keys starting with
+// prefix relative to root
+func listObjectsV2(bucketURL, root, prefix string, get func(u string) (*http.Response, error)) ([]FileInfo, error) {
+	rootKey := objectKey(root, "")
+	var files []FileInfo
+	var token string
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {rootKey + prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := get(bucketURL + "/?" + q.Encode())
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid object listing: %w", err)
+		}
+		for _, c := range result.Contents {
+			files = append(files, FileInfo{Name: strings.TrimPrefix(c.Key, rootKey), Size: c.Size, ModTime: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return files, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func setMetadataHeaders(h http.Header, meta Metadata) {
+	if meta.ContentType != "" {
+		h.Set("Content-Type", meta.ContentType)
+	}
+	if meta.CacheControl != "" {
+		h.Set("Cache-Control", meta.CacheControl)
+	}
+}
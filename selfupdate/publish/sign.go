@@ -0,0 +1,108 @@
+package publish
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"github.com/bobo/go-selfupdate/selfupdate"
+)
+
+// SignatureMetadata is used for detached signature files
+var SignatureMetadata = Metadata{ContentType: "text/plain", CacheControl: ManifestMetadata.CacheControl}
+
+// GenerateKey creates a new Ed25519 signing key pair and returns the contents
+// of the public and private key files, each a single line with the base64 of
+// the raw key
+func GenerateKey() (pub, priv []byte, err error) {
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub = []byte(base64.StdEncoding.EncodeToString(pk) + "\n")
+	priv = []byte(base64.StdEncoding.EncodeToString(sk) + "\n")
+	return pub, priv, nil
+}
+
+// ParsePrivateKey parses a private key file written by GenerateKey
+func ParsePrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	b, err := selfupdate.DecodeKeyData(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid private key length %d", len(b))
+	}
+	return ed25519.PrivateKey(b), nil
+}
+
+// Sign returns the contents of the detached signature file for content: a
+// single line with the base64 of its Ed25519ph signature. The format is
+// specific to go-selfupdate and not read by minisign or signify.
+func Sign(key ed25519.PrivateKey, content []byte) []byte {
+	digest := sha512.Sum512(content)
+	return signDigest(key, digest[:])
+}
+
+// SignReader returns the contents of the detached signature file for the
+// content read from r. Signatures are Ed25519ph over the SHA512 of the
+// content, so large artifacts never need to be held in memory.
+func SignReader(key ed25519.PrivateKey, r io.Reader) ([]byte, error) {
+	h := sha512.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return signDigest(key, h.Sum(nil)), nil
+}
+
+func signDigest(key ed25519.PrivateKey, digest []byte) []byte {
+	sig, err := key.Sign(nil, digest, &ed25519.Options{Hash: crypto.SHA512})
+	if err != nil {
+		// only possible for a malformed digest length
+		panic(err)
+	}
+	return []byte(base64.StdEncoding.EncodeToString(sig) + "\n")
+}
+
+// SigningBackend wraps a Backend and stores a detached signature next to
+// every file written through it
+type SigningBackend struct {
+	Backend
+	Key ed25519.PrivateKey
+}
+
+// Put stores the file and then its signature under name + ".sig". Seekable
+// readers are hashed in a first pass and rewound, anything else is buffered.
+func (b *SigningBackend) Put(ctx context.Context, name string, r io.Reader, meta Metadata) error {
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		rs = bytes.NewReader(content)
+	}
+
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	sig, err := SignReader(b.Key, rs)
+	if err != nil {
+		return err
+	}
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := b.Backend.Put(ctx, name, rs, meta); err != nil {
+		return err
+	}
+	return b.Backend.Put(ctx, name+selfupdate.SignatureSuffix, bytes.NewReader(sig), SignatureMetadata)
+}
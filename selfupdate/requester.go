@@ -1,9 +1,13 @@
 package selfupdate
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 )
 
 // Requester interface allows developers to customize the method in which
@@ -14,23 +18,201 @@ type Requester interface {
 
 // HTTPRequester is the normal requester that is used and does an HTTP
 // to the URL location requested to retrieve the specified data.
-type HTTPRequester struct{}
+type HTTPRequester struct {
+	// UserAgent of the requests. Updater fills it with its own User-Agent
+	// when empty, other users get the Go default.
+	UserAgent string
+}
 
 // Fetch will return an HTTP request to the specified url and return
 // the body of the result. An error will occur for a non 200 status code.
 func (httpRequester *HTTPRequester) Fetch(url string) (io.ReadCloser, error) {
-	resp, err := http.Get(url)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if httpRequester.UserAgent != "" {
+		req.Header.Set("User-Agent", httpRequester.UserAgent)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		resp.Body.Close()
+		return nil, &RateLimitError{URL: url, Status: resp.Status, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	}
 	if resp.StatusCode != 200 {
+		resp.Body.Close()
 		return nil, fmt.Errorf("bad http status from %s: %v", url, resp.Status)
 	}
 
 	return resp.Body, nil
 }
 
+// DefaultManifestTTL is how long a CachingRequester serves a manifest from
+// memory when its TTL is 0
+const DefaultManifestTTL = 30 * time.Second
+
+// CachingRequester shares the manifests fetched through it between the
+// Updaters of a process, such as the binaries of a suite checking the same
+// ApiURL. The manifests, indexes and signatures Updaters fetch with
+// FetchManifest are kept for TTL, and requests for a URL already being
+// fetched wait for that response instead of sending their own. Artifacts
+// and patches go through Fetch as they are. Errors are passed to the
+// requests waiting for them but not kept.
+//
+// Updaters fill in the User-Agent of an HTTPRequester they use directly,
+// not one wrapped here, so set its UserAgent when it matters.
+type CachingRequester struct {
+	Requester Requester     // requester responses are fetched with, an HTTPRequester when nil
+	TTL       time.Duration // how long a manifest is kept, DefaultManifestTTL when 0
+
+	mu      sync.Mutex
+	entries map[string]*cachedResponse
+	swept   time.Time // when expired entries were last removed
+}
+
+// manifestRequester is a Requester telling manifests, indexes and their
+// signatures, which Updaters fetch with FetchManifest, from artifacts
+type manifestRequester interface {
+	FetchManifest(url string) (io.ReadCloser, error)
+}
+
+// cachedResponse is a manifest fetched by a CachingRequester, or being
+// fetched until done is closed
+type cachedResponse struct {
+	done    chan struct{}
+	body    []byte
+	err     error
+	fetched time.Time
+}
+
+// Fetch fetches url without caching it
+func (c *CachingRequester) Fetch(url string) (io.ReadCloser, error) {
+	return c.requester().Fetch(url)
+}
+
+func (c *CachingRequester) requester() Requester {
+	if c.Requester == nil {
+		return &HTTPRequester{}
+	}
+	return c.Requester
+}
+
+// FetchManifest returns the manifest at url from memory when it was fetched
+// less than TTL ago, and fetches it otherwise
+func (c *CachingRequester) FetchManifest(url string) (io.ReadCloser, error) {
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = DefaultManifestTTL
+	}
+
+	c.mu.Lock()
+	c.sweep(ttl)
+	e := c.entries[url]
+	fresh := e != nil
+	if fresh {
+		select {
+		case <-e.done:
+			fresh = time.Since(e.fetched) < ttl
+		default: // still being fetched
+		}
+	}
+	if !fresh {
+		e = &cachedResponse{done: make(chan struct{})}
+		if c.entries == nil {
+			c.entries = map[string]*cachedResponse{}
+		}
+		c.entries[url] = e
+		c.mu.Unlock()
+		e.body, e.err = readManifest(c.requester(), url)
+		e.fetched = time.Now()
+		close(e.done)
+		if e.err != nil {
+			c.mu.Lock()
+			if c.entries[url] == e {
+				delete(c.entries, url)
+			}
+			c.mu.Unlock()
+		}
+	} else {
+		c.mu.Unlock()
+		<-e.done
+	}
+	if e.err != nil {
+		return nil, e.err
+	}
+	return io.NopCloser(bytes.NewReader(e.body)), nil
+}
+
+// sweep removes the entries that expired, at most once per ttl, so that a
+// long running process does not keep every URL it fetched. The caller
+// holds c.mu.
+func (c *CachingRequester) sweep(ttl time.Duration) {
+	now := time.Now()
+	if now.Sub(c.swept) < ttl {
+		return
+	}
+	c.swept = now
+	for url, e := range c.entries {
+		select {
+		case <-e.done:
+			if now.Sub(e.fetched) >= ttl {
+				delete(c.entries, url)
+			}
+		default:
+		}
+	}
+}
+
+// readManifest reads the manifest at url, up to one byte more than
+// DecodeManifest accepts
+func readManifest(requester Requester, url string) ([]byte, error) {
+	r, err := requester.Fetch(url)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(io.LimitReader(r, MaxManifestSize+1))
+}
+
+// RateLimitError is returned by HTTPRequester when the update host asks
+// clients to back off with 429 Too Many Requests or 503 Service Unavailable.
+// Custom requesters return it as well to have UpdateIfNeeded postpone the
+// next check.
+type RateLimitError struct {
+	URL        string
+	Status     string
+	RetryAfter time.Duration // from the Retry-After header, 0 when missing
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("rate limited by %s: %s, retry after %s", e.URL, e.Status, e.RetryAfter)
+	}
+	return fmt.Sprintf("rate limited by %s: %s", e.URL, e.Status)
+}
+
+// parseRetryAfter reads a Retry-After header, either a number of seconds or
+// an HTTP date
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
 // mockRequester used for some mock testing to ensure the requester contract
 // works as specified.
 type mockRequester struct {
@@ -0,0 +1,122 @@
+package selfupdate
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// ErrInsufficientResources is wrapped by a ResourceError
+var ErrInsufficientResources = errors.New("not enough resources for the update")
+
+// ResourceError is returned when the machine has less free disk or memory
+// than the manifest of the new version asks for. The update is skipped
+// before anything is downloaded.
+type ResourceError struct {
+	Resource  string // disk or memory
+	Required  int64  // bytes asked for by the manifest
+	Available int64  // bytes free on this machine
+}
+
+func (e *ResourceError) Error() string {
+	return fmt.Sprintf("%v: %d bytes of %s needed, %d available", ErrInsufficientResources, e.Required, e.Resource, e.Available)
+}
+
+func (e *ResourceError) Unwrap() error {
+	return ErrInsufficientResources
+}
+
+// checkResources compares the MinDisk and MinMemory of info with what the
+// machine has free. A requirement that cannot be measured on this platform
+// does not hold the update back.
+func checkResources(info UpdateInfo, execPath string) error {
+	if info.MinDisk > 0 {
+		if free, err := diskFree(filepath.Dir(execPath)); err == nil && free < info.MinDisk {
+			return &ResourceError{Resource: "disk", Required: info.MinDisk, Available: free}
+		}
+	}
+	if info.MinMemory > 0 {
+		if free, err := memoryAvailable(); err == nil && free < info.MinMemory {
+			return &ResourceError{Resource: "memory", Required: info.MinMemory, Available: free}
+		}
+	}
+	return nil
+}
+
+// memoryAvailable returns how much memory can be allocated without swapping:
+// MemAvailable on Linux and the free, inactive and speculative pages on macOS
+func memoryAvailable() (int64, error) {
+	switch runtime.GOOS {
+	case "linux":
+		f, err := os.Open("/proc/meminfo")
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		return parseMeminfo(f)
+	case "darwin":
+		out, err := runCommand(context.Background(), "vm_stat")
+		if err != nil {
+			return 0, err
+		}
+		return parseVMStat(string(out))
+	case "windows":
+		return windowsMemoryAvailable()
+	}
+	return 0, errors.ErrUnsupported
+}
+
+// parseMeminfo reads MemAvailable from /proc/meminfo, given in kB
+func parseMeminfo(r io.Reader) (int64, error) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid MemAvailable %q", fields[1])
+			}
+			return kb << 10, nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("no MemAvailable in /proc/meminfo")
+}
+
+// parseVMStat adds up the free, inactive and speculative pages printed by
+// vm_stat, whose first line gives the page size
+func parseVMStat(out string) (int64, error) {
+	lines := strings.Split(out, "\n")
+	var pageSize int64
+	if _, after, ok := strings.Cut(lines[0], "page size of "); ok {
+		pageSize, _ = strconv.ParseInt(strings.Fields(after)[0], 10, 64)
+	}
+	if pageSize <= 0 {
+		return 0, errors.New("no page size in vm_stat output")
+	}
+	var pages int64
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(name) {
+		case "Pages free", "Pages inactive", "Pages speculative":
+			n, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(value), "."), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid vm_stat line %q", line)
+			}
+			pages += n
+		}
+	}
+	return pages * pageSize, nil
+}
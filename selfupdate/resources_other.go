@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package selfupdate
+
+import "errors"
+
+func diskFree(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
+
+func windowsMemoryAvailable() (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd
+
+package selfupdate
+
+import (
+	"errors"
+	"syscall"
+)
+
+// diskFree returns the bytes of dir's file system available to unprivileged
+// users
+func diskFree(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+func windowsMemoryAvailable() (int64, error) {
+	return 0, errors.ErrUnsupported
+}
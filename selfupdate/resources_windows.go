@@ -0,0 +1,46 @@
+package selfupdate
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32                = syscall.NewLazyDLL("kernel32.dll")
+	procGetDiskFreeSpaceExW = kernel32.NewProc("GetDiskFreeSpaceExW")
+	procGlobalMemoryStatus  = kernel32.NewProc("GlobalMemoryStatusEx")
+)
+
+// diskFree returns the bytes of dir's volume available to the current user
+func diskFree(dir string) (int64, error) {
+	p, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	if r, _, err := procGetDiskFreeSpaceExW.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&free)), 0, 0); r == 0 {
+		return 0, err
+	}
+	return int64(free), nil
+}
+
+// memoryStatusEx is the MEMORYSTATUSEX structure
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+func windowsMemoryAvailable() (int64, error) {
+	m := memoryStatusEx{Length: uint32(unsafe.Sizeof(memoryStatusEx{}))}
+	if r, _, err := procGlobalMemoryStatus.Call(uintptr(unsafe.Pointer(&m))); r == 0 {
+		return 0, err
+	}
+	return int64(m.AvailPhys), nil
+}
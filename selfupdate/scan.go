@@ -0,0 +1,303 @@
+package selfupdate
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// scanManifest decodes the manifest in b into info without reflection or
+// intermediate values, allocating only the strings and digests it keeps. It
+// handles the manifests go-selfupdate and common release tools write and
+// reports false for anything else, such as null values, duplicate fields or
+// malformed input, which decodeManifest then decodes or explains.
+func scanManifest(b []byte, strict bool, info *UpdateInfo) bool {
+	s := scanner{b: b}
+	if !s.consume('{') {
+		return false
+	}
+	var seen uint64
+	if s.consume('}') {
+		return s.end()
+	}
+	for {
+		key, ok := s.key()
+		if !ok || !s.consume(':') {
+			return false
+		}
+		s.space()
+		i, ok := manifestFields[key]
+		if !ok {
+			if i, ok = foldField(key); !ok {
+				if strict || !s.skip() {
+					return false
+				}
+			}
+		}
+		if ok {
+			if seen&(1<<i) != 0 || !s.field(info, i) {
+				return false
+			}
+			seen |= 1 << i
+		}
+		if s.consume(',') {
+			continue
+		}
+		return s.consume('}') && s.end()
+	}
+}
+
+// foldField matches key to a field case insensitively, as encoding/json
+// does, limited to ASCII keys
+func foldField(key string) (int, bool) {
+	for i := 0; i < len(key); i++ {
+		if key[i] >= 0x80 {
+			return 0, false
+		}
+	}
+	for name, i := range manifestFields {
+		if strings.EqualFold(name, key) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// scanner reads JSON from b, from pos on
+type scanner struct {
+	b   []byte
+	pos int
+}
+
+func (s *scanner) space() {
+	for s.pos < len(s.b) {
+		switch s.b[s.pos] {
+		case ' ', '\t', '\n', '\r':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+// consume skips white space and c, reporting whether c was there
+func (s *scanner) consume(c byte) bool {
+	s.space()
+	if s.pos < len(s.b) && s.b[s.pos] == c {
+		s.pos++
+		return true
+	}
+	return false
+}
+
+// end reports whether only white space is left
+func (s *scanner) end() bool {
+	s.space()
+	return s.pos == len(s.b)
+}
+
+// key returns the name of the next field, without allocating for the
+// names of known fields
+func (s *scanner) key() (string, bool) {
+	raw, ok := s.rawString()
+	if !ok || !isPlain(raw) {
+		return "", false
+	}
+	if i, ok := manifestFields[string(raw)]; ok {
+		return manifestNames[i], true
+	}
+	return string(raw), true
+}
+
+// rawString returns the contents of the string at pos, still escaped
+func (s *scanner) rawString() ([]byte, bool) {
+	s.space()
+	if s.pos >= len(s.b) || s.b[s.pos] != '"' {
+		return nil, false
+	}
+	start := s.pos + 1
+	for i := start; i < len(s.b); i++ {
+		switch s.b[i] {
+		case '"':
+			s.pos = i + 1
+			return s.b[start:i], true
+		case '\\':
+			i++
+		}
+	}
+	return nil, false
+}
+
+// isPlain reports whether raw is printable ASCII without escapes, the same
+// as a string once decoded
+func isPlain(raw []byte) bool {
+	for _, c := range raw {
+		if c < 0x20 || c >= 0x80 || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *scanner) string() (string, bool) {
+	start := s.pos
+	raw, ok := s.rawString()
+	if !ok {
+		return "", false
+	}
+	if isPlain(raw) {
+		return string(raw), true
+	}
+	// escapes and UTF-8, such as in release notes, are decoded as
+	// encoding/json does
+	var v string
+	if err := json.Unmarshal(s.b[start:s.pos], &v); err != nil {
+		return "", false
+	}
+	return v, true
+}
+
+// int returns the integer at pos, which must fit into bits
+func (s *scanner) int(bits int) (int64, bool) {
+	start := s.pos
+	if !s.number() {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(string(s.b[start:s.pos]), 10, bits)
+	return n, err == nil
+}
+
+// digest returns the SHA256 or SHA512 digest at pos, in hex or base64 as
+// normalizeDigest takes them
+func (s *scanner) digest() ([]byte, bool) {
+	raw, ok := s.rawString()
+	if !ok || !isPlain(raw) {
+		return nil, false
+	}
+	if len(raw) == 64 || len(raw) == 128 {
+		d := make([]byte, len(raw)/2)
+		_, err := hex.Decode(d, raw)
+		return d, err == nil
+	}
+	d := make([]byte, base64.StdEncoding.DecodedLen(len(raw)))
+	n, err := base64.StdEncoding.Decode(d, raw)
+	return d[:n], err == nil
+}
+
+// skip skips the string, number or literal at pos, reporting false for
+// anything else, such as objects and arrays, and for invalid values
+func (s *scanner) skip() bool {
+	if s.pos >= len(s.b) {
+		return false
+	}
+	switch c := s.b[s.pos]; {
+	case c == '"':
+		start := s.pos
+		raw, ok := s.rawString()
+		return ok && (isPlain(raw) || json.Valid(s.b[start:s.pos]))
+	case c == '-' || (c >= '0' && c <= '9'):
+		return s.number()
+	}
+	for _, literal := range []string{"true", "false", "null"} {
+		if bytes.HasPrefix(s.b[s.pos:], []byte(literal)) {
+			s.pos += len(literal)
+			return true
+		}
+	}
+	return false
+}
+
+// number skips a JSON number, -?(0|[1-9][0-9]*)(.[0-9]+)?([eE][+-]?[0-9]+)?
+func (s *scanner) number() bool {
+	if s.peek() == '-' {
+		s.pos++
+	}
+	if s.peek() == '0' {
+		s.pos++
+	} else if !s.digits() {
+		return false
+	}
+	if s.peek() == '.' {
+		s.pos++
+		if !s.digits() {
+			return false
+		}
+	}
+	if c := s.peek(); c == 'e' || c == 'E' {
+		s.pos++
+		if c := s.peek(); c == '+' || c == '-' {
+			s.pos++
+		}
+		if !s.digits() {
+			return false
+		}
+	}
+	return true
+}
+
+// peek returns the byte at pos, 0 at the end
+func (s *scanner) peek() byte {
+	if s.pos < len(s.b) {
+		return s.b[s.pos]
+	}
+	return 0
+}
+
+// digits skips a run of digits, reporting whether there was any
+func (s *scanner) digits() bool {
+	start := s.pos
+	for c := s.peek(); c >= '0' && c <= '9'; c = s.peek() {
+		s.pos++
+	}
+	return s.pos > start
+}
+
+// field decodes the value at pos into field i of info
+func (s *scanner) field(info *UpdateInfo, i int) bool {
+	var ok bool
+	switch manifestNames[i] {
+	case "Version":
+		info.Version, ok = s.string()
+	case "Sha256":
+		info.Sha256, ok = s.digest()
+	case "Sha512":
+		info.Sha512, ok = s.digest()
+	case "Channel":
+		info.Channel, ok = s.string()
+	case "Date":
+		start := s.pos
+		if _, ok = s.rawString(); ok {
+			ok = info.Date.UnmarshalJSON(s.b[start:s.pos]) == nil
+		}
+	case "Compression":
+		info.Compression, ok = s.string()
+	case "Archive":
+		info.Archive, ok = s.string()
+	case "Executable":
+		info.Executable, ok = s.string()
+	case "Notes":
+		info.Notes, ok = s.string()
+	case "NotesURL":
+		info.NotesURL, ok = s.string()
+	case "Rollout":
+		var n int64
+		n, ok = s.int(strconv.IntSize)
+		info.Rollout = int(n)
+	case "SBOM":
+		info.SBOM, ok = s.string()
+	case "Provenance":
+		info.Provenance, ok = s.string()
+	case "Encryption":
+		info.Encryption, ok = s.string()
+	case "MinDisk":
+		info.MinDisk, ok = s.int(64)
+	case "MinMemory":
+		info.MinMemory, ok = s.int(64)
+	case "Size":
+		info.Size, ok = s.int(64)
+	}
+	return ok
+}
@@ -0,0 +1,49 @@
+package selfupdate
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// apparmorProfile returns the AppArmor profile enforced on this process, or
+// "" when it is unconfined, only complained about or AppArmor is not in use
+func apparmorProfile() string {
+	if runtime.GOOS != "linux" {
+		return ""
+	}
+	b, err := os.ReadFile("/proc/self/attr/apparmor/current")
+	if err != nil {
+		if b, err = os.ReadFile("/proc/self/attr/current"); err != nil {
+			return ""
+		}
+	}
+	return parseAppArmorLabel(string(b))
+}
+
+// parseAppArmorLabel reads a label such as "myapp (enforce)". Labels of
+// other security modules, such as the SELinux context in /proc/self/attr,
+// do not end in a mode and are not taken for a profile.
+func parseAppArmorLabel(label string) string {
+	profile, ok := strings.CutSuffix(strings.TrimRight(label, "\x00\n"), " (enforce)")
+	if !ok {
+		return ""
+	}
+	return profile
+}
+
+// explainDenied tells which AppArmor profile is likely to have denied an
+// update from writing or replacing the binary, since the error from the
+// kernel only says permission denied
+func explainDenied(err error) error {
+	if !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+	if profile := apparmorProfile(); profile != "" {
+		return fmt.Errorf("%w (check that AppArmor profile %s allows writing to the directory of the binary)", err, profile)
+	}
+	return err
+}
@@ -0,0 +1,43 @@
+//go:build linux
+
+package selfupdate
+
+import (
+	"errors"
+	"syscall"
+)
+
+// selinuxXattr holds the SELinux label of a file
+const selinuxXattr = "security.selinux"
+
+// copySecurityContext gives the binary at to the SELinux label of the one at
+// from, which a binary written by the updater would otherwise not get when
+// the policy labels files created by the process differently, as it does for
+// daemons under /opt labeled with semanage fcontext. Without SELinux there is
+// no label and nothing is done.
+func copySecurityContext(from, to string) error {
+	label, err := getxattr(from, selinuxXattr)
+	if errors.Is(err, syscall.ENODATA) || errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.ENOENT) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if current, err := getxattr(to, selinuxXattr); err == nil && string(current) == string(label) {
+		return nil
+	}
+	return syscall.Setxattr(to, selinuxXattr, label, 0)
+}
+
+func getxattr(path, name string) ([]byte, error) {
+	n, err := syscall.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	n, err = syscall.Getxattr(path, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package selfupdate
+
+func copySecurityContext(from, to string) error {
+	return nil
+}
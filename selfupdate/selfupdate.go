@@ -1,44 +1,83 @@
 package selfupdate
 
 import (
-	"compress/gzip"
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/ed25519"
 	"crypto/sha256"
-	"encoding/json"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
 	"runtime"
-	"strings"
+	"slices"
+	"sync"
 	"time"
+
+	"filippo.io/age"
+
+	"github.com/bobo/go-selfupdate/internal/archive"
+	"github.com/bobo/go-selfupdate/internal/bsdiff"
+	compress "github.com/bobo/go-selfupdate/internal/compression"
 )
 
 // Common errors
 var (
-	ErrHashMismatch    = errors.New("new file hash mismatch after patch")
-	ErrInvalidHash     = errors.New("invalid hash in update info")
-	ErrChannelMismatch = errors.New("update channel mismatch")
-	ErrNoRequester     = errors.New("no HTTP requester configured")
+	ErrHashMismatch      = errors.New("new file hash mismatch after patch")
+	ErrInvalidHash       = errors.New("invalid hash in update info")
+	ErrChannelMismatch   = errors.New("update channel mismatch")
+	ErrNoRequester       = errors.New("no HTTP requester configured")
+	ErrInvalidSignature  = errors.New("invalid signature")
+	ErrSignatureMismatch = errors.New("signature verification failed")
+	ErrEncrypted         = errors.New("artifact is encrypted and no identity was given")
+	ErrStagedUpdateDone  = errors.New("staged update already committed or discarded")
+	ErrTargetLocked      = errors.New("binary is being updated by another updater")
+	ErrUnknownVersion    = errors.New("version not available")
+	ErrArtifactSize      = errors.New("artifact larger than the size in the manifest")
 )
 
 const (
-	timeFile      = "cktime"                            // path to timestamp file relative to u.Dir
+	timeFile      = "cktime"                            // path to timestamp file relative to the working directory
+	statusFile    = "ckstatus.json"                     // Status of the update cycles, in u.Dir
+	cacheDir      = "cache"                             // verified binaries kept for the next attempt, in u.Dir
+	stateMarker   = ".selfupdate"                       // marks the directories the updater created, so Uninstall may remove them
 	platform      = runtime.GOOS + "-" + runtime.GOARCH // ex: linux-amd64
 	stableChannel = "stable"
 )
 
-// UpdateInfo contains metadata about an available update
+// UpdateInfo contains metadata about an available update. Sha256 and Sha512
+// are both optional, but at least one must be present and every digest that
+// is present must match the downloaded binary.
 type UpdateInfo struct {
-	Version string
-	Sha256  []byte
-	Channel string
-	Date    time.Time
+	Version     string
+	Sha256      []byte `json:",omitempty"`
+	Sha512      []byte `json:",omitempty"`
+	Channel     string
+	Date        time.Time
+	Compression string `json:",omitempty"` // gzip when empty, zstd or xz
+	Archive     string `json:",omitempty"` // tar.gz or zip when the binary is published inside an archive
+	Executable  string `json:",omitempty"` // name of the binary inside the archive, the first member when empty
+	Notes       string `json:",omitempty"` // release notes to show users, usually markdown
+	NotesURL    string `json:",omitempty"` // link to release notes published elsewhere
+	Rollout     int    `json:",omitempty"` // percentage of installations offered the update, everyone when 0
+	SBOM        string `json:",omitempty"` // path of the software bill of materials relative to the update tree
+	Provenance  string `json:",omitempty"` // path of the SLSA provenance statement relative to the update tree
+	Encryption  string `json:",omitempty"` // age when the artifact is encrypted and needs Updater.Identities
+	MinDisk     int64  `json:",omitempty"` // free bytes the update needs on the file system of the binary
+	MinMemory   int64  `json:",omitempty"` // bytes of available memory the new version needs
+	Size        int64  `json:",omitempty"` // bytes of the artifact as downloaded, compressed, archived or encrypted
 }
 
+// manifestMaxAge is how long a fetched manifest is trusted before the
+// binary is downloaded
+const manifestMaxAge = 5 * time.Minute
+
 // UpdateScheduler defines how update timing is handled
 type UpdateScheduler interface {
 	// ShouldUpdate returns true if an update should be performed now
@@ -49,56 +88,97 @@ type UpdateScheduler interface {
 	NextUpdate() time.Time
 }
 
+// DeferringScheduler is an UpdateScheduler that can postpone the next check
+// past its regular schedule, which UpdateIfNeeded does when the update host
+// asks clients to retry later
+type DeferringScheduler interface {
+	UpdateScheduler
+	// DeferUntil moves the next check to t unless it is already later
+	DeferUntil(t time.Time)
+}
+
 // DailyScheduler implements UpdateScheduler for updates at a specific hour
 type DailyScheduler struct {
-	hour     int
-	timeFile string
+	hour  int
+	loc   *time.Location
+	state scheduleState
 }
 
 // NewDailyScheduler creates a scheduler that runs once per day at the specified hour
 func NewDailyScheduler(hour int) *DailyScheduler {
+	return NewDailySchedulerIn(hour, time.Local)
+}
+
+// NewDailySchedulerIn creates a scheduler that runs once per day at the
+// specified hour in loc, such as time.UTC, so a fleet updates at the same
+// moment wherever its hosts are. On days when a DST change skips the hour,
+// the check runs at the first hour after it.
+func NewDailySchedulerIn(hour int, loc *time.Location) *DailyScheduler {
 	return &DailyScheduler{
-		hour:     hour,
-		timeFile: timeFile,
+		hour:  hour,
+		loc:   loc,
+		state: scheduleState{path: timeFile},
 	}
 }
 
 func (s *DailyScheduler) ShouldUpdate(currentVersion string, forceCheck bool) bool {
-	if currentVersion == "dev" {
-		slog.Info("skipping update for dev version")
-		return false
-	}
-	if forceCheck {
-		slog.Info("force update check requested")
-		return true
-	}
-	next := s.NextUpdate()
-	if next.After(time.Now()) {
-		slog.Info("next update scheduled for later",
-			"next_update", next.Format(time.RFC3339))
-		return false
-	}
-	return true
+	return shouldUpdate(s.NextUpdate(), currentVersion, forceCheck)
 }
 
 func (s *DailyScheduler) SetNextUpdate() {
-	now := time.Now()
-	next := time.Date(now.Year(), now.Month(), now.Day(), s.hour, 0, 0, 0, time.Local)
+	s.state.set(s.next(time.Now()))
+}
+
+// next returns the first time at the scheduled hour after now. Days are
+// counted on the calendar, as they are not 24 hours long across DST changes.
+func (s *DailyScheduler) next(now time.Time) time.Time {
+	loc := s.loc
+	if loc == nil {
+		loc = time.Local
+	}
+	now = now.In(loc)
+	next := atHour(now.Year(), now.Month(), now.Day(), s.hour, loc)
 	if next.Before(now) {
-		next = next.Add(24 * time.Hour)
+		next = atHour(now.Year(), now.Month(), now.Day()+1, s.hour, loc)
 	}
-	writeTime(s.timeFile, next)
+	return next
+}
+
+// atHour returns the start of hour on the given day, or of the hour after it
+// when a DST change skips it that day
+func atHour(year int, month time.Month, day, hour int, loc *time.Location) time.Time {
+	t := time.Date(year, month, day, hour, 0, 0, 0, loc)
+	if t.Hour() != hour {
+		t = time.Date(year, month, day, hour+1, 0, 0, 0, loc)
+	}
+	return t
 }
 
 func (s *DailyScheduler) NextUpdate() time.Time {
-	return readTime(s.timeFile)
+	return s.state.get()
+}
+
+func (s *DailyScheduler) DeferUntil(t time.Time) {
+	s.state.deferUntil(t)
+}
+
+func (s *DailyScheduler) Reload() {
+	s.state.reload()
+}
+
+func (s *DailyScheduler) resetError() error {
+	return s.state.resetError()
+}
+
+func (s *DailyScheduler) statePath() string {
+	return s.state.path
 }
 
 // IntervalScheduler implements UpdateScheduler for updates at fixed intervals
 type IntervalScheduler struct {
 	checkTime     int
 	randomizeTime int
-	timeFile      string
+	state         scheduleState
 }
 
 // NewIntervalScheduler creates a scheduler that runs at fixed intervals with optional randomization
@@ -106,11 +186,265 @@ func NewIntervalScheduler(checkTime, randomizeTime int) *IntervalScheduler {
 	return &IntervalScheduler{
 		checkTime:     checkTime,
 		randomizeTime: randomizeTime,
-		timeFile:      timeFile,
+		state:         scheduleState{path: timeFile},
 	}
 }
 
 func (s *IntervalScheduler) ShouldUpdate(currentVersion string, forceCheck bool) bool {
+	return shouldUpdate(s.NextUpdate(), currentVersion, forceCheck)
+}
+
+func (s *IntervalScheduler) SetNextUpdate() {
+	next := time.Now().Add(time.Duration(s.checkTime) * time.Hour)
+	if s.randomizeTime > 0 {
+		next = next.Add(time.Duration(randInt(0, s.randomizeTime)) * time.Hour)
+	}
+	s.state.set(next)
+}
+
+func (s *IntervalScheduler) NextUpdate() time.Time {
+	return s.state.get()
+}
+
+func (s *IntervalScheduler) DeferUntil(t time.Time) {
+	s.state.deferUntil(t)
+}
+
+func (s *IntervalScheduler) Reload() {
+	s.state.reload()
+}
+
+func (s *IntervalScheduler) resetError() error {
+	return s.state.resetError()
+}
+
+func (s *IntervalScheduler) statePath() string {
+	return s.state.path
+}
+
+// AlwaysScheduler implements UpdateScheduler for checking on every call of
+// UpdateIfNeeded, such as once per invocation of a CLI tool
+type AlwaysScheduler struct{}
+
+func (AlwaysScheduler) ShouldUpdate(currentVersion string, forceCheck bool) bool {
+	return shouldUpdate(time.Time{}, currentVersion, forceCheck)
+}
+
+func (AlwaysScheduler) SetNextUpdate() {}
+
+func (AlwaysScheduler) NextUpdate() time.Time { return time.Time{} }
+
+// NeverScheduler implements UpdateScheduler for disabling scheduled checks,
+// leaving updates to explicit calls of UpdateNow or Update
+type NeverScheduler struct{}
+
+func (NeverScheduler) ShouldUpdate(currentVersion string, forceCheck bool) bool { return false }
+
+func (NeverScheduler) SetNextUpdate() {}
+
+func (NeverScheduler) NextUpdate() time.Time { return time.Time{} }
+
+// WeeklyScheduler implements UpdateScheduler for updates once a week, for
+// software with long release cycles
+type WeeklyScheduler struct {
+	day   time.Weekday
+	hour  int
+	state scheduleState
+}
+
+// NewWeeklyScheduler creates a scheduler that runs every week on day at the
+// specified hour
+func NewWeeklyScheduler(day time.Weekday, hour int) *WeeklyScheduler {
+	return &WeeklyScheduler{
+		day:   day,
+		hour:  hour,
+		state: scheduleState{path: timeFile},
+	}
+}
+
+func (s *WeeklyScheduler) ShouldUpdate(currentVersion string, forceCheck bool) bool {
+	return shouldUpdate(s.NextUpdate(), currentVersion, forceCheck)
+}
+
+func (s *WeeklyScheduler) SetNextUpdate() {
+	s.state.set(s.next(time.Now()))
+}
+
+func (s *WeeklyScheduler) next(now time.Time) time.Time {
+	days := (int(s.day) - int(now.Weekday()) + 7) % 7
+	next := atHour(now.Year(), now.Month(), now.Day()+days, s.hour, now.Location())
+	if next.Before(now) {
+		next = atHour(now.Year(), now.Month(), now.Day()+days+7, s.hour, now.Location())
+	}
+	return next
+}
+
+func (s *WeeklyScheduler) NextUpdate() time.Time {
+	return s.state.get()
+}
+
+func (s *WeeklyScheduler) DeferUntil(t time.Time) {
+	s.state.deferUntil(t)
+}
+
+func (s *WeeklyScheduler) Reload() {
+	s.state.reload()
+}
+
+func (s *WeeklyScheduler) resetError() error {
+	return s.state.resetError()
+}
+
+func (s *WeeklyScheduler) statePath() string {
+	return s.state.path
+}
+
+// MonthlyScheduler implements UpdateScheduler for updates once a month
+type MonthlyScheduler struct {
+	day   int
+	hour  int
+	state scheduleState
+}
+
+// NewMonthlyScheduler creates a scheduler that runs every month on day at
+// the specified hour. Months shorter than day run on their last day.
+func NewMonthlyScheduler(day, hour int) *MonthlyScheduler {
+	return &MonthlyScheduler{
+		day:   day,
+		hour:  hour,
+		state: scheduleState{path: timeFile},
+	}
+}
+
+func (s *MonthlyScheduler) ShouldUpdate(currentVersion string, forceCheck bool) bool {
+	return shouldUpdate(s.NextUpdate(), currentVersion, forceCheck)
+}
+
+func (s *MonthlyScheduler) SetNextUpdate() {
+	s.state.set(s.next(time.Now()))
+}
+
+func (s *MonthlyScheduler) next(now time.Time) time.Time {
+	at := func(year int, month time.Month) time.Time {
+		// day 0 of the next month is the last day of this one
+		last := time.Date(year, month+1, 0, 0, 0, 0, 0, now.Location()).Day()
+		return atHour(year, month, min(s.day, last), s.hour, now.Location())
+	}
+	next := at(now.Year(), now.Month())
+	if next.Before(now) {
+		next = at(now.Year(), now.Month()+1)
+	}
+	return next
+}
+
+func (s *MonthlyScheduler) NextUpdate() time.Time {
+	return s.state.get()
+}
+
+func (s *MonthlyScheduler) DeferUntil(t time.Time) {
+	s.state.deferUntil(t)
+}
+
+func (s *MonthlyScheduler) Reload() {
+	s.state.reload()
+}
+
+func (s *MonthlyScheduler) resetError() error {
+	return s.state.resetError()
+}
+
+func (s *MonthlyScheduler) statePath() string {
+	return s.state.path
+}
+
+// scheduleState holds the next check of a scheduler, kept in its time file
+// so that it survives restarts. The file is read once and then served from
+// memory, so polling NextUpdate, as a UI showing the next check does, does
+// not touch the disk until Reload.
+type scheduleState struct {
+	path string
+
+	mu     sync.Mutex
+	loaded bool
+	next   time.Time
+	reset  error // why the file was unreadable and reset when it was loaded
+}
+
+// get returns the next check. A time file that cannot be read or parsed,
+// such as one truncated by a power loss, schedules a check right away and is
+// rewritten, instead of holding updates back.
+func (s *scheduleState) get() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.loaded {
+		return s.next
+	}
+	s.next, s.reset = readTime(s.path)
+	s.loaded = true
+	if s.reset != nil {
+		slog.Warn("resetting unreadable update schedule, checking now", "error", s.reset)
+		s.next = time.Now()
+		writeTime(s.path, s.next)
+	} else if fi, err := os.Stat(s.path); err == nil {
+		if next := adjustForSkew(s.next, fi.ModTime(), time.Now()); !next.Equal(s.next) {
+			s.next = next
+			writeTime(s.path, s.next)
+		}
+	}
+	return s.next
+}
+
+// clockSkewTolerance is how far the clock may be behind the time the time
+// file was written before the schedule is distrusted
+const clockSkewTolerance = 5 * time.Minute
+
+// adjustForSkew guards the next check read from a time file written at
+// written against a wall clock that went back since, as on embedded devices
+// whose clock resets on boot: the check then comes at most the delay it was
+// scheduled with from now, rather than years away. A clock that jumped
+// forward only makes the check due. While the process runs, Go's monotonic
+// clock keeps interval schedules immune to clock changes.
+func adjustForSkew(next, written, now time.Time) time.Time {
+	if !now.Before(written.Add(-clockSkewTolerance)) {
+		return next
+	}
+	delay := max(next.Sub(written), 0)
+	slog.Warn("clock is behind the update schedule, rescheduling",
+		"written", written.Format(time.RFC3339), "now", now.Format(time.RFC3339), "delay", delay)
+	return now.Add(delay)
+}
+
+// resetError returns why the time file had to be reset, if it had to
+func (s *scheduleState) resetError() error {
+	s.get()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reset
+}
+
+func (s *scheduleState) set(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeTime(s.path, t)
+	s.next, s.loaded = t, true
+}
+
+// deferUntil moves the next check to t unless it is already later
+func (s *scheduleState) deferUntil(t time.Time) {
+	if t.After(s.get()) {
+		s.set(t)
+	}
+}
+
+// reload drops the cached time, for when another process rewrote the file
+func (s *scheduleState) reload() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loaded, s.reset = false, nil
+}
+
+// shouldUpdate implements ShouldUpdate for schedulers checking at next
+func shouldUpdate(next time.Time, currentVersion string, forceCheck bool) bool {
 	if currentVersion == "dev" {
 		slog.Info("skipping update for dev version")
 		return false
@@ -119,7 +453,6 @@ func (s *IntervalScheduler) ShouldUpdate(currentVersion string, forceCheck bool)
 		slog.Info("force update check requested")
 		return true
 	}
-	next := s.NextUpdate()
 	if next.After(time.Now()) {
 		slog.Info("next update scheduled for later",
 			"next_update", next.Format(time.RFC3339))
@@ -128,18 +461,6 @@ func (s *IntervalScheduler) ShouldUpdate(currentVersion string, forceCheck bool)
 	return true
 }
 
-func (s *IntervalScheduler) SetNextUpdate() {
-	next := time.Now().Add(time.Duration(s.checkTime) * time.Hour)
-	if s.randomizeTime > 0 {
-		next = next.Add(time.Duration(randInt(0, s.randomizeTime)) * time.Hour)
-	}
-	writeTime(s.timeFile, next)
-}
-
-func (s *IntervalScheduler) NextUpdate() time.Time {
-	return readTime(s.timeFile)
-}
-
 var randSource = func() int64 {
 	return time.Now().UnixNano()
 }
@@ -153,18 +474,51 @@ func randInt(min, max int) int {
 
 // Updater handles the self-update process
 type Updater struct {
-	CurrentVersion     string
-	ApiURL             string
-	CmdName            string
-	BinURL             string
-	DiffURL            string
-	Dir                string
-	ForceCheck         bool
-	Scheduler          UpdateScheduler
-	Requester          Requester
-	Channel            string
-	Info               UpdateInfo
-	OnSuccessfulUpdate func()
+	CurrentVersion      string
+	ApiURL              string
+	CmdName             string
+	BinURL              string
+	BinLayout           string // template for binary paths below BinURL, DefaultBinLayout when empty
+	DiffURL             string
+	Dir                 string
+	ForceCheck          bool
+	Scheduler           UpdateScheduler
+	Requester           Requester
+	Channel             string
+	Info                UpdateInfo
+	OnSuccessfulUpdate  func()
+	PublicKey           ed25519.PublicKey     // Optional, require manifests and binaries to be signed by this key
+	RolloutID           string                // Optional, stable identifier of this installation for staged rollouts, the hostname when empty
+	Identities          []age.Identity        // Optional, decrypt artifacts published with -encrypt-to
+	ExecPath            string                // Optional, binary to replace, the running executable when empty, such as a worker managed by a supervisor
+	UserAgent           string                // Optional, User-Agent of HTTP requests, DefaultUserAgent when empty
+	Prechecks           []Precheck            // Optional, conditions an update cycle waits for, such as CheckOnline
+	Cooldown            time.Duration         // Optional, how long after applying an update further checks are skipped, even with ForceCheck
+	ApplyOnExit         bool                  // Optional, only stage verified updates and swap the binary in Finalize
+	Plugins             *PluginUpdater        // Optional, plugins updated after the application in each update cycle
+	FleetLock           FleetLock             // Optional, limits how many installations apply an update at the same time
+	Canary              *Canary               // Optional, lets a share of the cluster update first and the rest after a soak period
+	OnConfirmDownload   func(UpdateInfo) bool // Optional, asked before downloading an update, which is deferred when it returns false
+	CacheSize           int64                 // Optional, bytes of verified downloads kept for the next attempt when applying is deferred or fails, none when 0
+	CacheDir            string                // Optional, download cache shared by the binaries of a product, cache below Dir when empty
+	Assets              map[string]string     // Optional, members of the release archive installed after each update, such as "completions/": "/usr/share/bash-completion/completions"
+	AuthenticodeSigner  string                // Optional, on Windows require updates to be Authenticode signed by this certificate subject, common name or thumbprint
+	UsePackageManager   bool                  // Optional, update binaries installed by brew, scoop or winget by running the package manager instead of failing with ErrManagedInstall
+	ZoneID              int                   // Optional, on Windows the URL zone updated binaries are marked as downloaded from, such as 3 for the internet, unmarked when 0
+	QueryPackageDB      bool                  // Optional, on Linux ask dpkg and rpm whether the binary belongs to a package and fail with ErrManagedInstall if it does
+	OverwritePackaged   bool                  // Optional, with QueryPackageDB replace binaries owned by a dpkg or rpm package anyway, logging a warning
+	ChannelPolicy       string                // Optional, what to do with manifests of another channel, ChannelStrict when empty, ChannelWarn or ChannelUpstream
+	UpstreamChannels    []string              // Optional, with ChannelUpstream the channels whose manifests are accepted, such as beta for stable
+	ManifestURLTemplate string                // Optional, URL of the manifest used instead of the one below ApiURL, a template of LayoutData with the running version as .Version
+	ArtifactURLTemplate string                // Optional, URL of the artifact used instead of BinURL and BinLayout, a template of LayoutData such as "https://example.com/{{.Cmd}}_{{.Version}}_{{.OS}}_{{.Arch}}{{.Ext}}"
+
+	mu      sync.Mutex
+	pending *StagedUpdate // update staged for Finalize with ApplyOnExit
+
+	fetchedAt  time.Time // when Info was last fetched
+	cached     []byte    // last verified binary, with CacheSize
+	archived   []byte    // archive of the staged update, with Assets
+	archivedOf string    // version of archived
 }
 
 // UpdateIfNeeded starts the update check and apply cycle
@@ -174,50 +528,395 @@ func (u *Updater) UpdateIfNeeded() error {
 		return fmt.Errorf("failed to create update directory: %w", err)
 	}
 
-	if !u.Scheduler.ShouldUpdate(u.CurrentVersion, u.ForceCheck) {
+	u.releaseFleet(ctx)
+	if u.inCooldown() || !u.Scheduler.ShouldUpdate(u.CurrentVersion, u.ForceCheck) {
 		return nil
 	}
 
-	if err := canUpdate(); err != nil {
-		return fmt.Errorf("update not possible: %w", err)
+	if err := u.precheck(ctx); err != nil {
+		return err
 	}
 
 	u.Scheduler.SetNextUpdate()
 
-	if err := u.Update(ctx); err != nil {
+	err := u.updateAll(ctx)
+	failures := u.recordCycle(err)
+	if err != nil {
+		if ds, ok := u.Scheduler.(DeferringScheduler); ok {
+			var limited *RateLimitError
+			if errors.As(err, &limited) && limited.RetryAfter > 0 {
+				ds.DeferUntil(time.Now().Add(limited.RetryAfter))
+				slog.Warn("update host asked to retry later", "retry_after", limited.RetryAfter, "next_update", ds.NextUpdate().Format(time.RFC3339))
+			}
+			if backoff := failureBackoff(failures); backoff > 0 {
+				ds.DeferUntil(time.Now().Add(backoff))
+			}
+		}
 		return fmt.Errorf("update failed: %w", err)
 	}
 
 	return nil
 }
 
-// Update performs the self-update process
-func (u *Updater) Update(ctx context.Context) error {
-	execPath, err := os.Executable()
+// UpdateNow checks for an update and applies it right away, whatever the
+// Scheduler says, for short-lived tools that check once per invocation. The
+// Prechecks still apply and the cycle is recorded in Status.
+func (u *Updater) UpdateNow(ctx context.Context) error {
+	if u.CurrentVersion == "dev" {
+		slog.Info("skipping update for dev version")
+		return nil
+	}
+	u.releaseFleet(ctx)
+	if u.inCooldown() {
+		return nil
+	}
+	if err := os.MkdirAll(getExecRelativeDir(u.Dir), 0755); err != nil {
+		return fmt.Errorf("failed to create update directory: %w", err)
+	}
+	if err := u.precheck(ctx); err != nil {
+		return err
+	}
+
+	err := u.updateAll(ctx)
+	u.recordCycle(err)
 	if err != nil {
-		return fmt.Errorf("failed to get executable path: %w", err)
+		return fmt.Errorf("update failed: %w", err)
+	}
+	return nil
+}
+
+// updateAll updates the application and then its Plugins
+func (u *Updater) updateAll(ctx context.Context) error {
+	if err := u.Update(ctx); err != nil || u.Plugins == nil {
+		return err
+	}
+	plugins := *u.Plugins
+	if plugins.App == nil {
+		plugins.App = u
+	}
+	return plugins.Update(ctx)
+}
+
+// precheck runs the Prechecks and checks that the binary can be replaced.
+// Binaries of a package manager are often read-only, so they are left to
+// Stage, which reports them or has Update delegate to the package manager
+// once there is an update.
+func (u *Updater) precheck(ctx context.Context) error {
+	for _, check := range u.Prechecks {
+		if err := check(ctx, u); err != nil {
+			return fmt.Errorf("%w: %w", ErrDeferred, err)
+		}
+	}
+
+	execPath, err := u.execPath()
+	if err != nil {
+		return err
+	}
+	if managed := u.managedInstall(ctx, execPath); managed != nil && !u.overwrites(managed) {
+		return nil
+	}
+	if err := canUpdate(execPath); err != nil {
+		return fmt.Errorf("update not possible: %w", err)
+	}
+	return nil
+}
+
+// execPath returns the binary to replace, with symlinks resolved
+func (u *Updater) execPath() (string, error) {
+	execPath := u.ExecPath
+	if execPath == "" {
+		var err error
+		if execPath, err = os.Executable(); err != nil {
+			return "", fmt.Errorf("failed to get executable path: %w", err)
+		}
 	}
 
 	if resolvedPath, err := filepath.EvalSymlinks(execPath); err == nil {
 		execPath = resolvedPath
 	}
+	return execPath, nil
+}
+
+// Update performs the self-update process
+func (u *Updater) Update(ctx context.Context) error {
+	staged, err := u.Stage(ctx)
+	var managed *ManagedInstallError
+	if u.UsePackageManager && errors.As(err, &managed) && managed.Args != nil {
+		return u.delegate(ctx, managed)
+	}
+	if err != nil || staged == nil {
+		return err
+	}
+	return u.apply(staged)
+}
+
+// UpdateTo installs version in place of the running one, such as a known
+// good build support asks a user to move to. The version must be listed by
+// AvailableVersions and its binary is verified against the digests of the
+// index, which is signed like the manifests. Unlike Update it also moves to
+// older versions and does not wait for staged rollouts or canaries.
+func (u *Updater) UpdateTo(ctx context.Context, version string) error {
+	versions, err := u.AvailableVersions(ctx)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(versions, func(info UpdateInfo) bool { return info.Version == version })
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrUnknownVersion, version)
+	}
+
+	execPath, err := u.execPath()
+	if err != nil {
+		return err
+	}
+	if err := u.checkManaged(ctx, execPath); err != nil {
+		return err
+	}
+	unlock, err := lockTarget(execPath)
+	if err != nil {
+		return err
+	}
+	u.Info = versions[i]
+	staged, err := u.stageInfo(ctx, execPath, true)
+	unlock()
+	if err != nil || staged == nil {
+		return err
+	}
+	return u.apply(staged)
+}
+
+// apply commits staged, or keeps it for Finalize with ApplyOnExit
+func (u *Updater) apply(staged *StagedUpdate) error {
+	if u.ApplyOnExit {
+		u.mu.Lock()
+		previous := u.pending
+		u.pending = staged
+		u.mu.Unlock()
+		if previous != nil && previous.newPath != staged.newPath {
+			previous.Discard()
+		}
+		slog.Info("update staged, applying on exit", "version", staged.Version)
+		return nil
+	}
+	if err := staged.Commit(); err != nil {
+		if errors.Is(err, ErrFleetBusy) {
+			staged.Discard()
+			return fmt.Errorf("%w: %w", ErrDeferred, err)
+		}
+		return err
+	}
+	return nil
+}
 
+// Stage downloads and verifies the update, if there is one, and writes it
+// next to the executable without replacing it, returning nil when there is
+// nothing to update to. The host application decides when to Commit it,
+// such as after draining its work queues, or to Discard it.
+func (u *Updater) Stage(ctx context.Context) (*StagedUpdate, error) {
+	execPath, err := u.execPath()
+	if err != nil {
+		return nil, err
+	}
 	if err := u.fetchInfo(); err != nil {
-		return fmt.Errorf("failed to fetch update info: %w", err)
+		return nil, fmt.Errorf("failed to fetch update info: %w", err)
+	}
+	if u.Info.Version != u.CurrentVersion {
+		if err := u.checkManaged(ctx, execPath); err != nil {
+			return nil, err
+		}
 	}
+	unlock, err := lockTarget(execPath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return u.stageInfo(ctx, execPath, false)
+}
 
+// stageInfo stages the update described by u.Info for the binary at
+// execPath, which the caller holds the lock of. A pinned version was asked
+// for explicitly, so it is neither held back by rollouts and canaries nor
+// replaced by the latest manifest.
+func (u *Updater) stageInfo(ctx context.Context, execPath string, pinned bool) (*StagedUpdate, error) {
+	var err error
 	if u.Info.Version == u.CurrentVersion {
 		slog.Info("already at latest version", "version", u.CurrentVersion)
-		return nil
+		return nil, nil
+	}
+	if u.stagedVersion() == u.Info.Version {
+		slog.Info("update already staged for exit", "version", u.Info.Version)
+		return nil, nil
+	}
+
+	if !pinned && !u.inRollout() {
+		slog.Info("update not rolled out to this installation yet", "version", u.Info.Version, "rollout", u.Info.Rollout)
+		return nil, nil
+	}
+	if !pinned && u.waitForCanaries() {
+		return nil, nil
+	}
+	if err := checkResources(u.Info, execPath); err != nil {
+		return nil, err
+	}
+	if u.OnConfirmDownload != nil && !u.OnConfirmDownload(u.Info) {
+		return nil, fmt.Errorf("%w: %w", ErrDeferred, ErrDownloadDeclined)
 	}
+	if !pinned {
+		changed, err := u.refetchInfo()
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			slog.Info("manifest changed while waiting to download", "version", u.Info.Version)
+			return u.stageInfo(ctx, execPath, false)
+		}
+	}
+
+	var newPath string
+	bin := u.cachedBin()
+	if bin != nil {
+		slog.Info("using cached download", "version", u.Info.Version)
+	}
+	if bin == nil && u.DiffURL != "" && u.CurrentVersion != "" {
+		bin, newPath, err = u.patch(execPath)
+		if err != nil {
+			slog.Warn("patch update failed, falling back to full binary", "error", err)
+			bin, newPath = nil, ""
+		}
+	}
+	if bin == nil && newPath == "" {
+		bin, err = u.fetchAndVerifyFullBin(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch update binary: %w", err)
+		}
+	}
+	if newPath == "" {
+		u.cacheBin(bin)
+		newPath, err = writeStaged(execPath, bin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stage update: %w", explainDenied(err))
+		}
+	}
+	if err := markOfTheWeb(newPath, u.ZoneID); err != nil {
+		os.Remove(newPath)
+		return nil, fmt.Errorf("failed to stage update: %w", err)
+	}
+	if runtime.GOOS == "windows" && u.AuthenticodeSigner != "" {
+		if err := verifyAuthenticode(ctx, newPath, u.AuthenticodeSigner); err != nil {
+			os.Remove(newPath)
+			u.dropCached(cacheKey(u.Info))
+			return nil, err
+		}
+	}
+	return &StagedUpdate{Version: u.Info.Version, u: u, execPath: execPath, newPath: newPath, info: u.Info}, nil
+}
+
+// patch applies the patch to the binary at execPath, returning the new
+// binary, or for binaries of largePatchSize and more the path it is staged at
+func (u *Updater) patch(execPath string) ([]byte, string, error) {
+	if fi, err := os.Stat(execPath); err == nil && fi.Size() >= largePatchSize {
+		newPath, err := u.stagePatch(execPath)
+		return nil, newPath, err
+	}
+	bin, err := u.fetchAndVerifyPatch(execPath)
+	return bin, "", err
+}
 
-	bin, err := u.fetchAndVerifyFullBin(ctx)
+// writeStaged writes bin next to execPath under a name of its own, so
+// updaters staging the same target do not overwrite each other's binary
+func writeStaged(execPath string, bin []byte) (string, error) {
+	f, err := createStaged(execPath)
 	if err != nil {
-		return fmt.Errorf("failed to fetch update binary: %w", err)
+		return "", err
 	}
+	_, err = f.Write(bin)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0755)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// createStaged creates the file a new binary for execPath is staged in
+func createStaged(execPath string) (*os.File, error) {
+	return os.CreateTemp(filepath.Dir(execPath), fmt.Sprintf(".%s.new-*", filepath.Base(execPath)))
+}
 
-	if err := u.applyUpdate(execPath, bin); err != nil {
-		return fmt.Errorf("failed to apply update: %w", err)
+// Finalize applies the update staged with ApplyOnExit, if any. Call it when
+// the application shuts down, such as after its main loop returns or from
+// a signal handler; OnSuccessfulUpdate runs once the binary is swapped.
+func (u *Updater) Finalize() error {
+	u.mu.Lock()
+	staged := u.pending
+	u.pending = nil
+	u.mu.Unlock()
+	if staged == nil {
+		return nil
+	}
+	return staged.Commit()
+}
+
+func (u *Updater) stagedVersion() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.pending == nil {
+		return ""
+	}
+	return u.pending.Version
+}
+
+// StagedUpdate is a verified binary written next to the executable it
+// replaces, returned by Stage. Either Commit or Discard it, once.
+type StagedUpdate struct {
+	Version string // version of the staged binary
+
+	u        *Updater
+	execPath string
+	newPath  string
+	info     UpdateInfo
+	done     bool
+}
+
+// Commit swaps the staged binary in, records it in the Updater Status and
+// runs OnSuccessfulUpdate
+func (s *StagedUpdate) Commit() error {
+	if s.done {
+		return ErrStagedUpdateDone
+	}
+	unlock, err := lockTarget(s.execPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	u := s.u
+	if err := copySecurityContext(s.execPath, s.newPath); err != nil {
+		return fmt.Errorf("failed to restore SELinux label: %w", err)
+	}
+	if err := u.lockFleet(); err != nil {
+		return err
+	}
+	s.done = true
+	if err := swapBinary(s.execPath, s.newPath); err != nil {
+		os.Remove(s.newPath)
+		if uerr := u.unlockFleet(context.Background()); uerr != nil {
+			slog.Warn("keeping fleet lock slot", "error", uerr)
+		}
+		return fmt.Errorf("failed to apply update: %w", explainDenied(err))
+	}
+	u.recordStatus(func(st *Status) {
+		st.PreviousVersion = u.CurrentVersion
+		st.LastVersion = s.Version
+		st.LastApplied = time.Now()
+	})
+	u.dropCached(cacheKey(s.info))
+	if err := u.installAssets(s.info, s.execPath); err != nil {
+		slog.Warn("failed to install assets", "version", s.Version, "error", err)
 	}
 
 	if u.OnSuccessfulUpdate != nil {
@@ -227,24 +926,26 @@ func (u *Updater) Update(ctx context.Context) error {
 	return nil
 }
 
-func (u *Updater) applyUpdate(execPath string, newBin []byte) error {
-	updateDir := filepath.Dir(execPath)
-	filename := filepath.Base(execPath)
-
-	newPath := filepath.Join(updateDir, fmt.Sprintf(".%s.new", filename))
-	oldPath := filepath.Join(updateDir, fmt.Sprintf(".%s.old", filename))
+// Discard removes the staged binary, leaving the executable as it is
+func (s *StagedUpdate) Discard() error {
+	if s.done {
+		return ErrStagedUpdateDone
+	}
+	s.done = true
+	return os.Remove(s.newPath)
+}
 
-	// Clean up any existing files
-	os.Remove(newPath)
+// swapBinary replaces execPath with the binary at newPath, putting the
+// original back if that fails
+func swapBinary(execPath, newPath string) error {
+	oldPath := filepath.Join(filepath.Dir(execPath), fmt.Sprintf(".%s.old", filepath.Base(execPath)))
 	os.Remove(oldPath)
 
-	// Write new binary
-	if err := os.WriteFile(newPath, newBin, 0755); err != nil {
-		return err
-	}
-
 	// Swap files
-	if err := os.Rename(execPath, oldPath); err != nil {
+	if err := os.Rename(execPath, oldPath); os.IsNotExist(err) {
+		// first install, as of a plugin
+		return os.Rename(newPath, execPath)
+	} else if err != nil {
 		return err
 	}
 
@@ -265,97 +966,344 @@ func (u *Updater) applyUpdate(execPath string, newBin []byte) error {
 
 // Helper functions
 
+// inRollout reports whether this installation is among the percentage of
+// installations the update is offered to. Every version places installations
+// in new buckets so the same machines are not always the first to update,
+// while raising the percentage keeps the ones already included.
+func (u *Updater) inRollout() bool {
+	if u.Info.Rollout <= 0 || u.Info.Rollout >= 100 {
+		return true
+	}
+	return rolloutBucket(u.installationID(), u.Info.Version) < u.Info.Rollout
+}
+
+// rolloutBucket maps an installation to a bucket between 0 and 99 for version
+func rolloutBucket(id, version string) int {
+	sum := sha256.Sum256([]byte(id + "\x00" + version))
+	return int(binary.BigEndian.Uint64(sum[:8]) % 100)
+}
+
 func (u *Updater) NextUpdate() time.Time {
 	return u.Scheduler.NextUpdate()
 }
 
+// Reload makes the Scheduler read its state from disk again on the next
+// call, for when another process, such as a CLI sharing the Dir of a daemon,
+// checked for updates in the meantime. Schedulers cache the next check in
+// memory, so NextUpdate can be polled without reading a file every time.
+func (u *Updater) Reload() {
+	if r, ok := u.Scheduler.(interface{ Reload() }); ok {
+		r.Reload()
+	}
+}
+
 func (u *Updater) fetchInfo() error {
 	channel := u.Channel
 	if channel == "" {
 		channel = stableChannel
 	}
 
-	// Build URL path
-	urlPath := url.PathEscape(u.CmdName)
-	if channel != stableChannel {
-		urlPath = filepath.Join(urlPath, url.PathEscape(channel))
-	}
-	urlPath = filepath.Join(urlPath, url.PathEscape(platform)) + ".json"
-
-	if u.Requester == nil {
-		u.Requester = &HTTPRequester{}
-	}
-	if !strings.HasSuffix(u.ApiURL, "/") {
-		u.ApiURL = u.ApiURL + "/"
+	manifestURL, err := u.manifestURL(channel)
+	if err != nil {
+		return err
 	}
-	r, err := u.Requester.Fetch(u.ApiURL + urlPath)
+	r, err := u.fetchManifest(manifestURL)
 	if err != nil {
 		return fmt.Errorf("failed to fetch update info: %w", err)
 	}
 	defer r.Close()
 
-	var info UpdateInfo
-	if err := json.NewDecoder(r).Decode(&info); err != nil {
+	manifest, err := DecodeManifest(r, false)
+	if err != nil {
 		return fmt.Errorf("failed to decode update info: %w", err)
 	}
+	info := *manifest
+	if err := u.validateInfo(info, channel); err != nil {
+		return err
+	}
 
-	if len(info.Sha256) != sha256.Size {
-		return ErrInvalidHash
+	u.Info = info
+	u.fetchedAt = time.Now()
+	return nil
+}
+
+// refetchInfo fetches the manifest again when it was read more than
+// manifestMaxAge ago, such as while OnConfirmDownload waited for the user,
+// so that a version yanked in the meantime is not downloaded. It reports
+// whether the manifest changed.
+func (u *Updater) refetchInfo() (bool, error) {
+	if u.fetchedAt.IsZero() || time.Since(u.fetchedAt) < manifestMaxAge {
+		return false, nil
 	}
+	previous := u.Info
+	if err := u.fetchInfo(); err != nil {
+		return false, err
+	}
+	return !reflect.DeepEqual(previous, u.Info), nil
+}
 
-	if info.Channel != channel {
-		return fmt.Errorf("%w: expected %s, got %s",
-			ErrChannelMismatch, channel, info.Channel)
+// Policies for manifests of another channel than the one they were read
+// for, set in Updater.ChannelPolicy
+const (
+	ChannelStrict   = ""         // reject them with ErrChannelMismatch
+	ChannelWarn     = "warn"     // log a warning and accept them
+	ChannelUpstream = "upstream" // accept those of Updater.UpstreamChannels, as copied by promoting a release verbatim
+)
+
+// validateInfo checks that a manifest read for channel can be applied
+func (u *Updater) validateInfo(info UpdateInfo, channel string) error {
+	if err := validateDigests(info); err != nil {
+		return err
 	}
 
-	u.Info = info
+	if err := compress.Validate(info.Compression); err != nil {
+		return err
+	}
+
+	if info.Archive != "" {
+		if err := archive.Validate(info.Archive); err != nil {
+			return err
+		}
+	}
+
+	if info.Channel != channel {
+		return u.channelMismatch(info, channel)
+	}
 	return nil
 }
 
+// channelMismatch applies ChannelPolicy to a manifest of info.Channel read
+// for channel
+func (u *Updater) channelMismatch(info UpdateInfo, channel string) error {
+	err := fmt.Errorf("%w: expected %s, got %s", ErrChannelMismatch, channel, info.Channel)
+	switch u.ChannelPolicy {
+	case ChannelStrict:
+		return err
+	case ChannelWarn:
+		slog.Warn("accepting manifest of another channel", "channel", channel, "manifest_channel", info.Channel, "version", info.Version)
+		return nil
+	case ChannelUpstream:
+		if slices.Contains(u.UpstreamChannels, info.Channel) {
+			return nil
+		}
+		return fmt.Errorf("%w, which is not upstream of %s", err, channel)
+	}
+	return fmt.Errorf("unknown channel policy %q", u.ChannelPolicy)
+}
+
 func (u *Updater) fetchAndVerifyFullBin(ctx context.Context) ([]byte, error) {
+	artifact, err := u.artifactURL(u.Info)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("fetching binary from", artifact)
+	return u.fetchArtifact(ctx, artifact)
+}
+
+// manifestURL returns the URL of the manifest of channel, below ApiURL or
+// from ManifestURLTemplate
+func (u *Updater) manifestURL(channel string) (string, error) {
+	if channel == "" {
+		channel = stableChannel
+	}
+	if u.ManifestURLTemplate != "" {
+		return expandURLTemplate(u.ManifestURLTemplate, layoutData(u.CmdName, channel, u.CurrentVersion, platform, ""))
+	}
+	// Build URL path, which is slash separated on every OS
+	return joinURL(u.ApiURL, path.Join(escapeSegments(u.CmdName), ManifestPath(escapeSegment(channel), escapeSegment(platform))))
+}
+
+// artifactURL returns the URL of the artifact of info below BinURL, or from
+// ArtifactURLTemplate
+func (u *Updater) artifactURL(info UpdateInfo) (string, error) {
 	channel := u.Channel
 	if channel == "" {
 		channel = stableChannel
 	}
 
-	// Build URL path
-	urlPath := url.PathEscape(u.CmdName)
-	if channel != stableChannel {
-		urlPath = filepath.Join(urlPath, url.PathEscape(channel))
+	ext, err := compress.Extension(info.Compression)
+	if info.Archive != "" {
+		ext, err = archive.Extension(info.Archive)
+	}
+	if err != nil {
+		return "", err
 	}
-	urlPath = filepath.Join(urlPath,
-		url.PathEscape(u.Info.Version),
-		url.PathEscape(platform)) + ".gz"
 
-	if u.Requester == nil {
-		u.Requester = &HTTPRequester{}
+	data := layoutData(u.CmdName, channel, info.Version, platform, ext)
+	if u.ArtifactURLTemplate != "" {
+		return expandURLTemplate(u.ArtifactURLTemplate, data)
 	}
-	if !strings.HasSuffix(u.BinURL, "/") {
-		u.BinURL = u.BinURL + "/"
+
+	// Build URL path
+	layout := u.BinLayout
+	if layout == "" {
+		layout = DefaultBinLayout
 	}
-	fmt.Println("fetching binary from", u.BinURL+urlPath)
-	r, err := u.Requester.Fetch(u.BinURL + urlPath)
+	urlPath, err := ExpandLayout(layout, data.escaped())
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch binary: %w", err)
+		return "", err
+	}
+
+	return joinURL(u.BinURL, urlPath)
+}
+
+// readBin returns the binary in a downloaded artifact, decrypting it if
+// needed and decompressing it or extracting it from its archive. The binary
+// is verified against the digests of u.Info while it is decompressed, and
+// reading stops with ErrArtifactSize once the artifact exceeds u.Info.Size.
+func (u *Updater) readBin(r io.Reader) ([]byte, error) {
+	r, err := u.decrypt(limitArtifact(r, u.Info.Size), u.Info)
+	if err != nil {
+		return nil, err
+	}
+	if u.Info.Archive != "" && len(u.Assets) > 0 {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read binary: %w", err)
+		}
+		u.keepArchive(u.Info, b)
+		r = bytes.NewReader(b)
+	}
+	if u.Info.Archive != "" {
+		bin, err := archive.Extract(r, u.Info.Archive, u.Info.Executable)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract binary: %w", err)
+		}
+		if !verifyDigests(bin, u.Info) {
+			return nil, ErrHashMismatch
+		}
+		return bin, nil
 	}
-	defer r.Close()
 
-	// Decompress gzip
-	gz, err := gzip.NewReader(r)
+	// Decompress
+	cr, err := compress.NewReader(r, u.Info.Compression)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+		return nil, fmt.Errorf("failed to create decompressor: %w", err)
 	}
-	defer gz.Close()
+	defer cr.Close()
 
 	// Read and verify binary
-	bin, err := io.ReadAll(gz)
+	d := newDigester(u.Info)
+	bin, err := io.ReadAll(io.TeeReader(cr, d))
 	if err != nil {
 		return nil, fmt.Errorf("failed to read binary: %w", err)
 	}
+	if !d.verify() {
+		return nil, ErrHashMismatch
+	}
+	return bin, nil
+}
 
-	if !verifyHash(bin, u.Info.Sha256) {
+// decrypt returns the plaintext of an artifact of info
+func (u *Updater) decrypt(r io.Reader, info UpdateInfo) (io.Reader, error) {
+	switch info.Encryption {
+	case "":
+		return r, nil
+	case "age":
+		if len(u.Identities) == 0 {
+			return nil, ErrEncrypted
+		}
+		dr, err := age.Decrypt(r, u.Identities...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt binary: %w", err)
+		}
+		return dr, nil
+	}
+	return nil, fmt.Errorf("unsupported encryption %q", info.Encryption)
+}
+
+func (u *Updater) fetchAndVerifyPatch(execPath string) ([]byte, error) {
+	old, err := os.ReadFile(execPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read current binary: %w", err)
+	}
+
+	r, err := u.fetchPatch()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	bin, err := bsdiff.Patch(old, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply patch: %w", err)
+	}
+
+	if !verifyDigests(bin, u.Info) {
 		return nil, ErrHashMismatch
 	}
 
 	return bin, nil
 }
+
+// fetchPatch opens the patch from CurrentVersion to the version of u.Info
+func (u *Updater) fetchPatch() (io.ReadCloser, error) {
+	patchURL, err := joinURL(u.DiffURL, path.Join(escapeSegments(u.CmdName),
+		PatchPath(escapeSegment(u.CurrentVersion), escapeSegment(u.Info.Version), escapeSegment(platform))))
+	if err != nil {
+		return nil, err
+	}
+	r, err := u.fetch(patchURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch patch: %w", err)
+	}
+	return r, nil
+}
+
+// largePatchSize is the size from which binaries are patched from a memory
+// mapping of the current binary straight into the staged file, so that a
+// delta update holds neither the old nor the new binary in memory
+const largePatchSize = 64 << 20
+
+// stagePatch applies the patch to the binary at execPath like
+// fetchAndVerifyPatch, writing and verifying the new binary as it is
+// produced, and returns the path of the staged binary
+func (u *Updater) stagePatch(execPath string) (string, error) {
+	old, err := os.Open(execPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read current binary: %w", err)
+	}
+	defer old.Close()
+	fi, err := old.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to read current binary: %w", err)
+	}
+	var oldAt io.ReaderAt = old
+	if b, unmap, err := mapFile(old, fi.Size()); err == nil {
+		defer unmap()
+		oldAt = bytes.NewReader(b)
+	}
+
+	r, err := u.fetchPatch()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	f, err := createStaged(execPath)
+	if err != nil {
+		return "", err
+	}
+	d := newDigester(u.Info)
+	w := bufio.NewWriter(io.MultiWriter(f, d))
+	err = bsdiff.PatchTo(oldAt, fi.Size(), r, w)
+	if err != nil {
+		err = fmt.Errorf("failed to apply patch: %w", err)
+	} else {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && !d.verify() {
+		err = ErrHashMismatch
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0755)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -2,12 +2,37 @@ package selfupdate
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"filippo.io/age"
+
+	"github.com/bobo/go-selfupdate/internal/archive"
+	"github.com/bobo/go-selfupdate/internal/bsdiff"
+	compress "github.com/bobo/go-selfupdate/internal/compression"
 )
 
 // Test helpers
@@ -116,6 +141,137 @@ func TestFetchInfo(t *testing.T) {
 	equals(t, time.Date(2023, 7, 9, 0, 0, 0, 0, time.UTC), updater.Info.Date)
 }
 
+func TestChannelPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		policy   string
+		upstream []string
+		manifest string
+		ok       bool
+	}{
+		{ChannelStrict, nil, "beta", false},
+		{ChannelStrict, nil, "stable", true},
+		{ChannelWarn, nil, "nightly", true},
+		{ChannelUpstream, []string{"rc", "beta"}, "beta", true},
+		{ChannelUpstream, []string{"rc", "beta"}, "nightly", false},
+		{ChannelUpstream, nil, "beta", false},
+		{"lenient", nil, "beta", false},
+	} {
+		mr := &mockRequester{}
+		mr.handleRequest(func(url string) (io.ReadCloser, error) {
+			return newTestReaderCloser(`{"Version": "1.3", "Channel": "` + tt.manifest + `", "Sha256": "Q2vvTOW0p69A37StVANN+/ko1ZQDTElomq7fVcex/02="}`), nil
+		})
+		updater := createUpdater(mr)
+		updater.ChannelPolicy, updater.UpstreamChannels = tt.policy, tt.upstream
+		err := updater.fetchInfo()
+		if tt.ok != (err == nil) {
+			t.Errorf("%q %v with a %s manifest: got %v", tt.policy, tt.upstream, tt.manifest, err)
+		}
+		if !tt.ok && tt.policy != "lenient" && !errors.Is(err, ErrChannelMismatch) {
+			t.Errorf("%q with a %s manifest: got %v, want ErrChannelMismatch", tt.policy, tt.manifest, err)
+		}
+	}
+}
+
+func TestFetchInfoChannelURL(t *testing.T) {
+	for _, tt := range []struct{ cmd, channel, want string }{
+		{"myapp", "", "myapp/" + platform + ".json"},
+		{"myapp", "stable", "myapp/" + platform + ".json"},
+		{"myapp", "beta", "myapp/beta/" + platform + ".json"},
+		{"my app", "nightly build", "my%20app/nightly%20build/" + platform + ".json"},
+		{"", "beta", "beta/" + platform + ".json"},
+	} {
+		channel := tt.channel
+		if channel == "" {
+			channel = "stable"
+		}
+		mr := &mockRequester{}
+		mr.handleRequest(func(url string) (io.ReadCloser, error) {
+			// URLs are slash separated on every OS, Windows included
+			equals(t, "http://updates.yourdomain.com/"+tt.want, url)
+			return newTestReaderCloser(`{"Version": "1.3", "Channel": "` + channel + `", "Sha256": "Q2vvTOW0p69A37StVANN+/ko1ZQDTElomq7fVcex/02="}`), nil
+		})
+		updater := createUpdater(mr)
+		updater.CmdName, updater.Channel = tt.cmd, tt.channel
+		if err := updater.fetchInfo(); err != nil {
+			t.Errorf("%q %q: %v", tt.cmd, tt.channel, err)
+		}
+	}
+	equals(t, "patches/1.2/1.3/linux-amd64.patch", PatchPath("1.2", "1.3", "linux-amd64"))
+}
+
+func TestURLEscaping(t *testing.T) {
+	for _, tt := range []struct {
+		base, cmd, channel, version string
+		manifest, artifact, patch   string
+	}{
+		{
+			"http://u.example.com", "myapp", "", "1.3",
+			"http://u.example.com/myapp/" + platform + ".json",
+			"http://u.example.com/myapp/1.3/" + platform + ".gz",
+			"http://u.example.com/myapp/patches/1.2/1.3/" + platform + ".patch",
+		},
+		{
+			"http://u.example.com/updates/", "my app", "nightly build", "1.3 beta",
+			"http://u.example.com/updates/my%20app/nightly%20build/" + platform + ".json",
+			"http://u.example.com/updates/my%20app/1.3%20beta/" + platform + ".gz",
+			"http://u.example.com/updates/my%20app/patches/1.2/1.3%20beta/" + platform + ".patch",
+		},
+		{
+			"http://u.example.com/", "c++", "beta+1", "1.3+build5",
+			"http://u.example.com/c%2B%2B/beta%2B1/" + platform + ".json",
+			"http://u.example.com/c%2B%2B/1.3%2Bbuild5/" + platform + ".gz",
+			"http://u.example.com/c%2B%2B/patches/1.2/1.3%2Bbuild5/" + platform + ".patch",
+		},
+		{
+			// plugins keep the slashes of their command, channels and
+			// versions are single segments
+			"http://u.example.com/", "myapp/plugins/fmt", "team/a", "1.3/../..",
+			"http://u.example.com/myapp/plugins/fmt/team%2Fa/" + platform + ".json",
+			"http://u.example.com/myapp/plugins/fmt/1.3%2F..%2F../" + platform + ".gz",
+			"http://u.example.com/myapp/plugins/fmt/patches/1.2/1.3%2F..%2F../" + platform + ".patch",
+		},
+		{
+			"http://u.example.com/", "myapp", "..", "..",
+			"http://u.example.com/myapp/%2E%2E/" + platform + ".json",
+			"http://u.example.com/myapp/%2E%2E/" + platform + ".gz",
+			"http://u.example.com/myapp/patches/1.2/%2E%2E/" + platform + ".patch",
+		},
+		{
+			// the query of a presigned prefix is kept
+			"https://u.example.com/tree/?token=a%2Bb", "myapp", "", "1.3",
+			"https://u.example.com/tree/myapp/" + platform + ".json?token=a%2Bb",
+			"https://u.example.com/tree/myapp/1.3/" + platform + ".gz?token=a%2Bb",
+			"https://u.example.com/tree/myapp/patches/1.2/1.3/" + platform + ".patch?token=a%2Bb",
+		},
+	} {
+		var urls []string
+		mr := &mockRequester{}
+		for range 2 {
+			mr.handleRequest(func(url string) (io.ReadCloser, error) {
+				urls = append(urls, url)
+				return newTestReaderCloser(""), nil
+			})
+		}
+		u := createUpdater(mr)
+		u.ApiURL, u.BinURL, u.DiffURL = tt.base, tt.base, tt.base
+		u.CmdName, u.Channel = tt.cmd, tt.channel
+		u.Info = UpdateInfo{Version: tt.version, Compression: "gzip"}
+		u.fetchInfo()
+		artifact, err := u.artifactURL(u.Info)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.version, err)
+		}
+		r, err := u.fetchPatch()
+		if err != nil {
+			t.Fatalf("%q: %v", tt.version, err)
+		}
+		r.Close()
+		equals(t, tt.manifest+" "+tt.patch, strings.Join(urls, " "))
+		equals(t, tt.artifact, artifact)
+		equals(t, tt.base, u.ApiURL)
+	}
+}
+
 func getExpectedURL() string {
 	return "http://updates.yourdomain.com/myapp/" + runtime.GOOS + "-" + runtime.GOARCH + ".json"
 }
@@ -204,6 +360,37 @@ func TestDailyScheduler(t *testing.T) {
 			t.Errorf("Should maintain scheduled hour, got %d want %d", next.Hour(), (currentHour+1)%24)
 		}
 	})
+
+	t.Run("should schedule in the given location", func(t *testing.T) {
+		s := NewDailySchedulerIn(3, time.UTC)
+		now := time.Date(2024, 6, 1, 13, 0, 0, 0, time.FixedZone("UTC+9", 9*3600))
+		if next := s.next(now); !next.Equal(time.Date(2024, 6, 2, 3, 0, 0, 0, time.UTC)) {
+			t.Errorf("got %v, want 03:00 UTC the next day", next)
+		}
+	})
+
+	t.Run("should keep the hour across DST changes", func(t *testing.T) {
+		loc, err := time.LoadLocation("America/New_York")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := NewDailySchedulerIn(3, loc)
+		// the night of March 10 2024 is an hour shorter
+		next := s.next(time.Date(2024, 3, 9, 4, 0, 0, 0, loc))
+		if want := time.Date(2024, 3, 10, 3, 0, 0, 0, loc); !next.Equal(want) || next.Hour() != 3 {
+			t.Errorf("got %v, want %v", next, want)
+		}
+		next = s.next(time.Date(2024, 11, 2, 4, 0, 0, 0, loc))
+		if want := time.Date(2024, 11, 3, 3, 0, 0, 0, loc); !next.Equal(want) {
+			t.Errorf("got %v, want %v", next, want)
+		}
+		// on March 10 2024, 02:00 does not exist
+		s = NewDailySchedulerIn(2, loc)
+		next = s.next(time.Date(2024, 3, 9, 4, 0, 0, 0, loc))
+		if next.Day() != 10 || next.Hour() != 3 {
+			t.Errorf("got %v, want 03:00 on March 10", next)
+		}
+	})
 }
 
 func TestIntervalScheduler(t *testing.T) {
@@ -278,3 +465,1915 @@ func TestIntervalScheduler(t *testing.T) {
 		}
 	})
 }
+
+func TestVerifyDigests(t *testing.T) {
+	bin := []byte("new binary")
+	sum256 := sha256.Sum256(bin)
+	sum512 := sha512.Sum512(bin)
+	bad512 := sha512.Sum512([]byte("other binary"))
+
+	tests := []struct {
+		name  string
+		info  UpdateInfo
+		valid bool
+		match bool
+	}{
+		{"no digests", UpdateInfo{}, false, false},
+		{"sha256 only", UpdateInfo{Sha256: sum256[:]}, true, true},
+		{"sha512 only", UpdateInfo{Sha512: sum512[:]}, true, true},
+		{"both match", UpdateInfo{Sha256: sum256[:], Sha512: sum512[:]}, true, true},
+		{"sha512 mismatch", UpdateInfo{Sha256: sum256[:], Sha512: bad512[:]}, true, false},
+		{"truncated sha512", UpdateInfo{Sha256: sum256[:], Sha512: sum512[:32]}, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateDigests(tt.info)
+			if (err == nil) != tt.valid {
+				t.Errorf("validateDigests() error = %v, want valid %v", err, tt.valid)
+			}
+			if got := verifyDigests(bin, tt.info); got != tt.match {
+				t.Errorf("verifyDigests() = %v, want %v", got, tt.match)
+			}
+		})
+	}
+}
+
+func TestFetchAndVerifyPatch(t *testing.T) {
+	oldBin := []byte("old binary contents, version 1.2")
+	newBin := []byte("new binary contents, version 1.3")
+	execPath := filepath.Join(t.TempDir(), "myapp")
+	if err := os.WriteFile(execPath, oldBin, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var patch bytes.Buffer
+	if err := bsdiff.Diff(oldBin, newBin, &patch); err != nil {
+		t.Fatal(err)
+	}
+
+	mr := &mockRequester{}
+	mr.handleRequest(
+		func(url string) (io.ReadCloser, error) {
+			equals(t, "http://updates.yourdomain.com/myapp/patches/1.2/1.3/"+runtime.GOOS+"-"+runtime.GOARCH+".patch", url)
+			return newTestReaderCloser(patch.String()), nil
+		})
+	updater := createUpdater(mr)
+	sum := sha256.Sum256(newBin)
+	updater.Info = UpdateInfo{Version: "1.3", Sha256: sum[:]}
+
+	bin, err := updater.fetchAndVerifyPatch(execPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bin, newBin) {
+		t.Errorf("unexpected patched binary %q", bin)
+	}
+
+	// a patch producing the wrong binary must be rejected
+	mr.handleRequest(
+		func(url string) (io.ReadCloser, error) {
+			return newTestReaderCloser(patch.String()), nil
+		})
+	updater.Info.Sha256 = make([]byte, sha256.Size)
+	if _, err := updater.fetchAndVerifyPatch(execPath); err != ErrHashMismatch {
+		t.Errorf("expected ErrHashMismatch, got %v", err)
+	}
+}
+
+func TestStagePatch(t *testing.T) {
+	oldBin := make([]byte, 200000)
+	rand.New(rand.NewSource(1)).Read(oldBin)
+	newBin := append([]byte("new binary contents, version 1.3\n"), oldBin[1000:]...)
+	dir := t.TempDir()
+	execPath := filepath.Join(dir, "myapp")
+	if err := os.WriteFile(execPath, oldBin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var patch bytes.Buffer
+	if err := bsdiff.Diff(oldBin, newBin, &patch); err != nil {
+		t.Fatal(err)
+	}
+
+	mr := &mockRequester{}
+	for range 2 {
+		mr.handleRequest(func(url string) (io.ReadCloser, error) {
+			return newTestReaderCloser(patch.String()), nil
+		})
+	}
+	updater := createUpdater(mr)
+	sum := sha256.Sum256(newBin)
+	updater.Info = UpdateInfo{Version: "1.3", Sha256: sum[:]}
+
+	newPath, err := updater.stagePatch(execPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, newBin) {
+		t.Errorf("staged binary differs (got %d bytes, want %d)", len(got), len(newBin))
+	}
+	os.Remove(newPath)
+
+	updater.Info.Sha256 = make([]byte, sha256.Size)
+	if _, err := updater.stagePatch(execPath); err != ErrHashMismatch {
+		t.Errorf("expected ErrHashMismatch, got %v", err)
+	}
+	if staged, _ := filepath.Glob(filepath.Join(dir, ".myapp.new-*")); len(staged) != 0 {
+		t.Errorf("rejected binary left staged: %v", staged)
+	}
+}
+
+func TestFetchInfoSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := `{"Version": "1.3", "Sha256": "Q2vvTOW0p69A37StVANN+/ko1ZQDTElomq7fVcex/02=", "Channel": "stable"}`
+	signPrehashed := func(content string) string {
+		digest := sha512.Sum512([]byte(content))
+		sig, err := priv.Sign(nil, digest[:], &ed25519.Options{Hash: crypto.SHA512})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(sig)
+	}
+	goodSig := signPrehashed(manifest)
+	badSig := signPrehashed("something else")
+
+	tests := []struct {
+		name    string
+		sig     string
+		wantErr error
+	}{
+		{"valid signature", goodSig + "\n", nil},
+		{"signature with comment of earlier versions", "untrusted comment: test\n" + goodSig + "\n", nil},
+		{"signature of other content", badSig, ErrSignatureMismatch},
+		{"garbage signature", "not base64!", ErrInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := &mockRequester{}
+			mr.handleRequest(func(url string) (io.ReadCloser, error) {
+				equals(t, getExpectedURL(), url)
+				return newTestReaderCloser(manifest), nil
+			})
+			mr.handleRequest(func(url string) (io.ReadCloser, error) {
+				equals(t, getExpectedURL()+SignatureSuffix, url)
+				return newTestReaderCloser(tt.sig), nil
+			})
+			updater := createUpdater(mr)
+			updater.PublicKey = pub
+
+			err := updater.fetchInfo()
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("fetchInfo() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFetchAndVerifyFullBinCompression(t *testing.T) {
+	newBin := []byte("new binary contents")
+	sum := sha256.Sum256(newBin)
+
+	tests := []struct {
+		compression string
+		ext         string
+	}{
+		{"", ".gz"},
+		{"gzip", ".gz"},
+		{"zstd", ".zst"},
+		{"xz", ".xz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ext+" "+tt.compression, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := compress.NewWriter(&buf, tt.compression, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(newBin)
+			w.Close()
+
+			mr := &mockRequester{}
+			mr.handleRequest(func(url string) (io.ReadCloser, error) {
+				equals(t, "http://updates.yourdownmain.com/myapp/1.3/"+runtime.GOOS+"-"+runtime.GOARCH+tt.ext, url)
+				return newTestReaderCloser(buf.String()), nil
+			})
+			updater := createUpdater(mr)
+			updater.Info = UpdateInfo{Version: "1.3", Sha256: sum[:], Compression: tt.compression}
+
+			bin, err := updater.fetchAndVerifyFullBin(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(bin, newBin) {
+				t.Errorf("unexpected binary %q", bin)
+			}
+		})
+	}
+}
+
+func TestFetchAndVerifyFullBinSize(t *testing.T) {
+	newBin := []byte("new binary contents")
+	sum := sha256.Sum256(newBin)
+	var buf bytes.Buffer
+	w, err := compress.NewWriter(&buf, compress.Gzip, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(newBin)
+	w.Close()
+
+	for _, tt := range []struct {
+		name string
+		info UpdateInfo
+		want error
+	}{
+		{"exact size", UpdateInfo{Version: "1.3", Sha256: sum[:], Size: int64(buf.Len())}, nil},
+		{"larger than size", UpdateInfo{Version: "1.3", Sha256: sum[:], Size: int64(buf.Len()) - 1}, ErrArtifactSize},
+		{"digest mismatch", UpdateInfo{Version: "1.3", Sha256: make([]byte, sha256.Size)}, ErrHashMismatch},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := &mockRequester{}
+			mr.handleRequest(func(url string) (io.ReadCloser, error) {
+				return newTestReaderCloser(buf.String()), nil
+			})
+			updater := createUpdater(mr)
+			updater.Info = tt.info
+			if _, err := updater.fetchAndVerifyFullBin(context.Background()); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchAndVerifyFullBinArchive(t *testing.T) {
+	newBin := []byte("new binary contents")
+	sum := sha256.Sum256(newBin)
+
+	for _, format := range []string{archive.TarGz, archive.Zip} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := archive.Write(&buf, format, time.Time{}, 0, []archive.File{
+				{Name: "README", Mode: 0644, Size: 6, Body: strings.NewReader("readme")},
+				{Name: "myapp", Mode: 0755, Size: int64(len(newBin)), Body: bytes.NewReader(newBin)},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mr := &mockRequester{}
+			mr.handleRequest(func(url string) (io.ReadCloser, error) {
+				equals(t, "http://updates.yourdownmain.com/myapp/1.3/"+platform+"."+format, url)
+				return newTestReaderCloser(buf.String()), nil
+			})
+			updater := createUpdater(mr)
+			updater.Info = UpdateInfo{Version: "1.3", Sha256: sum[:], Archive: format, Executable: "myapp"}
+
+			bin, err := updater.fetchAndVerifyFullBin(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(bin, newBin) {
+				t.Errorf("unexpected binary %q", bin)
+			}
+		})
+	}
+}
+
+func TestFetchAndVerifyFullBinEncrypted(t *testing.T) {
+	newBin := []byte("private binary contents")
+	sum := sha256.Sum256(newBin)
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var artifact bytes.Buffer
+	ew, err := age.Encrypt(&artifact, identity.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := compress.NewWriter(ew, compress.Gzip, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(newBin)
+	w.Close()
+	ew.Close()
+
+	mr := &mockRequester{}
+	for range 2 {
+		mr.handleRequest(func(url string) (io.ReadCloser, error) {
+			return newTestReaderCloser(artifact.String()), nil
+		})
+	}
+	updater := createUpdater(mr)
+	updater.Info = UpdateInfo{Version: "1.3", Sha256: sum[:], Encryption: "age"}
+	if _, err := updater.fetchAndVerifyFullBin(context.Background()); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("without identity: got %v, want ErrEncrypted", err)
+	}
+
+	updater.Identities = []age.Identity{identity}
+	bin, err := updater.fetchAndVerifyFullBin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	equals(t, string(newBin), string(bin))
+}
+
+func TestBinLayout(t *testing.T) {
+	newBin := []byte("new binary contents")
+	sum := sha256.Sum256(newBin)
+	var gz bytes.Buffer
+	w, err := compress.NewWriter(&gz, compress.Gzip, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(newBin)
+	w.Close()
+
+	tests := []struct {
+		layout, want string
+	}{
+		// the channel only selects the manifest, binaries are shared
+		{"", "myapp/1.3/" + platform + ".gz"},
+		{"{{.Cmd}}/{{.Channel}}/{{.Version}}/{{.Platform}}.gz", "myapp/beta/1.3/" + platform + ".gz"},
+		{"releases/{{.Version}}/{{.Cmd}}_{{.Platform}}{{.Ext}}", "releases/1.3/myapp_" + platform + ".gz"},
+	}
+	for _, tt := range tests {
+		mr := &mockRequester{}
+		mr.handleRequest(func(url string) (io.ReadCloser, error) {
+			equals(t, "http://updates.yourdownmain.com/"+tt.want, url)
+			return newTestReaderCloser(gz.String()), nil
+		})
+		updater := createUpdater(mr)
+		updater.Channel = "beta"
+		updater.BinLayout = tt.layout
+		updater.Info = UpdateInfo{Version: "1.3", Channel: "beta", Sha256: sum[:]}
+		if _, err := updater.fetchAndVerifyFullBin(context.Background()); err != nil {
+			t.Errorf("layout %q: %v", tt.layout, err)
+		}
+	}
+
+	for _, layout := range []string{"{{.Cmd}}/", "{{.Nope}}", "{{.Cmd"} {
+		if _, err := ExpandLayout(layout, LayoutData{Cmd: "myapp"}); err == nil {
+			t.Errorf("expected error for layout %q", layout)
+		}
+	}
+}
+
+func TestURLTemplates(t *testing.T) {
+	newBin := []byte("new binary contents")
+	sum := sha256.Sum256(newBin)
+	var gz bytes.Buffer
+	w, err := compress.NewWriter(&gz, compress.Gzip, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(newBin)
+	w.Close()
+	goos, goarch, _ := strings.Cut(platform, "-")
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(content []byte) []byte {
+		digest := sha512.Sum512(content)
+		sig, err := priv.Sign(nil, digest[:], &ed25519.Options{Hash: crypto.SHA512})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []byte(base64.StdEncoding.EncodeToString(sig))
+	}
+	manifest := []byte(`{"Version": "1.3+b1", "Channel": "stable", "Sha256": "` + base64.StdEncoding.EncodeToString(sum[:]) + `"}`)
+
+	// a goreleaser style bucket signed with a token, which stays after the
+	// signature suffix
+	responses := map[string][]byte{
+		"https://legacy.example.com/myapp/stable/latest-" + goos + ".json?v=1.2&token=x":       manifest,
+		"https://legacy.example.com/myapp/stable/latest-" + goos + ".json.sig?v=1.2&token=x":   sign(manifest),
+		"https://legacy.example.com/myapp_1.3%2Bb1_" + goos + "_" + goarch + ".gz?token=x":     gz.Bytes(),
+		"https://legacy.example.com/myapp_1.3%2Bb1_" + goos + "_" + goarch + ".gz.sig?token=x": sign(gz.Bytes()),
+	}
+	var fetched []string
+	updater := createUpdater(nil)
+	updater.ApiURL, updater.BinURL = "", ""
+	updater.Requester = requesterFunc(func(url string) (io.ReadCloser, error) {
+		fetched = append(fetched, url)
+		b, ok := responses[url]
+		if !ok {
+			return nil, fmt.Errorf("unexpected fetch of %s", url)
+		}
+		return io.NopCloser(bytes.NewReader(b)), nil
+	})
+	updater.PublicKey = pub
+	updater.ManifestURLTemplate = "https://legacy.example.com/{{.Cmd}}/{{.Channel}}/latest-{{.OS}}.json?v={{.Version}}&token=x"
+	updater.ArtifactURLTemplate = "https://legacy.example.com/{{.Cmd}}_{{.Version}}_{{.OS}}_{{.Arch}}{{.Ext}}?token=x"
+	if err := updater.fetchInfo(); err != nil {
+		t.Fatal(err)
+	}
+	equals(t, "1.3+b1", updater.Info.Version)
+	if _, err := updater.fetchAndVerifyFullBin(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	equals(t, 4, len(fetched))
+
+	for _, tmpl := range []string{"{{.Cmd}}/{{.Version}}.gz", "https:///{{.Cmd}}.gz", "https://example.com/{{.Nope}}"} {
+		updater.ArtifactURLTemplate = tmpl
+		if _, err := updater.artifactURL(updater.Info); err == nil {
+			t.Errorf("expected error for template %q", tmpl)
+		}
+	}
+}
+
+func TestFetchIndex(t *testing.T) {
+	var idx Index
+	idx.Add(platform, UpdateInfo{Version: "1.0", Channel: "stable", Sha256: []byte{1}})
+	idx.Add("other-platform", UpdateInfo{Version: "1.1", Channel: "stable", Sha256: []byte{2}})
+	idx.Add(platform, UpdateInfo{Version: "1.2", Channel: "stable", Sha256: []byte{3}})
+	idx.Add(platform, UpdateInfo{Version: "1.3", Channel: "beta", Sha256: []byte{4}})
+	b, err := json.Marshal(&idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mr := &mockRequester{}
+	mr.handleRequest(func(url string) (io.ReadCloser, error) {
+		equals(t, "http://updates.yourdomain.com/myapp/index.json", url)
+		return newTestReaderCloser(string(b)), nil
+	})
+	got, err := createUpdater(mr).FetchIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var versions []string
+	for _, r := range got.Releases("") {
+		versions = append(versions, r.Version)
+	}
+	equals(t, "1.2,1.0", strings.Join(versions, ","))
+
+	got.Remove("1.3")
+	if _, ok := got.Channels["beta"]; ok {
+		t.Error("beta channel should be dropped with its only release")
+	}
+}
+
+func TestAvailableVersions(t *testing.T) {
+	var idx Index
+	date := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	idx.Add(platform, UpdateInfo{Version: "1.0", Channel: "stable", Sha256: []byte{1}, Date: date})
+	idx.Add(platform, UpdateInfo{Version: "1.1", Channel: "stable", Sha256: []byte{2}, Archive: "zip", Size: 42})
+	idx.Add(platform, UpdateInfo{Version: "1.2", Channel: "stable", Sha256: []byte{3}})
+	idx.Add(platform, UpdateInfo{Version: "1.3", Channel: "beta", Sha256: []byte{4}})
+	idx.Yank("1.2")
+	b, err := json.Marshal(&idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mr := &mockRequester{}
+	mr.handleRequest(func(url string) (io.ReadCloser, error) {
+		return newTestReaderCloser(string(b)), nil
+	})
+	versions, err := createUpdater(mr).AvailableVersions(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Version != "1.1" || versions[1].Version != "1.0" {
+		t.Fatalf("unexpected versions %+v", versions)
+	}
+	if v := versions[0]; v.Archive != "zip" || v.Size != 42 || v.Channel != "stable" || !bytes.Equal(v.Sha256, []byte{2}) {
+		t.Errorf("unexpected manifest for 1.1 %+v", v)
+	}
+	if !versions[1].Date.Equal(date) {
+		t.Errorf("unexpected date %v", versions[1].Date)
+	}
+}
+
+func TestRollout(t *testing.T) {
+	updater := createUpdater(&mockRequester{})
+	updater.Info = UpdateInfo{Version: "1.3"}
+	if !updater.inRollout() {
+		t.Error("an update without rollout should reach everyone")
+	}
+
+	included := map[string]bool{}
+	for _, rollout := range []int{10, 50} {
+		n := 0
+		for i := 0; i < 1000; i++ {
+			updater.RolloutID = "machine-" + strconv.Itoa(i)
+			updater.Info.Rollout = rollout
+			if !updater.inRollout() {
+				if included[updater.RolloutID] {
+					t.Fatalf("%s dropped out when raising the rollout to %d%%", updater.RolloutID, rollout)
+				}
+				continue
+			}
+			included[updater.RolloutID] = true
+			n++
+		}
+		if n < rollout*10-50 || n > rollout*10+50 {
+			t.Errorf("rollout %d%% reached %d of 1000 installations", rollout, n)
+		}
+	}
+}
+
+func TestDecodeManifest(t *testing.T) {
+	sum := sha256.Sum256([]byte("binary"))
+	sum512 := sha512.Sum512([]byte("binary"))
+	hex256 := fmt.Sprintf("%x", sum)
+	b64 := base64.StdEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		name, manifest string
+		strict         bool
+		wantErr        string
+	}{
+		{"base64", `{"Version": "1.0", "Sha256": "` + b64 + `"}`, true, ""},
+		{"hex", `{"Version": "1.0", "Sha256": "` + hex256 + `", "Sha512": "` + fmt.Sprintf("%x", sum512) + `"}`, true, ""},
+		{"case insensitive", `{"version": "1.0", "sha256": "` + b64 + `"}`, true, ""},
+		{"unknown field", `{"Version": "1.0", "Sha256": "` + b64 + `", "Mirror": "x"}`, false, ""},
+		{"unknown field strict", `{"Version": "1.0", "Sha256": "` + b64 + `", "Mirror": "x"}`, true, "unknown field Mirror"},
+		{"bad hex", `{"Version": "1.0", "Sha256": "` + strings.Repeat("zz", 32) + `"}`, false, "Sha256: invalid hex digest"},
+		{"bad digest", `{"Version": "1.0", "Sha256": "not a digest!"}`, false, "Sha256: digest \"not a digest!\" is neither base64 nor hex"},
+		{"bad date", `{"Version": "1.0", "Date": "yesterday"}`, false, "Date: "},
+		{"bad type", `{"Version": 1.0}`, false, "Version: expected string, got number"},
+		{"not an object", `["1.0"]`, false, "invalid manifest"},
+		{"too large", `{"Notes": "` + strings.Repeat("x", MaxManifestSize) + `"}`, false, "larger than"},
+	}
+	for _, tt := range tests {
+		info, err := DecodeManifest(strings.NewReader(tt.manifest), tt.strict)
+		if tt.wantErr != "" {
+			if !errors.Is(err, ErrInvalidManifest) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if info.Version != "1.0" || !bytes.Equal(info.Sha256, sum[:]) {
+			t.Errorf("%s: decoded %+v", tt.name, info)
+		}
+	}
+}
+
+func FuzzDecodeManifest(f *testing.F) {
+	f.Add([]byte(`{"Version": "1.0", "Sha256": "Q2vvTOW0p69A37StVANN+/ko1ZQDTElomq7fVcex/02=", "Date": "2023-07-09T00:00:00Z"}`))
+	f.Add([]byte(`{"Sha512": null, "Rollout": 50}`))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		info, err := DecodeManifest(bytes.NewReader(b), false)
+		if err != nil {
+			return
+		}
+		// whatever decodes encodes and decodes again to the same manifest
+		out, err := json.Marshal(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := DecodeManifest(bytes.NewReader(out), true)
+		if err != nil {
+			t.Fatalf("re-decoding %s: %v", out, err)
+		}
+		if !bytes.Equal(again.Sha256, info.Sha256) || again.Version != info.Version {
+			t.Errorf("round trip changed %+v into %+v", info, again)
+		}
+		// the lean path decodes exactly what encoding/json does
+		var scanned UpdateInfo
+		if scanManifest(b, false, &scanned) {
+			if decoded, err := decodeManifest(b, false); err != nil || !reflect.DeepEqual(&scanned, decoded) {
+				t.Errorf("scanned %+v, decoded %+v, %v", scanned, decoded, err)
+			}
+		}
+	})
+}
+
+func TestScanManifest(t *testing.T) {
+	sum := sha256.Sum256([]byte("binary"))
+	b64 := base64.StdEncoding.EncodeToString(sum[:])
+	full := `{
+    "Version": "1.3", "Sha256": "` + b64 + `", "Sha512": "` + strings.Repeat("ab", 64) + `", "Channel": "beta",
+    "Date": "2026-10-01T12:00:00.5+02:00", "Compression": "zstd", "Archive": "tar.gz", "Executable": "myapp",
+    "Notes": "Caf\u00e9 \"fixes\"\n- faster", "NotesURL": "https://example.com/1.3", "Rollout": 25, "SBOM": "1.3/sbom.json",
+    "Provenance": "1.3/provenance.json", "Encryption": "age", "MinDisk": 104857600, "MinMemory": -0, "Size": 4194304
+}`
+	var info UpdateInfo
+	if !scanManifest([]byte(full), true, &info) {
+		t.Fatal("manifest with every field not scanned")
+	}
+	decoded, err := decodeManifest([]byte(full), true)
+	if err != nil || !reflect.DeepEqual(&info, decoded) {
+		t.Errorf("scanned %+v, decoded %+v, %v", info, decoded, err)
+	}
+	v := reflect.ValueOf(info)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).IsZero() && manifestNames[i] != "MinMemory" {
+			t.Errorf("%s not scanned", manifestNames[i])
+		}
+	}
+
+	for _, tt := range []struct {
+		manifest string
+		strict   bool
+		scanned  bool
+	}{
+		{`{}`, true, true},
+		{`{"version": "1.0", "Mirror": {"url": "x"}}`, false, false},
+		{`{"version": "1.0", "Mirror": "x", "Weight": 1.5e3, "Beta": true}`, false, true},
+		{`{"Version": "1.0", "Mirror": "x"}`, true, false},
+		{`{"Version": "1.0", "version": "1.1"}`, false, false},
+		{`{"Sha512": null}`, false, false},
+		{`{"Rollout": 1.0}`, false, false},
+		{`{"Rollout": 01}`, false, false},
+		{`{"Version": "1.0"} {}`, false, false},
+		{`{"Version": "1.0",}`, false, false},
+	} {
+		var info UpdateInfo
+		if got := scanManifest([]byte(tt.manifest), tt.strict, &info); got != tt.scanned {
+			t.Errorf("%s: scanned %v, want %v", tt.manifest, got, tt.scanned)
+		}
+	}
+}
+
+func TestCachingRequester(t *testing.T) {
+	var mu sync.Mutex
+	fetched := map[string]int{}
+	release := make(chan struct{})
+	base := requesterFunc(func(url string) (io.ReadCloser, error) {
+		<-release
+		mu.Lock()
+		defer mu.Unlock()
+		fetched[url]++
+		if strings.HasSuffix(url, "/broken.json") {
+			return nil, errors.New("unreachable")
+		}
+		return newTestReaderCloser(`{"Version": "1.3", "Channel": "stable", "Sha256": "Q2vvTOW0p69A37StVANN+/ko1ZQDTElomq7fVcex/0k="}`), nil
+	})
+	cache := &CachingRequester{Requester: base}
+
+	// updaters of a suite checking at the same time send one request
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			updater := createUpdater(nil)
+			updater.Requester = cache
+			if err := updater.fetchInfo(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	manifest := "http://updates.yourdomain.com/myapp/" + ManifestPath("stable", platform)
+	r, err := cache.FetchManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if _, err := cache.Fetch("http://updates.yourdomain.com/myapp/1.3/" + platform + ".gz"); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if _, err := cache.FetchManifest("http://updates.yourdomain.com/broken.json"); err == nil {
+			t.Error("expected the error of the requester")
+		}
+	}
+	cache.entries[manifest].fetched = time.Now().Add(-DefaultManifestTTL)
+	if _, err := cache.FetchManifest(manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	// what is cached is up to the caller, not the URL
+	template := "http://legacy.example.com/myapp/latest?os=" + runtime.GOOS
+	for range 2 {
+		updater := createUpdater(nil)
+		updater.Requester = cache
+		updater.ManifestURLTemplate = template
+		if err := updater.fetchInfo(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]int{
+		manifest: 2,
+		"http://updates.yourdomain.com/myapp/1.3/" + platform + ".gz": 1,
+		"http://updates.yourdomain.com/broken.json":                   2,
+		template: 1,
+	}
+	if !reflect.DeepEqual(fetched, want) {
+		t.Errorf("fetched %v, want %v", fetched, want)
+	}
+
+	// expired entries are removed rather than kept forever
+	cache.entries[template].fetched = time.Now().Add(-DefaultManifestTTL)
+	cache.swept = time.Time{}
+	if _, err := cache.FetchManifest(manifest); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.entries[template]; ok || len(cache.entries) != 1 {
+		t.Errorf("expired entries kept: %v", cache.entries)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tt := range []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"-5", 0},
+		{now.Add(time.Hour).Format(http.TimeFormat), time.Hour},
+		{now.Add(-time.Hour).Format(http.TimeFormat), 0},
+		{"soon", 0},
+	} {
+		if got := parseRetryAfter(tt.header, now); got != tt.want {
+			t.Errorf("Retry-After %q: got %v, want %v", tt.header, got, tt.want)
+		}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+	u := &Updater{ApiURL: srv.URL, CmdName: "myapp", Requester: &HTTPRequester{}}
+	var limited *RateLimitError
+	if err := u.fetchInfo(); !errors.As(err, &limited) || limited.RetryAfter != time.Hour {
+		t.Fatalf("expected a rate limit error with Retry-After, got %v", err)
+	}
+
+	cleanupTimeFile(t)
+	t.Cleanup(func() { cleanupTimeFile(t) })
+	s := NewIntervalScheduler(24, 0)
+	s.SetNextUpdate()
+	regular := s.NextUpdate()
+	s.DeferUntil(time.Now().Add(time.Hour))
+	if !s.NextUpdate().Equal(regular) {
+		t.Errorf("deferring to before the next check moved it from %v to %v", regular, s.NextUpdate())
+	}
+	later := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	s.DeferUntil(later)
+	if !s.NextUpdate().Equal(later) {
+		t.Errorf("next check is %v, want %v", s.NextUpdate(), later)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.UserAgent()
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	u := &Updater{ApiURL: srv.URL, CmdName: "myapp", CurrentVersion: "1.2", Requester: &HTTPRequester{}}
+	u.fetchInfo()
+	want := "myapp/1.2 (" + runtime.GOOS + "-" + runtime.GOARCH + "; selfupdate/devel)"
+	equals(t, want, got)
+
+	u.UserAgent = DefaultUserAgent("myapp", "1.2") + " fleet/eu-west"
+	u.fetchInfo()
+	equals(t, want+" fleet/eu-west", got)
+
+	u.Requester = &HTTPRequester{UserAgent: "custom"}
+	u.fetchInfo()
+	equals(t, "custom", got)
+}
+
+func TestPrechecks(t *testing.T) {
+	cleanupTimeFile(t)
+	t.Cleanup(func() { cleanupTimeFile(t) })
+	mr := &mockRequester{}
+	updater := createUpdater(mr)
+	updater.Scheduler = NewIntervalScheduler(24, 0)
+	updater.ForceCheck = false
+	updater.Prechecks = []Precheck{func(ctx context.Context, u *Updater) error { return ErrMetered }}
+	if err := updater.UpdateIfNeeded(); !errors.Is(err, ErrDeferred) || !errors.Is(err, ErrMetered) {
+		t.Fatalf("expected a deferred update, got %v", err)
+	}
+	if !updater.Scheduler.NextUpdate().IsZero() || mr.currentIndex != 0 {
+		t.Error("a deferred update must not fetch anything or use up the scheduled check")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	online := &Updater{ApiURL: "http://" + ln.Addr().String() + "/"}
+	if err := CheckOnline(context.Background(), online); err != nil {
+		t.Errorf("CheckOnline with a listening host: %v", err)
+	}
+	ln.Close()
+	if err := CheckOnline(context.Background(), online); !errors.Is(err, ErrOffline) {
+		t.Errorf("CheckOnline with no host listening: got %v, want ErrOffline", err)
+	}
+
+	for out, want := range map[string]bool{
+		"Unrestricted False False\r\n": false,
+		"Fixed False False":            true,
+		"Unrestricted True False":      true,
+		"":                             false,
+	} {
+		if got := parseWindowsCost(out); got != want {
+			t.Errorf("parseWindowsCost(%q) = %v", out, got)
+		}
+	}
+	for out, want := range map[string]bool{"u 1\n": true, "u 3": true, "u 2": false, "u 4": false, "u 0": false} {
+		if got := parseNetworkManagerMetered(out); got != want {
+			t.Errorf("parseNetworkManagerMetered(%q) = %v", out, got)
+		}
+	}
+}
+
+func TestCheckPower(t *testing.T) {
+	dir := t.TempDir()
+	supply := func(name string, files map[string]string) {
+		os.MkdirAll(filepath.Join(dir, name), 0755)
+		for f, v := range files {
+			os.WriteFile(filepath.Join(dir, name, f), []byte(v+"\n"), 0644)
+		}
+	}
+	supply("AC", map[string]string{"type": "Mains", "online": "0"})
+	supply("BAT0", map[string]string{"type": "Battery", "status": "Discharging", "capacity": "15"})
+	onBattery, percent, ok := linuxBatteryState(dir)
+	if !ok || !onBattery || percent != 15 {
+		t.Errorf("linuxBatteryState = %v, %d, %v", onBattery, percent, ok)
+	}
+	if runtime.GOOS == "linux" {
+		defer func(old string) { powerSupplyDir = old }(powerSupplyDir)
+		powerSupplyDir = dir
+		if err := CheckPower(20)(context.Background(), &Updater{}); !errors.Is(err, ErrOnBattery) {
+			t.Errorf("CheckPower(20) at 15%% on battery: got %v, want ErrOnBattery", err)
+		}
+		if err := CheckPower(10)(context.Background(), &Updater{}); err != nil {
+			t.Errorf("CheckPower(10) at 15%%: %v", err)
+		}
+		supply("BAT0", map[string]string{"status": "Charging"})
+		if err := CheckPower(20)(context.Background(), &Updater{}); err != nil {
+			t.Errorf("CheckPower(20) while charging: %v", err)
+		}
+	}
+	if _, _, ok := linuxBatteryState(t.TempDir()); ok {
+		t.Error("a machine without battery must not report a battery state")
+	}
+
+	onBattery, percent, ok = parsePmset("Now drawing from 'Battery Power'\n -InternalBattery-0 (id=4653155)\t85%; discharging; 3:20 remaining present: true\n")
+	if !ok || !onBattery || percent != 85 {
+		t.Errorf("parsePmset on battery = %v, %d, %v", onBattery, percent, ok)
+	}
+	if onBattery, _, ok = parsePmset("Now drawing from 'AC Power'\n -InternalBattery-0 (id=4653155)\t100%; charged; 0:00 remaining present: true\n"); !ok || onBattery {
+		t.Errorf("parsePmset on AC = %v, %v", onBattery, ok)
+	}
+	if _, _, ok = parsePmset("Now drawing from 'AC Power'\n"); ok {
+		t.Error("parsePmset without battery must not report a battery state")
+	}
+
+	onBattery, percent, ok = parseWindowsBattery("1 42\r\n")
+	if !ok || !onBattery || percent != 42 {
+		t.Errorf("parseWindowsBattery = %v, %d, %v", onBattery, percent, ok)
+	}
+	if onBattery, _, _ = parseWindowsBattery("2 42"); onBattery {
+		t.Error("status 2 is on AC power")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	cleanupTimeFile(t)
+	t.Cleanup(func() { cleanupTimeFile(t) })
+	mr := &mockRequester{}
+	for i := 0; i < 3; i++ {
+		mr.handleRequest(func(url string) (io.ReadCloser, error) {
+			return nil, errors.New("connection refused")
+		})
+	}
+	mr.handleRequest(func(url string) (io.ReadCloser, error) {
+		return newTestReaderCloser(`{"Version": "1.2", "Channel": "stable", "Sha256": "Q2vvTOW0p69A37StVANN+/ko1ZQDTElomq7fVcex/02="}`), nil
+	})
+	updater := createUpdater(mr)
+	updater.Scheduler = NewIntervalScheduler(1, 0)
+	updater.ForceCheck = true
+	os.Remove(updater.statusPath())
+	t.Cleanup(func() { os.Remove(updater.statusPath()) })
+
+	for i := 0; i < 3; i++ {
+		if err := updater.UpdateIfNeeded(); err == nil {
+			t.Fatal("expected the update to fail")
+		}
+	}
+	s := updater.Status()
+	if s.Failures != 3 || s.LastError == "" || s.LastCheck.IsZero() || !s.LastSuccess.IsZero() {
+		t.Errorf("unexpected status after three failures: %+v", s)
+	}
+	// the third failure backs off for two hours, past the hourly schedule
+	if !s.NextUpdate.After(time.Now().Add(90 * time.Minute)) {
+		t.Errorf("next update at %v was not backed off", s.NextUpdate)
+	}
+
+	if err := updater.UpdateIfNeeded(); err != nil {
+		t.Fatal(err)
+	}
+	s = updater.Status()
+	if s.Failures != 0 || s.LastError != "" || s.LastSuccess.IsZero() {
+		t.Errorf("unexpected status after a successful check: %+v", s)
+	}
+
+	for failures, want := range map[int]time.Duration{0: 0, 1: 0, 2: time.Hour, 4: 4 * time.Hour, 10: maxBackoff, 100: maxBackoff} {
+		if got := failureBackoff(failures); got != want {
+			t.Errorf("failureBackoff(%d) = %v, want %v", failures, got, want)
+		}
+	}
+}
+
+func TestCalendarSchedulers(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(year int, month time.Month, day, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, loc)
+	}
+	for _, tt := range []struct {
+		name string
+		next func(time.Time) time.Time
+		now  time.Time
+		want time.Time
+	}{
+		// June 5 2024 is a Wednesday
+		{"weekly later this week", NewWeeklyScheduler(time.Friday, 3).next, at(2024, 6, 5, 12), at(2024, 6, 7, 3)},
+		{"weekly later today", NewWeeklyScheduler(time.Wednesday, 18).next, at(2024, 6, 5, 12), at(2024, 6, 5, 18)},
+		{"weekly next week", NewWeeklyScheduler(time.Wednesday, 3).next, at(2024, 6, 5, 12), at(2024, 6, 12, 3)},
+		{"weekly across DST", NewWeeklyScheduler(time.Sunday, 3).next, at(2024, 3, 30, 12), at(2024, 3, 31, 3)},
+		{"monthly this month", NewMonthlyScheduler(15, 3).next, at(2024, 6, 5, 12), at(2024, 6, 15, 3)},
+		{"monthly next month", NewMonthlyScheduler(1, 3).next, at(2024, 6, 5, 12), at(2024, 7, 1, 3)},
+		{"monthly next year", NewMonthlyScheduler(1, 3).next, at(2024, 12, 5, 12), at(2025, 1, 1, 3)},
+		{"monthly short month", NewMonthlyScheduler(31, 3).next, at(2024, 2, 5, 12), at(2024, 2, 29, 3)},
+		{"monthly after short month", NewMonthlyScheduler(31, 3).next, at(2024, 2, 29, 12), at(2024, 3, 31, 3)},
+	} {
+		if got := tt.next(tt.now); !got.Equal(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	cleanupTimeFile(t)
+	t.Cleanup(func() { cleanupTimeFile(t) })
+	s := NewMonthlyScheduler(time.Now().Day(), 0)
+	s.SetNextUpdate()
+	if s.ShouldUpdate("1.0", false) {
+		t.Error("should not update before the next scheduled check")
+	}
+}
+
+func TestUpdateNow(t *testing.T) {
+	mr := &mockRequester{}
+	for i := 0; i < 3; i++ {
+		mr.handleRequest(func(url string) (io.ReadCloser, error) {
+			return newTestReaderCloser(`{"Version": "1.2", "Channel": "stable", "Sha256": "Q2vvTOW0p69A37StVANN+/ko1ZQDTElomq7fVcex/02="}`), nil
+		})
+	}
+	updater := createUpdater(mr)
+	t.Cleanup(func() { os.Remove(updater.statusPath()) })
+
+	updater.Scheduler = NeverScheduler{}
+	if err := updater.UpdateIfNeeded(); err != nil || mr.currentIndex != 0 {
+		t.Fatalf("NeverScheduler checked for updates: %v", err)
+	}
+	if err := updater.UpdateNow(context.Background()); err != nil || mr.currentIndex != 1 {
+		t.Fatalf("UpdateNow did not check for updates: %v", err)
+	}
+	if updater.Status().LastSuccess.IsZero() {
+		t.Error("UpdateNow did not record the check")
+	}
+
+	updater.Scheduler = AlwaysScheduler{}
+	for i := 0; i < 2; i++ {
+		if err := updater.UpdateIfNeeded(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mr.currentIndex != 3 {
+		t.Errorf("AlwaysScheduler made %d checks, want 2", mr.currentIndex-1)
+	}
+
+	updater.CurrentVersion = "dev"
+	if err := updater.UpdateNow(context.Background()); err != nil || mr.currentIndex != 3 {
+		t.Errorf("UpdateNow updated a dev version: %v", err)
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	mr := &mockRequester{}
+	mr.handleRequest(func(url string) (io.ReadCloser, error) {
+		return newTestReaderCloser(`{"Version": "1.2", "Channel": "stable", "Sha256": "Q2vvTOW0p69A37StVANN+/ko1ZQDTElomq7fVcex/02="}`), nil
+	})
+	updater := createUpdater(mr)
+	updater.Scheduler = AlwaysScheduler{}
+	updater.ForceCheck = true
+	updater.Cooldown = time.Hour
+	t.Cleanup(func() { os.Remove(updater.statusPath()) })
+
+	updater.recordStatus(func(s *Status) { s.LastApplied = time.Now().Add(-30 * time.Minute) })
+	if err := updater.UpdateIfNeeded(); err != nil || mr.currentIndex != 0 {
+		t.Fatalf("checked for updates during the cooldown: %v", err)
+	}
+	if err := updater.UpdateNow(context.Background()); err != nil || mr.currentIndex != 0 {
+		t.Fatalf("UpdateNow checked for updates during the cooldown: %v", err)
+	}
+
+	updater.recordStatus(func(s *Status) { s.LastApplied = time.Now().Add(-2 * time.Hour) })
+	if err := updater.UpdateIfNeeded(); err != nil || mr.currentIndex != 1 {
+		t.Fatalf("did not check for updates after the cooldown: %v", err)
+	}
+}
+
+func TestCanary(t *testing.T) {
+	c := &Canary{Cluster: "eu-west", Percent: 10, Soak: 24 * time.Hour}
+	canaries := 0
+	for i := 0; i < 1000; i++ {
+		if c.IsCanary(fmt.Sprintf("node-%d", i), "1.3") {
+			canaries++
+		}
+	}
+	if canaries < 60 || canaries > 140 {
+		t.Errorf("%d canaries out of 1000 for 10%%", canaries)
+	}
+	if c.IsCanary("node-1", "1.3") != c.IsCanary("node-1", "1.3") {
+		t.Error("election is not deterministic")
+	}
+
+	now := time.Now()
+	none := &Canary{Cluster: "eu-west", Soak: 24 * time.Hour}
+	if wait := none.wait("node-1", UpdateInfo{Version: "1.3", Date: now.Add(-time.Hour)}, now); wait != 23*time.Hour {
+		t.Errorf("waiting %v, want 23h", wait)
+	}
+	if wait := none.wait("node-1", UpdateInfo{Version: "1.3", Date: now.Add(-48 * time.Hour)}, now); wait != 0 {
+		t.Errorf("waiting %v after the soak period", wait)
+	}
+	all := &Canary{Cluster: "eu-west", Percent: 100, Soak: 24 * time.Hour}
+	if wait := all.wait("node-1", UpdateInfo{Version: "1.3", Date: now}, now); wait != 0 {
+		t.Errorf("canary waiting %v", wait)
+	}
+
+	mr := &mockRequester{}
+	mr.handleRequest(func(url string) (io.ReadCloser, error) {
+		return newTestReaderCloser(`{"Version": "1.3", "Channel": "stable", "Sha256": "Q2vvTOW0p69A37StVANN+/ko1ZQDTElomq7fVcex/02=", "Date": "` + now.UTC().Format(time.RFC3339) + `"}`), nil
+	})
+	updater := createUpdater(mr)
+	updater.Canary = none
+	if err := updater.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if mr.currentIndex != 1 {
+		t.Error("an installation that is not a canary downloaded the update during the soak period")
+	}
+}
+
+func TestResourceRequirements(t *testing.T) {
+	meminfo := "MemTotal:       16283004 kB\nMemFree:         1201904 kB\nMemAvailable:    8120312 kB\n"
+	if n, err := parseMeminfo(strings.NewReader(meminfo)); err != nil || n != 8120312<<10 {
+		t.Errorf("MemAvailable %d, %v", n, err)
+	}
+	vmstat := "Mach Virtual Memory Statistics: (page size of 16384 bytes)\nPages free:                               10.\nPages active:                            500.\nPages inactive:                           20.\nPages speculative:                         2.\n"
+	if n, err := parseVMStat(vmstat); err != nil || n != 32*16384 {
+		t.Errorf("vm_stat %d, %v", n, err)
+	}
+
+	mr := &mockRequester{}
+	mr.handleRequest(func(url string) (io.ReadCloser, error) {
+		return newTestReaderCloser(`{"Version": "1.3", "Channel": "stable", "Sha256": "Q2vvTOW0p69A37StVANN+/ko1ZQDTElomq7fVcex/02=", "MinDisk": 4611686018427387904}`), nil
+	})
+	updater := createUpdater(mr)
+	err := updater.Update(context.Background())
+	var resErr *ResourceError
+	if !errors.As(err, &resErr) || resErr.Resource != "disk" || !errors.Is(err, ErrInsufficientResources) {
+		t.Fatalf("expected a disk ResourceError, got %v", err)
+	}
+	if mr.currentIndex != 1 {
+		t.Error("the binary was downloaded although the disk is too small")
+	}
+	if err := checkResources(UpdateInfo{MinDisk: 1, MinMemory: 1}, updater.ExecPath); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfirmDownload(t *testing.T) {
+	mr := &mockRequester{}
+	mr.handleRequest(func(url string) (io.ReadCloser, error) {
+		return newTestReaderCloser(`{"Version": "1.3", "Channel": "stable", "Sha256": "Q2vvTOW0p69A37StVANN+/ko1ZQDTElomq7fVcex/02=", "Size": 300000000}`), nil
+	})
+	updater := createUpdater(mr)
+	var asked UpdateInfo
+	updater.OnConfirmDownload = func(info UpdateInfo) bool {
+		asked = info
+		return false
+	}
+	err := updater.Update(context.Background())
+	if !errors.Is(err, ErrDeferred) || !errors.Is(err, ErrDownloadDeclined) {
+		t.Fatalf("expected a declined download, got %v", err)
+	}
+	if asked.Version != "1.3" || asked.Size != 300000000 {
+		t.Errorf("hook called with %+v", asked)
+	}
+	if mr.currentIndex != 1 {
+		t.Error("the binary was downloaded although the hook declined it")
+	}
+	if failures := updater.recordCycle(err); failures != 0 {
+		t.Errorf("a declined download counted as %d failures", failures)
+	}
+}
+
+func TestRefetchBeforeDownload(t *testing.T) {
+	mr := &mockRequester{}
+	mr.handleRequest(func(url string) (io.ReadCloser, error) {
+		return newTestReaderCloser(`{"Version": "1.3", "Channel": "stable", "Sha256": "Q2vvTOW0p69A37StVANN+/ko1ZQDTElomq7fVcex/02="}`), nil
+	})
+	// 1.3 was yanked while the user was asked, the manifest is back on 1.2
+	mr.handleRequest(func(url string) (io.ReadCloser, error) {
+		return newTestReaderCloser(`{"Version": "1.2", "Channel": "stable", "Sha256": "Q2vvTOW0p69A37StVANN+/ko1ZQDTElomq7fVcex/02="}`), nil
+	})
+	updater := createUpdater(mr)
+	asked := 0
+	updater.OnConfirmDownload = func(info UpdateInfo) bool {
+		asked++
+		updater.fetchedAt = time.Now().Add(-time.Hour)
+		return true
+	}
+	if err := updater.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if mr.currentIndex != 2 || asked != 1 {
+		t.Errorf("%d requests and %d confirmations, expected the manifest to be fetched again and nothing downloaded", mr.currentIndex, asked)
+	}
+	if updater.Info.Version != "1.2" {
+		t.Errorf("staged against version %s", updater.Info.Version)
+	}
+}
+
+func TestPruneCache(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for i, name := range []string{"oldest", "old", "new", "current"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, make([]byte, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(time.Duration(i) * time.Minute)
+		if name == "current" {
+			mtime = now.Add(-time.Hour)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pruneCache(dir, 250, "current")
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if strings.Join(names, ",") != "current,new" {
+		t.Errorf("cache holds %v after pruning, want current and new", names)
+	}
+}
+
+func TestSchedulerCachesState(t *testing.T) {
+	t.Cleanup(func() { cleanupTimeFile(t) })
+	cleanupTimeFile(t)
+	s := NewIntervalScheduler(24, 0)
+	s.SetNextUpdate()
+	next := s.NextUpdate()
+
+	// another process moves the next check
+	later := next.Add(48 * time.Hour).Truncate(time.Second)
+	if !writeTime(timeFile, later) {
+		t.Fatal("failed to write time file")
+	}
+	if got := s.NextUpdate(); !got.Equal(next) {
+		t.Errorf("NextUpdate read the file again: %v, want the cached %v", got, next)
+	}
+	u := &Updater{Scheduler: s}
+	u.Reload()
+	if got := s.NextUpdate(); !got.Equal(later) {
+		t.Errorf("NextUpdate after Reload is %v, want %v", got, later)
+	}
+}
+
+func TestCorruptTimeFile(t *testing.T) {
+	t.Cleanup(func() { cleanupTimeFile(t) })
+	if err := os.WriteFile(timeFile, []byte("\x00\x00garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewDailyScheduler(3)
+	if !s.ShouldUpdate("1.0", false) {
+		t.Error("a corrupt time file should schedule a check now")
+	}
+	if _, err := readTime(timeFile); err != nil {
+		t.Errorf("time file not rewritten: %v", err)
+	}
+	u := createUpdater(&mockRequester{})
+	u.Scheduler = s
+	if reset := u.Status().ScheduleReset; !strings.Contains(reset, "garbage") {
+		t.Errorf("Status does not report the reset: %q", reset)
+	}
+	u.Reload()
+	if reset := u.Status().ScheduleReset; reset != "" {
+		t.Errorf("reset still reported after reading the rewritten file: %q", reset)
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	written := now.AddDate(10, 0, 0)
+	if next := adjustForSkew(written.Add(24*time.Hour), written, now); !next.Equal(now.Add(24 * time.Hour)) {
+		t.Errorf("clock 10 years behind: next check %v, want a day from now", next)
+	}
+	if next := adjustForSkew(now.Add(time.Hour), now.Add(-time.Hour), now); !next.Equal(now.Add(time.Hour)) {
+		t.Errorf("schedule moved without skew: %v", next)
+	}
+	if next := adjustForSkew(now.Add(time.Hour), now.Add(time.Minute), now); !next.Equal(now.Add(time.Hour)) {
+		t.Errorf("schedule moved within the tolerance: %v", next)
+	}
+
+	// the device clock reset to 2000 after scheduling a check for tomorrow
+	t.Cleanup(func() { cleanupTimeFile(t) })
+	tomorrow := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	if !writeTime(timeFile, tomorrow.AddDate(10, 0, 0)) {
+		t.Fatal("failed to write time file")
+	}
+	future := time.Now().AddDate(10, 0, 0)
+	if err := os.Chtimes(timeFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+	next := NewIntervalScheduler(24, 0).NextUpdate()
+	if next.After(time.Now().Add(25*time.Hour)) || next.Before(time.Now().Add(23*time.Hour)) {
+		t.Errorf("next check %v, want about a day from now", next)
+	}
+}
+
+func TestInstall(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "myapp")
+	if err := os.WriteFile(src, []byte("binary"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !IsDownloadLocation(src) {
+		t.Errorf("%s should be a download location", src)
+	}
+
+	updater := createUpdater(&mockRequester{})
+	updater.ExecPath = src
+	t.Cleanup(func() { os.Remove(updater.statusPath()) })
+	updater.recordStatus(func(s *Status) { s.LastVersion = "1.2" })
+
+	dir := filepath.Join(t.TempDir(), "bin")
+	installed, err := updater.Install(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if installed != filepath.Join(dir, "myapp") {
+		t.Errorf("installed to %s", installed)
+	}
+	if b, err := os.ReadFile(installed); err != nil || string(b) != "binary" {
+		t.Errorf("unexpected installed binary %q, %v", b, err)
+	}
+	if s := readStatus(filepath.Join(dir, updater.Dir, statusFile)); s.LastVersion != "1.2" {
+		t.Errorf("status not carried over: %+v", s)
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("downloaded binary removed: %v", err)
+	}
+}
+
+func TestMarkOfTheWeb(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("the Mark of the Web is an NTFS alternate data stream")
+	}
+	newBin := []byte("new binary contents")
+	sum := sha256.Sum256(newBin)
+	var gz bytes.Buffer
+	w, err := compress.NewWriter(&gz, compress.Gzip, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(newBin)
+	w.Close()
+
+	for zone, want := range map[int]string{0: "", 3: "[ZoneTransfer]\r\nZoneId=3\r\n"} {
+		mr := &mockRequester{}
+		mr.handleRequest(func(url string) (io.ReadCloser, error) {
+			return newTestReaderCloser(`{"Version": "1.3", "Channel": "stable", "Sha256": "` + base64.StdEncoding.EncodeToString(sum[:]) + `"}`), nil
+		})
+		mr.handleRequest(func(url string) (io.ReadCloser, error) {
+			return newTestReaderCloser(gz.String()), nil
+		})
+		updater := createUpdater(mr)
+		updater.DiffURL = ""
+		updater.ExecPath = filepath.Join(t.TempDir(), "myapp.exe")
+		updater.ZoneID = zone
+		if err := os.WriteFile(updater.ExecPath, []byte("old binary"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		staged, err := updater.Stage(context.Background())
+		if err != nil {
+			t.Fatalf("zone %d: %v", zone, err)
+		}
+		b, err := os.ReadFile(staged.newPath + zoneIdentifier)
+		if want == "" {
+			if !os.IsNotExist(err) {
+				t.Errorf("zone 0: got a mark %q, %v", b, err)
+			}
+		} else if err != nil || string(b) != want {
+			t.Errorf("zone %d: got mark %q, %v, want %q", zone, b, err, want)
+		}
+		staged.Discard()
+	}
+}
+
+func TestInstallMarkFails(t *testing.T) {
+	orig := markOfTheWeb
+	t.Cleanup(func() { markOfTheWeb = orig })
+	markOfTheWeb = func(path string, zone int) error { return errors.New("no alternate data streams") }
+
+	src := filepath.Join(t.TempDir(), "myapp")
+	if err := os.WriteFile(src, []byte("binary"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	updater := createUpdater(&mockRequester{})
+	updater.ExecPath = src
+	updater.ZoneID = 3
+	dir := t.TempDir()
+	if _, err := updater.Install(dir); err == nil {
+		t.Fatal("expected the error of markOfTheWeb")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != ".myapp.lock" {
+			t.Errorf("%s left behind", e.Name())
+		}
+	}
+}
+
+func TestLockTargetRefresh(t *testing.T) {
+	orig := lockRefresh
+	t.Cleanup(func() { lockRefresh = orig })
+	lockRefresh = 10 * time.Millisecond
+
+	exe := filepath.Join(t.TempDir(), "myapp")
+	lockPath := filepath.Join(filepath.Dir(exe), ".myapp.lock")
+	unlock, err := lockTarget(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a download outlasting staleLockAge keeps the lock fresh
+	old := time.Now().Add(-2 * staleLockAge)
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := lockTarget(exe); !errors.Is(err, ErrTargetLocked) {
+		t.Errorf("held lock taken for stale: %v", err)
+	}
+
+	unlock()
+	unlock()
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Errorf("lock not removed: %v", err)
+	}
+	unlock, err = lockTarget(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
+
+func TestUninstall(t *testing.T) {
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "myapp")
+	for _, name := range []string{"myapp", ".myapp.old", ".myapp.new-123", "other"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("binary"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	updater := createUpdater(&mockRequester{})
+	updater.ExecPath = exe
+	updater.Scheduler = NewDailyScheduler(3)
+	updater.recordStatus(func(s *Status) { s.LastVersion = "1.2" })
+	cleanupTimeFile(t)
+	writeTime(timeFile, time.Now())
+
+	if err := updater.Uninstall(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "other" {
+		t.Errorf("unexpected files left: %v", entries)
+	}
+	for _, path := range []string{getExecRelativeDir(updater.Dir), timeFile} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s not removed: %v", path, err)
+		}
+	}
+
+	// files of others in Dir are kept, and with them Dir
+	if err := os.WriteFile(exe, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	updater.recordStatus(func(s *Status) { s.LastVersion = "1.2" })
+	stateDir := getExecRelativeDir(updater.Dir)
+	foreign := filepath.Join(stateDir, "notes.txt")
+	if err := os.WriteFile(foreign, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(stateDir) })
+	if err := updater.Uninstall(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(foreign); err != nil {
+		t.Errorf("file not created by the updater removed: %v", err)
+	}
+	if _, err := os.Stat(updater.statusPath()); !os.IsNotExist(err) {
+		t.Errorf("status not removed: %v", err)
+	}
+
+	// state next to the binary is removed without touching its neighbours
+	sibling := getExecRelativeDir("notes.txt")
+	if err := os.WriteFile(sibling, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(sibling) })
+	// a cache directory of another program, and plugins the updater created
+	foreignCache := filepath.Join(getExecRelativeDir(cacheDir), "entry")
+	plugins := getExecRelativeDir(PluginsDir)
+	t.Cleanup(func() { os.RemoveAll(filepath.Dir(foreignCache)); os.RemoveAll(plugins) })
+	for _, next := range []string{"", "."} {
+		if err := os.WriteFile(exe, []byte("binary"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(foreignCache), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(foreignCache, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := makeStateDir(plugins); err != nil {
+			t.Fatal(err)
+		}
+		updater.Dir = next
+		updater.recordStatus(func(s *Status) { s.LastVersion = "1.2" })
+		t.Cleanup(func() { os.Remove(updater.statusPath()) })
+		if err := updater.Uninstall(); err != nil {
+			t.Errorf("Dir %q: %v", next, err)
+		}
+		if _, err := os.Stat(updater.statusPath()); !os.IsNotExist(err) {
+			t.Errorf("Dir %q: status not removed: %v", next, err)
+		}
+		if _, err := os.Stat(sibling); err != nil {
+			t.Errorf("Dir %q: file next to the binary removed: %v", next, err)
+		}
+		if _, err := os.Stat(foreignCache); err != nil {
+			t.Errorf("Dir %q: cache directory not created by the updater removed: %v", next, err)
+		}
+		if _, err := os.Stat(plugins); !os.IsNotExist(err) {
+			t.Errorf("Dir %q: plugin directory not removed: %v", next, err)
+		}
+		if _, err := os.Stat(exe); !os.IsNotExist(err) {
+			t.Errorf("Dir %q: binary not removed: %v", next, err)
+		}
+	}
+
+	for _, unsafe := range []string{"..", "../x", "update/../.."} {
+		if err := os.WriteFile(exe, []byte("binary"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		updater.Dir = unsafe
+		if err := updater.Uninstall(); !errors.Is(err, ErrUnsafeDir) {
+			t.Errorf("Dir %q: got %v, want ErrUnsafeDir", unsafe, err)
+		}
+		if _, err := os.Stat(exe); err != nil {
+			t.Errorf("Dir %q: binary removed although Dir was refused", unsafe)
+		}
+	}
+}
+
+func TestVerifyAuthenticode(t *testing.T) {
+	out := "Valid\r\nA1B2C3\r\nCN=Example Corp, O=Example Corp, C=US\r\n"
+	orig := runCommand
+	t.Cleanup(func() { runCommand = orig })
+	runCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		if !strings.Contains(args[len(args)-1], `'C:\it''s\app.exe'`) {
+			t.Errorf("path not quoted in %q", args[len(args)-1])
+		}
+		return []byte(out), nil
+	}
+
+	for _, signer := range []string{"Example Corp", "a1b2c3", "CN=Example Corp, O=Example Corp, C=US"} {
+		if err := verifyAuthenticode(context.Background(), `C:\it's\app.exe`, signer); err != nil {
+			t.Errorf("signer %q: %v", signer, err)
+		}
+	}
+	if err := verifyAuthenticode(context.Background(), `C:\it's\app.exe`, "Other Corp"); !errors.Is(err, ErrAuthenticode) {
+		t.Errorf("wrong signer: got %v, want ErrAuthenticode", err)
+	}
+	out = "NotSigned\r\n\r\n\r\n"
+	if err := verifyAuthenticode(context.Background(), `C:\it's\app.exe`, "Example Corp"); !errors.Is(err, ErrAuthenticode) {
+		t.Errorf("unsigned binary: got %v, want ErrAuthenticode", err)
+	}
+}
+
+func TestAppArmorLabel(t *testing.T) {
+	for label, want := range map[string]string{
+		"myapp (enforce)\n":                 "myapp",
+		"/usr/bin/myapp (complain)\n":       "",
+		"unconfined\n":                      "",
+		"system_u:system_r:myapp_t:s0\x00":  "",
+		"snap.myapp.daemon (enforce)\x00\n": "snap.myapp.daemon",
+	} {
+		if got := parseAppArmorLabel(label); got != want {
+			t.Errorf("parseAppArmorLabel(%q) = %q, want %q", label, got, want)
+		}
+	}
+}
+
+func TestManagedInstall(t *testing.T) {
+	booted := filepath.Join(t.TempDir(), "ostree-booted")
+	orig := ostreeBooted
+	ostreeBooted = booted
+	t.Cleanup(func() { ostreeBooted = orig })
+	t.Setenv("FLATPAK_ID", "")
+
+	for path, want := range map[string]string{
+		"/nix/store/abc-myapp-1.2/bin/myapp":                "nix profile upgrade",
+		"/snap/myapp/42/bin/myapp":                          "snap refresh myapp",
+		"/var/lib/flatpak/app/org.example.MyApp/x86_64/bin": "flatpak update org.example.MyApp",
+		"/opt/homebrew/Cellar/myapp/1.2/bin/myapp":          "brew upgrade myapp",
+		"/usr/local/Caskroom/myapp/1.2/myapp":               "brew upgrade --cask myapp",
+		"C:/Users/me/scoop/apps/myapp/current/myapp.exe":    "scoop update myapp",
+		"C:/Users/me/AppData/Local/Microsoft/WinGet/Packages/Example.MyApp_Microsoft.Winget.Source_8wekyb3d8bbwe/myapp.exe": "winget upgrade --silent --accept-source-agreements --accept-package-agreements --id Example.MyApp",
+		"/usr/bin/myapp":              "",
+		"/home/user/.local/bin/myapp": "",
+	} {
+		got := detectManagedInstall(path)
+		if want == "" {
+			if got != nil {
+				t.Errorf("%s detected as installed by %s", path, got.Manager)
+			}
+			continue
+		}
+		if got == nil || got.Command != want {
+			t.Errorf("%s: got %+v, want %s", path, got, want)
+		}
+	}
+
+	if err := os.WriteFile(booted, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := detectManagedInstall("/usr/bin/myapp"); got == nil || got.Manager != "rpm-ostree" {
+		t.Errorf("/usr on ostree: got %+v", got)
+	}
+	t.Setenv("FLATPAK_ID", "org.example.MyApp")
+	if got := detectManagedInstall("/app/bin/myapp"); got == nil || got.Command != "flatpak update org.example.MyApp" {
+		t.Errorf("flatpak sandbox: got %+v", got)
+	}
+
+	mr := &mockRequester{}
+	mr.handleRequest(func(url string) (io.ReadCloser, error) {
+		return newTestReaderCloser(`{"Version": "1.3", "Channel": "stable", "Sha256": "Q2vvTOW0p69A37StVANN+/ko1ZQDTElomq7fVcex/0k="}`), nil
+	})
+	updater := createUpdater(mr)
+	updater.ExecPath = "/nix/store/abc-myapp-1.2/bin/myapp"
+	if _, err := updater.Stage(context.Background()); !errors.Is(err, ErrManagedInstall) {
+		t.Errorf("Stage of a Nix binary: got %v, want ErrManagedInstall", err)
+	}
+
+	// the read-only store must not fail the writability check first
+	t.Cleanup(func() { cleanupTimeFile(t) })
+	mr.handleRequest(func(url string) (io.ReadCloser, error) {
+		return newTestReaderCloser(`{"Version": "1.3", "Channel": "stable", "Sha256": "Q2vvTOW0p69A37StVANN+/ko1ZQDTElomq7fVcex/0k="}`), nil
+	})
+	updater.Dir = t.TempDir()
+	updater.Scheduler = NewIntervalScheduler(24, 0)
+	updater.ForceCheck = true
+	if err := updater.UpdateIfNeeded(); !errors.Is(err, ErrManagedInstall) {
+		t.Errorf("UpdateIfNeeded of a Nix binary: got %v, want ErrManagedInstall", err)
+	}
+}
+
+func TestQueryPackageDB(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("dpkg and rpm are only queried on Linux")
+	}
+	owner := map[string]string{"dpkg-query": "diversion by foo from: /usr/bin/myapp\nmyapp:amd64, myapp-extra: /usr/bin/myapp\n"}
+	orig := runCommand
+	t.Cleanup(func() { runCommand = orig })
+	runCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		if out, ok := owner[name]; ok {
+			return []byte(out), nil
+		}
+		return nil, errors.New("exit status 1")
+	}
+
+	mr := &mockRequester{}
+	mr.handleRequest(func(url string) (io.ReadCloser, error) {
+		return newTestReaderCloser(`{"Version": "1.3", "Channel": "stable", "Sha256": "Q2vvTOW0p69A37StVANN+/ko1ZQDTElomq7fVcex/0k="}`), nil
+	})
+	updater := createUpdater(mr)
+	updater.ExecPath = "/usr/bin/myapp"
+	if managed, err := updater.ManagedInstall(); err != nil || managed != nil {
+		t.Errorf("without QueryPackageDB: got %+v, %v", managed, err)
+	}
+	updater.QueryPackageDB = true
+	managed, err := updater.ManagedInstall()
+	if err != nil || managed == nil || managed.Manager != "dpkg" || managed.Command != "apt-get install --only-upgrade myapp" {
+		t.Errorf("dpkg: got %+v, %v", managed, err)
+	}
+	var stageErr *ManagedInstallError
+	if _, err := updater.Stage(context.Background()); !errors.As(err, &stageErr) || stageErr.Package != "myapp" {
+		t.Errorf("Stage of a dpkg binary: got %v, want a ManagedInstallError", err)
+	}
+
+	// a binary of /usr/bin the process cannot write to is reported as
+	// packaged rather than failing the writability check
+	t.Cleanup(func() { cleanupTimeFile(t) })
+	mr.handleRequest(func(url string) (io.ReadCloser, error) {
+		return newTestReaderCloser(`{"Version": "1.3", "Channel": "stable", "Sha256": "Q2vvTOW0p69A37StVANN+/ko1ZQDTElomq7fVcex/0k="}`), nil
+	})
+	updater.ExecPath = filepath.Join(t.TempDir(), "missing", "myapp")
+	updater.Dir = t.TempDir()
+	updater.Scheduler = NewIntervalScheduler(24, 0)
+	updater.ForceCheck = true
+	if err := updater.UpdateIfNeeded(); !errors.As(err, &stageErr) || stageErr.Manager != "dpkg" {
+		t.Errorf("UpdateIfNeeded of a dpkg binary: got %v, want a ManagedInstallError", err)
+	}
+	updater.OverwritePackaged = true
+	if err := updater.UpdateIfNeeded(); err == nil || errors.Is(err, ErrManagedInstall) {
+		t.Errorf("UpdateIfNeeded overwriting an unwritable dpkg binary: got %v, want the writability error", err)
+	}
+	updater.OverwritePackaged = false
+
+	owner = map[string]string{"rpm": "myapp\n"}
+	if managed, _ := updater.ManagedInstall(); managed == nil || managed.Command != "dnf upgrade myapp" {
+		t.Errorf("rpm: got %+v", managed)
+	}
+	updater.OverwritePackaged = true
+	if err := updater.checkManaged(context.Background(), updater.ExecPath); err != nil {
+		t.Errorf("OverwritePackaged: got %v", err)
+	}
+	owner = nil
+	updater.OverwritePackaged = false
+	if managed, _ := updater.ManagedInstall(); managed != nil {
+		t.Errorf("unowned file: got %+v", managed)
+	}
+}
+
+func TestUsePackageManager(t *testing.T) {
+	var ran []string
+	orig := runPackageManager
+	t.Cleanup(func() { runPackageManager = orig })
+	runPackageManager = func(ctx context.Context, args []string) ([]byte, error) {
+		ran = args
+		return nil, nil
+	}
+
+	mr := &mockRequester{}
+	for i := 0; i < 2; i++ {
+		mr.handleRequest(func(url string) (io.ReadCloser, error) {
+			return newTestReaderCloser(`{"Version": "1.3", "Channel": "stable", "Sha256": "Q2vvTOW0p69A37StVANN+/ko1ZQDTElomq7fVcex/0k="}`), nil
+		})
+	}
+	updater := createUpdater(mr)
+	updater.ExecPath = "/opt/homebrew/Cellar/myapp/1.2/bin/myapp"
+	t.Cleanup(func() { os.Remove(updater.statusPath()) })
+	if err := updater.Update(context.Background()); !errors.Is(err, ErrManagedInstall) || ran != nil {
+		t.Fatalf("without UsePackageManager: got %v, ran %v", err, ran)
+	}
+
+	updater.UsePackageManager = true
+	updated := false
+	updater.OnSuccessfulUpdate = func() { updated = true }
+	if err := updater.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(ran, " ") != "brew upgrade myapp" || !updated {
+		t.Errorf("ran %v, OnSuccessfulUpdate called: %v", ran, updated)
+	}
+	if s := updater.Status(); s.LastVersion != "1.3" || s.PreviousVersion != "1.2" {
+		t.Errorf("update not recorded: %+v", s)
+	}
+
+	// the scheduled cycle delegates although the Cellar is not writable
+	t.Cleanup(func() { cleanupTimeFile(t) })
+	ran = nil
+	mr.handleRequest(func(url string) (io.ReadCloser, error) {
+		return newTestReaderCloser(`{"Version": "1.3", "Channel": "stable", "Sha256": "Q2vvTOW0p69A37StVANN+/ko1ZQDTElomq7fVcex/0k="}`), nil
+	})
+	updater.Scheduler = NewIntervalScheduler(24, 0)
+	updater.ForceCheck = true
+	if err := updater.UpdateIfNeeded(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(ran, " ") != "brew upgrade myapp" {
+		t.Errorf("UpdateIfNeeded ran %v", ran)
+	}
+}
+
+// requesterFunc serves every request of a benchmark from a function
+type requesterFunc func(url string) (io.ReadCloser, error)
+
+func (f requesterFunc) Fetch(url string) (io.ReadCloser, error) {
+	return f(url)
+}
+
+// benchBinary returns a binary of size bytes compressing about as well as
+// an executable, along with its SHA256
+func benchBinary(size int) ([]byte, []byte) {
+	bin := make([]byte, size)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < size; i += 64 {
+		rnd.Read(bin[i : i+min(16, size-i)])
+	}
+	sum := sha256.Sum256(bin)
+	return bin, sum[:]
+}
+
+func benchManifest(sum []byte) string {
+	return `{"Version": "1.3", "Channel": "stable", "Date": "2026-10-01T12:00:00Z", "Sha256": "` + base64.StdEncoding.EncodeToString(sum) +
+		`", "Size": 4194304, "Notes": "` + strings.Repeat("Fixes and improvements. ", 20) + `"}`
+}
+
+func BenchmarkDecodeManifest(b *testing.B) {
+	_, sum := benchBinary(1)
+	manifest := benchManifest(sum)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(manifest)))
+	for range b.N {
+		if _, err := DecodeManifest(strings.NewReader(manifest), false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFetchInfo(b *testing.B) {
+	_, sum := benchBinary(1)
+	manifest := benchManifest(sum)
+	updater := createUpdater(nil)
+	updater.Requester = requesterFunc(func(url string) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(manifest)), nil
+	})
+	b.ReportAllocs()
+	for range b.N {
+		if err := updater.fetchInfo(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkVerifyDigests(b *testing.B) {
+	bin, sum := benchBinary(4 << 20)
+	info := UpdateInfo{Sha256: sum}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(bin)))
+	for range b.N {
+		if !verifyDigests(bin, info) {
+			b.Fatal("digest mismatch")
+		}
+	}
+}
+
+func BenchmarkFetchAndVerifyFullBin(b *testing.B) {
+	bin, sum := benchBinary(4 << 20)
+	for _, compression := range []string{compress.Gzip, compress.Zstd} {
+		b.Run(compression, func(b *testing.B) {
+			var artifact bytes.Buffer
+			w, err := compress.NewWriter(&artifact, compression, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			w.Write(bin)
+			w.Close()
+			updater := createUpdater(nil)
+			updater.Requester = requesterFunc(func(url string) (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(artifact.Bytes())), nil
+			})
+			updater.Info = UpdateInfo{Version: "1.3", Sha256: sum, Compression: compression}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(bin)))
+			b.ResetTimer()
+			for range b.N {
+				if _, err := updater.fetchAndVerifyFullBin(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkUpdate runs the whole cycle of a fleet member finding an update:
+// fetching the manifest, downloading, verifying, staging and swapping in
+func BenchmarkUpdate(b *testing.B) {
+	bin, sum := benchBinary(4 << 20)
+	manifest := benchManifest(sum)
+	var artifact bytes.Buffer
+	w, _ := compress.NewWriter(&artifact, compress.Gzip, 0)
+	w.Write(bin)
+	w.Close()
+
+	updater := createUpdater(nil)
+	updater.DiffURL = ""
+	updater.ExecPath = filepath.Join(b.TempDir(), "myapp")
+	updater.Requester = requesterFunc(func(url string) (io.ReadCloser, error) {
+		if strings.HasSuffix(url, ".json") {
+			return io.NopCloser(strings.NewReader(manifest)), nil
+		}
+		return io.NopCloser(bytes.NewReader(artifact.Bytes())), nil
+	})
+	b.Cleanup(func() { os.Remove(updater.statusPath()) })
+	if err := os.WriteFile(updater.ExecPath, []byte("old binary"), 0755); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(bin)))
+	b.ResetTimer()
+	for range b.N {
+		if err := updater.Update(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// allocatedBytes returns the bytes allocated while running f
+func allocatedBytes(f func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+// TestPerformanceBudget fails when the check and apply path allocates
+// noticeably more than it used to, since fleets run it every hour on small
+// hosts. Raise a budget only along with the reason it had to grow.
+func TestPerformanceBudget(t *testing.T) {
+	if bi, ok := debug.ReadBuildInfo(); ok && slices.Contains(bi.Settings, debug.BuildSetting{Key: "-race", Value: "true"}) {
+		t.Skip("the race detector changes what escapes to the heap")
+	}
+	bin, sum := benchBinary(4 << 20)
+	manifest := benchManifest(sum)
+
+	if n := testing.AllocsPerRun(20, func() { DecodeManifest(strings.NewReader(manifest), false) }); n > 10 {
+		t.Errorf("DecodeManifest: %.0f allocations, budget 10", n)
+	}
+	updater := createUpdater(nil)
+	updater.Requester = requesterFunc(func(url string) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(manifest)), nil
+	})
+	if n := testing.AllocsPerRun(20, func() { updater.fetchInfo() }); n > 14 {
+		t.Errorf("fetchInfo: %.0f allocations, budget 14", n)
+	}
+	info := UpdateInfo{Sha256: sum}
+	if n := testing.AllocsPerRun(5, func() { verifyDigests(bin, info) }); n > 1 {
+		t.Errorf("verifyDigests: %.0f allocations, budget 1", n)
+	}
+
+	// bytes allocated to download, decompress and verify the binary, as a
+	// multiple of its size
+	for compression, budget := range map[string]uint64{compress.Gzip: 3, compress.Zstd: 6} {
+		var artifact bytes.Buffer
+		w, err := compress.NewWriter(&artifact, compression, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(bin)
+		w.Close()
+		updater.Requester = requesterFunc(func(url string) (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(artifact.Bytes())), nil
+		})
+		updater.Info = UpdateInfo{Version: "1.3", Sha256: sum, Compression: compression}
+		n := allocatedBytes(func() { _, err = updater.fetchAndVerifyFullBin(context.Background()) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > budget*uint64(len(bin)) {
+			t.Errorf("fetchAndVerifyFullBin with %s: %d bytes allocated, budget %d", compression, n, budget*uint64(len(bin)))
+		}
+	}
+}
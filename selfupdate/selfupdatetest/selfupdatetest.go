@@ -0,0 +1,178 @@
+// Package selfupdatetest helps applications test how they wire up
+// selfupdate without network access: an in-process update host publishing
+// releases held in memory, and a sandboxed executable for Updater.ExecPath
+// to replace.
+//
+//	srv := selfupdatetest.NewServer(t, "myapp",
+//		selfupdatetest.Release{Version: "1.0", Binary: []byte("v1")},
+//		selfupdatetest.Release{Version: "1.1", Binary: []byte("v2")})
+//	exe := selfupdatetest.NewExecutable(t, []byte("v1"))
+//	if err := srv.Updater("1.0", exe).Update(ctx); err != nil {
+//		t.Fatal(err)
+//	}
+//	selfupdatetest.AssertSwapped(t, exe, []byte("v2"))
+package selfupdatetest
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/bobo/go-selfupdate/selfupdate"
+	"github.com/bobo/go-selfupdate/selfupdate/publish"
+)
+
+// Release is a version of the application published on a Server
+type Release struct {
+	Version  string
+	Channel  string // stable when empty
+	Platform string // the running platform when empty
+	Binary   []byte
+	Archive  string            // tar.gz or zip to publish the binary in an archive named Cmd, compressed when empty
+	Assets   map[string][]byte // files bundled into the archive next to the binary, by slash separated name
+}
+
+// Server is an update host serving the tree published from a list of
+// releases, the way the storage backends would
+type Server struct {
+	*httptest.Server
+	Cmd string
+	Dir string // root of the served tree, holding the Cmd directory
+
+	mu       sync.Mutex
+	requests []string
+}
+
+// NewServer publishes releases for cmd in order, so the last release of
+// each channel and platform is the one offered, and serves them until the
+// test ends. Every release also gets a patch from the release published
+// before it for the same platform.
+func NewServer(t testing.TB, cmd string, releases ...Release) *Server {
+	t.Helper()
+	s := &Server{Cmd: cmd, Dir: t.TempDir()}
+	ctx := context.Background()
+	backend := &publish.DirBackend{Root: filepath.Join(s.Dir, cmd)}
+	index := &selfupdate.Index{}
+	binDir := t.TempDir()
+	previous := map[string]Release{}
+	for i, r := range releases {
+		platform := r.Platform
+		if platform == "" {
+			platform = runtime.GOOS + "-" + runtime.GOARCH
+		}
+		bin := filepath.Join(binDir, strconv.Itoa(i))
+		if err := os.WriteFile(bin, r.Binary, 0755); err != nil {
+			t.Fatal(err)
+		}
+		var assets []publish.Asset
+		for name, content := range r.Assets {
+			asset := filepath.Join(binDir, strconv.Itoa(i)+"-"+strconv.Itoa(len(assets)))
+			if err := os.WriteFile(asset, content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			assets = append(assets, publish.Asset{Name: name, Path: asset})
+		}
+		release := &publish.Release{
+			Version:   r.Version,
+			Channel:   r.Channel,
+			Artifacts: []publish.Artifact{{Platform: platform, Path: bin}},
+			Index:     index,
+		}
+		if r.Archive != "" {
+			release.Archive, release.Executable, release.Assets = r.Archive, cmd, assets
+		}
+		err := publish.Publish(ctx, release, backend)
+		if err != nil {
+			t.Fatalf("publishing %s: %v", r.Version, err)
+		}
+
+		if old, ok := previous[platform]; ok {
+			var patch bytes.Buffer
+			if err := publish.CreatePatch(&patch, old.Binary, r.Binary); err != nil {
+				t.Fatal(err)
+			}
+			name := publish.PatchPath(old.Version, r.Version, platform)
+			if err := backend.Put(ctx, name, &patch, publish.PatchMetadata); err != nil {
+				t.Fatal(err)
+			}
+		}
+		previous[platform] = r
+	}
+	if err := publish.PutIndex(ctx, backend, index); err != nil {
+		t.Fatal(err)
+	}
+
+	files := http.FileServer(http.Dir(s.Dir))
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r.URL.Path)
+		s.mu.Unlock()
+		files.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Requests returns the paths requested from the server so far
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// Updater returns an Updater of version currentVersion fetching manifests,
+// binaries and patches from s and replacing the binary at execPath
+func (s *Server) Updater(currentVersion, execPath string) *selfupdate.Updater {
+	return &selfupdate.Updater{
+		CurrentVersion: currentVersion,
+		ApiURL:         s.URL + "/",
+		BinURL:         s.URL + "/",
+		DiffURL:        s.URL + "/",
+		CmdName:        s.Cmd,
+		Requester:      &selfupdate.HTTPRequester{},
+		ExecPath:       execPath,
+	}
+}
+
+// NewExecutable writes contents as an executable in a directory of its own
+// and returns its path, to be set as Updater.ExecPath
+func NewExecutable(t testing.TB, contents []byte) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "app")
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	if err := os.WriteFile(name, contents, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// AssertSwapped fails the test unless the executable at execPath holds want
+// and the update left no other files next to it
+func AssertSwapped(t testing.TB, execPath string, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(execPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("executable holds %q, want %q", got, want)
+	}
+	entries, err := os.ReadDir(filepath.Dir(execPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != filepath.Base(execPath) {
+			t.Errorf("update left %s behind", e.Name())
+		}
+	}
+}
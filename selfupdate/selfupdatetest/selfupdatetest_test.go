@@ -0,0 +1,417 @@
+package selfupdatetest
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bobo/go-selfupdate/selfupdate"
+	"github.com/bobo/go-selfupdate/selfupdate/publish"
+)
+
+func TestUpdateFromServer(t *testing.T) {
+	platform := runtime.GOOS + "-" + runtime.GOARCH
+	srv := NewServer(t, "myapp",
+		Release{Version: "1.0", Binary: []byte("myapp binary at version 1.0")},
+		Release{Version: "1.1", Binary: []byte("myapp binary at version 1.1")},
+		Release{Version: "1.2-beta", Channel: "beta", Binary: []byte("myapp binary at version 1.2-beta")})
+
+	exe := NewExecutable(t, []byte("myapp binary at version 1.0"))
+	if err := srv.Updater("1.0", exe).Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	AssertSwapped(t, exe, []byte("myapp binary at version 1.1"))
+	if !slices.Contains(srv.Requests(), "/myapp/patches/1.0/1.1/"+platform+".patch") {
+		t.Errorf("update did not use the patch: %v", srv.Requests())
+	}
+
+	u := srv.Updater("1.1", exe)
+	u.Channel = "beta"
+	u.DiffURL = ""
+	if err := u.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	AssertSwapped(t, exe, []byte("myapp binary at version 1.2-beta"))
+	if !slices.Contains(srv.Requests(), "/myapp/1.2-beta/"+platform+".gz") {
+		t.Errorf("update did not download the full binary: %v", srv.Requests())
+	}
+}
+
+func TestStatusAfterUpdate(t *testing.T) {
+	srv := NewServer(t, "myapp",
+		Release{Version: "1.0", Binary: []byte("v1")},
+		Release{Version: "1.1", Binary: []byte("v2")})
+	exe := NewExecutable(t, []byte("v1"))
+	u := srv.Updater("1.0", exe)
+	if err := u.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s := u.Status()
+	if s.LastVersion != "1.1" || s.PreviousVersion != "1.0" || s.LastApplied.IsZero() {
+		t.Errorf("unexpected status after updating: %+v", s)
+	}
+}
+
+func TestApplyOnExit(t *testing.T) {
+	srv := NewServer(t, "myapp",
+		Release{Version: "1.0", Binary: []byte("v1")},
+		Release{Version: "1.1", Binary: []byte("v2")})
+	exe := NewExecutable(t, []byte("v1"))
+	u := srv.Updater("1.0", exe)
+	u.ApplyOnExit = true
+	for i := 0; i < 2; i++ {
+		if err := u.Update(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, _ := os.ReadFile(exe); string(got) != "v1" {
+		t.Fatalf("executable replaced before Finalize: %q", got)
+	}
+	var downloads int
+	for _, r := range srv.Requests() {
+		if strings.HasSuffix(r, ".patch") || strings.HasSuffix(r, ".gz") {
+			downloads++
+		}
+	}
+	if downloads != 1 {
+		t.Errorf("staged update downloaded %d times: %v", downloads, srv.Requests())
+	}
+
+	if err := u.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	AssertSwapped(t, exe, []byte("v2"))
+	if err := u.Finalize(); err != nil {
+		t.Errorf("second Finalize: %v", err)
+	}
+}
+
+func TestStageAndCommit(t *testing.T) {
+	srv := NewServer(t, "myapp",
+		Release{Version: "1.0", Binary: []byte("v1")},
+		Release{Version: "1.1", Binary: []byte("v2")})
+	exe := NewExecutable(t, []byte("v1"))
+	u := srv.Updater("1.0", exe)
+
+	staged, err := u.Stage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if staged.Version != "1.1" {
+		t.Errorf("staged version %s, want 1.1", staged.Version)
+	}
+	if err := staged.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	AssertSwapped(t, exe, []byte("v1"))
+
+	if staged, err = u.Stage(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := staged.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	AssertSwapped(t, exe, []byte("v2"))
+	if err := staged.Commit(); !errors.Is(err, selfupdate.ErrStagedUpdateDone) {
+		t.Errorf("second Commit: got %v, want ErrStagedUpdateDone", err)
+	}
+
+	if staged, err := srv.Updater("1.1", exe).Stage(context.Background()); err != nil || staged != nil {
+		t.Errorf("Stage when up to date returned %v, %v", staged, err)
+	}
+}
+
+func TestDownloadCache(t *testing.T) {
+	srv := NewServer(t, "myapp",
+		Release{Version: "1.0", Binary: []byte("v1")},
+		Release{Version: "1.1", Binary: []byte("cached v2")})
+	exe := NewExecutable(t, []byte("v1"))
+	u := srv.Updater("1.0", exe)
+	u.CacheSize = 1 << 20
+	staged, err := u.Stage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := staged.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	downloads := func() (n int) {
+		for _, r := range srv.Requests() {
+			if strings.HasSuffix(r, ".patch") || strings.HasSuffix(r, ".gz") {
+				n++
+			}
+		}
+		return n
+	}
+
+	// a new process finds the verified binary in the cache
+	u = srv.Updater("1.0", exe)
+	u.CacheSize = 1 << 20
+	if staged, err = u.Stage(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := downloads(); n != 1 {
+		t.Errorf("downloaded %d times: %v", n, srv.Requests())
+	}
+	if err := staged.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	AssertSwapped(t, exe, []byte("cached v2"))
+
+	u = srv.Updater("1.0", NewExecutable(t, []byte("v1")))
+	u.CacheSize = 1 << 20
+	if err := u.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := downloads(); n != 2 {
+		t.Errorf("applied binary still cached, %d downloads", n)
+	}
+}
+
+func TestSharedDownloadCache(t *testing.T) {
+	srv := NewServer(t, "suite",
+		Release{Version: "1.0", Binary: []byte("v1")},
+		Release{Version: "1.1", Binary: []byte("shared v2")})
+	cache := t.TempDir()
+	exes := []string{NewExecutable(t, []byte("v1")), NewExecutable(t, []byte("v1")), NewExecutable(t, []byte("v1"))}
+	errs := make(chan error, len(exes))
+	for _, exe := range exes {
+		u := srv.Updater("1.0", exe)
+		u.DiffURL = ""
+		u.CacheSize = 1 << 20
+		u.CacheDir = cache
+		go func() { errs <- u.Update(context.Background()) }()
+	}
+	for range exes {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, exe := range exes {
+		AssertSwapped(t, exe, []byte("shared v2"))
+	}
+	var downloads int
+	for _, r := range srv.Requests() {
+		if strings.HasSuffix(r, ".gz") {
+			downloads++
+		}
+	}
+	if downloads != 1 {
+		t.Errorf("artifact downloaded %d times: %v", downloads, srv.Requests())
+	}
+}
+
+func TestInstallAssets(t *testing.T) {
+	srv := NewServer(t, "myapp",
+		Release{Version: "1.0", Binary: []byte("v1"), Archive: "tar.gz",
+			Assets: map[string][]byte{"completions/myapp.bash": []byte("complete v1"), "myapp.1": []byte("man v1")}},
+		Release{Version: "1.1", Binary: []byte("v2"), Archive: "tar.gz",
+			Assets: map[string][]byte{"completions/myapp.bash": []byte("complete v2"), "completions/zsh/_myapp": []byte("zsh v2"), "myapp.1": []byte("man v2")}})
+	share := t.TempDir()
+	for _, diff := range []bool{false, true} {
+		exe := NewExecutable(t, []byte("v1"))
+		u := srv.Updater("1.0", exe)
+		if !diff {
+			u.DiffURL = ""
+		}
+		u.Assets = map[string]string{
+			"completions/": filepath.Join(share, "completions"),
+			"myapp.1":      "man/myapp.1",
+		}
+		if err := u.Update(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		for path, want := range map[string]string{
+			exe: "v2",
+			filepath.Join(share, "completions", "myapp.bash"):    "complete v2",
+			filepath.Join(share, "completions", "zsh", "_myapp"): "zsh v2",
+			filepath.Join(filepath.Dir(exe), "man", "myapp.1"):   "man v2",
+		} {
+			if got, err := os.ReadFile(path); err != nil || string(got) != want {
+				t.Errorf("patch %v: %s holds %q, %v", diff, path, got, err)
+			}
+		}
+	}
+}
+
+func TestUpdateTo(t *testing.T) {
+	srv := NewServer(t, "myapp",
+		Release{Version: "1.0", Binary: []byte("v1")},
+		Release{Version: "1.1", Binary: []byte("v2")},
+		Release{Version: "1.2", Binary: []byte("v3")})
+	exe := NewExecutable(t, []byte("v3"))
+	u := srv.Updater("1.2", exe)
+	u.DiffURL = ""
+	if err := u.UpdateTo(context.Background(), "1.0"); err != nil {
+		t.Fatal(err)
+	}
+	AssertSwapped(t, exe, []byte("v1"))
+	if s := u.Status(); s.LastVersion != "1.0" || s.PreviousVersion != "1.2" {
+		t.Errorf("unexpected status after moving to 1.0: %+v", s)
+	}
+
+	if err := srv.Updater("1.0", exe).UpdateTo(context.Background(), "0.9"); !errors.Is(err, selfupdate.ErrUnknownVersion) {
+		t.Errorf("expected ErrUnknownVersion, got %v", err)
+	}
+}
+
+func TestTargetLocked(t *testing.T) {
+	srv := NewServer(t, "worker",
+		Release{Version: "1.0", Binary: []byte("v1")},
+		Release{Version: "1.1", Binary: []byte("v2")})
+	exe := NewExecutable(t, []byte("v1"))
+	lock := filepath.Join(filepath.Dir(exe), "."+filepath.Base(exe)+".lock")
+	if err := os.WriteFile(lock, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	u := srv.Updater("1.0", exe)
+	if err := u.Update(context.Background()); !errors.Is(err, selfupdate.ErrTargetLocked) {
+		t.Fatalf("updating a locked binary: got %v, want ErrTargetLocked", err)
+	}
+
+	// the lock of an updater that was killed is taken over
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(lock, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	AssertSwapped(t, exe, []byte("v2"))
+}
+
+func TestPluginUpdater(t *testing.T) {
+	platform := runtime.GOOS + "-" + runtime.GOARCH
+	srv := NewServer(t, "myapp", Release{Version: "1.0", Binary: []byte("app")})
+	ctx := context.Background()
+	publishPlugins := func(plugins map[string]Release) {
+		t.Helper()
+		infos := map[string]*selfupdate.UpdateInfo{}
+		for name, r := range plugins {
+			root := filepath.Join(srv.Dir, filepath.FromSlash(selfupdate.PluginCmd("myapp", name)))
+			bin := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(bin, r.Binary, 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := publish.Publish(ctx, &publish.Release{
+				Version:   r.Version,
+				Artifacts: []publish.Artifact{{Platform: platform, Path: bin}},
+			}, &publish.DirBackend{Root: root})
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(filepath.Join(root, platform+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			infos[name], err = selfupdate.DecodeManifest(f, true)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		backend := &publish.DirBackend{Root: filepath.Join(srv.Dir, "myapp")}
+		if err := publish.PutPluginManifest(ctx, backend, "", platform, infos); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	publishPlugins(map[string]Release{
+		"export.so": {Version: "1.0", Binary: []byte("export 1.0")},
+		"import.so": {Version: "2.0", Binary: []byte("import 2.0")},
+	})
+	dir := t.TempDir()
+	plugins := &selfupdate.PluginUpdater{App: srv.Updater("1.0", NewExecutable(t, []byte("app"))), Dir: dir}
+	if err := plugins.Update(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"export.so": "export 1.0", "import.so": "import 2.0"} {
+		if got, _ := os.ReadFile(filepath.Join(dir, name)); string(got) != want {
+			t.Errorf("%s holds %q, want %q", name, got, want)
+		}
+	}
+
+	publishPlugins(map[string]Release{
+		"export.so": {Version: "1.1", Binary: []byte("export 1.1")},
+		"import.so": {Version: "2.0", Binary: []byte("import 2.0")},
+	})
+	if err := plugins.Update(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "export.so")); string(got) != "export 1.1" {
+		t.Errorf("export.so holds %q after the update", got)
+	}
+	installed, err := plugins.Installed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if installed["export.so"] != "1.1" || installed["import.so"] != "2.0" {
+		t.Errorf("installed versions %v", installed)
+	}
+
+	plugins.Plugins = []string{"missing.so"}
+	if err := plugins.Update(ctx); !errors.Is(err, selfupdate.ErrUnknownPlugin) {
+		t.Errorf("updating a plugin missing from the manifest: got %v, want ErrUnknownPlugin", err)
+	}
+}
+
+type testFleetLock struct {
+	busy    bool
+	holders map[string]bool
+}
+
+func (l *testFleetLock) Lock(ctx context.Context, id string) error {
+	if l.busy {
+		return selfupdate.ErrFleetBusy
+	}
+	l.holders[id] = true
+	return nil
+}
+
+func (l *testFleetLock) Unlock(ctx context.Context, id string) error {
+	delete(l.holders, id)
+	return nil
+}
+
+func TestFleetLock(t *testing.T) {
+	srv := NewServer(t, "myapp",
+		Release{Version: "1.0", Binary: []byte("v1")},
+		Release{Version: "1.1", Binary: []byte("v2")})
+	exe := NewExecutable(t, []byte("v1"))
+	lock := &testFleetLock{busy: true, holders: map[string]bool{}}
+	u := srv.Updater("1.0", exe)
+	u.RolloutID = "node-a"
+	u.FleetLock = lock
+
+	if err := u.Update(context.Background()); !errors.Is(err, selfupdate.ErrDeferred) || !errors.Is(err, selfupdate.ErrFleetBusy) {
+		t.Fatalf("updating with every slot taken: got %v", err)
+	}
+	AssertSwapped(t, exe, []byte("v1"))
+
+	lock.busy = false
+	if err := u.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	AssertSwapped(t, exe, []byte("v2"))
+	if !lock.holders["node-a"] || !u.Status().FleetLocked {
+		t.Fatal("the slot was not taken for the update")
+	}
+
+	// the new version releases the slot once it runs
+	u = srv.Updater("1.1", exe)
+	u.RolloutID = "node-a"
+	u.FleetLock = lock
+	u.Scheduler = selfupdate.NeverScheduler{}
+	if err := u.UpdateIfNeeded(); err != nil {
+		t.Fatal(err)
+	}
+	if lock.holders["node-a"] || u.Status().FleetLocked {
+		t.Error("the slot was not released by the new version")
+	}
+}
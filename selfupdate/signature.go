@@ -0,0 +1,109 @@
+package selfupdate
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SignatureSuffix is appended to the path of the URL of a manifest, artifact or patch to
+// locate its detached signature
+const SignatureSuffix = ".sig"
+
+// ParsePublicKey parses an Ed25519 public key as written by
+// `go-selfupdate keygen`, either the whole .pub file or just its base64 line
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := DecodeKeyData(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key length %d", len(b))
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// DecodeKeyData returns the base64 decoded payload of a key or signature
+// file. The "untrusted comment:" lines that files written by earlier
+// versions start with are skipped.
+func DecodeKeyData(s string) ([]byte, error) {
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "untrusted comment:") {
+			continue
+		}
+		return base64.StdEncoding.DecodeString(line)
+	}
+	return nil, fmt.Errorf("no key data found")
+}
+
+// VerifySignature checks the detached signature sig over content. Signatures
+// are Ed25519ph over the SHA512 of the content.
+func VerifySignature(key ed25519.PublicKey, content, sig []byte) error {
+	b, err := DecodeKeyData(string(sig))
+	if err != nil || len(b) != ed25519.SignatureSize {
+		return ErrInvalidSignature
+	}
+	digest := sha512.Sum512(content)
+	if err := ed25519.VerifyWithOptions(key, digest[:], b, &ed25519.Options{Hash: crypto.SHA512}); err != nil {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
+
+// fetch retrieves url through the requester. When a public key is configured
+// the whole body is read and checked against its detached signature before
+// being returned.
+func (u *Updater) fetch(url string) (io.ReadCloser, error) {
+	return u.fetchWith(url, false)
+}
+
+// fetchManifest retrieves the manifest or index at url like fetch, through
+// the FetchManifest of requesters caching them
+func (u *Updater) fetchManifest(url string) (io.ReadCloser, error) {
+	return u.fetchWith(url, true)
+}
+
+func (u *Updater) fetchWith(url string, manifest bool) (io.ReadCloser, error) {
+	if u.Requester == nil {
+		u.Requester = &HTTPRequester{}
+	}
+	requester := u.Requester
+	if h, ok := requester.(*HTTPRequester); ok && h.UserAgent == "" {
+		requester = &HTTPRequester{UserAgent: u.userAgent()}
+	}
+	get := requester.Fetch
+	if m, ok := requester.(manifestRequester); ok && manifest {
+		get = m.FetchManifest
+	}
+	r, err := get(url)
+	if err != nil || u.PublicKey == nil {
+		return r, err
+	}
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	sr, err := get(withSuffix(url, SignatureSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch signature: %w", err)
+	}
+	defer sr.Close()
+	sig, err := io.ReadAll(io.LimitReader(sr, 4096))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signature: %w", err)
+	}
+
+	if err := VerifySignature(u.PublicKey, content, sig); err != nil {
+		return nil, fmt.Errorf("%s: %w", url, err)
+	}
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
@@ -0,0 +1,139 @@
+package selfupdate
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// maxBackoff bounds how far failed cycles push the next check
+const maxBackoff = 7 * 24 * time.Hour
+
+// Status is the state of the update cycles of an installation, kept in
+// Updater.Dir across restarts
+type Status struct {
+	LastCheck   time.Time // last cycle that ran, whatever its outcome
+	LastSuccess time.Time // last cycle that completed without error
+	Failures    int       `json:",omitempty"` // consecutive failed cycles
+	LastError   string    `json:",omitempty"` // error of the last failed cycle
+
+	// LastVersion is the version last applied and PreviousVersion the one it
+	// replaced. An installation restarting again and again soon after
+	// LastApplied is likely crash looping on LastVersion.
+	LastVersion     string `json:",omitempty"`
+	PreviousVersion string `json:",omitempty"`
+	LastApplied     time.Time
+	FleetLocked     bool `json:",omitempty"` // holds a FleetLock slot until LastVersion runs
+
+	NextUpdate    time.Time `json:"-"` // from the scheduler
+	ScheduleReset string    `json:"-"` // why the schedule could not be read and was reset to check now, if it was
+}
+
+// Status returns the state recorded by previous update cycles, the zero
+// Status when none ran yet
+func (u *Updater) Status() Status {
+	s := readStatus(u.statusPath())
+	if u.Scheduler != nil {
+		s.NextUpdate = u.Scheduler.NextUpdate()
+	}
+	if r, ok := u.Scheduler.(interface{ resetError() error }); ok {
+		if err := r.resetError(); err != nil {
+			s.ScheduleReset = err.Error()
+		}
+	}
+	return s
+}
+
+// inCooldown reports whether an update was applied less than Cooldown ago,
+// which keeps a manifest flapping during a publish from updating the
+// installation back and forth
+func (u *Updater) inCooldown() bool {
+	if u.Cooldown <= 0 {
+		return false
+	}
+	applied := readStatus(u.statusPath()).LastApplied
+	if until := applied.Add(u.Cooldown); time.Now().Before(until) {
+		slog.Info("skipping update check during cooldown", "last_applied", applied.Format(time.RFC3339), "until", until.Format(time.RFC3339))
+		return true
+	}
+	return false
+}
+
+func (u *Updater) statusPath() string {
+	return filepath.Join(getExecRelativeDir(u.Dir), statusFile)
+}
+
+// recordStatus applies change to the stored Status. Failing to store it
+// only loses history, so it is logged rather than failing the update.
+func (u *Updater) recordStatus(change func(s *Status)) Status {
+	path := u.statusPath()
+	s := readStatus(path)
+	change(&s)
+	if err := writeStatus(path, s); err != nil {
+		slog.Warn("failed to record update status", "error", err)
+	}
+	return s
+}
+
+// recordCycle records the outcome of an update cycle and returns the
+// failure streak
+func (u *Updater) recordCycle(err error) int {
+	now := time.Now()
+	return u.recordStatus(func(s *Status) {
+		s.LastCheck = now
+		if errors.Is(err, ErrDeferred) {
+			// not a failure, the conditions were not right
+			s.LastError = err.Error()
+			return
+		}
+		if err != nil {
+			s.Failures++
+			s.LastError = err.Error()
+			return
+		}
+		s.LastSuccess = now
+		s.Failures = 0
+		s.LastError = ""
+	}).Failures
+}
+
+// failureBackoff returns how long to wait before the next check after
+// failures consecutive failed cycles: an hour after the second, doubling
+// with each failure up to maxBackoff. Schedulers only move the check later,
+// so the backoff only shows once it exceeds the regular schedule.
+func failureBackoff(failures int) time.Duration {
+	if failures < 2 {
+		return 0
+	}
+	if failures > 10 {
+		return maxBackoff
+	}
+	return min(time.Hour<<(failures-2), maxBackoff)
+}
+
+func readStatus(path string) Status {
+	var s Status
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return s
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		slog.Warn("ignoring unreadable update status", "path", path, "error", err)
+		return Status{}
+	}
+	return s
+}
+
+func writeStatus(path string, s Status) error {
+	b, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
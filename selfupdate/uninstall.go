@@ -0,0 +1,111 @@
+package selfupdate
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// ErrUnsafeDir is returned by Uninstall for a Dir outside the directory of
+// the executable, whose other files it would remove
+var ErrUnsafeDir = errors.New("update directory is outside the executable directory")
+
+// Uninstall removes the binary of u together with everything the updater
+// created for it: staged binaries, the backup of the previous version, the
+// lock file, the time file of the Scheduler and the status, cache and plugin
+// state in Dir, which is removed when nothing else is left in it. With the
+// default Dir, next to the binary, only the cache and plugin directories
+// the updater created itself are removed, never ones that were there
+// before. A shared CacheDir is left alone, as other binaries may use it. On
+// Windows the running executable cannot be deleted, so it is moved aside and
+// deleted by a command that waits for this process to exit; the application
+// should exit soon after.
+func (u *Updater) Uninstall() error {
+	dir := getExecRelativeDir(u.Dir)
+	rel, err := filepath.Rel(getExecRelativeDir(""), dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%w: %s", ErrUnsafeDir, u.Dir)
+	}
+	execPath, err := u.execPath()
+	if err != nil {
+		return err
+	}
+	unlock, err := lockTarget(execPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var errs []error
+	base := filepath.Base(execPath)
+	staged, _ := filepath.Glob(filepath.Join(filepath.Dir(execPath), "."+base+".new-*"))
+	for _, path := range append(staged, filepath.Join(filepath.Dir(execPath), "."+base+".old")) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+
+	if s, ok := u.Scheduler.(interface{ statePath() string }); ok {
+		if err := os.Remove(s.statePath()); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	if err := os.Remove(filepath.Join(dir, statusFile)); err != nil && !os.IsNotExist(err) {
+		errs = append(errs, err)
+	}
+	// next to the binary, directories of those names may belong to others
+	for _, name := range []string{cacheDir, PluginsDir} {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(filepath.Join(path, stateMarker)); err != nil && rel == "." {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// state next to the binary leaves the directory, and any other Dir
+	// stays if files not created by the updater are left in it
+	if rel != "." {
+		if err := os.Remove(dir); err != nil && !os.IsNotExist(err) && !isNotEmpty(dir) {
+			errs = append(errs, err)
+		}
+	}
+	u.mu.Lock()
+	u.cached = nil
+	u.mu.Unlock()
+
+	if err := removeBinary(execPath); err != nil {
+		errs = append(errs, fmt.Errorf("failed to remove %s: %w", execPath, err))
+	}
+	return errors.Join(errs...)
+}
+
+// removeBinary deletes the binary at execPath. Windows refuses to delete
+// the executable of a running process, there it is renamed out of the way
+// and left to a detached cmd.exe to delete after a few seconds.
+func removeBinary(execPath string) error {
+	err := os.Remove(execPath)
+	if err == nil || os.IsNotExist(err) || runtime.GOOS != "windows" {
+		return err
+	}
+	doomed := filepath.Join(filepath.Dir(execPath), fmt.Sprintf(".%s.uninstall", filepath.Base(execPath)))
+	os.Remove(doomed)
+	if err := os.Rename(execPath, doomed); err != nil {
+		return err
+	}
+	cmd := exec.Command("cmd.exe", "/C", "ping -n 4 127.0.0.1 >NUL & del /F /Q \""+doomed+"\"")
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// isNotEmpty reports whether dir has entries left
+func isNotEmpty(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	return err == nil && len(entries) > 0
+}
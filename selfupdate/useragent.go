@@ -0,0 +1,48 @@
+package selfupdate
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+)
+
+// modulePath is the module selfupdate is part of, looked up in the build
+// info for the version sent in the User-Agent
+const modulePath = "github.com/bobo/go-selfupdate"
+
+// DefaultUserAgent returns the User-Agent an Updater sends for cmdName at
+// version, such as myapp/1.2 (linux-amd64; selfupdate/1.0.0), so update
+// hosts can tell client versions and platforms apart in their access logs.
+// Callers setting Updater.UserAgent can extend it with details of their own.
+func DefaultUserAgent(cmdName, version string) string {
+	return fmt.Sprintf("%s/%s (%s; selfupdate/%s)", cmdName, version, platform, libraryVersion())
+}
+
+func (u *Updater) userAgent() string {
+	if u.UserAgent != "" {
+		return u.UserAgent
+	}
+	return DefaultUserAgent(u.CmdName, u.CurrentVersion)
+}
+
+// libraryVersion returns the version of this module the binary was built
+// with, devel when unknown such as in its own tests
+func libraryVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	m := &info.Main
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			m = dep
+		}
+	}
+	if m.Path != modulePath || m.Version == "" || m.Version == "(devel)" {
+		return "devel"
+	}
+	if m.Replace != nil && m.Replace.Version != "" {
+		return strings.TrimPrefix(m.Replace.Version, "v")
+	}
+	return strings.TrimPrefix(m.Version, "v")
+}
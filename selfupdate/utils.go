@@ -3,26 +3,40 @@ package selfupdate
 import (
 	"bytes"
 	"crypto/sha256"
+	"crypto/sha512"
 	"fmt"
+	"hash"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
-// readTime reads and parses a timestamp from a file
-func readTime(path string) time.Time {
+// readTime reads and parses a timestamp from a file, the zero time when
+// the file does not exist
+func readTime(path string) (time.Time, error) {
 	p, err := os.ReadFile(path)
 	if os.IsNotExist(err) {
-		return time.Time{}
+		return time.Time{}, nil
 	}
 	if err != nil {
-		return time.Now().Add(1000 * time.Hour)
+		return time.Time{}, err
 	}
-	t, err := time.Parse(time.RFC3339, string(p))
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(p)))
 	if err != nil {
-		return time.Now().Add(1000 * time.Hour)
+		return time.Time{}, fmt.Errorf("invalid timestamp in %s: %q", path, truncate(string(p), 64))
 	}
-	return t
+	return t, nil
+}
+
+// truncate shortens s to at most n bytes for error messages
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
 }
 
 // writeTime writes a timestamp to a file
@@ -37,19 +51,203 @@ func verifyHash(bin []byte, expectedHash []byte) bool {
 	return bytes.Equal(h.Sum(nil), expectedHash)
 }
 
+// verifySha512 checks if a binary matches the expected SHA512 hash
+func verifySha512(bin []byte, expectedHash []byte) bool {
+	h := sha512.New()
+	h.Write(bin)
+	return bytes.Equal(h.Sum(nil), expectedHash)
+}
+
+// validateDigests checks that info carries at least one digest and that
+// every digest present has the correct length for its algorithm
+func validateDigests(info UpdateInfo) error {
+	if len(info.Sha256) == 0 && len(info.Sha512) == 0 {
+		return ErrInvalidHash
+	}
+	if len(info.Sha256) != 0 && len(info.Sha256) != sha256.Size {
+		return ErrInvalidHash
+	}
+	if len(info.Sha512) != 0 && len(info.Sha512) != sha512.Size {
+		return ErrInvalidHash
+	}
+	return nil
+}
+
+// verifyDigests checks a binary against every digest present in info
+func verifyDigests(bin []byte, info UpdateInfo) bool {
+	if validateDigests(info) != nil {
+		return false
+	}
+	if len(info.Sha256) != 0 && !verifyHash(bin, info.Sha256) {
+		return false
+	}
+	if len(info.Sha512) != 0 && !verifySha512(bin, info.Sha512) {
+		return false
+	}
+	return true
+}
+
+// digester hashes what is written to it with the algorithms of the digests
+// of info, so a binary is verified as it is decompressed or patched rather
+// than read a second time
+type digester struct {
+	info   UpdateInfo
+	sha256 hash.Hash
+	sha512 hash.Hash
+}
+
+func newDigester(info UpdateInfo) *digester {
+	return &digester{info: info, sha256: sha256.New(), sha512: sha512.New()}
+}
+
+func (d *digester) Write(p []byte) (int, error) {
+	if len(d.info.Sha256) != 0 {
+		d.sha256.Write(p)
+	}
+	if len(d.info.Sha512) != 0 {
+		d.sha512.Write(p)
+	}
+	return len(p), nil
+}
+
+// verify reports whether everything written matches every digest of info
+func (d *digester) verify() bool {
+	if validateDigests(d.info) != nil {
+		return false
+	}
+	if len(d.info.Sha256) != 0 && !bytes.Equal(d.sha256.Sum(nil), d.info.Sha256) {
+		return false
+	}
+	if len(d.info.Sha512) != 0 && !bytes.Equal(d.sha512.Sum(nil), d.info.Sha512) {
+		return false
+	}
+	return true
+}
+
+// sizeLimitedReader fails with ErrArtifactSize as soon as more than n bytes
+// are read, instead of downloading the rest
+type sizeLimitedReader struct {
+	r io.Reader
+	n int64 // bytes left
+}
+
+// limitArtifact bounds r to size bytes, the Size of a manifest, leaving it
+// unbounded when the manifest has no size
+func limitArtifact(r io.Reader, size int64) io.Reader {
+	if size <= 0 {
+		return r
+	}
+	return &sizeLimitedReader{r: r, n: size}
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, ErrArtifactSize
+	}
+	// read one byte past the limit to tell an artifact of exactly n bytes
+	// from a larger one
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n + int(l.n), ErrArtifactSize
+	}
+	return n, err
+}
+
+// Verify checks bin against the digests in info, for tooling that validates
+// an update tree before clients see it
+func (info UpdateInfo) Verify(bin []byte) error {
+	if err := validateDigests(info); err != nil {
+		return err
+	}
+	if !verifyDigests(bin, info) {
+		return ErrHashMismatch
+	}
+	return nil
+}
+
+// makeStateDir creates the directory dir of the updater and its parents.
+// A directory it creates gets a stateMarker, which Uninstall requires before
+// removing it, so that a directory of the same name that was there already
+// is never taken for the updater's.
+func makeStateDir(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, stateMarker), nil, 0644)
+}
+
 // getExecRelativeDir returns a path relative to the executable
 func getExecRelativeDir(dir string) string {
 	filename, _ := os.Executable()
 	return filepath.Join(filepath.Dir(filename), dir)
 }
 
-// canUpdate checks if the binary can be updated by attempting to create a test file
-func canUpdate() error {
-	path, err := os.Executable()
-	if err != nil {
-		return err
+// staleLockAge is how old a lock file must be to be taken for the leftover
+// of an updater that was killed
+const staleLockAge = 10 * time.Minute
+
+// lockRefresh is how often a held lock file is touched, so that it never
+// looks stale while a slow download keeps it held
+var lockRefresh = staleLockAge / 5
+
+// holdLock keeps the lock file at lockPath fresh until the returned function
+// releases it by removing the file
+func holdLock(lockPath string) func() {
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(lockRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				now := time.Now()
+				os.Chtimes(lockPath, now, now)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+			os.Remove(lockPath)
+		})
 	}
+}
 
+// lockTarget takes the lock file of the binary at execPath, held while an
+// updater stages or swaps it, and returns the function releasing it
+func lockTarget(execPath string) (func(), error) {
+	lockPath := filepath.Join(filepath.Dir(execPath), fmt.Sprintf(".%s.lock", filepath.Base(execPath)))
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+			return holdLock(lockPath), nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		fi, serr := os.Stat(lockPath)
+		if attempt > 0 || serr != nil || time.Since(fi.ModTime()) < staleLockAge {
+			return nil, fmt.Errorf("%w: %s", ErrTargetLocked, execPath)
+		}
+		os.Remove(lockPath)
+	}
+}
+
+// canUpdate checks if the binary can be updated by attempting to create a test file
+func canUpdate(path string) error {
 	fileDir := filepath.Dir(path)
 	fileName := filepath.Base(path)
 